@@ -0,0 +1,53 @@
+#!/bin/bash
+#
+# Times restoring an archive with the extraction tuning options, from an
+# input limited to RATE per second (requires pv), and onto a slow disk,
+# simulated by syncing each file as it's written.
+#
+# Usage: benchextract.sh ARCHIVE [RATE]
+
+if [ -z "$1" ];
+then
+    echo "usage: $0 ARCHIVE [RATE]" >&2
+    exit 1
+fi
+
+ARCHIVE=`readlink -f $1`
+RATE=${2:-20m}
+FA=${FA:-fast-archiver}
+TARGET=`mktemp -d`
+trap "rm -rf $TARGET" EXIT
+
+restore() {
+    rm -rf $TARGET/*
+    start=`date +%s%N`
+    (cd $TARGET && $FA -x "$@")
+    end=`date +%s%N`
+    echo $(( (end - start) / 1000000 ))
+}
+
+settings=(
+    ""
+    "-input-buffer-size 8M"
+    "-file-queue 64"
+    "-file-writers 16"
+    "-file-writers 16 -file-queue 64"
+    "-file-buffer-size 1M"
+)
+
+if command -v pv > /dev/null;
+then
+    echo "slow input ($RATE/s):"
+    for s in "${settings[@]}";
+    do
+        printf "  %-35s %sms\n" "${s:-defaults}" `pv -q -L $RATE $ARCHIVE | restore $s`
+    done
+else
+    echo "pv isn't installed; skipping slow input" >&2
+fi
+
+echo "slow disk (-drop-caches):"
+for s in "${settings[@]}";
+do
+    printf "  %-35s %sms\n" "${s:-defaults}" `restore -i $ARCHIVE -drop-caches $s`
+done
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Set in the environment of a copy of the test binary that's run as the
+// fast-archiver command by runCommand.
+const runMainEnv = "FAST_ARCHIVER_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Runs fast-archiver with args in dir, returning what it wrote to stdout
+// and stderr, and its exit status.
+func runCommand(t *testing.T, dir string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), stderr.String(), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// Like runCommand, but fails the test unless the command succeeds.
+func mustRun(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	stdout, stderr, status := runCommand(t, dir, args...)
+	if status != 0 {
+		t.Fatalf("fast-archiver %s exited with %d: %s", strings.Join(args, " "), status, stderr)
+	}
+	return stdout
+}
+
+// Writes files beneath dir, creating their parent directories; paths are
+// slash-separated, and a path ending in a slash is an empty directory.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Reads the tree beneath dir in the form writeTree takes, with every
+// directory listed.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	retval := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		name, _ := filepath.Rel(dir, path)
+		name = filepath.ToSlash(name)
+		if info.IsDir() {
+			retval[name+"/"] = ""
+			return nil
+		}
+		contents, err := os.ReadFile(path)
+		retval[name] = string(contents)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return retval
+}
+
+// Lists archive, returning its paths in the order they're listed.
+func listPaths(t *testing.T, dir string, archive string) []string {
+	t.Helper()
+	return strings.Split(strings.TrimSuffix(mustRun(t, dir, "list", "-i", archive), "\n"), "\n")
+}
+
+func TestCreateExtractListVerify(t *testing.T) {
+	work := t.TempDir()
+	tree := map[string]string{
+		"src/":            "",
+		"src/a":           "alpha",
+		"src/b/":          "",
+		"src/b/c":         strings.Repeat("charlie", 20000),
+		"src/b/empty/":    "",
+		"src/b/zero-size": "",
+	}
+	writeTree(t, work, tree)
+
+	mustRun(t, work, "create", "-o", "archive.fa", "src")
+	target := filepath.Join(work, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, target, "extract", "-i", filepath.Join(work, "archive.fa"))
+	if extracted := readTree(t, target); !reflect.DeepEqual(extracted, tree) {
+		t.Errorf("extracted %v, expected %v", extracted, tree)
+	}
+
+	// Directories are listed with a trailing slash, as tar does.
+	listed := listPaths(t, work, "archive.fa")
+	var expected []string
+	for name := range tree {
+		expected = append(expected, name)
+	}
+	sort.Strings(listed)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("listed %q, expected %q", listed, expected)
+	}
+
+	if stdout, stderr, status := runCommand(t, work, "verify", "-i", "archive.fa"); status != 0 || stdout != "" || stderr != "" {
+		t.Errorf("verifying an intact archive exited with %d, printing %q %q", status, stdout, stderr)
+	}
+	archive, err := os.ReadFile(filepath.Join(work, "archive.fa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive[bytes.Index(archive, []byte("alpha"))] ^= 1
+	if err := os.WriteFile(filepath.Join(work, "damaged.fa"), archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, stderr, status := runCommand(t, work, "verify", "-i", "damaged.fa"); status == 0 || !strings.Contains(stderr, "crc64 mismatch") {
+		t.Errorf("verifying a damaged archive exited with %d, printing %q", status, stderr)
+	}
+}
+
+func TestListCountsNonNFCPaths(t *testing.T) {
+	work := t.TempDir()
+	// "café", decomposed as macOS stores it.
+	writeTree(t, work, map[string]string{"src/cafe\u0301": "data"})
+	mustRun(t, work, "create", "-o", "nfd.fa", "src")
+	mustRun(t, work, "create", "-normalize", "nfc", "-o", "nfc.fa", "src")
+
+	if _, stderr, status := runCommand(t, work, "list", "-i", "nfd.fa"); status != 0 || !strings.Contains(stderr, "1 paths aren't in Unicode NFC") {
+		t.Errorf("listing NFD paths exited with %d, printing %q", status, stderr)
+	}
+	if _, stderr, status := runCommand(t, work, "list", "-i", "nfc.fa"); status != 0 || stderr != "" {
+		t.Errorf("listing NFC paths exited with %d, printing %q", status, stderr)
+	}
+}
+
+func TestCreateInsideArchivedDirectory(t *testing.T) {
+	work := t.TempDir()
+	writeTree(t, work, map[string]string{"data": strings.Repeat("data", 100000)})
+	_, stderr, status := runCommand(t, work, "create", "-o", "backup.fa", ".")
+	if status != 0 || !strings.Contains(stderr, "file is the archive; not dumped") {
+		t.Errorf("archiving into the archived directory exited with %d, printing %q", status, stderr)
+	}
+	if listed := listPaths(t, work, "backup.fa"); !reflect.DeepEqual(listed, []string{"./", "data"}) {
+		t.Errorf("listed %q, expected only data and its directory", listed)
+	}
+	target := t.TempDir()
+	mustRun(t, target, "extract", "-i", filepath.Join(work, "backup.fa"))
+	if extracted := readTree(t, target); !reflect.DeepEqual(extracted, map[string]string{"data": strings.Repeat("data", 100000)}) {
+		t.Errorf("extracted %d entries, expected only data", len(extracted))
+	}
+}
+
+func TestTotalsOnStderr(t *testing.T) {
+	work := t.TempDir()
+	writeTree(t, work, map[string]string{"src/a": "alpha", "src/b/c": "charlie"})
+	// The archive goes to stdout, so the totals mustn't.
+	archive, stderr, status := runCommand(t, work, "create", "-totals", "-o", "-", "src")
+	if status != 0 || !strings.HasPrefix(stderr, "2 files, 2 directories; read 12, wrote ") || !strings.Contains(stderr, "; 0 problems") {
+		t.Errorf("creating with -totals exited with %d, printing %q", status, stderr)
+	}
+	if err := os.WriteFile(filepath.Join(work, "archive.fa"), []byte(archive), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	stdout, stderr, status := runCommand(t, target, "extract", "-totals", "-i", filepath.Join(work, "archive.fa"))
+	expected := fmt.Sprintf("2 files, 2 directories; read %d, wrote 12 in ", len(archive))
+	if status != 0 || stdout != "" || !strings.HasPrefix(stderr, expected) {
+		t.Errorf("extracting with -totals exited with %d, printing %q and %q", status, stdout, stderr)
+	}
+}
+
+func TestArchiveMetadataShown(t *testing.T) {
+	work := t.TempDir()
+	writeTree(t, work, map[string]string{"src/a": "alpha"})
+	mustRun(t, work, "create", "-o", "archive.fa", "src")
+	mustRun(t, work, "create", "-no-metadata", "-o", "bare.fa", "src")
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The producing host and platform are shown after extracting verbosely,
+	// and at the top of the long listing.
+	_, stderr, status := runCommand(t, t.TempDir(), "extract", "-v", "-i", filepath.Join(work, "archive.fa"))
+	if status != 0 || !strings.Contains(stderr, "archive {") || !strings.Contains(stderr, "hostname="+hostname) || !strings.Contains(stderr, "goos="+runtime.GOOS) {
+		t.Errorf("extracting verbosely exited with %d, printing %q", status, stderr)
+	}
+	if listed := mustRun(t, work, "list", "-v", "-i", "archive.fa"); !strings.HasPrefix(listed, "archive {") || !strings.Contains(listed, "hostname="+hostname) {
+		t.Errorf("long listing is %q, expected it to start with the archive metadata", listed)
+	}
+
+	_, stderr, _ = runCommand(t, t.TempDir(), "extract", "-v", "-i", filepath.Join(work, "bare.fa"))
+	if strings.Contains(stderr, "archive {") {
+		t.Errorf("extracting an archive without metadata printed %q", stderr)
+	}
+	if listed := mustRun(t, work, "list", "-v", "-i", "bare.fa"); strings.HasPrefix(listed, "archive") {
+		t.Errorf("long listing of an archive without metadata is %q", listed)
+	}
+}
+
+// An archive split into chunks is read from several -i inputs in order, and
+// an error names the chunk it's in.
+func TestSplitInput(t *testing.T) {
+	work := t.TempDir()
+	tree := map[string]string{"src/": "", "src/a": strings.Repeat("alpha", 20000), "src/b": strings.Repeat("bravo", 20000)}
+	writeTree(t, work, tree)
+	mustRun(t, work, "create", "-o", "archive.fa", "src")
+	archive, err := os.ReadFile(filepath.Join(work, "archive.fa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := len(archive)/3 + 1
+	var chunks []string
+	for i := 0; i*chunk < len(archive); i++ {
+		name := fmt.Sprintf("part.a%c", 'a'+i)
+		end := (i + 1) * chunk
+		if end > len(archive) {
+			end = len(archive)
+		}
+		if err := os.WriteFile(filepath.Join(work, name), archive[i*chunk:end], 0644); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, "-i", filepath.Join(work, name))
+	}
+
+	target := filepath.Join(work, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, target, append([]string{"extract"}, chunks...)...)
+	if extracted := readTree(t, target); !reflect.DeepEqual(extracted, tree) {
+		t.Errorf("extracted %v, expected %v", extracted, tree)
+	}
+	listed := strings.Fields(mustRun(t, work, append([]string{"list"}, chunks...)...))
+	sort.Strings(listed)
+	if expected := []string{"src/", "src/a", "src/b"}; !reflect.DeepEqual(listed, expected) {
+		t.Errorf("listed %q from the chunks, expected %q", listed, expected)
+	}
+
+	// Leaving out the middle chunk breaks the archive in the last one.
+	_, stderr, status := runCommand(t, work, "verify", chunks[0], chunks[1], chunks[4], chunks[5])
+	if status == 0 || !strings.Contains(stderr, ", in "+filepath.Join(work, "part.ac")+" at offset ") {
+		t.Errorf("verifying without part.ab exited with %d, printing %q", status, stderr)
+	}
+
+	// A missing chunk is reported before anything is extracted.
+	target = filepath.Join(work, "missing")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, status = runCommand(t, target, "extract", chunks[0], chunks[1], "-i", "part.ad")
+	if status == 0 || !strings.Contains(stderr, "Error opening input file") {
+		t.Errorf("extracting with a missing chunk exited with %d, printing %q", status, stderr)
+	}
+	if extracted := readTree(t, target); len(extracted) != 0 {
+		t.Errorf("extracted %v before reporting a missing chunk", extracted)
+	}
+}
+
+// An archive written to several -o outputs, one of them stdout, is the same
+// in each.
+func TestSeveralOutputs(t *testing.T) {
+	work := t.TempDir()
+	writeTree(t, work, map[string]string{"src/a": "alpha", "src/b": strings.Repeat("bravo", 20000)})
+	stdout := mustRun(t, work, "create", "-o", "first.fa", "-o", "-", "-o", "second.fa", "src")
+	for _, name := range []string{"first.fa", "second.fa"} {
+		archive, err := os.ReadFile(filepath.Join(work, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(archive) == 0 || string(archive) != stdout {
+			t.Errorf("%s has %d bytes, differing from the %d written to stdout", name, len(archive), len(stdout))
+		}
+	}
+	if listed := listPaths(t, work, "second.fa"); len(listed) != 3 {
+		t.Errorf("listed %q, expected src and its two files", listed)
+	}
+}
+
+// Each -o file gets a sidecar for each -output-checksum, in the format of
+// sha256sum and its relatives.
+func TestOutputChecksumFiles(t *testing.T) {
+	work := t.TempDir()
+	writeTree(t, work, map[string]string{"src/a": "alpha"})
+	mustRun(t, work, "create", "-o", "first.fa", "-o", "second.fa", "-output-checksum", "sha256", "-output-checksum", "md5", "src")
+	for _, name := range []string{"first.fa", "second.fa"} {
+		archive, err := os.ReadFile(filepath.Join(work, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for algorithm, digest := range map[string]string{
+			"sha256": fmt.Sprintf("%x", sha256.Sum256(archive)),
+			"md5":    fmt.Sprintf("%x", md5.Sum(archive)),
+		} {
+			sidecar, err := os.ReadFile(filepath.Join(work, name+"."+algorithm))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := digest + "  " + name + "\n"; string(sidecar) != expected {
+				t.Errorf("%s.%s is %q, expected %q", name, algorithm, sidecar, expected)
+			}
+		}
+	}
+
+	// An unknown algorithm fails before the output is created.
+	if _, _, status := runCommand(t, work, "create", "-o", "third.fa", "-output-checksum", "sha265", "src"); status == 0 {
+		t.Error("creating with an unknown checksum algorithm succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(work, "third.fa")); !os.IsNotExist(err) {
+		t.Errorf("output created despite an unknown checksum algorithm: %v", err)
+	}
+}
+
+// With -log-timestamps, every line on stderr starts with the time, and
+// those naming an extracted file with its phase.
+func TestLogTimestamps(t *testing.T) {
+	work := t.TempDir()
+	writeTree(t, work, map[string]string{"src/a": "alpha"})
+	mustRun(t, work, "create", "-o", "archive.fa", "src")
+	target := filepath.Join(work, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, status := runCommand(t, target, "extract", "-v", "-log-timestamps", "-i", filepath.Join(work, "archive.fa"))
+	if status != 0 {
+		t.Fatalf("extracting exited with %d: %s", status, stderr)
+	}
+	found := false
+	for _, line := range strings.Split(strings.TrimSuffix(stderr, "\n"), "\n") {
+		stamp, rest, _ := strings.Cut(line, " ")
+		if _, err := time.Parse(time.RFC3339, stamp); err != nil {
+			t.Errorf("line %q doesn't start with an RFC 3339 time", line)
+		}
+		if rest == "[extract] src/a" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no line for src/a from the extract phase in %q", stderr)
+	}
+}
+
+// The legacy -c, -x and -t invocations behave the same as the create,
+// extract and list commands: the same archive, extracted tree, listing,
+// output and exit status.
+func TestLegacyFlagsMatchCommands(t *testing.T) {
+	work := t.TempDir()
+	writeTree(t, work, map[string]string{
+		"src/a":        "alpha",
+		"src/b/c":      strings.Repeat("charlie", 20000),
+		"src/b/empty/": "",
+	})
+	mustRun(t, work, "create", "-deterministic", "-o", "archive.fa", "src")
+	archive, err := os.ReadFile(filepath.Join(work, "archive.fa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(work, "truncated.fa"), archive[:len(archive)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name            string
+		legacy, command []string
+		// The file each run writes in its own directory, compared between
+		// them, or "" to compare only the output.
+		output string
+	}{
+		{"create", []string{"-c", "-deterministic", "-o", "out.fa", "../src"}, []string{"create", "-deterministic", "-o", "out.fa", "../src"}, "out.fa"},
+		{"create to stdout", []string{"-c", "-deterministic", "../src"}, []string{"create", "-deterministic", "../src"}, ""},
+		{"create excluding", []string{"-c", "-deterministic", "-o", "out.fa", "-exclude", "*/b", "../src"}, []string{"create", "-deterministic", "-o", "out.fa", "-exclude", "*/b", "../src"}, "out.fa"},
+		{"extract", []string{"-x", "-i", "../archive.fa"}, []string{"extract", "-i", "../archive.fa"}, "src"},
+		{"extract verbose", []string{"-x", "-v", "-i", "../archive.fa"}, []string{"extract", "-v", "-i", "../archive.fa"}, "src"},
+		{"list", []string{"-t", "-i", "../archive.fa"}, []string{"list", "-i", "../archive.fa"}, ""},
+		{"list long", []string{"-t", "-v", "-i", "../archive.fa"}, []string{"list", "-v", "-i", "../archive.fa"}, ""},
+		{"list sorted", []string{"-t", "-json", "-sort", "size", "-top", "2", "-i", "../archive.fa"}, []string{"list", "-json", "-sort", "size", "-top", "2", "-i", "../archive.fa"}, ""},
+		{"extract truncated", []string{"-x", "-i", "../truncated.fa"}, []string{"extract", "-i", "../truncated.fa"}, ""},
+		{"list truncated", []string{"-t", "-i", "../truncated.fa"}, []string{"list", "-i", "../truncated.fa"}, ""},
+		{"missing input", []string{"-x", "-i", "../missing.fa"}, []string{"extract", "-i", "../missing.fa"}, ""},
+	} {
+		run := func(args []string) (string, string, int, map[string]string) {
+			dir, err := os.MkdirTemp(work, "run")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout, stderr, status := runCommand(t, dir, args...)
+			var output map[string]string
+			if test.output != "" {
+				output = readTree(t, dir)
+			}
+			return stdout, stderr, status, output
+		}
+		legacyOut, legacyErr, legacyStatus, legacyFiles := run(test.legacy)
+		commandOut, commandErr, commandStatus, commandFiles := run(test.command)
+		if legacyStatus != commandStatus {
+			t.Errorf("%s: legacy flags exited with %d, the command with %d", test.name, legacyStatus, commandStatus)
+		}
+		if legacyOut != commandOut {
+			t.Errorf("%s: legacy flags printed %q, the command %q", test.name, legacyOut, commandOut)
+		}
+		if legacyErr != commandErr {
+			t.Errorf("%s: legacy flags reported %q, the command %q", test.name, legacyErr, commandErr)
+		}
+		if !reflect.DeepEqual(legacyFiles, commandFiles) {
+			t.Errorf("%s: legacy flags wrote %d files, the command %d, differing", test.name, len(legacyFiles), len(commandFiles))
+		}
+	}
+}
+
+// -no-verify extracts a damaged archive, warning that it wasn't verified
+// before the run and at the end.
+func TestNoVerify(t *testing.T) {
+	work := t.TempDir()
+	writeTree(t, work, map[string]string{"src/a": "alpha"})
+	mustRun(t, work, "create", "-o", "archive.fa", "src")
+	archive, err := os.ReadFile(filepath.Join(work, "archive.fa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive[bytes.Index(archive, []byte("alpha"))] ^= 1
+	if err := os.WriteFile(filepath.Join(work, "damaged.fa"), archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(work, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, status := runCommand(t, target, "extract", "-i", "../damaged.fa"); status == 0 {
+		t.Error("extracting a damaged archive succeeded")
+	}
+	_, stderr, status := runCommand(t, target, "extract", "-force", "-no-verify", "-i", "../damaged.fa")
+	if status != 0 {
+		t.Fatalf("extracting with -no-verify exited with %d: %s", status, stderr)
+	}
+	if strings.Count(stderr, "WARNING") != 2 || !strings.Contains(stderr, "were skipped") {
+		t.Errorf("-no-verify reported %q, expected a warning before and after", stderr)
+	}
+	if extracted := readTree(t, target); extracted["src/a"] != "`lpha" {
+		t.Errorf("extracted %v", extracted)
+	}
+}
+
+// A root given with a trailing slash is archived as its contents, which
+// extract straight into the target; without one, beneath its name.
+func TestTrailingSlashArgument(t *testing.T) {
+	work := t.TempDir()
+	writeTree(t, work, map[string]string{"data/a": "alpha", "data/tmp/x": "x", "data/sub/tmp/y": "y"})
+	mustRun(t, work, "create", "-o", "contents.fa", "-exclude", "tmp", "data/")
+	mustRun(t, work, "create", "-o", "named.fa", "-exclude", "tmp", "data")
+	for archive, expected := range map[string][]string{
+		"contents.fa": {"a", "sub/", "sub/tmp/", "sub/tmp/y"},
+		"named.fa":    {"data/", "data/a", "data/sub/", "data/sub/tmp/", "data/sub/tmp/y", "data/tmp/", "data/tmp/x"},
+	} {
+		listed := listPaths(t, work, archive)
+		sort.Strings(listed)
+		if !reflect.DeepEqual(listed, expected) {
+			t.Errorf("%s lists %q, expected %q", archive, listed, expected)
+		}
+	}
+
+	target := filepath.Join(work, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, target, "extract", "-i", "../contents.fa")
+	expected := map[string]string{"a": "alpha", "sub/": "", "sub/tmp/": "", "sub/tmp/y": "y"}
+	if extracted := readTree(t, target); !reflect.DeepEqual(extracted, expected) {
+		t.Errorf("extracted %v, expected %v", extracted, expected)
+	}
+}
@@ -0,0 +1,91 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Returns the first byte of s that could corrupt a line of output or
+// control a terminal, or -1 if there's none.
+func unsafeByte(s string) int {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size == 1) || (r < 0x20 && r != '\n') || r == 0x7f {
+			return i
+		}
+		i += size
+	}
+	return -1
+}
+
+func TestAdversarialNames(t *testing.T) {
+	work := t.TempDir()
+	tree := map[string]string{
+		"src/":            "",
+		"src/line\nbreak": "1",
+		"src/tab\there":   "2",
+		"src/\x1b[31mred": "3",
+		"src/invalid\xff": "4",
+		"src/-dash":       "5",
+		"src/back\\slash": "6",
+		"src/cr\r/":       "",
+		"src/cr\r/inside": "7",
+	}
+	expected := []string{`src/`, `src/-dash`, `src/\x1b[31mred`, `src/back\\slash`, `src/cr\x0d/`, `src/cr\x0d/inside`, `src/invalid\xff`, `src/line\x0abreak`, `src/tab\x09here`}
+	if runtime.GOOS == "darwin" {
+		// APFS refuses names that aren't valid UTF-8.
+		delete(tree, "src/invalid\xff")
+		expected = append(expected[:6], expected[7:]...)
+	}
+	writeTree(t, work, tree)
+	mustRun(t, work, "create", "-o", "archive.fa", "src")
+
+	listed := mustRun(t, work, "list", "-i", "archive.fa")
+	if i := unsafeByte(listed); i >= 0 {
+		t.Errorf("listing has an unescaped byte at %d: %q", i, listed)
+	}
+	lines := strings.Split(strings.TrimSuffix(listed, "\n"), "\n")
+	sort.Strings(lines)
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("listed %q, expected %q", lines, expected)
+	}
+
+	// -no-quote leaves the names for tools that expect raw bytes.
+	raw := mustRun(t, work, "list", "-no-quote", "-i", "archive.fa")
+	for name := range tree {
+		if !strings.Contains(raw, name+"\n") {
+			t.Errorf("raw listing %q doesn't include %q", raw, name)
+		}
+	}
+
+	// Verbose output names every entry, escaped.
+	target := filepath.Join(work, "target")
+	writeTree(t, work, map[string]string{"target/": ""})
+	_, stderr, status := runCommand(t, target, "extract", "-v", "-i", filepath.Join(work, "archive.fa"))
+	if status != 0 {
+		t.Fatalf("extracting exited with %d: %q", status, stderr)
+	}
+	if i := unsafeByte(stderr); i >= 0 {
+		t.Errorf("verbose output has an unescaped byte at %d: %q", i, stderr)
+	}
+	if !strings.Contains(stderr, `src/line\x0abreak`) {
+		t.Errorf("verbose output %q doesn't name src/line\\x0abreak", stderr)
+	}
+	if extracted := readTree(t, target); !reflect.DeepEqual(extracted, tree) {
+		t.Errorf("extracted %q, expected %q", extracted, tree)
+	}
+
+	// A root starting with a dash follows "--".
+	mustRun(t, filepath.Join(work, "src"), "create", "-o", filepath.Join(work, "dash.fa"), "--", "-dash")
+	if listed := listPaths(t, work, "dash.fa"); !reflect.DeepEqual(listed, []string{"-dash"}) {
+		t.Errorf("listed %q, expected -dash", listed)
+	}
+}
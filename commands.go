@@ -0,0 +1,377 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"log"
+	"os"
+	"time"
+)
+
+// The modes a flag applies to, as a set.
+type mode int
+
+const (
+	modeCreate mode = 1 << iota
+	modeExtract
+	modeList
+	modeVerify
+
+	modeAll = modeCreate | modeExtract | modeList | modeVerify
+	// The modes that can be chosen with -c, -x and -t rather than a
+	// command.
+	modeLegacy = modeCreate | modeExtract | modeList
+)
+
+// The commands, in the order they're listed in the usage.
+var commands = []struct {
+	name    string
+	mode    mode
+	args    string
+	summary string
+}{
+	{"create", modeCreate, " [flags] PATH...", "Archive the given directories and files."},
+	{"extract", modeExtract, " [flags]", "Extract an archive into the current directory."},
+	{"list", modeList, " [flags]", "List the contents of an archive."},
+	{"verify", modeVerify, " [flags]", "Read a whole archive, checking its structure and checksums, without extracting anything."},
+}
+
+// The command line, parsed for one command.  Every field is set, but only
+// the flags that apply to the command can be given; the others keep their
+// defaults.
+type options struct {
+	flags *flag.FlagSet
+	// The modes whose flags are defined: the command's, or all of those
+	// available through -c, -x and -t.
+	modes  mode
+	legacy bool
+	// Set by runLogger with -verbose-summary.
+	progress *falib.ProgressLogger
+
+	create                 *bool
+	extract                *bool
+	list                   *bool
+	jsonList               *bool
+	sortList               *string
+	reverseList            *bool
+	topList                *int
+	sortLimit              *int
+	inputFileNames         stringList
+	changeDir              *string
+	outputFileNames        stringList
+	outputChecksums        stringList
+	dropFailedOutputs      *bool
+	requestedBlockSize     *uint
+	largeBlockSize         *uint
+	largeFileThreshold     *string
+	dirReaderCount         *int
+	fileReaderCount        *int
+	largeFileReaderCount   *int
+	intraFileParallelism   *int
+	directoryScanQueueSize *int
+	fileReadQueueSize      *int
+	blockQueueSize         *int
+	maxOpenFiles           *int
+	diagnostics            *bool
+	writeBufferSize        *string
+	outputBufferSize       *string
+	inputBufferSize        *string
+	fileBufferSize         *string
+	fileQueueSize          *int
+	fileWriterCount        *int
+	maxMemory              *string
+	writeBufferCount       *int
+	multiCpu               *int
+	exclude                *string
+	include                stringList
+	ignoreCase             *bool
+	matchBaseNames         *bool
+	minSize                *string
+	maxSize                *string
+	excludeCaches          *bool
+	excludeVCS             *bool
+	excludeVCSIgnores      *bool
+	ignoreMarker           *string
+	strictRoots            *bool
+	skipRootLinks          *bool
+	includeVirtualFS       *bool
+	oneFileSystem          *bool
+	maxDepth               *int
+	normalize              *string
+	noMetadata             *bool
+	compat                 *bool
+	transformPrefix        *string
+	deterministic          *bool
+	inodeOrder             *bool
+	noAtime                *bool
+	resumeStateFile        *string
+	failFast               *bool
+	dropCaches             *bool
+	readRetries            *int
+	readRetryDelay         *time.Duration
+	fileReadTimeout        *time.Duration
+	rereadChanged          *bool
+	freshMetadata          *bool
+	ignoreFailedRead       *bool
+	verbose                *bool
+	totals                 *bool
+	verboseSummary         *bool
+	summaryInterval        *time.Duration
+	dryRun                 *bool
+	ignorePerms            *bool
+	resume                 *bool
+	transform              *string
+	ignoreOwners           *bool
+	fileMode               *string
+	dirMode                *string
+	caseCollisions         *string
+	caseSuffix             *string
+	noVerify               *bool
+	metadataOnly           *bool
+	unknownOwner           *string
+	maxOwnerId             *int
+	strictDirs             *bool
+	force                  *bool
+	logTimestamps          *bool
+	noQuote                *bool
+	backslashPaths         *bool
+}
+
+// Defines the flags that apply to any of the given modes on flags.  With
+// legacy set, -c, -x and -t are defined too, and each flag's usage says
+// which of them it applies to.
+func newOptions(flags *flag.FlagSet, modes mode, legacy bool) *options {
+	o := &options{flags: flags, modes: modes, legacy: legacy}
+	o.create = o.boolFlag("c", false, "create archive", 0)
+	o.extract = o.boolFlag("x", false, "extract archive", 0)
+	o.list = o.boolFlag("t", false, "list the contents of an archive; with -v, in the long form of tar -tv", 0)
+	o.jsonList = o.boolFlag("json", false, "list entries as JSON Lines, ending with a summary object", modeList)
+	o.sortList = o.stringFlag("sort", "", "list entries sorted by name, or by size with the largest first, rather than as they're read", modeList)
+	o.reverseList = o.boolFlag("reverse", false, "reverse the order given by -sort", modeList)
+	o.topList = o.intFlag("top", 0, "list only the first this many entries in the order given by -sort", modeList)
+	o.sortLimit = o.intFlag("sort-limit", 1000000, "most entries -sort will hold in memory without -top; 0 is unlimited", modeList)
+	o.varFlag(&o.inputFileNames, "i", "archive file to read; defaults to stdin; can be repeated to read an archive split into several files, in order", modeExtract|modeList|modeVerify)
+	o.changeDir = o.stringFlag("C", "", "read the files and directories to archive relative to this directory", modeCreate)
+	o.varFlag(&o.outputFileNames, "o", "output file for creation; defaults to stdout; can be repeated to write the archive to several files at once, with - for stdout", modeCreate)
+	o.varFlag(&o.outputChecksums, "output-checksum", "write the output's checksum, using md5, sha1, sha256 or sha512, to a file beside it named for the algorithm, eg. archive.fa.sha256; can be repeated", modeCreate)
+	o.dropFailedOutputs = o.boolFlag("drop-failed-outputs", false, "when writing to several outputs, stop writing to one that fails and carry on with the others, rather than failing", modeCreate)
+	o.requestedBlockSize = o.uintFlag("block-size", 4096, "internal block-size", modeCreate)
+	o.largeBlockSize = o.uintFlag("large-block-size", 65535, "internal block-size for files of at least large-file-threshold bytes", modeCreate)
+	o.largeFileThreshold = o.stringFlag("large-file-threshold", "1M", "size at which files are considered large; accepts K, M and G suffixes", modeCreate)
+	o.dirReaderCount = o.intFlag("dir-readers", 16, "number of simultaneous directory readers", modeCreate)
+	o.fileReaderCount = o.intFlag("file-readers", 16, "number of simultaneous file readers", modeCreate)
+	o.largeFileReaderCount = o.intFlag("file-readers-large", 0, "if non-zero, number of simultaneous file readers dedicated to files of at least large-file-threshold bytes", modeCreate)
+	o.intraFileParallelism = o.intFlag("intra-file-readers", 0, "if greater than one, read each file of at least large-file-threshold bytes in this many concurrent byte ranges", modeCreate)
+	o.directoryScanQueueSize = o.intFlag("queue-dir", 128, "queue size for scanning directories", modeCreate)
+	o.fileReadQueueSize = o.intFlag("queue-read", 128, "queue size for reading files", modeCreate)
+	o.blockQueueSize = o.intFlag("queue-write", 128, "queue size for archive write; increasing can cause increased memory usage", modeCreate)
+	o.maxOpenFiles = o.intFlag("max-open-files", -1, "most files and directories to have open at once; -1 is the process's limit on open files, less some headroom, and 0 is unlimited", modeCreate)
+	o.diagnostics = o.boolFlag("diagnostics", false, "report queue lengths and how busy each stage was, for tuning", modeCreate)
+	o.writeBufferSize = o.stringFlag("write-buffer-size", "64K", "size of each buffer the archive is written through; accepts K, M and G suffixes", modeCreate)
+	o.outputBufferSize = o.stringFlag("output-buffer-size", "1M", "size of the buffer in front of the archive output; accepts K, M and G suffixes", modeCreate)
+	o.inputBufferSize = o.stringFlag("input-buffer-size", "1M", "size of the buffer the archive is read through; accepts K, M and G suffixes", modeExtract)
+	o.fileBufferSize = o.stringFlag("file-buffer-size", "64K", "size of the buffer each restored file is written through; accepts K, M and G suffixes", modeExtract)
+	o.fileQueueSize = o.intFlag("file-queue", 1, "number of blocks queued for each restored file's writer", modeExtract)
+	o.fileWriterCount = o.intFlag("file-writers", 0, "if non-zero, number of goroutines writing restored files, rather than one for each file", modeExtract)
+	o.maxMemory = o.stringFlag("max-memory", "", "most file data to buffer while restoring, eg. 256M; reading the archive waits for writes once it's reached; accepts K, M and G suffixes", modeExtract)
+	o.writeBufferCount = o.intFlag("write-buffers", 4, "number of buffers the archive is written through, so that blocks are collected while earlier ones are written", modeCreate)
+	o.multiCpu = o.intFlag("multicpu", 1, "maximum number of CPUs that can be executing simultaneously", modeAll)
+	o.exclude = o.stringFlag("exclude", "", "file patterns to exclude (eg. */core.*); can be path list separated (eg. : in Linux) for multiple excludes", modeCreate|modeExtract)
+	o.varFlag(&o.include, "include", "file pattern to include (eg. etc/*.conf); only matching files are archived or extracted; can be repeated", modeCreate|modeExtract)
+	o.ignoreCase = o.boolFlag("ignore-case", false, "match include and exclude patterns without regard to case", modeCreate|modeExtract)
+	o.matchBaseNames = o.boolFlag("match-basenames", false, "let include and exclude patterns match just the file name, so that core.* matches at any depth", modeCreate|modeExtract)
+	o.minSize = o.stringFlag("min-size", "", "skip files smaller than this size; accepts K, M and G suffixes", modeCreate)
+	o.maxSize = o.stringFlag("max-size", "", "skip files larger than this size; accepts K, M and G suffixes", modeCreate)
+	o.excludeCaches = o.boolFlag("exclude-caches", false, "skip the contents of directories containing a CACHEDIR.TAG file, except the tag itself", modeCreate)
+	o.excludeVCS = o.boolFlag("exclude-vcs", false, "skip version control metadata: .git, .hg, .svn and .bzr", modeCreate)
+	o.excludeVCSIgnores = o.boolFlag("exclude-vcs-ignores", false, "skip files and directories ignored by .gitignore files found in the tree", modeCreate)
+	o.ignoreMarker = o.stringFlag("ignore-marker", "", "skip the contents of directories containing a file with this name, eg. .fast-archiver-ignore", modeCreate)
+	o.strictRoots = o.boolFlag("strict-roots", false, "fail if a path given as an argument is the same as, or beneath, another argument", modeCreate)
+	o.skipRootLinks = o.boolFlag("skip-root-links", false, "skip directories and files given as arguments that are symbolic links, rather than following them", modeCreate)
+	o.includeVirtualFS = o.boolFlag("include-virtual-fs", false, "archive the contents of virtual filesystems such as /proc and /sys, rather than skipping them", modeCreate)
+	o.oneFileSystem = o.boolFlag("one-file-system", false, "skip directories that are on a different filesystem from the directory being archived", modeCreate)
+	o.maxDepth = o.intFlag("max-depth", 0, "archive directories more than this many levels deep as empty directories; 0 is unlimited", modeCreate)
+	o.normalize = o.stringFlag("normalize", "", "convert paths to this Unicode normalization form, nfc or nfd, when archiving or extracting", modeCreate|modeExtract)
+	o.noMetadata = o.boolFlag("no-metadata", false, "don't record the fast-archiver version, host and creation time in the archive, so that versions before 3 of the archive format can read it", modeCreate)
+	o.compat = o.boolFlag("compat", false, "write a version 2 archive that every release of fast-archiver can read; implies -no-metadata, and can't be used with -intra-file-readers", modeCreate)
+	o.transformPrefix = o.stringFlag("transform-prefix", "", "prefix prepended to every path stored in the archive, eg. hostname/2024-06-01", modeCreate)
+	o.deterministic = o.boolFlag("deterministic", false, "write a reproducible archive by processing files one at a time in sorted order; much slower", modeCreate)
+	o.inodeOrder = o.boolFlag("inode-order", false, "read the files in each directory in inode order, to reduce seeking on rotating disks; uses 2 file readers unless -file-readers is given", modeCreate)
+	o.noAtime = o.boolFlag("noatime", false, "don't update the access time of files being archived, where permitted (Linux only)", modeCreate)
+	o.resumeStateFile = o.stringFlag("resume-state", "", "record progress in this file, and resume from it if it exists; requires -o", modeCreate)
+	o.failFast = o.boolFlag("fail-fast", false, "stop at the first file that can't be archived or extracted completely", modeCreate|modeExtract)
+	o.dropCaches = o.boolFlag("drop-caches", false, "drop files from the page cache once they've been read or written (64-bit Linux only)", modeCreate|modeExtract)
+	o.readRetries = o.intFlag("read-retries", 0, "number of times to reopen a file and resume reading after a read error", modeCreate)
+	o.readRetryDelay = o.durationFlag("read-retry-delay", time.Second, "time to wait before retrying a failed read", modeCreate)
+	o.fileReadTimeout = o.durationFlag("file-read-timeout", 0, "abandon files whose open or any single read takes longer than this, eg. 5m; 0 is unlimited", modeCreate)
+	o.rereadChanged = o.boolFlag("reread-changed", false, "read files again if they change while being archived", modeCreate)
+	o.freshMetadata = o.boolFlag("fresh-metadata", false, "read each file's mode and ownership after opening it, rather than using the scan's", modeCreate)
+	o.ignoreFailedRead = o.boolFlag("ignore-failed-read", false, "don't warn about files that are deleted while being archived", modeCreate)
+	o.verbose = o.boolFlag("v", false, "verbose output on stderr", modeAll)
+	o.totals = o.boolFlag("totals", false, "print a line on stderr at the end with the entries, bytes and time taken, how long was spent in each phase, and the number of problems", modeCreate|modeExtract)
+	o.verboseSummary = o.boolFlag("verbose-summary", false, "rather than naming every file, print a progress line on stderr every summary-interval, and the totals at the end", modeCreate|modeExtract)
+	o.summaryInterval = o.durationFlag("summary-interval", 5*time.Second, "how often to print a progress line with -verbose-summary", modeCreate|modeExtract)
+	o.dryRun = o.boolFlag("n", false, "dry run; show what would be done, but do not write anything", modeCreate|modeExtract)
+	o.ignorePerms = o.boolFlag("ignore-perms", false, "ignore permissions when restoring files", modeExtract)
+	o.force = o.boolFlag("force", false, "extract even if the archive's top-level paths already exist in the current directory", modeExtract)
+	o.resume = o.boolFlag("resume", false, "only write the parts of existing files that differ from the archive", modeExtract)
+	o.transform = o.stringFlag("transform", "", "sed-like substitution applied to paths when restoring, eg. s/^old-host/new-host/", modeExtract)
+	o.ignoreOwners = o.boolFlag("ignore-owners", false, "ignore owners when restoring files", modeExtract)
+	o.fileMode = o.stringFlag("mode", "", "octal mode given to every restored file instead of the archived one, eg. 0644", modeExtract)
+	o.dirMode = o.stringFlag("dir-mode", "", "octal mode given to every restored directory instead of the archived one, eg. 0755", modeExtract)
+	o.unknownOwner = o.stringFlag("unknown-owner", "", "uid:gid given to entries whose uid or gid doesn't exist on this system, eg. 1000:1000", modeExtract)
+	o.maxOwnerId = o.intFlag("max-owner-id", -1, "with -unknown-owner, also treat uids and gids above this as unknown", modeExtract)
+	o.caseCollisions = o.stringFlag("case-collisions", "detect", "check for paths that differ only in case: detect (when the target is case-insensitive), always or never", modeExtract)
+	o.caseSuffix = o.stringFlag("case-suffix", "", "extract paths that differ only in case from an earlier path with this suffix, rather than stopping", modeExtract)
+	o.strictDirs = o.boolFlag("strict-dirs", false, "stop if a directory is archived more than once with different owners or permissions, rather than warning", modeExtract)
+	o.noVerify = o.boolFlag("no-verify", false, "don't verify the archive's checksums, for speed; corrupted data is extracted without error", modeExtract)
+	o.metadataOnly = o.boolFlag("metadata-only", false, "write no file data; create directories and restore the ownership and permissions of existing files", modeExtract)
+	o.logTimestamps = o.boolFlag("log-timestamps", false, "start each message on stderr with the time, and the phase of the run it comes from: scan, read, write or extract", modeAll)
+	o.noQuote = o.boolFlag("no-quote", false, "print file names in messages and listings exactly as they are, rather than escaping non-printable characters as \\xNN", modeAll)
+	o.backslashPaths = o.boolFlag("backslash-paths", false, "treat backslashes in archive paths as separators, for archives made on Windows by older versions", modeExtract|modeList|modeVerify)
+	return o
+}
+
+// Returns true if a flag for any of the given modes should be defined.
+// Modes of 0 is for -c, -x and -t, which are only defined for legacy
+// command lines.
+func (o *options) defines(modes mode) bool {
+	if modes == 0 {
+		return o.legacy
+	}
+	return o.modes&modes != 0
+}
+
+// Returns a flag's usage, noting which of -c, -x and -t it applies to on a
+// legacy command line.
+func (o *options) usage(usage string, modes mode) string {
+	if !o.legacy {
+		return usage
+	}
+	switch modes & modeLegacy {
+	case modeCreate:
+		return usage + " (-c only)"
+	case modeExtract:
+		return usage + " (-x only)"
+	case modeList:
+		return usage + " (-t only)"
+	case modeExtract | modeList:
+		return usage + " (-x and -t only)"
+	}
+	return usage
+}
+
+func (o *options) boolFlag(name string, value bool, usage string, modes mode) *bool {
+	retval := new(bool)
+	*retval = value
+	if o.defines(modes) {
+		o.flags.BoolVar(retval, name, value, o.usage(usage, modes))
+	}
+	return retval
+}
+
+func (o *options) intFlag(name string, value int, usage string, modes mode) *int {
+	retval := new(int)
+	*retval = value
+	if o.defines(modes) {
+		o.flags.IntVar(retval, name, value, o.usage(usage, modes))
+	}
+	return retval
+}
+
+func (o *options) uintFlag(name string, value uint, usage string, modes mode) *uint {
+	retval := new(uint)
+	*retval = value
+	if o.defines(modes) {
+		o.flags.UintVar(retval, name, value, o.usage(usage, modes))
+	}
+	return retval
+}
+
+func (o *options) stringFlag(name string, value string, usage string, modes mode) *string {
+	retval := new(string)
+	*retval = value
+	if o.defines(modes) {
+		o.flags.StringVar(retval, name, value, o.usage(usage, modes))
+	}
+	return retval
+}
+
+func (o *options) durationFlag(name string, value time.Duration, usage string, modes mode) *time.Duration {
+	retval := new(time.Duration)
+	*retval = value
+	if o.defines(modes) {
+		o.flags.DurationVar(retval, name, value, o.usage(usage, modes))
+	}
+	return retval
+}
+
+func (o *options) varFlag(value flag.Value, name string, usage string, modes mode) {
+	if o.defines(modes) {
+		o.flags.Var(value, name, o.usage(usage, modes))
+	}
+}
+
+// Checks whether a flag was explicitly provided on the command line.
+func (o *options) given(name string) bool {
+	given := false
+	o.flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+func printVersion() {
+	if tag != "" || rev != "" {
+		fmt.Fprintf(os.Stderr, "%s (tag: %s, rev: %s)\n", os.Args[0], tag, rev)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s\n", os.Args[0])
+	}
+}
+
+// Parses the command line, which starts with a command, such as "create",
+// or for compatibility with older versions, chooses one with -c, -x or -t.
+// Returns the mode to run in, and exits if there isn't exactly one.
+func parseCommandLine(args []string) (mode, *options) {
+	for _, command := range commands {
+		if len(args) == 0 || args[0] != command.name {
+			continue
+		}
+		command := command
+		flags := flag.NewFlagSet(command.name, flag.ExitOnError)
+		o := newOptions(flags, command.mode, false)
+		flags.Usage = func() {
+			printVersion()
+			fmt.Fprintf(os.Stderr, "Usage: %s %s%s\n\n%s\n\nFlags:\n", os.Args[0], command.name, command.args, command.summary)
+			flags.PrintDefaults()
+		}
+		flags.Parse(args[1:])
+		return command.mode, o
+	}
+
+	o := newOptions(flag.CommandLine, modeLegacy, true)
+	flag.Usage = func() {
+		printVersion()
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		for _, command := range commands {
+			fmt.Fprintf(os.Stderr, "  %s %s%s\n", os.Args[0], command.name, command.args)
+		}
+		fmt.Fprintf(os.Stderr, "\nRun \"%s COMMAND -h\" for the flags each command takes.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOlder versions' flags are still accepted, with -c, -x or -t in place of\na command:\n")
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+	switch {
+	case *o.create && !*o.extract && !*o.list:
+		return modeCreate, o
+	case *o.extract && !*o.create && !*o.list:
+		return modeExtract, o
+	case *o.list && !*o.extract && !*o.create:
+		return modeList, o
+	}
+	log.New(os.Stderr, "", 0).Fatalln("a command (create, extract, list or verify), or exactly one of create (-c), extract (-x) or list (-t), must be given")
+	return 0, nil
+}
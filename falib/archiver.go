@@ -2,14 +2,18 @@ package falib
 
 import (
 	"bufio"
-	"encoding/binary"
-	"hash"
-	"hash/crc64"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
 )
 
 type Archiver struct {
@@ -19,257 +23,1839 @@ type Archiver struct {
 	FileReadQueueSize int
 	BlockQueueSize    int
 	ExcludePatterns   []string
-	Logger            Logger
-	BlockSize         uint16
 
-	directoryScanQueue chan string
-	fileReadQueue      chan string
+	// The archive is written through WriteBufferCount buffers of
+	// WriteBufferSize bytes; one is filled with blocks while the others are
+	// checksummed and written to the output, so that a slow output doesn't
+	// hold up the file readers until every buffer is full.  Default to
+	// 64 KiB and 4.
+	WriteBufferSize  int
+	WriteBufferCount int
+
+	// Size of the buffer in front of the output, so that it's written in
+	// large pieces.  Defaults to 1 MiB.
+	OutputBufferSize int
+
+	Logger    Logger
+	BlockSize uint16
+
+	// Files of at least LargeFileThreshold bytes are read in blocks of
+	// LargeFileBlockSize, rather than BlockSize, reducing the per-block
+	// overhead for large files while small files keep small blocks.  A zero
+	// threshold disables this.
+	LargeFileBlockSize uint16
+	LargeFileThreshold int64
+
+	// If greater than zero, files of at least LargeFileThreshold bytes are
+	// read by a separate pool of this many readers, so that a few huge files
+	// can't hold up many small ones, nor the reverse.  FileReaderCount and
+	// FileReadQueueSize then apply to the small file pool only.
+	LargeFileReaderCount int
+
+	// If greater than one, files of at least LargeFileThreshold bytes are
+	// split into up to this many byte ranges which are read concurrently,
+	// each range being at least 8 MiB.  This lets a single huge file be read
+	// at the full speed of fast storage.  The file's data is written using
+	// offset data blocks, so the archive is written in version 4 of the
+	// format, which earlier versions of fast-archiver reject by its header.
+	// When resuming, it must be the same as for the interrupted run.
+	// Ignored in Deterministic mode.
+	IntraFileParallelism int
+
+	// If non-empty, only files matching at least one of these patterns (or
+	// residing beneath a directory that matches one) are archived.
+	// Directories are always scanned, but are only archived if they match a
+	// pattern or contain an archived file.  A trailing "/**" on a pattern is
+	// accepted and is equivalent to the directory pattern itself.
+	IncludePatterns []string
+
+	// If set, include and exclude patterns are matched without regard to
+	// case; both the pattern and the path are case-folded before matching.
+	MatchCaseInsensitive bool
+
+	// If set, include and exclude patterns also match just the final element
+	// of a path, so that "core.*" matches core files at any depth.  By
+	// default a pattern must match the whole path.
+	MatchBaseNames bool
+
+	// Files smaller than MinFileSize, or larger than MaxFileSize, are not
+	// archived.  Zero disables the respective limit.  Directories are not
+	// affected.
+	MinFileSize int64
+	MaxFileSize int64
+
+	// If set, directories containing a valid CACHEDIR.TAG file are archived
+	// with only the tag file itself; the rest of their contents are skipped.
+	HonorCacheDirTags bool
+
+	// If non-empty, directories containing a file with this name are
+	// archived as empty directories; neither the marker nor any other
+	// contents are archived.
+	IgnoreMarker string
+
+	// If set, the files and directories version-control systems keep their
+	// metadata in, .git, .hg, .svn and .bzr, are skipped, and counted in
+	// Stats().SkippedVCS.
+	ExcludeVCS bool
+
+	// If set, files and directories ignored by the .gitignore files found
+	// while scanning are skipped, and counted in Stats().SkippedGitignore.
+	// Only .gitignore files in and beneath the directories passed to AddDir
+	// are read; global and per-repository excludes aren't.
+	ExcludeVCSIgnores bool
+
+	// If set, directories on a different filesystem from the root directory
+	// being archived (ie. mount points) are skipped.  If the root's device
+	// can't be found, a warning is logged and nothing beneath it is skipped.
+	OneFileSystem bool
+
+	// Directories on filesystems whose contents are generated by the kernel,
+	// such as /proc and /sys, are archived as empty directories, with a
+	// warning, unless IncludeVirtualFS is set.  Reading them can hang, or
+	// never finish, as with /proc/kcore.  Only recognized on Linux.
+	IncludeVirtualFS bool
+
+	// Directories more than MaxDepth levels beneath the directory passed to
+	// AddDir are archived as empty directories.  Zero is unlimited.
+	MaxDepth int
+
+	// Symbolic links found while scanning are always skipped, but a path
+	// passed to AddDir or AddFile that is a link is followed, and what it
+	// points to is archived under the link's path.  If SkipRootLinks is set,
+	// such paths are skipped too, and counted in Stats().SkippedSymlinks.
+	SkipRootLinks bool
+
+	// Paths passed to AddDir and AddFile that are already archived as part
+	// of another, because they're the same path or beneath a directory
+	// that was added, are skipped with a warning, and counted in
+	// Stats().OverlappingRoots.  If StrictRoots is set, they're an error
+	// instead, returned as an *OverlappingRootError by AddDir and by Run.
+	// Paths added with Begin after the overlapping path has been scanned
+	// are archived twice.
+	StrictRoots bool
+
+	// If set, files passed to AddFile are archived without directory entries
+	// for their parent directories.  Extracting such an archive requires the
+	// parent directories to already exist.
+	OmitFileParents bool
+
+	// If non-empty, prepended to every path stored in the archive, eg.
+	// "hostname/2024-06-01".  Directory entries for the prefix itself are
+	// written at the start of the archive.  Must be relative and clean.
+	PathPrefix string
+
+	// If set, paths are stored in this Unicode normalization form.  Names
+	// that differ only in normalization are stored under the same path, so
+	// the later one replaces the earlier when the archive is extracted.
+	NormalizePaths Normalization
+
+	// If set, the archive is written in a reproducible order: directory
+	// entries are sorted, and directories and files are processed one at a
+	// time, in order, so that archiving an unchanged tree twice produces
+	// byte-identical archives.  This disables all of the concurrency that
+	// makes fast-archiver fast; DirReaderCount and FileReaderCount are
+	// ignored, and throughput will be similar to tar.  ArchiveMetadata is
+	// written as given, so it mustn't hold anything that varies between
+	// runs or hosts, such as the time or the hostname.
+	Deterministic bool
+
+	// If set, the files in each directory are queued for reading in inode
+	// order, rather than the order they're listed in.  On rotating disks,
+	// inode order approximates physical order, reducing seeking; this works
+	// best combined with a small FileReaderCount, so that reads are close to
+	// sequential.  It has little benefit on SSDs or network filesystems.
+	InodeOrder bool
+
+	// If set, files are opened without updating their access time, where
+	// the platform and permissions allow it (Linux, for files owned by the
+	// user running the archiver).
+	NoAtime bool
+
+	// If set, each file's pages are dropped from the page cache once it has
+	// been read, so that archiving doesn't evict more useful data, such as a
+	// database's working set.  Only supported on 64-bit Linux.
+	DropCaches bool
+
+	// When a file read fails, the file is reopened and reading resumes from
+	// the last successful offset, up to ReadRetries times per file, waiting
+	// ReadRetryDelay before each attempt.  This helps with transient errors
+	// on network filesystems.  Files that still can't be read completely
+	// are counted in Stats().DamagedFiles.
+	ReadRetries    int
+	ReadRetryDelay time.Duration
+
+	// If greater than zero, the maximum time allowed for opening a file,
+	// and for each read from it.  A file that stalls for longer, such as one
+	// on a hung network filesystem, is abandoned with whatever contents were
+	// read before it stalled, and is listed in Stats().TimedOutFiles.  A
+	// large file that keeps making progress is never abandoned.  Because
+	// file reads can't be interrupted, an abandoned read is left running in
+	// the background.
+	FileReadTimeout time.Duration
+
+	// If set, files and directories that are deleted between being found by
+	// the scanner and being read are skipped quietly, rather than with a
+	// warning, and are counted in Stats().Vanished.  Other errors are still
+	// warnings.
+	IgnoreVanished bool
+
+	// If set, a file whose size or modification time changed while it was
+	// being read is read and archived a second time.  The later copy
+	// replaces the earlier one when the archive is extracted.
+	RereadChanged bool
+
+	// If set, each file's mode, ownership and size are read from the file
+	// once it's opened.  Otherwise, they're taken from the FileInfo found
+	// while scanning, when the scan needed one, saving a stat per file.
+	FreshMetadata bool
+
+	// If set, called before each file is read.  Returning an error skips the
+	// file.  Like OnFileComplete, it's called from the file reader
+	// goroutines, so it may be called concurrently for different files and
+	// must be safe for concurrent use; a slow hook holds up a file reader.
+	OnFileStart func(path string) error
+
+	// If set, called after each file has been read, with the number of bytes
+	// archived and the error that prevented the file from being archived
+	// completely, if any.  Not called for files skipped by OnFileStart.
+	OnFileComplete func(path string, bytes int64, err error)
+
+	// If set, files and directories are read from FS rather than from the
+	// operating system, and the paths given to AddDir and AddFile are
+	// interpreted within it.  Ownership isn't available through fs.FS, so
+	// every entry is archived with uid and gid 0.  NoAtime and DropCaches
+	// have no effect, nor does OneFileSystem unless the FS's FileInfo.Sys
+	// is a *syscall.Stat_t.
+	FS fs.FS
+
+	// If set, called for every file and directory found while scanning,
+	// after the exclude patterns and other built-in filters have been
+	// applied.  See the Filter type for the concurrency requirements.
+	Filter Filter
+
+	// If set, called for each file and directory as it's written, with its
+	// path in the archive before PathPrefix, for key/value pairs to store
+	// with it; see Header.Metadata.  The archive is then written in
+	// version 3 of the format, which versions of fast-archiver before it
+	// can't read.  It's called from the writer's goroutine only, so it
+	// needn't be safe for concurrent use, but it holds up the writer.
+	// Metadata that can't be stored, such as more than
+	// faformat.MaxEntryMetaSize bytes, is reported as a problem, and the
+	// entry is archived without it.  When resuming, it must be set if, and
+	// only if, it was set for the interrupted run.
+	MetadataFor func(path string) map[string]string
+
+	// Key/value pairs describing the whole archive; see
+	// Writer.ArchiveMetadata.  Setting it also writes version 3 of the
+	// format.  When resuming, it must be set if, and only if, it was set
+	// for the interrupted run, though its contents aren't written again.
+	ArchiveMetadata map[string]string
+
+	// The most files and directories that may be open at once for reading,
+	// or 0 for no limit.  Defaults to the process's limit on open files,
+	// less some headroom for the rest of the process.  If an open still fails
+	// because too many files are open, the limit is lowered and the open is
+	// retried, rather than the file being skipped.  The most open at once is
+	// in Stats().PeakOpenFiles.  Ignored in Deterministic mode, which opens
+	// a directory for each level it's descended.
+	MaxOpenFiles int
+
+	// The maximum number of problems kept for Problems(); 0 keeps them all.
+	MaxProblems int
+
+	// Algorithms, of md5, sha1, sha256 and sha512, to hash the archive with
+	// as it's written to the output, eg. for a sidecar file or an upload's
+	// integrity header.  Can't be used with ResumeFrom, since the part of
+	// the archive written before isn't seen.
+	OutputChecksums []string
+
+	// If set, called once the archive has been completely written and
+	// flushed to the output, with the hex digest for each of
+	// OutputChecksums.  Not called if writing the archive failed.
+	OnOutputComplete func(digests map[string]string)
+
+	// If set, the progress of the archive is recorded in this file at each
+	// checksum block, so that an interrupted run can be resumed with
+	// LoadResumeState and ResumeFrom.
+	StateFile string
+
+	// If set, continues an interrupted archive: the output must already
+	// hold the archive truncated to ResumeFrom.Offset.  Entries written
+	// before that point are skipped, even if they have since changed;
+	// anything else is archived as usual, so new files are picked up, and
+	// entries deleted since the first run remain in the archive.  The same
+	// paths and options as the first run should be used; Run fails with
+	// ErrResumeVersion if they'd write another version of the format.
+	ResumeFrom *ResumeState
+
+	// Whether a problem, such as a file that can't be read, stops the run.
+	// Defaults to ContinueOnError.
+	ErrorPolicy ErrorPolicy
+
+	// If set, the length of each queue is sampled every second, and the time
+	// each stage spends working is measured, for tuning the reader counts
+	// and queue sizes.  The results are in Stats().Diagnostics.
+	Diagnostics bool
+
+	directoryScanQueue chan directoryScan
+	fileReadQueue      chan fileRead
+	largeFileReadQueue chan fileRead
 	blockQueue         chan block
 	workInProgress     sync.WaitGroup
 	excludePatterns    []string
+	excludeDirPatterns []string
+	excludeContents    []string
+	includePatterns    []string
+	pathPrefix         string
+	pendingDirs        map[string]block
+	pendingDirsLock    sync.Mutex
+	fileParentDirs     map[string]bool
+	rawOutput          io.Writer
 	output             *bufio.Writer
-	error              error
+	stats              ArchiverStats
+	problems           problemList
+	addLock            sync.Mutex
+	added              []directoryScan
+	running            bool
+	ran                bool
+	streaming          bool
+	stopped            chan bool
+	closed             bool
+	result             chan error
+	pausedFlag         int32
+	pauseLock          sync.Mutex
+	pauseCond          *sync.Cond
+	pauseFlush         chan bool
+	timedOutFilesLock  sync.Mutex
+	diag               *diagnostics
+	openFiles          openFileLimit
+	outputInfos        []os.FileInfo
+	outputHashes       *outputHashes
+	roots              map[string][]*root
+	rootError          error
+	overlappingRoots   int64
+
+	// The first path found to be unsafe to store, returned from Run; set by
+	// the scanners with setError.
+	errorLock sync.Mutex
+	error     error
 }
 
-func NewArchiver(output io.Writer) *Archiver {
+// Returns an Archiver with no output, to be configured and given paths once,
+// and run any number of times with RunTo, eg. to archive the same directories
+// to a new file each night.
+func NewArchiverTemplate() *Archiver {
 	retval := &Archiver{}
+	retval.Logger = NopLogger
 	retval.ExcludePatterns = []string{}
-	retval.output = bufio.NewWriter(output)
 	retval.DirReaderCount = 16
 	retval.FileReaderCount = 16
 	retval.DirScanQueueSize = 128
 	retval.FileReadQueueSize = 128
 	retval.BlockQueueSize = 128
+	retval.WriteBufferSize = faformat.DefaultWriteBufferSize
+	retval.WriteBufferCount = faformat.DefaultWriteBufferCount
+	retval.OutputBufferSize = defaultStreamBufferSize
 	retval.BlockSize = 4096
+	retval.LargeFileBlockSize = 65535
+	retval.LargeFileThreshold = 1 << 20
+	retval.MaxOpenFiles = defaultMaxOpenFiles()
+	retval.MaxProblems = defaultMaxProblems
+	retval.pauseCond = sync.NewCond(&retval.pauseLock)
+	retval.pauseFlush = make(chan bool, 1)
+	return retval
+}
+
+// Returns an Archiver that writes to output when Run or Begin is called.
+func NewArchiver(output io.Writer) *Archiver {
+	retval := NewArchiverTemplate()
+	retval.rawOutput = output
 	return retval
 }
 
-func (a *Archiver) AddDir(directoryPath string) {
-	if a.directoryScanQueue == nil {
-		a.directoryScanQueue = make(chan string, a.DirScanQueueSize)
+// Adds a directory and its contents to the archive.  Returns an error if the
+// path isn't a directory, or can't be stored in an archive.  A symbolic link
+// to a directory is followed, unless SkipRootLinks is set.  As with rsync, a
+// trailing slash archives just the directory's contents, at the top level of
+// the archive; see AddDirContentsAs.
+func (a *Archiver) AddDir(directoryPath string) error {
+	if hasTrailingSlash(directoryPath) {
+		return a.AddDirContentsAs(directoryPath, ".")
+	}
+	return a.AddDirAs(directoryPath, directoryPath)
+}
+
+// Adds a directory to the archive, reading it from fsPath, but storing it
+// and its contents beneath archivePath.  fsPath may be absolute; archivePath
+// must be relative, and must not refer to a parent directory.
+func (a *Archiver) AddDirAs(fsPath string, archivePath string) error {
+	if err := a.checkDir(fsPath, archivePath); err != nil {
+		return err
 	}
+	return a.addDirAs(fsPath, archivePath, false)
+}
+
+// Like AddDirAs, but stores the directory's contents directly beneath
+// archivePath, without an entry for the directory itself, so that they're
+// extracted straight into the target.  With an archivePath of ".", the
+// contents are at the top level of the archive.  Exclude and include
+// patterns match the stored paths, so they're relative to the directory.
+func (a *Archiver) AddDirContentsAs(fsPath string, archivePath string) error {
+	if err := a.checkDir(fsPath, archivePath); err != nil {
+		return err
+	}
+	return a.addDirAs(fsPath, archivePath, true)
+}
+
+// Checks that fsPath is a directory, and archivePath can be stored in an
+// archive.
+func (a *Archiver) checkDir(fsPath string, archivePath string) error {
+	if err := checkArchivePath(filepath.Clean(archivePath)); err != nil {
+		return err
+	}
+	fileInfo, err := a.stat(fsPath)
+	if err != nil {
+		return err
+	} else if !fileInfo.IsDir() {
+		return &os.PathError{Op: "add", Path: fsPath, Err: ErrNotDirectory}
+	}
+	return nil
+}
+
+// Like AddDir, but doesn't check the path; problems are reported as warnings
+// once Run is called.
+func (a *Archiver) AddDirLazy(directoryPath string) {
+	if hasTrailingSlash(directoryPath) {
+		a.addDirAs(directoryPath, ".", true)
+		return
+	}
+	a.addDirAs(directoryPath, directoryPath, false)
+}
+
+func (a *Archiver) addDirAs(fsPath string, archivePath string, contentsOnly bool) error {
+	archivePath = filepath.Clean(archivePath)
+	r, err := a.addRoot(fsPath, archivePath, true)
+	if r == nil {
+		return err
+	} else if !a.add(directoryScan{path: archivePath, fsPath: fsPath, contentsOnly: contentsOnly, root: r}) {
+		return ErrArchiverReused
+	}
+	return nil
+}
+
+// Returns true if a path ends with a separator, other than a path that's
+// only a root, such as "/".
+func hasTrailingSlash(p string) bool {
+	return len(p) > 1 && os.IsPathSeparator(p[len(p)-1]) && filepath.Clean(p) != filepath.VolumeName(p)+string(filepath.Separator)
+}
+
+// Returns true if paths can no longer be added, because Run has been called,
+// or Close has been called after Begin.  Must be called with addLock held.
+func (a *Archiver) addsRejected() bool {
+	return a.ran && (!a.streaming || a.closed)
+}
+
+// Records a path for each later run to archive, or sends it to the current
+// run if it was started with Begin.  Returns false if paths can no longer be
+// added.
+func (a *Archiver) add(scan directoryScan) bool {
+	a.addLock.Lock()
+	if a.addsRejected() {
+		a.addLock.Unlock()
+		return false
+	} else if !a.streaming {
+		a.added = append(a.added, scan)
+		a.addLock.Unlock()
+		return true
+	}
+	// Done under addLock so that Close can't let workInProgress drain
+	// between the check above and this Add.
 	a.workInProgress.Add(1)
-	a.directoryScanQueue <- directoryPath
+	a.addLock.Unlock()
+	a.directoryScanQueue <- scan
+	return true
 }
 
+// Adds a single file to the archive.  Unless OmitFileParents is set, the
+// file's parent directories are archived as well, but none of their other
+// contents are.
+func (a *Archiver) AddFile(filePath string) {
+	a.AddFileAs(filePath, filePath)
+}
+
+// Adds a single file to the archive, reading it from fsPath, but storing it
+// as archivePath.  Parent directories are archived as with AddFile, with the
+// metadata of the corresponding parents of fsPath.
+func (a *Archiver) AddFileAs(fsPath string, archivePath string) {
+	archivePath = filepath.Clean(archivePath)
+	r, _ := a.addRoot(fsPath, archivePath, false)
+	if r != nil {
+		a.add(directoryScan{path: archivePath, fsPath: filepath.Clean(fsPath), isFile: true, root: r})
+	}
+}
+
+// Adds a file to the archive whose contents are read from r until EOF, rather
+// than from disk; r is not closed.  The entry is written with the given path
+// and metadata, and is read by one of the file reader goroutines once Run is
+// called.  Since r can only be read once, the entry is only archived by the
+// next run, not by later calls to RunTo.  Entries aren't ordered relative to
+// directories being scanned, so an entry beneath a directory added with
+// AddDir could be written before that directory; such archives extract
+// correctly only if the directory already exists.
+func (a *Archiver) AddEntry(path string, r io.Reader, mode os.FileMode, uid int, gid int) {
+	a.add(directoryScan{path: path, entry: &entrySource{r, uid, gid, mode}})
+}
+
+// Archives everything that has been added to the output given to
+// NewArchiver.  Run can only be called once, since the output then holds a
+// complete archive; a second call, or a call to RunTo or Begin after it,
+// returns ErrArchiverReused, and paths added after the first call are
+// ignored.
 func (a *Archiver) Run() error {
-	if a.directoryScanQueue == nil {
-		a.directoryScanQueue = make(chan string, a.DirScanQueueSize)
+	err := a.start(a.rawOutput, true, false)
+	if err != nil {
+		return err
+	}
+	return a.finish()
+}
+
+// Archives everything that has been added to output, as Run does, but leaves
+// the Archiver ready to be run again.  Each run scans the paths afresh, with
+// the fields as they are when it's called, and Stats and Problems describe
+// the latest run.  Runs can't overlap; RunTo returns ErrArchiverRunning if
+// another is in progress.
+func (a *Archiver) RunTo(output io.Writer) error {
+	err := a.start(output, false, false)
+	if err != nil {
+		return err
+	}
+	return a.finish()
+}
+
+// Starts archiving in the background, for callers that discover paths to
+// archive while the archive is being written.  AddDir, AddFile and AddEntry
+// may then be called from any goroutine until Close is called.
+func (a *Archiver) Begin() error {
+	err := a.start(a.rawOutput, true, true)
+	if err != nil {
+		return err
+	}
+	a.result = make(chan error, 1)
+	go func() {
+		a.result <- a.finish()
+	}()
+	return nil
+}
+
+// Signals that no more paths will be added after Begin, waits for the
+// archive to be completely written, and returns the error Run would have.
+func (a *Archiver) Close() error {
+	a.addLock.Lock()
+	if !a.streaming || a.closed {
+		a.addLock.Unlock()
+		return ErrNotBegun
+	}
+	a.closed = true
+	a.addLock.Unlock()
+
+	a.workInProgress.Done()
+	return <-a.result
+}
+
+// Validates the configuration and starts the scanning, reading and writing
+// goroutines, writing to output.  With once set, as for Run and Begin, the
+// Archiver can't be run again; with streaming, paths added from now until
+// Close are sent to this run.
+func (a *Archiver) start(output io.Writer, once bool, streaming bool) error {
+	a.addLock.Lock()
+	ran, running, stopped := a.ran, a.running, a.stopped
+	if !running {
+		a.ran = ran || once
+		a.running = !ran
+	}
+	a.addLock.Unlock()
+	if running {
+		return ErrArchiverRunning
+	} else if ran {
+		return ErrArchiverReused
+	}
+	if stopped != nil {
+		// The last run's workers are still draining its queues if it
+		// failed, and mustn't send to this run's.
+		<-stopped
 	}
-	a.fileReadQueue = make(chan string, a.FileReadQueueSize)
+	err := a.prepare(output, streaming)
+	if err != nil {
+		a.addLock.Lock()
+		a.running = false
+		a.addLock.Unlock()
+	}
+	return err
+}
+
+// Sets up the state for a run, and starts its goroutines.
+func (a *Archiver) prepare(rawOutput io.Writer, streaming bool) error {
+	if rawOutput == nil {
+		return ErrNoOutput
+	} else if a.rootError != nil {
+		return a.rootError
+	}
+
+	a.pathPrefix = strings.TrimSuffix(a.PathPrefix, "/")
+	if a.pathPrefix != "" {
+		if err := checkArchivePath(a.pathPrefix); err != nil {
+			return err
+		} else if filepath.Clean(a.pathPrefix) != a.pathPrefix || a.pathPrefix == "." {
+			return ErrInvalidPathPrefix
+		}
+	}
+
+	output := rawOutput
+	a.outputHashes = nil
+	if len(a.OutputChecksums) > 0 {
+		if a.ResumeFrom != nil {
+			return ErrChecksumResume
+		}
+		hashes, err := newOutputHashes(a.OutputChecksums)
+		if err != nil {
+			return err
+		}
+		a.outputHashes = hashes
+		output = hashes.writer(output)
+	}
+	a.output = bufio.NewWriterSize(output, a.OutputBufferSize)
+	// An archive written to a file among those being archived mustn't be
+	// read into itself.  Only files with the output's name are checked, so
+	// an output such as os.Stdout, whose name isn't the file's, isn't found.
+	a.outputInfos = nil
+	outputs := []io.Writer{rawOutput}
+	if tee, ok := rawOutput.(*TeeWriter); ok {
+		outputs = tee.writers()
+	}
+	for _, output := range outputs {
+		if outputFile, ok := output.(*os.File); ok && a.FS == nil {
+			if fileInfo, err := outputFile.Stat(); err == nil && fileInfo.Mode().IsRegular() {
+				a.outputInfos = append(a.outputInfos, fileInfo)
+			}
+		}
+	}
+	a.fileReadQueue = make(chan fileRead, a.FileReadQueueSize)
+	a.largeFileReadQueue = make(chan fileRead, a.FileReadQueueSize)
 	a.blockQueue = make(chan block, a.BlockQueueSize)
-	a.error = nil
+	a.excludePatterns, a.excludeDirPatterns, a.excludeContents = splitExcludePatterns(foldPatterns(a.ExcludePatterns, a.MatchCaseInsensitive))
+	a.includePatterns = foldPatterns(a.IncludePatterns, a.MatchCaseInsensitive)
+	for i, pattern := range a.includePatterns {
+		a.includePatterns[i] = strings.TrimSuffix(pattern, "/**")
+	}
+	a.pendingDirs = make(map[string]block)
+	a.fileParentDirs = make(map[string]bool)
+	a.stats = ArchiverStats{}
+	a.problems.reset(a.MaxProblems, a.ErrorPolicy)
+	a.setError(nil)
+
+	dirReaderCount, fileReaderCount, largeFileReaderCount := a.DirReaderCount, a.FileReaderCount, a.LargeFileReaderCount
+	maxOpenFiles := a.MaxOpenFiles
+	if a.Deterministic {
+		// A single scanner processes the roots in the order they were
+		// added, and reads every file itself.
+		dirReaderCount, fileReaderCount, largeFileReaderCount = 1, 0, 0
+		maxOpenFiles = 0
+	}
+	a.openFiles.reset(maxOpenFiles)
+	// Each stage's busy time is always recorded, for Stats; the queues are
+	// only sampled for Diagnostics.
+	a.diag = newDiagnostics([stageCount]int{dirReaderCount, fileReaderCount, largeFileReaderCount, 1})
+
+	stopped := make(chan bool)
+	a.addLock.Lock()
+	a.directoryScanQueue = make(chan directoryScan, a.DirScanQueueSize)
+	a.stopped = stopped
+	scans := a.added
+	a.added = nil
+	for _, scan := range scans {
+		if scan.entry == nil {
+			a.added = append(a.added, scan)
+		}
+	}
+	a.workInProgress.Add(len(scans))
+	if streaming {
+		a.streaming = true
+		// Held until Close, so that the queues aren't closed while more
+		// paths may still be added.
+		a.workInProgress.Add(1)
+	}
+	a.addLock.Unlock()
+	go func() {
+		for _, scan := range scans {
+			a.directoryScanQueue <- scan
+		}
+	}()
 
-	for i := 0; i < a.DirReaderCount; i++ {
-		go a.directoryScanner()
+	if a.Diagnostics {
+		go a.diag.sample(a)
+	}
+	// The workers read the Archiver's fields, so the next run waits for them
+	// to return, not only for their queues to be closed.
+	var workers sync.WaitGroup
+	workers.Add(dirReaderCount + fileReaderCount + largeFileReaderCount)
+	for i := 0; i < dirReaderCount; i++ {
+		go func() {
+			a.directoryScanner()
+			workers.Done()
+		}()
+	}
+	for i := 0; i < fileReaderCount; i++ {
+		go func() {
+			a.fileReader(a.fileReadQueue)
+			workers.Done()
+		}()
 	}
-	for i := 0; i < a.FileReaderCount; i++ {
-		go a.fileReader()
+	for i := 0; i < largeFileReaderCount; i++ {
+		go func() {
+			a.fileReader(a.largeFileReadQueue)
+			workers.Done()
+		}()
 	}
 
 	go func() {
 		a.workInProgress.Wait()
 		close(a.directoryScanQueue)
 		close(a.fileReadQueue)
+		close(a.largeFileReadQueue)
 		close(a.blockQueue)
+		workers.Wait()
+		close(stopped)
 	}()
 
+	return nil
+}
+
+// Writes blocks to the output until every queued path has been archived.
+func (a *Archiver) finish() error {
+	defer func() {
+		a.addLock.Lock()
+		a.running = false
+		a.addLock.Unlock()
+	}()
 	err := a.archiveWriter()
-	a.output.Flush()
+	if flushErr := a.output.Flush(); err == nil {
+		err = flushErr
+	}
+	a.diag.finish()
+	if err != nil {
+		// Let the workers finish, so that they stop before the next run.
+		go func(blockQueue chan block) {
+			for range blockQueue {
+			}
+		}(a.blockQueue)
+	}
 
 	if err != nil {
 		return err
 	}
+	if a.OnOutputComplete != nil {
+		var digests map[string]string
+		if a.outputHashes != nil {
+			digests = a.outputHashes.digests()
+		}
+		a.OnOutputComplete(digests)
+	}
+	if err = a.problems.failureErr(); err != nil {
+		return err
+	}
+	return a.runError()
+}
+
+// Records an error to be returned from Run, unless one already has been.
+// Called concurrently by the scanners, so the error is guarded by errorLock;
+// nil clears it, at the start of a run.
+func (a *Archiver) setError(err error) {
+	a.errorLock.Lock()
+	if err == nil || a.error == nil {
+		a.error = err
+	}
+	a.errorLock.Unlock()
+}
+
+func (a *Archiver) runError() error {
+	a.errorLock.Lock()
+	defer a.errorLock.Unlock()
 	return a.error
 }
 
 func (a *Archiver) directoryScanner() {
-	for directoryPath := range a.directoryScanQueue {
-		if strings.HasPrefix(directoryPath, "/") {
-			a.error = ErrAbsoluteDirectoryPath
-			a.workInProgress.Done()
-			continue
+	for scan := range a.directoryScanQueue {
+		begun := time.Now()
+		if a.rootSkipped(scan.root) {
+			// Archived as part of a root added later.
+		} else if scan.entry != nil {
+			a.queueEntry(scan.path, scan.entry)
+		} else if scan.isFile {
+			a.scanFile(scan.fsPath, scan.path)
+		} else {
+			a.scanDirectory(scan)
 		}
-		a.Logger.Verbose(directoryPath)
+		a.diag.add(stageScan, begun)
+		a.workInProgress.Done()
+	}
+}
 
-		directory, err := os.Open(directoryPath)
-		if err != nil {
-			a.Logger.Warning("directory read error:", err.Error())
-			a.workInProgress.Done()
-			continue
+// A directory waiting in the directory scan queue.
+type directoryScan struct {
+	// The path stored in the archive.
+	path string
+	// The path on the filesystem; the same as path, unless added with one of
+	// the "As" methods.  Unused for entries.
+	fsPath string
+	// Set for a file passed to AddFile, rather than a directory.
+	isFile bool
+	// Set for an entry passed to AddEntry, rather than a directory.
+	entry *entrySource
+	// If set, the directory's own entry is only written if something beneath
+	// it is archived.
+	excluded bool
+	// If set, the directory's own entry is never written; only its contents
+	// are archived.  Only set for a directory passed to AddDirContentsAs.
+	contentsOnly bool
+	// The number of levels beneath the directory passed to AddDir.
+	depth int
+	// The device id of the root directory this directory was found in; only
+	// used with OneFileSystem, and if hasDevice is set.
+	device    uint64
+	hasDevice bool
+	// For a path passed to AddDir or AddFile, its record of the root.
+	root *root
+	// The .gitignore rules from the directories above, with
+	// ExcludeVCSIgnores.
+	ignores *gitignore
+	// The pending directory above, whose entry is dropped once all the scans
+	// beneath it have finished without archiving anything.
+	parent *pendingScan
+}
+
+// Queues an entry passed to AddEntry to be read.
+func (a *Archiver) queueEntry(path string, entry *entrySource) {
+	if err := checkArchivePath(path); err != nil {
+		a.setError(err)
+		return
+	}
+	a.queueRead(fileRead{path: path, entry: entry})
+}
+
+// A directory kept pending while it and the directories beneath it are
+// scanned.  remaining counts its own scan and those of its subdirectories
+// that haven't finished.
+type pendingScan struct {
+	path      string
+	parent    *pendingScan
+	remaining int32
+}
+
+// Returns true if a directory's entry may have to wait until something
+// beneath it is archived, because of IncludePatterns or Filter.  Otherwise
+// directories are written as soon as they're scanned.
+func (a *Archiver) holdsDirs() bool {
+	return len(a.includePatterns) != 0 || a.Filter != nil
+}
+
+// Records the end of a scan beneath p.  A directory whose scans have all
+// finished is removed from pendingDirs, since nothing beneath it can be
+// archived any more; if it was written, it's already gone.
+func (a *Archiver) finishPendingScan(p *pendingScan) {
+	for ; p != nil; p = p.parent {
+		if atomic.AddInt32(&p.remaining, -1) != 0 {
+			return
+		}
+		a.pendingDirsLock.Lock()
+		delete(a.pendingDirs, p.path)
+		a.pendingDirsLock.Unlock()
+	}
+}
+
+// Queues a file passed to AddFile, after writing its parent directories.
+func (a *Archiver) scanFile(fsFilePath string, filePath string) {
+	if err := checkArchivePath(filePath); err != nil {
+		a.setError(err)
+		return
+	} else if a.skipRootLink(fsFilePath, filePath) {
+		return
+	}
+
+	size := int64(-1)
+	fileInfo, err := a.stat(fsFilePath)
+	if err == nil {
+		if a.isOutput(fsFilePath, fileInfo.Name(), fileInfo) {
+			a.log(PhaseScan).Warning("file is the archive; not dumped:", filePath)
+			return
 		}
+		size = fileInfo.Size()
+	}
 
-		uid, gid, mode := a.getModeOwnership(directory)
-		a.blockQueue <- block{directoryPath, 0, nil, blockTypeDirectory, uid, gid, mode}
+	if !a.OmitFileParents {
+		a.pendingDirsLock.Lock()
+		fsDirectoryPath := filepath.Dir(fsFilePath)
+		for directoryPath := filepath.Dir(filePath); directoryPath != "."; directoryPath = filepath.Dir(directoryPath) {
+			if a.fileParentDirs[directoryPath] {
+				break
+			}
+			a.fileParentDirs[directoryPath] = true
+			// Opened as a file, since directories can't take the last
+			// slot, and scanners holding the others may be waiting for
+			// pendingDirsLock.
+			directory, err := a.open(fsDirectoryPath, false, PhaseScan)
+			fsDirectoryPath = filepath.Dir(fsDirectoryPath)
+			if err != nil {
+				a.log(PhaseScan).Warning("directory read error:", err.Error())
+				atomic.AddInt64(&a.stats.Errors, 1)
+				a.problems.add(directoryPath, "open", err)
+				break
+			}
+			uid, gid, mode, attributes := a.getModeOwnership(directory, directoryPath)
+			a.closeFile(directory)
+			a.pendingDirs[directoryPath] = block{directoryPath, 0, nil, blockTypeDirectory, uid, gid, mode, 0, attributes}
+		}
+		a.pendingDirsLock.Unlock()
+		a.writePendingDir(filepath.Dir(filePath))
+	}
 
-		for fileName := range a.readdirnames(directory) {
-			filePath := filepath.Join(directoryPath, fileName)
+	a.queueRead(fileRead{path: filePath, fsPath: fsFilePath, size: size, info: fileInfo})
+}
 
-			excludeFile := false
-			for _, excludePattern := range a.excludePatterns {
-				match, err := filepath.Match(excludePattern, filePath)
-				if err == nil && match {
-					excludeFile = true
-					break
+func (a *Archiver) scanDirectory(scan directoryScan) {
+	directoryPath := scan.path
+	fsDirectoryPath := scan.fsPath
+	var pending *pendingScan
+	if a.holdsDirs() && !scan.contentsOnly {
+		pending = &pendingScan{path: directoryPath, parent: scan.parent, remaining: 1}
+		defer a.finishPendingScan(pending)
+	}
+	if err := checkArchivePath(directoryPath); err != nil {
+		a.setError(err)
+		return
+	}
+	if scan.depth == 0 && a.skipRootLink(fsDirectoryPath, directoryPath) {
+		return
+	}
+	if !scan.contentsOnly {
+		logEntry(a.log(PhaseScan), directoryPath, true)
+	}
+
+	directory, err := a.open(fsDirectoryPath, true, PhaseScan)
+	if err != nil {
+		if scan.depth == 0 || !a.vanished(directoryPath, err, PhaseScan) {
+			a.log(PhaseScan).Warning("directory read error:", err.Error())
+			atomic.AddInt64(&a.stats.Errors, 1)
+			a.problems.add(directoryPath, "open", err)
+		}
+		return
+	}
+	defer a.closeFile(directory)
+
+	if a.OneFileSystem && scan.depth == 0 {
+		// Without the root's device, every subdirectory would look like a
+		// mount point, so mount points aren't looked for beneath it.
+		fi, err := directory.Stat()
+		if err == nil {
+			scan.device, scan.hasDevice = fileDevice(fi)
+		} else {
+			a.log(PhaseScan).Warning("unable to find the filesystem of", directoryPath+"; archiving any filesystems mounted beneath it:", err.Error())
+		}
+	}
+
+	// With include patterns or a filter, a directory may only be written
+	// once we know that it, or something beneath it, is being archived;
+	// until then, it's kept pending.  A pending parent must be written
+	// before this directory.  A directory whose contents alone are archived
+	// is never pending, so nothing beneath it writes it.
+	if !scan.contentsOnly && !a.holdsDirs() {
+		uid, gid, mode, attributes := a.getModeOwnership(directory, directoryPath)
+		a.blockQueue <- block{directoryPath, 0, nil, blockTypeDirectory, uid, gid, mode, 0, attributes}
+	} else if !scan.contentsOnly {
+		uid, gid, mode, attributes := a.getModeOwnership(directory, directoryPath)
+		a.pendingDirsLock.Lock()
+		a.pendingDirs[directoryPath] = block{directoryPath, 0, nil, blockTypeDirectory, uid, gid, mode, 0, attributes}
+		a.pendingDirsLock.Unlock()
+		if !scan.excluded && (len(a.includePatterns) == 0 || a.isIncluded(directoryPath)) {
+			a.writePendingDir(directoryPath)
+		}
+	}
+
+	if a.MaxDepth > 0 && scan.depth >= a.MaxDepth {
+		a.log(PhaseScan).Verbose("skipping contents of directory at maximum depth", directoryPath)
+		return
+	}
+
+	if !a.IncludeVirtualFS {
+		if fsName, ok := virtualFilesystem(directory); ok {
+			a.log(PhaseScan).Warning("skipping contents of", fsName, "filesystem", directoryPath)
+			atomic.AddInt64(&a.stats.SkippedVirtualFS, 1)
+			return
+		}
+	}
+
+	// Everything in the directory would be excluded one by one, so it isn't
+	// read at all.
+	if matchesPathAny(a.excludeContents, directoryPath, a.MatchCaseInsensitive) {
+		a.log(PhaseScan).Verbose("skipping contents of excluded directory", directoryPath)
+		atomic.AddInt64(&a.stats.Excluded, 1)
+		return
+	}
+
+	if a.HonorCacheDirTags && a.isCacheDir(fsDirectoryPath) {
+		a.log(PhaseScan).Verbose("skipping contents of cache directory", directoryPath)
+		a.queueFile(filepath.Join(fsDirectoryPath, cacheDirTagName), filepath.Join(directoryPath, cacheDirTagName), nil)
+		return
+	}
+
+	if a.IgnoreMarker != "" && a.hasIgnoreMarker(fsDirectoryPath, a.IgnoreMarker) {
+		a.log(PhaseScan).Verbose("skipping contents of ignore-marked directory", directoryPath)
+		atomic.AddInt64(&a.stats.SkippedByMarker, 1)
+		return
+	}
+
+	ignores := scan.ignores
+	if a.ExcludeVCSIgnores {
+		ignores = a.readGitignore(fsDirectoryPath, directoryPath, ignores)
+	}
+
+	var inodeOrderFiles []inodeOrderFile
+	entries := a.readDirEntries(directory, directoryPath)
+	if a.Deterministic {
+		entries = sortedEntries(entries)
+	}
+	for entry := range entries {
+		a.waitIfPaused()
+		if a.problems.aborted() {
+			// Drain the generator so that its goroutine can finish.
+			continue
+		}
+		fileName := entry.Name()
+		filePath := filepath.Join(directoryPath, fileName)
+		fsFilePath := filepath.Join(fsDirectoryPath, fileName)
+
+		if matchesAny(a.excludePatterns, filePath, a.MatchCaseInsensitive, a.MatchBaseNames) {
+			a.log(PhaseScan).Verbose("skipping excluded file", filePath)
+			atomic.AddInt64(&a.stats.Excluded, 1)
+			continue
+		}
+		if a.ExcludeVCS && vcsNames[fileName] {
+			a.log(PhaseScan).Verbose("skipping version control metadata", filePath)
+			atomic.AddInt64(&a.stats.SkippedVCS, 1)
+			continue
+		} else if ignores.ignored(filePath, entry.Type().IsDir()) {
+			a.log(PhaseScan).Verbose("skipping file ignored by .gitignore", filePath)
+			atomic.AddInt64(&a.stats.SkippedGitignore, 1)
+			continue
+		}
+
+		// The directory entry gives the file's type, which is all that's
+		// needed unless an option looks at its size, inode or device; the
+		// file readers find the size once the file is opened.
+		mode := entry.Type()
+		var fileInfo os.FileInfo
+		if a.needsInfo(mode.IsDir()) {
+			fileInfo, err = a.entryInfo(entry, fsFilePath)
+			if err != nil {
+				if !a.vanished(filePath, err, PhaseScan) {
+					a.log(PhaseScan).Warning("unable to lstat file", err.Error())
+					atomic.AddInt64(&a.stats.Errors, 1)
+					a.problems.add(filePath, "lstat", err)
 				}
+				continue
 			}
-			if excludeFile {
-				a.Logger.Verbose("skipping excluded file", filePath)
+			mode = fileInfo.Mode()
+		}
+		size := int64(-1)
+		if fileInfo != nil {
+			size = fileInfo.Size()
+		}
+
+		if isLink(mode) {
+			a.log(PhaseScan).Verbose("skipping symbolic link", filePath)
+			atomic.AddInt64(&a.stats.SkippedSymlinks, 1)
+			continue
+		} else if !mode.IsDir() && !mode.IsRegular() {
+			// Sockets, FIFOs and devices can't be archived; opening a FIFO
+			// would also block until something writes to it.
+			a.log(PhaseScan).Verbose("skipping special file", filePath)
+			atomic.AddInt64(&a.stats.SkippedSpecial, 1)
+			continue
+		} else if !mode.IsDir() && fileInfo != nil && !a.sizeAllowed(size) {
+			a.log(PhaseScan).Verbose("skipping file by size", filePath)
+			atomic.AddInt64(&a.stats.SkippedBySize, 1)
+			continue
+		}
+
+		if !mode.IsDir() && a.isOutput(fsFilePath, fileName, fileInfo) {
+			a.log(PhaseScan).Warning("file is the archive; not dumped:", filePath)
+			continue
+		}
+
+		if mode.IsDir() && matchesAny(a.excludeDirPatterns, filePath, a.MatchCaseInsensitive, a.MatchBaseNames) {
+			a.log(PhaseScan).Verbose("skipping excluded directory", filePath)
+			atomic.AddInt64(&a.stats.Excluded, 1)
+			continue
+		}
+
+		if a.OneFileSystem && scan.hasDevice && mode.IsDir() {
+			device, ok := fileDevice(fileInfo)
+			if ok && device != scan.device {
+				a.log(PhaseScan).Verbose("skipping mount point", filePath)
 				continue
 			}
+		}
 
-			fileInfo, err := os.Lstat(filePath)
-			if err != nil {
-				a.Logger.Warning("unable to lstat file", err.Error())
+		excluded := false
+		if a.Filter != nil {
+			switch a.Filter(filePath, fileInfo) {
+			case FilterExclude:
+				excluded = true
+			case FilterPrune:
+				a.log(PhaseScan).Verbose("skipping filtered path", filePath)
+				atomic.AddInt64(&a.stats.Excluded, 1)
 				continue
-			} else if (fileInfo.Mode() & os.ModeSymlink) != 0 {
-				a.Logger.Warning("skipping symbolic link", filePath)
+			}
+			if excluded && !mode.IsDir() {
+				a.log(PhaseScan).Verbose("skipping filtered file", filePath)
+				atomic.AddInt64(&a.stats.Excluded, 1)
 				continue
 			}
+		}
 
-			a.workInProgress.Add(1)
-			if fileInfo.IsDir() {
-				// Sending to directoryScanQueue can block if it's full; since
-				// we're also the goroutine responsible for reading from it,
-				// this could cause a deadlock.  We break that deadlock by
-				// performing the send in a goroutine, where it can block
-				// safely.  This does have the side-effect that
-				// directoryScanQueue's max size is pretty much ineffective...
-				// but that's better than a deadlock.
-				go func(filePath string) {
-					a.directoryScanQueue <- filePath
-				}(filePath)
-			} else {
-				a.fileReadQueue <- filePath
+		if mode.IsDir() {
+			subdirectory := directoryScan{
+				path:      filePath,
+				fsPath:    fsFilePath,
+				excluded:  excluded,
+				depth:     scan.depth + 1,
+				device:    scan.device,
+				hasDevice: scan.hasDevice,
+				ignores:   ignores,
+				parent:    pending,
+			}
+			if pending != nil {
+				atomic.AddInt32(&pending.remaining, 1)
 			}
+			if a.Deterministic {
+				a.scanDirectory(subdirectory)
+				continue
+			}
+			a.workInProgress.Add(1)
+			// Sending to directoryScanQueue can block if it's full; since
+			// we're also the goroutine responsible for reading from it,
+			// this could cause a deadlock.  We break that deadlock by
+			// performing the send in a goroutine, where it can block
+			// safely.  This does have the side-effect that
+			// directoryScanQueue's max size is pretty much ineffective...
+			// but that's better than a deadlock.
+			go func(scan directoryScan) {
+				a.directoryScanQueue <- scan
+			}(subdirectory)
+		} else if a.InodeOrder {
+			inode, _ := fileInode(fileInfo)
+			inodeOrderFiles = append(inodeOrderFiles, inodeOrderFile{inode, fsFilePath, filePath, fileInfo})
+		} else {
+			a.queueFile(fsFilePath, filePath, fileInfo)
 		}
+	}
+
+	sort.Sort(byInode(inodeOrderFiles))
+	for _, file := range inodeOrderFiles {
+		a.queueFile(file.fsPath, file.path, file.info)
+	}
+}
+
+// A file waiting to be queued in inode order.
+type inodeOrderFile struct {
+	inode  uint64
+	fsPath string
+	path   string
+	info   os.FileInfo
+}
 
-		directory.Close()
+type byInode []inodeOrderFile
+
+func (s byInode) Len() int           { return len(s) }
+func (s byInode) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byInode) Less(i, j int) bool { return s[i].inode < s[j].inode }
+
+// Queues a file to be read, if it passes the include patterns.  Any pending
+// parent directories are written first so that they precede the file in the
+// archive.  info is the FileInfo found while scanning, or nil if the scan
+// didn't need one.
+func (a *Archiver) queueFile(fsFilePath string, filePath string, info os.FileInfo) {
+	if len(a.includePatterns) != 0 && !a.isIncluded(filePath) {
+		a.log(PhaseScan).Verbose("skipping file not included", filePath)
+		atomic.AddInt64(&a.stats.Excluded, 1)
+		return
+	}
+	a.writePendingDir(filepath.Dir(filePath))
+	size := int64(-1)
+	if info != nil {
+		size = info.Size()
+	}
+	a.queueRead(fileRead{path: filePath, fsPath: fsFilePath, size: size, info: info})
+}
+
+// Sends a file to the file readers, or reads it immediately in Deterministic
+// mode.
+func (a *Archiver) queueRead(read fileRead) {
+	if a.ResumeFrom.isCompleted(read.path) {
+		a.log(PhaseScan).Verbose("skipping file archived before resuming", read.path)
+		return
+	}
+	if a.Deterministic {
+		a.processRead(read)
+		return
+	}
+	a.workInProgress.Add(1)
+	if a.LargeFileReaderCount > 0 && a.LargeFileThreshold > 0 && read.size >= a.LargeFileThreshold {
+		a.largeFileReadQueue <- read
+	} else {
+		a.fileReadQueue <- read
+	}
+}
+
+// Checks whether the path, or any of its parent directories, matches an
+// include pattern.
+func (a *Archiver) isIncluded(filePath string) bool {
+	for {
+		if matchesAny(a.includePatterns, filePath, a.MatchCaseInsensitive, a.MatchBaseNames) {
+			return true
+		}
+		parent := filepath.Dir(filePath)
+		if parent == filePath || parent == "." {
+			return false
+		}
+		filePath = parent
+	}
+}
+
+// Writes the directory block for directoryPath, and any of its parents, if
+// they haven't already been written.  The lock is held while sending to the
+// block queue so that a parent is always written before its children, which
+// serializes the scanners; so unless holdsDirs, directories are written
+// directly, and only the parents of files passed to AddFile are pending.
+func (a *Archiver) writePendingDir(directoryPath string) {
+	a.pendingDirsLock.Lock()
+	defer a.pendingDirsLock.Unlock()
+
+	var chain []block
+	for {
+		dirBlock, ok := a.pendingDirs[directoryPath]
+		if !ok {
+			break
+		}
+		delete(a.pendingDirs, directoryPath)
+		chain = append(chain, dirBlock)
+		directoryPath = filepath.Dir(directoryPath)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		a.blockQueue <- chain[i]
+	}
+}
+
+// Checks whether err indicates that a file was deleted after it was found,
+// and if so, whether it should be ignored due to IgnoreVanished.  phase is
+// that of the caller, for the message logged.
+func (a *Archiver) vanished(filePath string, err error, phase Phase) bool {
+	if !a.IgnoreVanished || !os.IsNotExist(err) {
+		return false
+	}
+	a.log(phase).Verbose("skipping vanished file", filePath)
+	atomic.AddInt64(&a.stats.Vanished, 1)
+	return true
+}
+
+func (a *Archiver) sizeAllowed(size int64) bool {
+	if a.MinFileSize > 0 && size < a.MinFileSize {
+		return false
+	}
+	if a.MaxFileSize > 0 && size > a.MaxFileSize {
+		return false
+	}
+	return true
+}
+
+// A file waiting in the file read queue.
+type fileRead struct {
+	// The path stored in the archive.
+	path string
+	// The path on the filesystem; unused for entries.
+	fsPath string
+	// The size of the file when it was scanned, if known.
+	size int64
+	// The FileInfo found while scanning, if any.
+	info os.FileInfo
+	// For entries added with AddEntry, the source of the file's contents;
+	// nil for files read from disk.
+	entry *entrySource
+}
+
+// The contents and metadata of an entry added with AddEntry.
+type entrySource struct {
+	reader io.Reader
+	uid    int
+	gid    int
+	mode   os.FileMode
+}
+
+func (a *Archiver) fileReader(queue chan fileRead) {
+	stage := stageRead
+	if queue == a.largeFileReadQueue {
+		stage = stageLargeRead
+	}
+	for read := range queue {
+		a.waitIfPaused()
+		begun := time.Now()
+		if !a.problems.aborted() {
+			a.processRead(read)
+		}
+		a.diag.add(stage, begun)
 		a.workInProgress.Done()
 	}
 }
 
-func (a *Archiver) fileReader() {
-	for filePath := range a.fileReadQueue {
-		a.Logger.Verbose(filePath)
+func (a *Archiver) processRead(read fileRead) {
+	if a.OnFileStart != nil {
+		if err := a.OnFileStart(read.path); err != nil {
+			a.log(PhaseRead).Verbose("skipping file:", err.Error())
+			return
+		}
+	}
 
-		file, err := os.Open(filePath)
-		if err == nil {
+	var bytesRead int64
+	var err error
+	if read.entry != nil {
+		logEntry(a.log(PhaseRead), read.path, false)
+		start := block{read.path, 0, nil, blockTypeStartOfFile, read.entry.uid, read.entry.gid, read.entry.mode, 0, 0}
+		bytesRead, err = a.writeFileBlocks(start, read.entry.reader, a.BlockSize, -1, nil)
+	} else {
+		var changed bool
+		bytesRead, changed, err = a.readFile(read.fsPath, read.path, read.size, read.info)
+		if changed && a.RereadChanged {
+			a.log(PhaseRead).Warning("file changed as we read it; reading it again:", read.path)
+			bytesRead, changed, err = a.readFile(read.fsPath, read.path, read.size, nil)
+		}
+		if changed {
+			a.log(PhaseRead).Warning("file changed as we read it:", read.path)
+			atomic.AddInt64(&a.stats.ChangedFiles, 1)
+		}
+	}
+
+	if a.OnFileComplete != nil {
+		a.OnFileComplete(read.path, bytesRead, err)
+	}
+}
+
+// Chooses the block size for reading a file of the given size.
+func (a *Archiver) blockSizeFor(size int64) uint16 {
+	if a.LargeFileThreshold > 0 && size >= a.LargeFileThreshold && a.LargeFileBlockSize > a.BlockSize {
+		return a.LargeFileBlockSize
+	}
+	return a.BlockSize
+}
+
+// Archives a single file.  Returns the number of bytes archived, whether the
+// file's size or modification time changed while it was being read, and the
+// error that prevented it from being archived completely, if any.  scanInfo,
+// if not nil, is used in place of stat'ing the opened file.
+func (a *Archiver) readFile(fsFilePath string, filePath string, size int64, scanInfo os.FileInfo) (int64, bool, error) {
+	logEntry(a.log(PhaseRead), filePath, false)
+
+	deadline := newFileDeadline(a.FileReadTimeout)
+
+	// An abandoned open still holds its file once it completes, so it's
+	// closed then.
+	opened := make(chan fs.File, 1)
+	_, err := deadline.run(func() (int, error) {
+		file, err := a.open(fsFilePath, false, PhaseRead)
+		opened <- file
+		return 0, err
+	})
+	var file fs.File
+	if err == ErrReadTimeout {
+		go func() {
+			if file := <-opened; file != nil {
+				a.closeFile(file)
+			}
+		}()
+		a.log(PhaseRead).Warning("file open timed out:", filePath)
+		a.addTimedOutFile(filePath)
+		a.problems.add(filePath, "open", err)
+		return 0, false, err
+	} else if err != nil {
+		if !a.vanished(filePath, err, PhaseRead) {
+			a.log(PhaseRead).Warning("file open error:", err.Error())
+			atomic.AddInt64(&a.stats.Errors, 1)
+			a.problems.add(filePath, "open", err)
+		}
+		return 0, false, err
+	}
+	file = <-opened
+	// file may be replaced by reopen, below, so it's only evaluated when
+	// the deferred function runs.
+	defer func() {
+		if osFile, ok := file.(*os.File); ok && a.DropCaches {
+			dropCache(osFile, 0, 0)
+		}
+		if file != nil {
+			a.closeFile(file)
+		}
+	}()
+
+	// Only the bytes present when the file was opened are archived, so that
+	// a file being appended to doesn't hold up the archive indefinitely.
+	openInfo := scanInfo
+	if openInfo == nil || a.FreshMetadata {
+		openInfo, err = file.Stat()
+		if err != nil {
+			a.log(PhaseRead).Warning("file stat error; uid/gid/mode will be incorrect:", err.Error())
+			a.problems.add(filePath, "stat", err)
+			openInfo = nil
+		}
+	}
+	if openInfo != nil {
+		size = openInfo.Size()
+	}
+	blockSize := a.blockSizeFor(size)
+
+	var uid, gid int
+	var mode os.FileMode
+	var attributes uint32
+	if openInfo != nil {
+		uid, gid, mode, attributes = a.infoModeOwnership(openInfo, PhaseRead)
+	}
+	start := block{filePath, 0, nil, blockTypeStartOfFile, uid, gid, mode, 0, attributes}
+	readerAt, isReaderAt := file.(io.ReaderAt)
+	if ranges := a.intraFileRanges(size); ranges > 1 && isReaderAt {
+		a.blockQueue <- start
+		bytesRead, err := a.readFileRanges(filePath, readerAt, size, ranges, blockSize, deadline)
+		a.blockQueue <- block{filePath, 0, nil, blockTypeEndOfFile, 0, 0, 0, 0, 0}
+		return bytesRead, a.changedSinceOpen(file, openInfo), err
+	}
+
+	reopen := func(offset int64) (io.Reader, error) {
+		a.closeFile(file)
+		file = nil
+		reopened, err := a.open(fsFilePath, false, PhaseRead)
+		if err != nil {
+			return nil, err
+		}
+		file = reopened
+		if seeker, ok := file.(io.Seeker); ok {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, file, offset)
+		}
+		return deadlineReader{file, deadline}, err
+	}
+	bytesRead, err := a.writeFileBlocks(start, deadlineReader{file, deadline}, blockSize, size, reopen)
+	if err != nil {
+		return bytesRead, false, err
+	}
+	if bytesRead < size {
+		a.log(PhaseRead).Verbose("file shrank while being read; archived", bytesRead, "of", size, "bytes:", filePath)
+		atomic.AddInt64(&a.stats.TruncatedFiles, 1)
+	} else if info, err := file.Stat(); err == nil && info.Size() > size {
+		a.log(PhaseRead).Verbose("file grew while being read; archived the first", size, "bytes:", filePath)
+		atomic.AddInt64(&a.stats.GrowingFiles, 1)
+	}
+	return bytesRead, a.changedSinceOpen(file, openInfo), nil
+}
+
+// Compares the file's current size and modification time with those
+// observed when it was opened.
+func (a *Archiver) changedSinceOpen(file fs.File, openInfo os.FileInfo) bool {
+	if openInfo == nil {
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Size() != openInfo.Size() || !info.ModTime().Equal(openInfo.ModTime())
+}
+
+// The smallest byte range that IntraFileParallelism will split a file into.
+const intraFileMinRange = 8 << 20
+
+// Returns true if large files may be read in ranges, and so written with
+// offset data blocks.
+func (a *Archiver) splitsFiles() bool {
+	return a.IntraFileParallelism > 1 && !a.Deterministic && a.LargeFileThreshold > 0
+}
 
-			uid, gid, mode := a.getModeOwnership(file)
-			a.blockQueue <- block{filePath, 0, nil, blockTypeStartOfFile, uid, gid, mode}
+// Determines how many ranges a file of the given size should be read in.
+func (a *Archiver) intraFileRanges(size int64) int {
+	if !a.splitsFiles() || size < a.LargeFileThreshold {
+		return 1
+	}
+	ranges := int((size + intraFileMinRange - 1) / intraFileMinRange)
+	if ranges > a.IntraFileParallelism {
+		ranges = a.IntraFileParallelism
+	}
+	return ranges
+}
 
-			bufferedFile := bufio.NewReader(file)
+// Reads a file as a number of byte ranges concurrently, writing offset data
+// blocks for each.  Ranges are a multiple of the block size, so that every
+// block but the last is full.
+// Returns the number of bytes archived, and the first error that caused a
+// range to be abandoned, if any.
+func (a *Archiver) readFileRanges(filePath string, file io.ReaderAt, size int64, ranges int, blockSize uint16, deadline *fileDeadline) (int64, error) {
+	rangeSize := (size + int64(ranges) - 1) / int64(ranges)
+	rangeSize = (rangeSize + int64(blockSize) - 1) / int64(blockSize) * int64(blockSize)
 
-			for {
-				buffer := make([]byte, a.BlockSize)
-				bytesRead, err := bufferedFile.Read(buffer)
+	var wg sync.WaitGroup
+	var timedOut int32
+	var bytesArchived int64
+	var rangeErr error
+	var rangeErrLock sync.Mutex
+	setRangeErr := func(err error) {
+		rangeErrLock.Lock()
+		if rangeErr == nil {
+			rangeErr = err
+		}
+		rangeErrLock.Unlock()
+	}
+	for start := int64(0); start < size; start += rangeSize {
+		end := start + rangeSize
+		if end > size {
+			end = size
+		}
+		wg.Add(1)
+		go func(offset int64, end int64) {
+			defer wg.Done()
+			retries := 0
+			for offset < end && !a.problems.aborted() {
+				a.waitIfPaused()
+				length := int64(blockSize)
+				if end-offset < length {
+					length = end - offset
+				}
+				buffer := make([]byte, length)
+				bytesRead, err := deadline.run(func() (int, error) {
+					return file.ReadAt(buffer, offset)
+				})
+				if bytesRead > 0 {
+					a.blockQueue <- block{filePath, uint16(bytesRead), buffer, blockTypeDataAt, 0, 0, 0, offset, 0}
+					offset += int64(bytesRead)
+					atomic.AddInt64(&bytesArchived, int64(bytesRead))
+				}
 				if err == io.EOF {
 					break
+				} else if err == ErrReadTimeout {
+					a.log(PhaseRead).Warning("file read timed out; file contents will be incomplete:", filePath)
+					atomic.StoreInt32(&timedOut, 1)
+					setRangeErr(err)
+					break
 				} else if err != nil {
-					a.Logger.Warning("file read error; file contents will be incomplete:", err.Error())
+					// ReadAt doesn't depend on the file position, so a retry
+					// doesn't require reopening the file.
+					if retries < a.ReadRetries {
+						retries += 1
+						a.log(PhaseRead).Warning("file read error; retrying:", err.Error())
+						time.Sleep(a.ReadRetryDelay)
+						continue
+					}
+					a.log(PhaseRead).Warning("file read error; file contents will be incomplete:", err.Error())
+					atomic.AddInt64(&a.stats.DamagedFiles, 1)
+					setRangeErr(err)
 					break
 				}
-
-				a.blockQueue <- block{filePath, uint16(bytesRead), buffer, blockTypeData, 0, 0, 0}
 			}
+		}(start, end)
+	}
+	wg.Wait()
 
-			a.blockQueue <- block{filePath, 0, nil, blockTypeEndOfFile, 0, 0, 0}
-			file.Close()
-		} else {
-			a.Logger.Warning("file open error:", err.Error())
+	if atomic.LoadInt32(&timedOut) != 0 {
+		a.addTimedOutFile(filePath)
+	}
+	if rangeErr != nil {
+		a.problems.add(filePath, "read", rangeErr)
+	}
+	return bytesArchived, rangeErr
+}
+
+// Writes a complete file to the block queue, starting with the start file
+// block start, and reading its contents from reader until EOF, or at most
+// limit bytes if limit isn't negative.  If reopen is non-nil, it's used to
+// retry after read errors by providing a new reader positioned at the given
+// offset.  Returns the number of bytes archived, and the error that caused
+// reading to be abandoned, if any.
+func (a *Archiver) writeFileBlocks(start block, reader io.Reader, blockSize uint16, limit int64, reopen func(int64) (io.Reader, error)) (int64, error) {
+	filePath := start.filePath
+	a.blockQueue <- start
+
+	bufferedFile := bufio.NewReader(reader)
+	var offset int64
+	retries := 0
+	var readErr error
+
+	for (limit < 0 || offset < limit) && !a.problems.aborted() {
+		a.waitIfPaused()
+		length := int64(blockSize)
+		if limit >= 0 && limit-offset < length {
+			length = limit - offset
+		}
+		buffer := make([]byte, length)
+		bytesRead, err := bufferedFile.Read(buffer)
+		if err == io.EOF {
+			break
+		} else if err == ErrReadTimeout {
+			a.log(PhaseRead).Warning("file read timed out; file contents will be incomplete:", filePath)
+			a.addTimedOutFile(filePath)
+			readErr = err
+			break
+		} else if err != nil {
+			reader = a.retryRead(err, offset, &retries, reopen)
+			if reader == nil {
+				readErr = err
+				break
+			}
+			bufferedFile = bufio.NewReader(reader)
+			continue
 		}
 
-		a.workInProgress.Done()
+		a.blockQueue <- block{filePath, uint16(bytesRead), buffer, blockTypeData, 0, 0, 0, 0, 0}
+		offset += int64(bytesRead)
+	}
+
+	a.blockQueue <- block{filePath, 0, nil, blockTypeEndOfFile, 0, 0, 0, 0, 0}
+	if readErr != nil {
+		a.problems.add(filePath, "read", readErr)
 	}
+	return offset, readErr
 }
 
-func (b *block) writeBlock(output io.Writer) error {
-	filePath := []byte(b.filePath)
-	err := binary.Write(output, binary.BigEndian, uint16(len(filePath)))
-	if err == nil {
-		_, err = output.Write(filePath)
+// Attempts to reopen a file after a read error, up to ReadRetries times in
+// total for the file.  Returns nil if reading should be abandoned, in which
+// case the file is counted as damaged.
+func (a *Archiver) retryRead(readErr error, offset int64, retries *int, reopen func(int64) (io.Reader, error)) io.Reader {
+	for reopen != nil && *retries < a.ReadRetries {
+		*retries += 1
+		a.log(PhaseRead).Warning("file read error; retrying:", readErr.Error())
+		time.Sleep(a.ReadRetryDelay)
+		reader, err := reopen(offset)
+		if err == nil {
+			return reader
+		}
+		readErr = err
 	}
-	if err == nil {
-		blockType := []byte{byte(b.blockType)}
-		_, err = output.Write(blockType)
+	a.log(PhaseRead).Warning("file read error; file contents will be incomplete:", readErr.Error())
+	atomic.AddInt64(&a.stats.DamagedFiles, 1)
+	return nil
+}
+
+func (a *Archiver) archiveWriter() error {
+	writer := newWriter(a.output, a.WriteBufferSize, a.WriteBufferCount)
+	writer.EnableMetadata = a.MetadataFor != nil
+	writer.ArchiveMetadata = a.ArchiveMetadata
+	writer.dataAt = a.splitsFiles()
+	defer writer.blocks.Close()
+
+	writer.enableFeatures()
+	if a.ResumeFrom != nil && a.ResumeFrom.Offset > 0 && a.ResumeFrom.version != writer.blocks.Version() {
+		// Carrying on would mix blocks of one version into a header of
+		// another, such as when MetadataFor is set for only one of the runs.
+		return ErrResumeVersion
 	}
-	if err == nil {
-		switch b.blockType {
-		case blockTypeDirectory, blockTypeStartOfFile:
-			err = binary.Write(output, binary.BigEndian, uint32(b.uid))
-			if err == nil {
-				err = binary.Write(output, binary.BigEndian, uint32(b.gid))
-			}
+
+	var state *stateLog
+	if a.StateFile != "" {
+		var err error
+		state, err = newStateLog(a.StateFile, writer.blocks.Version(), a.ResumeFrom)
+		if err != nil {
+			return err
+		}
+		defer state.close()
+
+		// Record the progress up to each checksum block.
+		writer.onChecksum = func() error {
+			err := a.output.Flush()
 			if err == nil {
-				err = binary.Write(output, binary.BigEndian, b.mode)
+				err = state.checkpoint(writer.blocks.Offset(), writer.blocks.ChecksumState())
 			}
-		case blockTypeEndOfFile:
-			// Nothing to write aside from the block type
-		case blockTypeData:
-			err = binary.Write(output, binary.BigEndian, uint16(b.numBytes))
-			if err == nil {
-				_, err = output.Write(b.buffer[:b.numBytes])
+			return err
+		}
+	}
+
+	// Writes a block, with the path prefix applied, and with the entry's
+	// metadata for a start file or directory block.
+	writeBlock := func(b block) error {
+		var metadata map[string]string
+		if a.MetadataFor != nil && (b.blockType == blockTypeStartOfFile || b.blockType == blockTypeDirectory) {
+			metadata = a.MetadataFor(b.filePath)
+			if err := faformat.CheckEntryMeta(metadata); err != nil {
+				a.log(PhaseWrite).Warning("unable to store metadata for", b.filePath+":", err.Error())
+				a.problems.add(b.filePath, "metadata", err)
+				metadata = nil
 			}
-		default:
-			panic("Internal error: unexpected block type")
 		}
+		if a.pathPrefix != "" {
+			b.filePath = filepath.Join(a.pathPrefix, b.filePath)
+		}
+		b.filePath = a.NormalizePaths.apply(b.filePath)
+		return writer.writeEntryBlock(b, metadata)
 	}
-	return err
-}
 
-func (a *Archiver) archiveWriter() error {
-	hash := crc64.New(crc64.MakeTable(crc64.ECMA))
-	output := io.MultiWriter(a.output, hash)
-	blockCount := 0
+	if a.ResumeFrom != nil && a.ResumeFrom.Offset > 0 {
+		// The output already holds the archive up to the checkpoint, so
+		// carry on from there.  Files that were partly written are ended
+		// here; they'll be archived again in full, and the later copy
+		// replaces the partial one when the archive is extracted.
+		err := writer.resume(a.ResumeFrom.Offset, a.ResumeFrom.hash)
+		if err != nil {
+			return err
+		}
+		for _, filePath := range a.ResumeFrom.open {
+			err = writeBlock(block{filePath, 0, nil, blockTypeEndOfFile, 0, 0, 0, 0, 0})
+			if err != nil {
+				return err
+			}
+			if state != nil {
+				delete(state.open, filePath)
+			}
+		}
+	} else {
+		err := writer.start()
+		if err != nil {
+			return err
+		}
 
-	_, err := output.Write(fastArchiverHeader)
-	if err != nil {
-		return err
+		for _, block := range prefixDirectoryBlocks(a.pathPrefix) {
+			// Prefix directories already have the prefix applied.
+			block.filePath = a.NormalizePaths.apply(block.filePath)
+			err = writer.writeBlock(block)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	for block := range a.blockQueue {
-		err = block.writeBlock(output)
+	// Writes a checksum covering everything written so far, and flushes the
+	// output, so that the archive is consistent while the archiver is paused.
+	checkpoint := func() error {
+		if writer.blocks.BlocksSinceChecksum() > 0 {
+			err := writer.writeChecksum()
+			if err != nil {
+				return err
+			}
+		}
+		return a.output.Flush()
+	}
 
-		blockCount += 1
-		if err == nil && (blockCount%1000) == 0 {
-			err = writeChecksumBlock(hash, output)
+	for {
+		var block block
+		var ok bool
+		waiting := time.Now()
+		select {
+		case block, ok = <-a.blockQueue:
+			a.diag.add(stageWrite, waiting)
+		case <-a.pauseFlush:
+			a.diag.add(stageWrite, waiting)
+			if a.isPaused() && len(a.blockQueue) == 0 {
+				err := checkpoint()
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !ok {
+			break
 		}
 
+		if a.problems.aborted() {
+			// The run has failed; keep draining the queue so that the
+			// goroutines feeding it can finish.
+			continue
+		}
+		if block.blockType == blockTypeDirectory && a.ResumeFrom.isCompleted(block.filePath) {
+			continue
+		}
+		err := writeBlock(block)
 		if err != nil {
 			return err
 		}
+		if state != nil {
+			state.blockWritten(block)
+		}
+		switch block.blockType {
+		case blockTypeStartOfFile:
+			atomic.AddInt64(&a.stats.Files, 1)
+		case blockTypeDirectory:
+			atomic.AddInt64(&a.stats.Directories, 1)
+		case blockTypeData, blockTypeDataAt:
+			atomic.AddInt64(&a.stats.BytesRead, int64(block.numBytes))
+		}
+		atomic.StoreInt64(&a.stats.BytesWritten, writer.blocks.Offset())
+
+		// Blocks that were in flight when the archiver was paused are
+		// checkpointed once they've all arrived.
+		if a.isPaused() && len(a.blockQueue) == 0 {
+			err = checkpoint()
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	return writeChecksumBlock(hash, output)
+	err := writer.writeChecksum()
+	atomic.StoreInt64(&a.stats.BytesWritten, writer.blocks.Offset())
+	return err
 }
 
-func writeChecksumBlock(hash hash.Hash64, output io.Writer) error {
-	// file path length... zero
-	err := binary.Write(output, binary.BigEndian, uint16(0))
-	if err == nil {
-		blockType := []byte{byte(blockTypeChecksum)}
-		_, err = output.Write(blockType)
+// Creates directory blocks for each element of a path prefix, so that the
+// prefix directories exist when the archive is extracted.
+func prefixDirectoryBlocks(prefix string) []block {
+	if prefix == "" {
+		return nil
 	}
-	if err == nil {
-		err = binary.Write(output, binary.BigEndian, hash.Sum64())
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid < 0 || gid < 0 {
+		uid, gid = 0, 0
 	}
-	return err
+	var retval []block
+	for directoryPath := prefix; directoryPath != "."; directoryPath = filepath.Dir(directoryPath) {
+		retval = append([]block{{directoryPath, 0, nil, blockTypeDirectory, uid, gid, os.ModeDir | 0755, 0, 0}}, retval...)
+	}
+	return retval
 }
 
-// Wrapper for Readdirnames that converts it into a generator-style method.
-func (a *Archiver) readdirnames(dir *os.File) chan string {
-	retval := make(chan string, 256)
-	go func(dir *os.File) {
+// Drains a channel of names, and returns a channel yielding them in sorted
+// order.
+func sortedEntries(entries chan fs.DirEntry) chan fs.DirEntry {
+	var sorted []fs.DirEntry
+	for entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name() < sorted[j].Name() })
+	retval := make(chan fs.DirEntry, len(sorted))
+	for _, entry := range sorted {
+		retval <- entry
+	}
+	close(retval)
+	return retval
+}
+
+// Wrapper for ReadDir that converts it into a generator-style method.
+func (a *Archiver) readDirEntries(dir fs.File, directoryPath string) chan fs.DirEntry {
+	retval := make(chan fs.DirEntry, 256)
+	go func(dir fs.File) {
 		for {
-			names, err := dir.Readdirnames(256)
+			entries, err := readDir(dir, 256)
+			for _, entry := range entries {
+				retval <- entry
+			}
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				a.Logger.Warning("error reading directory:", err.Error())
-			}
-			for _, name := range names {
-				retval <- name
+				a.log(PhaseScan).Warning("error reading directory:", err.Error())
+				atomic.AddInt64(&a.stats.Errors, 1)
+				a.problems.add(directoryPath, "readdir", err)
+				break
 			}
 		}
 		close(retval)
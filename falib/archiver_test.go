@@ -0,0 +1,404 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// Writes files beneath dir, creating their parent directories; paths are
+// slash-separated, and a path ending in a slash is an empty directory.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeterministicRunsAreIdentical(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a":         "alpha",
+		"b/c":       "charlie",
+		"b/d/e":     "echo",
+		"b/f/":      "",
+		"g/h":       string(bytes.Repeat([]byte("x"), 200000)),
+		"g/i/j/k/l": "lima",
+	})
+
+	a := NewArchiverTemplate()
+	a.Deterministic = true
+	a.ArchiveMetadata = map[string]string{"goos": "linux", "tag": "v1"}
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	var first, second bytes.Buffer
+	if err := a.RunTo(&first); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RunTo(&second); err != nil {
+		t.Fatal(err)
+	}
+	if first.Len() == 0 {
+		t.Fatal("archive is empty")
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("two deterministic runs differ: %d and %d bytes", first.Len(), second.Len())
+	}
+}
+
+func TestIntraFileParallelismWritesVersion4(t *testing.T) {
+	dir := t.TempDir()
+	large := bytes.Repeat([]byte("0123456789abcdef"), (20<<20)/16)
+	writeTree(t, dir, map[string]string{"small": "small", "large": string(large)})
+
+	for _, parallelism := range []int{0, 4} {
+		a := NewArchiverTemplate()
+		a.IntraFileParallelism = parallelism
+		if err := a.AddDirAs(dir, "tree"); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := a.RunTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		expected := faformat.FileHeader
+		if parallelism > 1 {
+			expected = faformat.FileHeaderV4
+		}
+		if !bytes.HasPrefix(buf.Bytes(), expected) {
+			t.Errorf("IntraFileParallelism %d: header %q, expected %q", parallelism, buf.Bytes()[:8], expected)
+		}
+		entries, err := ExtractToMapLimit(&buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(entries["tree/large"].Data, large) {
+			t.Errorf("IntraFileParallelism %d: large file didn't round-trip", parallelism)
+		}
+	}
+}
+
+func TestUnsafePathsFromConcurrentScanners(t *testing.T) {
+	// Each unsafe path is found by whichever scanner takes it, so the run's
+	// error is recorded from several goroutines at once.
+	a := NewArchiverTemplate()
+	a.DirReaderCount = 8
+	for i := 0; i < 64; i++ {
+		a.AddEntry("../escape", bytes.NewReader(nil), 0644, 0, 0)
+		a.AddEntry("/absolute", bytes.NewReader(nil), 0644, 0, 0)
+	}
+	var buf bytes.Buffer
+	err := a.RunTo(&buf)
+	if !errors.Is(err, faformat.ErrParentDirectoryPath) && !errors.Is(err, faformat.ErrAbsoluteDirectoryPath) {
+		t.Errorf("RunTo returned %v, expected an unsafe path error", err)
+	}
+}
+
+// Compares reading large files in the default 4 KiB blocks with the 64 KiB
+// blocks used for files over LargeFileThreshold; the larger blocks cut the
+// per-block overhead of queueing, checksumming and writing.
+func BenchmarkArchive(b *testing.B) {
+	dir := b.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4<<20/16)
+	var size int64
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+		size += int64(len(data))
+	}
+
+	for _, test := range []struct {
+		name      string
+		threshold int64
+	}{
+		{"4KiB", 0},
+		{"64KiB", 1 << 20},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			a := NewArchiverTemplate()
+			a.LargeFileThreshold = test.threshold
+			if err := a.AddDirAs(dir, "tree"); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := a.RunTo(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Counts the writes passed on to an io.Writer.
+type countingWriter struct {
+	w      io.Writer
+	writes int
+}
+
+func (c *countingWriter) Write(buf []byte) (int, error) {
+	c.writes++
+	return c.w.Write(buf)
+}
+
+// Archives through an OS pipe with output buffers of different sizes;
+// writes/op is the number of write system calls.
+func BenchmarkOutputBufferSize(b *testing.B) {
+	dir := b.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4<<20/16)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			a := NewArchiverTemplate()
+			a.OutputBufferSize = size
+			if err := a.AddDirAs(dir, "tree"); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(4 * len(data)))
+			writes := 0
+			for i := 0; i < b.N; i++ {
+				r, w, err := os.Pipe()
+				if err != nil {
+					b.Fatal(err)
+				}
+				go io.Copy(io.Discard, r)
+				output := &countingWriter{w: w}
+				err = a.RunTo(output)
+				w.Close()
+				r.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				writes += output.writes
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestMetadataFor(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "alpha", "b/": "", "c": "charlie"})
+
+	a := NewArchiverTemplate()
+	a.PathPrefix = "host"
+	var seen []string
+	a.MetadataFor = func(path string) map[string]string {
+		seen = append(seen, path)
+		switch path {
+		case "tree/a":
+			return map[string]string{"oid": "16384", "label": "public"}
+		case "tree/b":
+			return map[string]string{"label": "empty"}
+		case "tree/c":
+			// Too large to store, so c is archived without it.
+			return map[string]string{"big": string(bytes.Repeat([]byte("x"), faformat.MaxEntryMetaSize))}
+		}
+		return nil
+	}
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+	// Paths are passed before the prefix is applied.
+	for _, path := range seen {
+		if path != "tree" && filepath.Dir(path) != "tree" {
+			t.Errorf("MetadataFor called with %q", path)
+		}
+	}
+	problems, _ := a.Problems()
+	if len(problems) != 1 || problems[0].Path != "tree/c" || problems[0].Op != "metadata" {
+		t.Errorf("problems %v, expected only the metadata for tree/c", problems)
+	}
+
+	reader := faformat.NewBlockReader(bytes.NewReader(archive.Bytes()))
+	if err := reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if reader.Version() != faformat.VersionEntryMeta {
+		t.Errorf("archive written in version %d, expected %d", reader.Version(), faformat.VersionEntryMeta)
+	}
+
+	events := make(chan Event, 100)
+	u := NewUnarchiverWithSink(bytes.NewReader(archive.Bytes()), nopSink{})
+	u.Events = events
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+	metadata := make(map[string]map[string]string)
+	for event := range events {
+		if event, ok := event.(EntryMetadata); ok {
+			metadata[event.Path] = event.Metadata
+		}
+	}
+	expected := map[string]map[string]string{
+		"host/tree/a": {"oid": "16384", "label": "public"},
+		"host/tree/b": {"label": "empty"},
+	}
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("extracted metadata %v, expected %v", metadata, expected)
+	}
+}
+
+// An archive written into the directory being archived isn't read into
+// itself, whether it's found while scanning or passed to AddFile; another
+// file with the same name is still archived.
+func TestOutputNotArchived(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"data": strings.Repeat("data", 100000), "sub/backup.fa": "not the archive"})
+	chdir(t, dir)
+	output, err := os.Create("backup.fa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewArchiver(output)
+	if err := a.AddDirContentsAs(".", "."); err != nil {
+		t.Fatal(err)
+	}
+	a.AddFile("backup.fa")
+	err = a.Run()
+	output.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := os.Open("backup.fa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	entries, err := ExtractToMap(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"data", "sub", "sub/backup.fa"}
+	if paths := entryPaths(entries); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("archived %v, expected %v", paths, expected)
+	}
+}
+
+// An output whose writes wait until release is closed, signalling started
+// on the first.
+type blockedWriter struct {
+	started chan bool
+	release chan bool
+	once    sync.Once
+}
+
+func (w *blockedWriter) Write(buf []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.release
+	return len(buf), nil
+}
+
+// One configured Archiver writes a complete archive to each output given to
+// RunTo, after a failed run as well as a successful one.
+func TestArchiverTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "alpha", "b/c": "charlie"})
+	a := NewArchiverTemplate()
+	a.Deterministic = true
+	a.DirScanQueueSize = 4
+	// More paths than the scan queue holds don't block before the run.
+	for i := 0; i < 300; i++ {
+		a.AddFileAs(filepath.Join(dir, "a"), fmt.Sprintf("files/%d", i))
+	}
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	a.AddEntry("entry", strings.NewReader("once"), 0644, 0, 0)
+
+	if err := a.RunTo(&failingWriter{100, errors.New("disk full")}); err == nil {
+		t.Fatal("archiving to a failing output succeeded")
+	}
+	var first, second bytes.Buffer
+	for _, output := range []*bytes.Buffer{&first, &second} {
+		if err := a.RunTo(output); err != nil {
+			t.Fatal(err)
+		}
+		if problems, count := a.Problems(); count != 0 {
+			t.Errorf("problems archiving: %v", problems)
+		}
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("two runs of the template differ: %d and %d bytes", first.Len(), second.Len())
+	}
+	entries, err := ExtractToMap(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 300 files and their directory, and the tree's 4 entries, without
+	// the entry read by the failed run.
+	if len(entries) != 305 {
+		t.Errorf("archived %d entries, expected 305", len(entries))
+	}
+	if _, ok := entries["entry"]; ok {
+		t.Error("an entry added with AddEntry was archived by a second run")
+	}
+
+	// Runs can't overlap.
+	output := &blockedWriter{started: make(chan bool), release: make(chan bool)}
+	done := make(chan error)
+	go func() { done <- a.RunTo(output) }()
+	<-output.started
+	if err := a.RunTo(io.Discard); err != ErrArchiverRunning {
+		t.Errorf("RunTo during another run returned %v", err)
+	}
+	close(output.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if a.Stats().Files != 302 {
+		t.Errorf("the blocked run archived %d files, expected 302", a.Stats().Files)
+	}
+}
+
+func TestArchiverRunOnce(t *testing.T) {
+	if err := NewArchiverTemplate().Run(); err != ErrNoOutput {
+		t.Errorf("Run without an output returned %v", err)
+	}
+	a := NewArchiver(io.Discard)
+	a.AddEntry("entry", strings.NewReader("data"), 0644, 0, 0)
+	if err := a.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Run(); err != ErrArchiverReused {
+		t.Errorf("a second Run returned %v", err)
+	}
+	if err := a.RunTo(io.Discard); err != ErrArchiverReused {
+		t.Errorf("RunTo after Run returned %v", err)
+	}
+}
@@ -1,15 +1,22 @@
 package falib
 
-import "os"
+import (
+	"os"
 
-type blockType byte
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+type blockType = faformat.BlockType
 
 const (
-	blockTypeData blockType = iota
-	blockTypeStartOfFile
-	blockTypeEndOfFile
-	blockTypeDirectory
-	blockTypeChecksum
+	blockTypeData        = faformat.BlockData
+	blockTypeStartOfFile = faformat.BlockStartOfFile
+	blockTypeEndOfFile   = faformat.BlockEndOfFile
+	blockTypeDirectory   = faformat.BlockDirectory
+	blockTypeChecksum    = faformat.BlockChecksum
+	blockTypeDataAt      = faformat.BlockDataAt
+	blockTypeAttributes  = faformat.BlockAttributes
+	blockTypeEntryMeta   = faformat.BlockEntryMeta
 )
 
 type block struct {
@@ -20,8 +27,20 @@ type block struct {
 	uid       int
 	gid       int
 	mode      os.FileMode
+	offset    int64
+	// File attributes, for start file and directory blocks; written as a
+	// separate attributes block when non-zero.
+	attributes uint32
 }
 
-// Archive header: stole ideas from the PNG file header here, but replaced
-// 'PNG' with 'FA1' to identify the fast-archive format (version 1).
-var fastArchiverHeader = []byte{0x89, 0x46, 0x41, 0x31, 0x0D, 0x0A, 0x1A, 0x0A}
+func (b *block) format() *faformat.Block {
+	var data []byte
+	if b.blockType == blockTypeData || b.blockType == blockTypeDataAt {
+		data = b.buffer[:b.numBytes]
+	}
+	return &faformat.Block{Path: b.filePath, Type: b.blockType, Uid: b.uid, Gid: b.gid, Mode: b.mode, Offset: b.offset, Data: data, Attributes: b.attributes}
+}
+
+func blockFromFormat(b *faformat.Block) block {
+	return block{b.Path, uint16(len(b.Data)), b.Data, b.Type, b.Uid, b.Gid, b.Mode, b.Offset, b.Attributes}
+}
@@ -0,0 +1,53 @@
+package falib
+
+import "sync"
+
+// Limits the bytes held in buffers at once.  acquire blocks until enough has
+// been released; a request larger than the whole budget is let through once
+// nothing else is held, so that it can't wait forever.
+type byteBudget struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	// The most that may be held at once, or 0 for no limit.
+	max  int64
+	used int64
+	peak int64
+}
+
+// Empties the budget and sets its limit, ready for a new run.
+func (b *byteBudget) reset(max int64) {
+	b.lock.Lock()
+	if b.cond == nil {
+		b.cond = sync.NewCond(&b.lock)
+	}
+	b.max = max
+	b.used = 0
+	b.peak = 0
+	b.lock.Unlock()
+}
+
+func (b *byteBudget) acquire(n int64) {
+	b.lock.Lock()
+	for b.max > 0 && b.used > 0 && b.used+n > b.max {
+		b.cond.Wait()
+	}
+	b.used += n
+	if b.used > b.peak {
+		b.peak = b.used
+	}
+	b.lock.Unlock()
+}
+
+func (b *byteBudget) release(n int64) {
+	b.lock.Lock()
+	b.used -= n
+	b.cond.Broadcast()
+	b.lock.Unlock()
+}
+
+// Returns the most that's been held at once since the last reset.
+func (b *byteBudget) getPeak() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.peak
+}
@@ -0,0 +1,115 @@
+package falib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Whether an Unarchiver checks for entries whose paths differ only in case,
+// which would overwrite each other on a case-insensitive filesystem.
+type CaseCollisions int
+
+const (
+	// Check when extracting into the current directory and it turns out to
+	// be on a case-insensitive filesystem, such as the defaults on macOS and
+	// Windows.
+	CaseCollisionsDetect CaseCollisions = iota
+	// Always check, as if the target were case-insensitive.
+	CaseCollisionsAlways
+	// Never check.
+	CaseCollisionsNever
+)
+
+// Returned from Run when two entries differ only in case, and
+// CaseCollisionSuffix isn't set.
+type CaseCollisionError struct {
+	// The entry that was extracted first.
+	Existing string
+	// The entry that would have overwritten it.
+	Path string
+}
+
+func (e *CaseCollisionError) Error() string {
+	return fmt.Sprintf("%s and %s differ only in case, and would overwrite each other", e.Existing, e.Path)
+}
+
+func (e *CaseCollisionError) Unwrap() error {
+	return ErrCaseCollision
+}
+
+// Tracks the paths extracted so far by their case-folded form.
+type caseFolder struct {
+	suffix string
+	// Extracted paths, by their case-folded form.
+	seen map[string]string
+	// Directories extracted to a path other than their own, so that their
+	// contents follow them.
+	moved map[string]string
+}
+
+func newCaseFolder(suffix string) *caseFolder {
+	retval := &caseFolder{}
+	retval.suffix = suffix
+	retval.seen = make(map[string]string)
+	retval.moved = make(map[string]string)
+	return retval
+}
+
+func foldCase(p string) string {
+	return strings.ToLower(p)
+}
+
+// Returns the path an entry is extracted to, and whether it collided with an
+// earlier entry.  A colliding entry is renamed by appending the suffix, and a
+// number if that's taken too; without a suffix, a *CaseCollisionError is
+// returned.  Entries with exactly the same path aren't collisions.
+func (f *caseFolder) resolve(p string, isDir bool) (string, bool, error) {
+	if parent, ok := f.moved[path.Dir(p)]; ok {
+		p = path.Join(parent, path.Base(p))
+	}
+	existing, ok := f.seen[foldCase(p)]
+	if !ok || existing == p {
+		f.seen[foldCase(p)] = p
+		return p, false, nil
+	} else if f.suffix == "" {
+		return "", true, &CaseCollisionError{existing, p}
+	}
+
+	renamed := p + f.suffix
+	for i := 2; f.seen[foldCase(renamed)] != ""; i++ {
+		renamed = fmt.Sprintf("%s%s%d", p, f.suffix, i)
+	}
+	f.seen[foldCase(renamed)] = renamed
+	if isDir {
+		f.moved[p] = renamed
+	}
+	return renamed, true, nil
+}
+
+// Returns true if dir is on a case-insensitive filesystem, by creating a
+// file and looking for it under an upper-case name.
+func caseInsensitiveDir(dir string) (bool, error) {
+	file, err := ioutil.TempFile(dir, "fast-archiver-case-probe-")
+	if err != nil {
+		return false, err
+	}
+	name := file.Name()
+	file.Close()
+	defer os.Remove(name)
+
+	lower, err := os.Stat(name)
+	if err != nil {
+		return false, err
+	}
+	upper, err := os.Stat(filepath.Join(filepath.Dir(name), strings.ToUpper(filepath.Base(name))))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(lower, upper), nil
+}
@@ -0,0 +1,100 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// An archive with entries that differ only in case, and a directory whose
+// contents have to follow it when it's renamed.
+func caseArchive(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, hdr := range []Header{
+		{Path: "Makefile"},
+		{Path: "makefile.case"},
+		{Path: "makefile"},
+		{Path: "MAKEFILE"},
+		{Path: "Dir", IsDir: true},
+		{Path: "Dir/a"},
+		{Path: "dir", IsDir: true},
+		{Path: "dir/b"},
+		// Exactly the same path again isn't a collision.
+		{Path: "Dir/a"},
+	} {
+		hdr := hdr
+		hdr.Mode = 0644
+		if err := w.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Extracts archive into memory, returning the paths extracted.
+func extractCases(archive []byte, setup func(u *Unarchiver)) ([]string, *Unarchiver, error) {
+	sink := &mapSink{entries: make(map[string]Entry)}
+	u := NewUnarchiverWithSink(bytes.NewReader(archive), sink)
+	setup(u)
+	err := u.Run()
+	var paths []string
+	for path := range sink.entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, u, err
+}
+
+func TestCaseCollisionsRenamed(t *testing.T) {
+	paths, u, err := extractCases(caseArchive(t), func(u *Unarchiver) {
+		u.CaseCollisions = CaseCollisionsAlways
+		u.CaseCollisionSuffix = ".case"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Dir", "Dir/a", "MAKEFILE.case3", "Makefile", "dir.case", "dir.case/b", "makefile.case", "makefile.case2"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("extracted %q, expected %q", paths, expected)
+	}
+	// makefile.case itself collides with nothing.
+	if collisions := u.Stats().CaseCollisions; collisions != 3 {
+		t.Errorf("%d collisions counted, expected 3", collisions)
+	}
+}
+
+func TestCaseCollisionError(t *testing.T) {
+	_, u, err := extractCases(caseArchive(t), func(u *Unarchiver) {
+		u.CaseCollisions = CaseCollisionsAlways
+	})
+	var collision *CaseCollisionError
+	if !errors.As(err, &collision) || !errors.Is(err, ErrCaseCollision) {
+		t.Fatalf("extracting colliding entries without a suffix gave %v, expected a *CaseCollisionError", err)
+	}
+	if collision.Existing != "Makefile" || collision.Path != "makefile" {
+		t.Errorf("collision between %q and %q, expected Makefile and makefile", collision.Existing, collision.Path)
+	}
+	if collisions := u.Stats().CaseCollisions; collisions != 1 {
+		t.Errorf("%d collisions counted, expected 1", collisions)
+	}
+}
+
+func TestCaseCollisionsNever(t *testing.T) {
+	paths, _, err := extractCases(caseArchive(t), func(u *Unarchiver) {
+		u.CaseCollisions = CaseCollisionsNever
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Dir", "Dir/a", "MAKEFILE", "Makefile", "dir", "dir/b", "makefile", "makefile.case"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("extracted %q, expected %q", paths, expected)
+	}
+}
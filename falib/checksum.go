@@ -0,0 +1,65 @@
+package falib
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+// The algorithms Archiver.OutputChecksums accepts, named as in the
+// md5sum, sha1sum, sha256sum and sha512sum tools.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Returns ErrUnknownChecksum if any of names isn't an algorithm that
+// Archiver.OutputChecksums accepts.
+func CheckOutputChecksums(names []string) error {
+	_, err := newOutputHashes(names)
+	return err
+}
+
+// Hashes the bytes of the archive as they're written.
+type outputHashes struct {
+	names  []string
+	hashes []hash.Hash
+}
+
+func newOutputHashes(names []string) (*outputHashes, error) {
+	retval := &outputHashes{}
+	for _, name := range names {
+		newHash, ok := checksumAlgorithms[name]
+		if !ok {
+			return nil, ErrUnknownChecksum
+		}
+		retval.names = append(retval.names, name)
+		retval.hashes = append(retval.hashes, newHash())
+	}
+	return retval, nil
+}
+
+// Returns a writer that hashes what's written to output, once output has
+// accepted it.
+func (h *outputHashes) writer(output io.Writer) io.Writer {
+	writers := []io.Writer{output}
+	for _, hash := range h.hashes {
+		writers = append(writers, hash)
+	}
+	return io.MultiWriter(writers...)
+}
+
+// Returns the digest for each algorithm, in hex.
+func (h *outputHashes) digests() map[string]string {
+	retval := make(map[string]string)
+	for i, name := range h.names {
+		retval[name] = hex.EncodeToString(h.hashes[i].Sum(nil))
+	}
+	return retval
+}
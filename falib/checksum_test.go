@@ -0,0 +1,61 @@
+package falib
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestOutputChecksums(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "alpha", "b": string(bytes.Repeat([]byte("bravo"), 100000))})
+	a := NewArchiverTemplate()
+	a.OutputChecksums = []string{"sha256", "md5"}
+	var digests map[string]string
+	a.OnOutputComplete = func(d map[string]string) { digests = d }
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+	sha := sha256.Sum256(archive.Bytes())
+	md := md5.Sum(archive.Bytes())
+	expected := map[string]string{"sha256": hex.EncodeToString(sha[:]), "md5": hex.EncodeToString(md[:])}
+	if len(digests) != len(expected) || digests["sha256"] != expected["sha256"] || digests["md5"] != expected["md5"] {
+		t.Errorf("digests %v, expected %v", digests, expected)
+	}
+
+	// A failed run doesn't report digests of an incomplete archive.
+	digests = nil
+	if err := a.RunTo(&failingWriter{1000, errors.New("disk full")}); err == nil {
+		t.Error("archiving to a failing output succeeded")
+	}
+	if digests != nil {
+		t.Errorf("OnOutputComplete called after a failure, with %v", digests)
+	}
+
+	a.ResumeFrom = &ResumeState{Offset: 1000}
+	if err := a.RunTo(&archive); err != ErrChecksumResume {
+		t.Errorf("resuming with output checksums returned %v", err)
+	}
+}
+
+func TestCheckOutputChecksums(t *testing.T) {
+	if err := CheckOutputChecksums([]string{"md5", "sha1", "sha256", "sha512"}); err != nil {
+		t.Error(err)
+	}
+	if err := CheckOutputChecksums([]string{"sha256", "sha265"}); err != ErrUnknownChecksum {
+		t.Errorf("checking a misspelt algorithm returned %v", err)
+	}
+	a := NewArchiverTemplate()
+	a.OutputChecksums = []string{"crc32"}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != ErrUnknownChecksum {
+		t.Errorf("archiving with an unknown algorithm returned %v", err)
+	}
+}
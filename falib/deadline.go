@@ -0,0 +1,61 @@
+package falib
+
+import (
+	"io"
+	"time"
+)
+
+// Enforces Archiver.FileReadTimeout for a single file.  File operations on a
+// hung network filesystem can't be interrupted, so each operation is run in
+// its own goroutine, and is abandoned (left running in the background) if it
+// doesn't complete within the timeout.  Each open and read has the whole
+// timeout to itself, so a large file that's read steadily is never abandoned,
+// only one that stalls.  A nil *fileDeadline runs operations directly, with
+// no timeout.
+type fileDeadline struct {
+	timeout time.Duration
+}
+
+func newFileDeadline(timeout time.Duration) *fileDeadline {
+	if timeout <= 0 {
+		return nil
+	}
+	return &fileDeadline{timeout}
+}
+
+type deadlineResult struct {
+	n   int
+	err error
+}
+
+// Runs op, returning ErrReadTimeout if it takes longer than the timeout.
+func (d *fileDeadline) run(op func() (int, error)) (int, error) {
+	if d == nil {
+		return op()
+	}
+	result := make(chan deadlineResult, 1)
+	go func() {
+		n, err := op()
+		result <- deadlineResult{n, err}
+	}()
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-result:
+		return r.n, r.err
+	case <-timer.C:
+		return 0, ErrReadTimeout
+	}
+}
+
+// An io.Reader for a file that enforces the timeout on every read.
+type deadlineReader struct {
+	file     io.Reader
+	deadline *fileDeadline
+}
+
+func (r deadlineReader) Read(buf []byte) (int, error) {
+	return r.deadline.run(func() (int, error) {
+		return r.file.Read(buf)
+	})
+}
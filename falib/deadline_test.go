@@ -0,0 +1,92 @@
+package falib
+
+import (
+	"bytes"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// A filesystem whose files named "slow" return a block at a time with a
+// delay before each, and whose files named "stalled" return one block and
+// then hang until release is closed.
+type slowFS struct {
+	fstest.MapFS
+	delay   time.Duration
+	release chan bool
+}
+
+type slowFile struct {
+	fs.File
+	fsys    *slowFS
+	stalled bool
+	reads   int
+}
+
+func (f *slowFile) Read(buf []byte) (int, error) {
+	if len(buf) > 4096 {
+		buf = buf[:4096]
+	}
+	f.reads++
+	if f.stalled && f.reads > 1 {
+		<-f.fsys.release
+	} else if !f.stalled {
+		time.Sleep(f.fsys.delay)
+	}
+	return f.File.Read(buf)
+}
+
+func (f *slowFS) Open(name string) (fs.File, error) {
+	file, err := f.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "root/slow":
+		return &slowFile{File: file, fsys: f}, nil
+	case "root/stalled":
+		return &slowFile{File: file, fsys: f, stalled: true}, nil
+	}
+	return file, nil
+}
+
+func TestFileReadTimeoutAppliesToEachRead(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16*4096/16)
+	fsys := &slowFS{
+		MapFS: fstest.MapFS{
+			"root/slow":    &fstest.MapFile{Data: data},
+			"root/stalled": &fstest.MapFile{Data: data},
+		},
+		delay:   20 * time.Millisecond,
+		release: make(chan bool),
+	}
+	defer close(fsys.release)
+
+	// The slow file takes 16 reads of 20ms, well over the timeout in all,
+	// but each read is well within it.
+	a := NewArchiverTemplate()
+	a.FS = fsys
+	a.FileReadTimeout = 200 * time.Millisecond
+	if err := a.AddDir("root"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := a.RunTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if timedOut := a.Stats().TimedOutFiles; !reflect.DeepEqual(timedOut, []string{"root/stalled"}) {
+		t.Errorf("timed out files are %v, expected only root/stalled", timedOut)
+	}
+	entries, err := ExtractToMapLimit(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entries["root/slow"].Data, data) {
+		t.Errorf("slow file archived with %d bytes, expected %d", len(entries["root/slow"].Data), len(data))
+	}
+	if stalled := entries["root/stalled"].Data; !bytes.Equal(stalled, data[:4096]) {
+		t.Errorf("stalled file archived with %d bytes, expected the 4096 read before it stalled", len(stalled))
+	}
+}
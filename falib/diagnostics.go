@@ -0,0 +1,210 @@
+package falib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the queue lengths are sampled when Archiver.Diagnostics is set.
+const diagnosticsInterval = time.Second
+
+// The stages of the archiver's pipeline, in the order data flows through
+// them, and the queue that feeds each one.
+const (
+	stageScan = iota
+	stageRead
+	stageLargeRead
+	stageWrite
+	stageCount
+)
+
+var stageNames = [stageCount]string{"directory scanners", "file readers", "large file readers", "writer"}
+var queueNames = [stageCount]string{"directory scan queue", "file read queue", "large file read queue", "block queue"}
+
+// How full one of the archiver's queues was, sampled every second.
+type QueueDiagnostics struct {
+	Name     string
+	Capacity int
+	Mean     float64
+	Max      int
+}
+
+// How much of the time one stage's goroutines spent working, rather than
+// waiting for work.  Time spent waiting to pass work on to a full queue
+// counts as busy.
+type StageDiagnostics struct {
+	Name        string
+	Workers     int
+	BusyPercent float64
+}
+
+// Queue lengths and worker utilization from a run with Archiver.Diagnostics
+// set, for tuning reader counts and queue sizes.  Queues[i] is the queue
+// feeding Stages[i].
+type DiagnosticsReport struct {
+	Elapsed time.Duration
+	Samples int
+	Queues  []QueueDiagnostics
+	Stages  []StageDiagnostics
+}
+
+// A queue that's at least this full on average is holding up the stages
+// before it.
+const fullQueuePercent = 90
+
+// Returns the stage holding up the others.  That's the last stage whose
+// queue was usually full, since the stages before it spend their time
+// waiting to queue work for it; if there's none, it's the busiest stage,
+// with ties going to the later stage.
+func (r *DiagnosticsReport) Bottleneck() StageDiagnostics {
+	for i := len(r.Stages) - 1; i >= 0; i-- {
+		queue := r.Queues[i]
+		if r.Samples > 0 && queue.Capacity > 0 && 100*queue.Mean >= fullQueuePercent*float64(queue.Capacity) {
+			return r.Stages[i]
+		}
+	}
+	var retval StageDiagnostics
+	for i := len(r.Stages) - 1; i >= 0; i-- {
+		if retval.Name == "" || r.Stages[i].BusyPercent > retval.BusyPercent {
+			retval = r.Stages[i]
+		}
+	}
+	return retval
+}
+
+// Summarizes the report over several lines, ending with the bottleneck.
+func (r *DiagnosticsReport) String() string {
+	var lines []string
+	for _, queue := range r.Queues {
+		lines = append(lines, fmt.Sprintf("%s: mean %.1f, max %d of %d", queue.Name, queue.Mean, queue.Max, queue.Capacity))
+	}
+	for _, stage := range r.Stages {
+		lines = append(lines, fmt.Sprintf("%s (%d): busy %.0f%%", stage.Name, stage.Workers, stage.BusyPercent))
+	}
+	bottleneck := r.Bottleneck()
+	verb := "was"
+	if strings.HasSuffix(bottleneck.Name, "s") {
+		verb = "were"
+	}
+	summary := fmt.Sprintf("%s %s busy %.0f%% of the time", bottleneck.Name, verb, bottleneck.BusyPercent)
+	for _, stage := range r.Stages {
+		if stage.Name != bottleneck.Name {
+			summary += fmt.Sprintf("; %s idle %.0f%%", stage.Name, 100-stage.BusyPercent)
+		}
+	}
+	lines = append(lines, summary)
+	return strings.Join(lines, "\n")
+}
+
+type diagnostics struct {
+	started time.Time
+	stop    chan bool
+	workers [stageCount]int
+	// Nanoseconds spent busy by each stage's workers, except for the
+	// writer, which records the time it spent waiting instead.
+	busy [stageCount]int64
+
+	lock     sync.Mutex
+	stopped  time.Time
+	samples  int
+	queueSum [stageCount]int64
+	queueMax [stageCount]int
+}
+
+func newDiagnostics(workers [stageCount]int) *diagnostics {
+	retval := &diagnostics{}
+	retval.started = time.Now()
+	retval.stop = make(chan bool)
+	retval.workers = workers
+	return retval
+}
+
+// Adds the time since start to a stage's busy time; for the writer, to its
+// waiting time.
+func (d *diagnostics) add(stage int, start time.Time) {
+	atomic.AddInt64(&d.busy[stage], int64(time.Since(start)))
+}
+
+// Samples the archiver's queues until the run finishes.
+func (d *diagnostics) sample(a *Archiver) {
+	ticker := time.NewTicker(diagnosticsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.stop:
+			return
+		}
+		lengths := [stageCount]int{len(a.directoryScanQueue), len(a.fileReadQueue), len(a.largeFileReadQueue), len(a.blockQueue)}
+		d.lock.Lock()
+		d.samples++
+		for i, length := range lengths {
+			d.queueSum[i] += int64(length)
+			if length > d.queueMax[i] {
+				d.queueMax[i] = length
+			}
+		}
+		d.lock.Unlock()
+	}
+}
+
+// Stops sampling, at the end of the run.
+func (d *diagnostics) finish() {
+	d.lock.Lock()
+	d.stopped = time.Now()
+	d.lock.Unlock()
+	close(d.stop)
+}
+
+// Returns the time since the run started, or its length once it's
+// finished, and the time each stage has spent busy, summed across its
+// workers.
+func (d *diagnostics) times() (time.Duration, [stageCount]time.Duration) {
+	d.lock.Lock()
+	end := d.stopped
+	d.lock.Unlock()
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(d.started)
+	var busy [stageCount]time.Duration
+	for i := range busy {
+		busy[i] = time.Duration(atomic.LoadInt64(&d.busy[i]))
+	}
+	busy[stageWrite] = elapsed - busy[stageWrite]
+	if busy[stageWrite] < 0 {
+		busy[stageWrite] = 0
+	}
+	return elapsed, busy
+}
+
+func (d *diagnostics) report(a *Archiver) *DiagnosticsReport {
+	elapsed, busyTimes := d.times()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	retval := &DiagnosticsReport{}
+	retval.Elapsed = elapsed
+	retval.Samples = d.samples
+
+	capacities := [stageCount]int{cap(a.directoryScanQueue), cap(a.fileReadQueue), cap(a.largeFileReadQueue), cap(a.blockQueue)}
+	for i := 0; i < stageCount; i++ {
+		if d.workers[i] == 0 {
+			continue
+		}
+		queue := QueueDiagnostics{queueNames[i], capacities[i], 0, d.queueMax[i]}
+		if d.samples > 0 {
+			queue.Mean = float64(d.queueSum[i]) / float64(d.samples)
+		}
+		retval.Queues = append(retval.Queues, queue)
+
+		stage := StageDiagnostics{stageNames[i], d.workers[i], 0}
+		if retval.Elapsed > 0 {
+			stage.BusyPercent = 100 * float64(busyTimes[i]) / float64(retval.Elapsed*time.Duration(d.workers[i]))
+		}
+		retval.Stages = append(retval.Stages, stage)
+	}
+	return retval
+}
@@ -0,0 +1,101 @@
+package falib
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBottleneck(t *testing.T) {
+	report := func(means []float64, busy []float64) *DiagnosticsReport {
+		retval := &DiagnosticsReport{Samples: 10}
+		for i, mean := range means {
+			retval.Queues = append(retval.Queues, QueueDiagnostics{Name: queueNames[i], Capacity: 100, Mean: mean})
+			retval.Stages = append(retval.Stages, StageDiagnostics{Name: stageNames[i], Workers: 1, BusyPercent: busy[i]})
+		}
+		return retval
+	}
+	for _, test := range []struct {
+		means, busy []float64
+		bottleneck  string
+		summary     string
+	}{
+		// Everything before a full block queue is waiting on the writer.
+		{[]float64{100, 100, 0, 95}, []float64{100, 100, 0, 98}, "writer",
+			"writer was busy 98% of the time; directory scanners idle 0%; file readers idle 0%; large file readers idle 100%"},
+		// The file read queue is full, but the block queue isn't.
+		{[]float64{100, 100, 0, 10}, []float64{100, 100, 0, 40}, "file readers",
+			"file readers were busy 100% of the time; directory scanners idle 0%; large file readers idle 100%; writer idle 60%"},
+		// No queue is full, so it's the busiest stage.
+		{[]float64{0, 20, 0, 10}, []float64{10, 60, 0, 30}, "file readers",
+			"file readers were busy 60% of the time; directory scanners idle 90%; large file readers idle 100%; writer idle 70%"},
+		// Ties go to the later stage.
+		{[]float64{0, 0, 0, 0}, []float64{50, 50, 0, 50}, "writer",
+			"writer was busy 50% of the time; directory scanners idle 50%; file readers idle 50%; large file readers idle 100%"},
+	} {
+		r := report(test.means, test.busy)
+		if bottleneck := r.Bottleneck().Name; bottleneck != test.bottleneck {
+			t.Errorf("bottleneck of %v, %v is %s, expected %s", test.means, test.busy, bottleneck, test.bottleneck)
+		}
+		lines := strings.Split(r.String(), "\n")
+		if summary := lines[len(lines)-1]; summary != test.summary {
+			t.Errorf("summarized %v, %v as %q, expected %q", test.means, test.busy, summary, test.summary)
+		}
+	}
+}
+
+// An output that writes rate bytes a second.
+type rateWriter struct {
+	rate int
+}
+
+func (w rateWriter) Write(buf []byte) (int, error) {
+	time.Sleep(time.Duration(len(buf)) * time.Second / time.Duration(w.rate))
+	return len(buf), nil
+}
+
+// Archives to an output slow enough that the block queue fills, for the two
+// seconds it takes for the queues to be sampled.
+func TestDiagnosticsSlowOutput(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<20/16)
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := NewArchiverTemplate()
+	a.Diagnostics = true
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RunTo(rateWriter{1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	report := a.Stats().Diagnostics
+	if report == nil {
+		t.Fatal("no diagnostics with Diagnostics set")
+	}
+	if report.Samples == 0 {
+		t.Fatalf("queues weren't sampled in a run of %v", report.Elapsed)
+	}
+	if bottleneck := report.Bottleneck(); bottleneck.Name != "writer" || bottleneck.BusyPercent < 90 {
+		t.Errorf("bottleneck was %+v, expected the writer; the report was:\n%s", bottleneck, report)
+	}
+
+	a = NewArchiverTemplate()
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RunTo(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if a.Stats().Diagnostics != nil {
+		t.Error("diagnostics reported without Diagnostics set")
+	}
+}
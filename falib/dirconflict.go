@@ -0,0 +1,60 @@
+package falib
+
+import (
+	"fmt"
+)
+
+// Returned from Run when a directory appears more than once in the archive
+// with different ownership, permissions or attributes, and
+// StrictDirectories is set.
+type DirectoryConflictError struct {
+	Path string
+	// The metadata of the earlier entry, and of the one that disagrees with
+	// it.
+	Existing EntryMeta
+	Conflict EntryMeta
+}
+
+func (e *DirectoryConflictError) Error() string {
+	return fmt.Sprintf("%s is archived more than once with different metadata: %s, then %s", e.Path, describeMeta(e.Existing), describeMeta(e.Conflict))
+}
+
+func (e *DirectoryConflictError) Unwrap() error {
+	return ErrDirectoryConflict
+}
+
+// Describes an entry's metadata for messages, eg. "0:0 drwxr-xr-x".
+func describeMeta(meta EntryMeta) string {
+	retval := fmt.Sprintf("%d:%d %v", meta.Uid, meta.Gid, meta.Mode)
+	if meta.Attributes != 0 {
+		retval += fmt.Sprintf(" attributes %#x", meta.Attributes)
+	}
+	return retval
+}
+
+// Tracks the directories extracted so far, so that a directory archived more
+// than once, as when it's under two roots, is only created once.
+type directorySet struct {
+	seen map[string]EntryMeta
+}
+
+func newDirectorySet() *directorySet {
+	retval := &directorySet{}
+	retval.seen = make(map[string]EntryMeta)
+	return retval
+}
+
+// Records a directory about to be extracted.  Returns false if it's an exact
+// duplicate of an earlier entry, which needn't be extracted again, or a
+// *DirectoryConflictError if an earlier entry's metadata differs; the later
+// entry's metadata is kept either way.
+func (s *directorySet) add(path string, meta EntryMeta) (bool, error) {
+	existing, ok := s.seen[path]
+	s.seen[path] = meta
+	if !ok {
+		return true, nil
+	} else if existing == meta {
+		return false, nil
+	}
+	return true, &DirectoryConflictError{path, existing, meta}
+}
@@ -1,10 +1,39 @@
 package falib
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
 
 var (
-	ErrAbsoluteDirectoryPath = errors.New("unable to process archive with absolute path reference")
-	ErrFileHeaderMismatch    = errors.New("unexpected file header")
-	ErrCrcMismatch           = errors.New("crc64 mismatch")
-	ErrUnrecognizedBlockType = errors.New("unrecognized block type")
+	ErrAbsoluteDirectoryPath = faformat.ErrAbsoluteDirectoryPath
+	ErrParentDirectoryPath   = faformat.ErrParentDirectoryPath
+	ErrInvalidPathPrefix     = errors.New("path prefix must be a relative, clean path")
+	ErrFileHeaderMismatch    = faformat.ErrFileHeaderMismatch
+	ErrCrcMismatch           = faformat.ErrCrcMismatch
+	ErrUnrecognizedBlockType = faformat.ErrUnrecognizedBlockType
+	ErrDataOffsetRange       = faformat.ErrDataOffsetRange
+	ErrReadTimeout           = errors.New("file read timed out")
+	ErrNotDirectory          = errors.New("not a directory")
+	ErrNotRegularFile        = errors.New("not a regular file")
+	ErrArchiverReused        = errors.New("an archiver can only be run once")
+	ErrArchiverRunning       = errors.New("archiver is already running")
+	ErrNoOutput              = errors.New("archiver has no output; use RunTo")
+	ErrNotBegun              = errors.New("archiver was not started with Begin, or is already closed")
+	ErrExtractLimit          = errors.New("archive is larger than the extraction limit")
+	ErrInterleaved           = errors.New("archive entries are interleaved; spooling is required to read it")
+	ErrWriteWithoutHeader    = errors.New("write before the first file header")
+	ErrWriteAfterClose       = errors.New("write after the writer was closed")
+	ErrSinkNotWriterAt       = errors.New("file was archived in ranges, but the sink's writer doesn't implement io.WriterAt")
+	ErrCaseCollision         = errors.New("paths differ only in case")
+	ErrDirectoryConflict     = errors.New("directory archived more than once with different metadata")
+	ErrPathExists            = errors.New("path already exists at the destination")
+	ErrUnknownChecksum       = errors.New("checksum algorithm must be md5, sha1, sha256 or sha512")
+	ErrChecksumResume        = errors.New("output checksums can't be computed when resuming an archive")
+	ErrResumeVersion         = errors.New("resume state is for an archive in another version of the format")
 )
+
+// An error that occurred while reading or writing an archive stream, with
+// the location in the stream where it happened.
+type BlockError = faformat.BlockError
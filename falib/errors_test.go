@@ -0,0 +1,103 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// Writes an archive of files with Writer, given as pairs of a path and its
+// contents.
+func writeArchive(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		if err := w.WriteHeader(&Header{Path: files[i], EntryMeta: EntryMeta{Mode: 0644}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBlockErrorFromUnarchiver(t *testing.T) {
+	archive := writeArchive(t, "a", "first", "b", "second")
+	archive[bytes.Index(archive, []byte("second"))] ^= 1
+	// The final checksum block is the last 11 bytes: an empty path's length,
+	// its type and the checksum.
+	checksumOffset := int64(len(archive) - 11)
+
+	_, err := ExtractToMapLimit(bytes.NewReader(archive), 0)
+	if !errors.Is(err, ErrCrcMismatch) {
+		t.Fatalf("extracting a corrupt archive gave %v, expected ErrCrcMismatch", err)
+	}
+	var blockErr *BlockError
+	if !errors.As(err, &blockErr) {
+		t.Fatalf("%T isn't a *BlockError", err)
+	}
+	if blockErr.Offset != checksumOffset || blockErr.Path != "b" || blockErr.BlockType != int(faformat.BlockChecksum) {
+		t.Errorf("error at offset %d, path %q, block type %d; expected %d, \"b\" and %d",
+			blockErr.Offset, blockErr.Path, blockErr.BlockType, checksumOffset, faformat.BlockChecksum)
+	}
+}
+
+func TestBlockErrorForUnsafePath(t *testing.T) {
+	var buf bytes.Buffer
+	w := faformat.NewBlockWriter(&buf)
+	w.WriteHeader()
+	w.WriteBlock(&faformat.Block{Path: "ok", Type: faformat.BlockDirectory, Mode: 0755})
+	offset := w.Offset()
+	w.WriteBlock(&faformat.Block{Path: "ok/../../escape", Type: faformat.BlockStartOfFile, Mode: 0644})
+
+	_, err := ExtractToMapLimit(&buf, 0)
+	var blockErr *BlockError
+	if !errors.Is(err, ErrParentDirectoryPath) || !errors.As(err, &blockErr) {
+		t.Fatalf("extracting an unsafe path gave %v, expected a *BlockError for ErrParentDirectoryPath", err)
+	}
+	if blockErr.Offset != offset || blockErr.Path != "ok/../../escape" {
+		t.Errorf("error at offset %d, path %q; expected %d and the unsafe path", blockErr.Offset, blockErr.Path, offset)
+	}
+}
+
+// A writer that fails once limit bytes have been written.
+type failingWriter struct {
+	limit int
+	err   error
+}
+
+func (w *failingWriter) Write(buf []byte) (int, error) {
+	if len(buf) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, w.err
+	}
+	w.limit -= len(buf)
+	return len(buf), nil
+}
+
+func TestBlockErrorFromArchiver(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": string(make([]byte, 1<<20)), "b": "b"})
+	a := NewArchiverTemplate()
+	a.OutputBufferSize = 4096
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	diskFull := errors.New("disk full")
+	err := a.RunTo(&failingWriter{64 << 10, diskFull})
+	var blockErr *BlockError
+	if !errors.Is(err, diskFull) || !errors.As(err, &blockErr) {
+		t.Fatalf("archiving to a failing writer gave %v, expected a *BlockError for its error", err)
+	}
+	if blockErr.Offset <= 0 || blockErr.Path == "" {
+		t.Errorf("error at offset %d, path %q; expected the location of the failed write", blockErr.Offset, blockErr.Path)
+	}
+}
@@ -0,0 +1,129 @@
+package falib
+
+import "sync/atomic"
+
+// An event reported by the Unarchiver through its Events channel.  Each event
+// is one of the types below.
+type Event interface {
+	isEvent()
+}
+
+// A file has been created and is about to be written.
+type FileStarted struct {
+	Path string
+}
+
+// A file has been completely written.
+type FileCompleted struct {
+	Path string
+}
+
+// The ownership of a file or directory couldn't be set.
+type ChownFailed struct {
+	Path string
+	Err  error
+}
+
+// A checksum block matched the archive contents read so far.  Offset is the
+// position in the archive just after the checksum block.
+type ChecksumVerified struct {
+	Offset int64
+}
+
+// An entry in the archive wasn't extracted.
+type EntrySkipped struct {
+	Path   string
+	Reason string
+}
+
+// Key/value pairs stored with an entry; see Header.Metadata.  Sent before
+// the entry is extracted, whether or not it's extracted, and with its path in
+// the archive.
+type EntryMetadata struct {
+	Path     string
+	Metadata map[string]string
+}
+
+func (FileStarted) isEvent()      {}
+func (FileCompleted) isEvent()    {}
+func (ChownFailed) isEvent()      {}
+func (ChecksumVerified) isEvent() {}
+func (EntrySkipped) isEvent()     {}
+func (EntryMetadata) isEvent()    {}
+
+// What to do with an event when the Events channel is full.
+type EventOverflow int
+
+const (
+	// Discard the event, counting it in DroppedEvents.
+	EventsDrop EventOverflow = iota
+	// Hold the event in an unbounded queue until the channel has room.
+	// Events are still delivered after Run returns if the reader falls
+	// behind.
+	EventsBuffer
+)
+
+// Delivers events to a channel without ever blocking the sender.
+type eventSender struct {
+	out      chan<- Event
+	overflow EventOverflow
+	queue    chan Event
+	dropped  int64
+}
+
+func newEventSender(out chan<- Event, overflow EventOverflow) *eventSender {
+	retval := &eventSender{out: out, overflow: overflow}
+	if out != nil && overflow == EventsBuffer {
+		retval.queue = make(chan Event)
+		go retval.forward()
+	}
+	return retval
+}
+
+func (s *eventSender) send(event Event) {
+	if s.out == nil {
+		return
+	}
+	if s.queue != nil {
+		s.queue <- event
+		return
+	}
+	select {
+	case s.out <- event:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// Stops accepting events; buffered events are still delivered.
+func (s *eventSender) close() {
+	if s.queue != nil {
+		close(s.queue)
+	}
+}
+
+// Moves events from queue to out, holding as many as necessary in between.
+// queue is always read promptly, so send never blocks for long.
+func (s *eventSender) forward() {
+	var pending []Event
+	queue := s.queue
+	for queue != nil || len(pending) > 0 {
+		var out chan<- Event
+		var next Event
+		if len(pending) > 0 {
+			out = s.out
+			next = pending[0]
+		}
+		select {
+		case event, ok := <-queue:
+			if !ok {
+				queue = nil
+				continue
+			}
+			pending = append(pending, event)
+		case out <- next:
+			pending[0] = nil
+			pending = pending[1:]
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package falib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Returned from Run when RefuseExisting is set and an entry would be
+// extracted over something already in the current directory.
+type ExistingPathError struct {
+	// The archive entry's path, and the existing file or directory, at the
+	// top level of the current directory, that it collides with.
+	Path     string
+	Existing string
+	// Any other existing names that the entries at the start of the archive
+	// collide with, found along with the first before anything was
+	// extracted; at most maxListedCollisions.
+	Others []string
+}
+
+// The most collisions listed by an ExistingPathError.
+const maxListedCollisions = 10
+
+func (e *ExistingPathError) Error() string {
+	var retval string
+	if e.Existing == "." {
+		retval = "the current directory isn't empty, and the archive's . entry would change its owner and mode"
+	} else if e.Existing == e.Path {
+		retval = fmt.Sprintf("%s already exists, and would be overwritten", e.Path)
+	} else {
+		retval = fmt.Sprintf("%s already exists, and would be overwritten by %s", e.Existing, e.Path)
+	}
+	if len(e.Others) > 0 {
+		retval += "; so would " + strings.Join(e.Others, ", ")
+	}
+	return retval
+}
+
+func (e *ExistingPathError) Unwrap() error {
+	return ErrPathExists
+}
+
+// Checks each top-level name in the archive against the current directory,
+// once, for RefuseExisting.  A nil checker allows everything.
+type existingChecker struct {
+	seen map[string]bool
+}
+
+func newExistingChecker() *existingChecker {
+	retval := &existingChecker{}
+	retval.seen = make(map[string]bool)
+	return retval
+}
+
+// Returns an *ExistingPathError if the first component of path existed
+// before the extraction began.  Names the extraction creates itself are
+// remembered, so their contents aren't checked.  The archive's "." entry,
+// which would change the current directory's owner and mode, only collides
+// if the current directory isn't empty.
+func (c *existingChecker) check(path string) error {
+	if c == nil {
+		return nil
+	}
+	name := strings.SplitN(path, "/", 2)[0]
+	if c.seen[name] {
+		return nil
+	}
+	c.seen[name] = true
+	if name == "." {
+		if !dirEmpty(".") {
+			return &ExistingPathError{Path: path, Existing: name}
+		}
+	} else if _, err := os.Lstat(longPath(filepath.FromSlash(name))); err == nil {
+		return &ExistingPathError{Path: path, Existing: name}
+	}
+	return nil
+}
+
+// Checks every one of paths, as check does, returning an *ExistingPathError
+// for the first collision that lists the others.
+func (c *existingChecker) checkAll(paths []string) error {
+	var retval *ExistingPathError
+	for _, path := range paths {
+		err, ok := c.check(path).(*ExistingPathError)
+		if !ok {
+			continue
+		} else if retval == nil {
+			retval = err
+		} else if len(retval.Others) < maxListedCollisions {
+			retval.Others = append(retval.Others, err.Existing)
+		}
+	}
+	if retval == nil {
+		return nil
+	}
+	return retval
+}
+
+// Returns true if the directory has no entries, or can't be read.
+func dirEmpty(name string) bool {
+	dir, err := os.Open(longPath(name))
+	if err != nil {
+		return true
+	}
+	defer dir.Close()
+	names, _ := dir.Readdirnames(1)
+	return len(names) == 0
+}
@@ -0,0 +1,94 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Changes to dir for the rest of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+func TestRefuseExistingListsCollisions(t *testing.T) {
+	source := t.TempDir()
+	writeTree(t, source, map[string]string{
+		"a/file":  "a",
+		"b/file":  "b",
+		"c/file":  "c",
+		"d":       "d",
+		"e/inner": "e",
+	})
+	a := NewArchiverTemplate()
+	if err := a.AddDirContentsAs(source, "."); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	target := t.TempDir()
+	writeTree(t, target, map[string]string{"b/": "", "d": "mine", "e/mine": "mine"})
+	chdir(t, target)
+
+	u := NewUnarchiver(bytes.NewReader(archive.Bytes()))
+	u.RefuseExisting = true
+	err := u.Run()
+	var existing *ExistingPathError
+	if !errors.As(err, &existing) || !errors.Is(err, ErrPathExists) {
+		t.Fatalf("Run returned %v, expected an *ExistingPathError", err)
+	}
+	collisions := append([]string{existing.Existing}, existing.Others...)
+	if len(collisions) != 3 {
+		t.Errorf("collisions are %v, expected b, d and e in any order", collisions)
+	}
+	// Nothing was extracted, not even the entries that didn't collide.
+	for _, name := range []string{"a", "c"} {
+		if _, err := os.Lstat(name); err == nil {
+			t.Errorf("%s was extracted before the collisions were found", name)
+		}
+	}
+	if contents, _ := os.ReadFile("d"); string(contents) != "mine" {
+		t.Errorf("d was overwritten with %q", contents)
+	}
+}
+
+func TestCheckAllLimitsListedCollisions(t *testing.T) {
+	target := t.TempDir()
+	chdir(t, target)
+	var paths []string
+	files := make(map[string]string)
+	for i := 0; i < maxListedCollisions+5; i++ {
+		name := string(rune('a' + i))
+		files[name] = ""
+		paths = append(paths, name+"/file")
+	}
+	writeTree(t, target, files)
+
+	err := newExistingChecker().checkAll(paths)
+	existing, ok := err.(*ExistingPathError)
+	if !ok {
+		t.Fatalf("checkAll returned %v", err)
+	}
+	if existing.Path != "a/file" || existing.Existing != "a" || len(existing.Others) != maxListedCollisions {
+		t.Errorf("checkAll returned %+v", existing)
+	}
+	if !reflect.DeepEqual(existing.Others[:2], []string{"b", "c"}) {
+		t.Errorf("others are %v, expected them in order", existing.Others)
+	}
+	if err := newExistingChecker().checkAll([]string{"missing", "also/missing"}); err != nil {
+		t.Errorf("checkAll without collisions returned %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package falib
+
+import (
+	"os"
+	"syscall"
+)
+
+const fadviseDontNeed = 4
+
+// Advises the kernel that the cached pages of a file are no longer needed,
+// so that archiving doesn't evict more useful data from the page cache.  A
+// length of zero covers the rest of the file.  Errors are ignored; this is
+// purely advisory.
+func dropCache(file *os.File, offset int64, length int64) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), uintptr(offset), uintptr(length), fadviseDontNeed, 0, 0)
+}
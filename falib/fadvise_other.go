@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package falib
+
+import "os"
+
+// posix_fadvise isn't available on this platform, so dropping cached pages is
+// a no-op.
+func dropCache(file *os.File, offset int64, length int64) {
+}
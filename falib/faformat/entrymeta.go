@@ -0,0 +1,96 @@
+package faformat
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// The most bytes the key/value pairs of an entry metadata block can take up,
+// as encoded in the archive.
+const MaxEntryMetaSize = 4096
+
+// Returns the number of bytes metadata takes up in an entry metadata block,
+// after the count of pairs, or an error if it can't be stored.
+func entryMetaSize(metadata map[string]string) (int, error) {
+	size := 0
+	for key, value := range metadata {
+		if key == "" {
+			return 0, ErrEntryMetaEmptyKey
+		}
+		size += 4 + len(key) + len(value)
+		if size > MaxEntryMetaSize {
+			return 0, ErrEntryMetaTooLarge
+		}
+	}
+	return size, nil
+}
+
+// Returns an error if metadata can't be stored in an entry metadata block:
+// ErrEntryMetaEmptyKey, or ErrEntryMetaTooLarge if it would take up more
+// than MaxEntryMetaSize bytes.
+func CheckEntryMeta(metadata map[string]string) error {
+	_, err := entryMetaSize(metadata)
+	return err
+}
+
+// Writes the pairs of an entry metadata block, sorted by key so that the
+// same metadata is always written the same way.
+func writeEntryMeta(output io.Writer, metadata map[string]string) error {
+	if _, err := entryMetaSize(metadata); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	err := binary.Write(output, binary.BigEndian, uint16(len(keys)))
+	for _, key := range keys {
+		for _, s := range []string{key, metadata[key]} {
+			if err == nil {
+				err = binary.Write(output, binary.BigEndian, uint16(len(s)))
+			}
+			if err == nil {
+				_, err = io.WriteString(output, s)
+			}
+		}
+	}
+	return err
+}
+
+func readEntryMeta(in io.Reader) (map[string]string, error) {
+	var count uint16
+	err := binary.Read(in, binary.BigEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+	retval := make(map[string]string, count)
+	size := 0
+	var pair [2]string
+	for i := 0; i < int(count); i++ {
+		for j := range pair {
+			var length uint16
+			err = binary.Read(in, binary.BigEndian, &length)
+			if err != nil {
+				return nil, err
+			}
+			size += 2 + int(length)
+			if size > MaxEntryMetaSize {
+				return nil, ErrEntryMetaTooLarge
+			}
+			buf := make([]byte, length)
+			_, err = io.ReadFull(in, buf)
+			if err != nil {
+				return nil, err
+			}
+			pair[j] = string(buf)
+		}
+		if pair[0] == "" {
+			return nil, ErrEntryMetaEmptyKey
+		}
+		retval[pair[0]] = pair[1]
+	}
+	return retval, nil
+}
@@ -0,0 +1,275 @@
+package faformat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+// Writes an archive with the given blocks, after calling enable.
+func writeBlocks(t *testing.T, enable func(*BlockWriter), blocks ...*Block) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewBlockWriter(&buf)
+	if enable != nil {
+		enable(w)
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blocks {
+		if err := w.WriteBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteChecksum(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHeaderVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		enable func(*BlockWriter)
+		header []byte
+	}{
+		{"default", nil, FileHeader},
+		{"entry metadata", (*BlockWriter).EnableEntryMeta, FileHeaderV3},
+		{"offset data", (*BlockWriter).EnableDataAt, FileHeaderV4},
+		{"both", func(w *BlockWriter) { w.EnableEntryMeta(); w.EnableDataAt() }, FileHeaderV4},
+	}
+	for _, test := range tests {
+		archive := writeBlocks(t, test.enable)
+		if !bytes.HasPrefix(archive, test.header) {
+			t.Errorf("%s: header is %q, expected %q", test.name, archive[:8], test.header)
+		}
+	}
+}
+
+func TestDataAtRequiresVersion4(t *testing.T) {
+	dataAt := &Block{Path: "f", Type: BlockDataAt, Offset: 4096, Data: []byte("data")}
+
+	var buf bytes.Buffer
+	w := NewBlockWriter(&buf)
+	w.EnableEntryMeta()
+	w.WriteHeader()
+	if err := w.WriteBlock(dataAt); !errors.Is(err, ErrDataAtDisabled) {
+		t.Errorf("writing an offset data block to a version 3 archive gave %v", err)
+	}
+
+	archive := writeBlocks(t, (*BlockWriter).EnableDataAt,
+		&Block{Path: "f", Type: BlockStartOfFile, Mode: 0644}, dataAt,
+		&Block{Path: "f", Type: BlockEndOfFile})
+	r := NewBlockReader(bytes.NewReader(archive))
+	var got *Block
+	for {
+		b, err := r.Next()
+		if err != nil {
+			break
+		} else if b.Type == BlockDataAt {
+			got = b
+		}
+	}
+	if r.Version() != VersionDataAt {
+		t.Errorf("version is %d, expected %d", r.Version(), VersionDataAt)
+	}
+	if got == nil || got.Offset != 4096 || string(got.Data) != "data" {
+		t.Errorf("offset data block read back as %+v", got)
+	}
+
+	// The same blocks behind a version 2 header, as written before version 4
+	// existed, are rejected at the offset data block.
+	v2 := append(append([]byte{}, FileHeader...), archive[len(FileHeaderV4):]...)
+	r = NewBlockReader(bytes.NewReader(v2))
+	var err error
+	for err == nil {
+		_, err = r.Next()
+	}
+	if !errors.Is(err, ErrUnrecognizedBlockType) {
+		t.Errorf("offset data block in a version 2 archive gave %v", err)
+	}
+}
+
+// Encodes a block by hand, with fields the writer refuses to write.
+func rawBlock(path string, blockType BlockType, fields ...interface{}) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(len(path)))
+	buf.WriteString(path)
+	buf.WriteByte(byte(blockType))
+	for _, field := range fields {
+		binary.Write(&buf, binary.BigEndian, field)
+	}
+	return buf.Bytes()
+}
+
+// Reads blocks from archive until an error, returning it.
+func readUntilError(archive []byte) error {
+	r := NewBlockReader(bytes.NewReader(archive))
+	for {
+		if _, err := r.Next(); err != nil {
+			return err
+		}
+	}
+}
+
+func TestDataAtOffsetRange(t *testing.T) {
+	data := []byte("12345678")
+	for _, offset := range []uint64{1 << 63, math.MaxUint64, math.MaxInt64 - 4} {
+		archive := append(append([]byte{}, FileHeaderV4...), rawBlock("f", BlockStartOfFile, uint32(0), uint32(0), uint32(0100644))...)
+		archive = append(archive, rawBlock("f", BlockDataAt, offset, uint16(len(data)), data)...)
+		err := readUntilError(archive)
+		var blockErr *BlockError
+		if !errors.Is(err, ErrDataOffsetRange) || !errors.As(err, &blockErr) || blockErr.Path != "f" {
+			t.Errorf("offset %#x gave %v, expected ErrDataOffsetRange for f", offset, err)
+		}
+	}
+
+	// The largest offset the data fits below is still allowed.
+	archive := append(append([]byte{}, FileHeaderV4...), rawBlock("f", BlockDataAt, uint64(math.MaxInt64)-uint64(len(data)), uint16(len(data)), data)...)
+	if err := readUntilError(archive); err != io.EOF {
+		t.Errorf("offset data block ending at the largest offset gave %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := NewBlockWriter(&buf)
+	w.EnableDataAt()
+	w.WriteHeader()
+	for _, offset := range []int64{-1, math.MaxInt64 - 4} {
+		if err := w.WriteBlock(&Block{Path: "f", Type: BlockDataAt, Offset: offset, Data: data}); !errors.Is(err, ErrDataOffsetRange) {
+			t.Errorf("writing offset %d gave %v, expected ErrDataOffsetRange", offset, err)
+		}
+	}
+	if buf.Len() != len(FileHeaderV4) {
+		t.Errorf("rejected blocks left %d bytes after the header", buf.Len()-len(FileHeaderV4))
+	}
+}
+
+// Concatenates the parts of an archive.
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestMalformedArchives(t *testing.T) {
+	startFile := rawBlock("f", BlockStartOfFile, uint32(0), uint32(0), uint32(0100644))
+	valid := writeBlocks(t, nil,
+		&Block{Path: "f", Type: BlockStartOfFile, Mode: 0644},
+		&Block{Path: "f", Type: BlockData, Data: []byte("contents")},
+		&Block{Path: "f", Type: BlockEndOfFile})
+	corrupt := append([]byte{}, valid...)
+	corrupt[bytes.Index(corrupt, []byte("contents"))] ^= 1
+
+	tests := []struct {
+		name     string
+		archive  []byte
+		expected error
+	}{
+		{"empty", nil, io.EOF},
+		{"truncated header", FileHeader[:5], io.ErrUnexpectedEOF},
+		{"wrong header", []byte("\x89FA9\r\n\x1a\n"), ErrFileHeaderMismatch},
+		{"truncated path length", join(FileHeader, []byte{0}), io.ErrUnexpectedEOF},
+		{"truncated path", join(FileHeader, []byte{0, 5, 'a', 'b'}), io.ErrUnexpectedEOF},
+		{"missing type", join(FileHeader, []byte{0, 1, 'f'}), io.ErrUnexpectedEOF},
+		{"truncated start file", join(FileHeader, startFile[:len(startFile)-2]), io.ErrUnexpectedEOF},
+		{"truncated data", join(FileHeader, startFile, rawBlock("f", BlockData, uint16(8), []byte("cont"))), io.ErrUnexpectedEOF},
+		{"truncated checksum", join(FileHeader, rawBlock("", BlockChecksum, uint32(0))), io.ErrUnexpectedEOF},
+		{"absolute path", join(FileHeader, rawBlock("/etc/passwd", BlockStartOfFile, uint32(0), uint32(0), uint32(0100644))), ErrAbsoluteDirectoryPath},
+		{"parent path", join(FileHeader, rawBlock("a/../../x", BlockDirectory, uint32(0), uint32(0), uint32(040755))), ErrParentDirectoryPath},
+		{"unknown block type", join(FileHeader, rawBlock("f", BlockType(42))), ErrUnrecognizedBlockType},
+		{"entry metadata in version 2", join(FileHeader, rawBlock("f", BlockEntryMeta, uint16(0))), ErrUnrecognizedBlockType},
+		{"offset data in version 3", join(FileHeaderV3, rawBlock("f", BlockDataAt, uint64(0), uint16(0))), ErrUnrecognizedBlockType},
+		{"checksum mismatch", corrupt, ErrCrcMismatch},
+		{"oversized metadata", join(FileHeaderV3, rawBlock("f", BlockEntryMeta, uint16(1), uint16(10), []byte("0123456789"), uint16(4095))), ErrEntryMetaTooLarge},
+		{"empty metadata key", join(FileHeaderV3, rawBlock("f", BlockEntryMeta, uint16(1), uint16(0), uint16(1), []byte("v"))), ErrEntryMetaEmptyKey},
+		{"truncated metadata", join(FileHeaderV3, rawBlock("f", BlockEntryMeta, uint16(2), uint16(1), []byte("k"), uint16(1), []byte("v"))), io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		err := readUntilError(test.archive)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: %v, expected %v", test.name, err, test.expected)
+		}
+		var blockErr *BlockError
+		if test.expected != io.EOF && !errors.As(err, &blockErr) {
+			t.Errorf("%s: %T isn't a *BlockError", test.name, err)
+		}
+	}
+	if err := readUntilError(valid); err != io.EOF {
+		t.Errorf("unmodified archive: %v", err)
+	}
+}
+
+func TestWriterRejectsInvalidMetadata(t *testing.T) {
+	tests := []struct {
+		metadata map[string]string
+		expected error
+	}{
+		{map[string]string{"": "v"}, ErrEntryMetaEmptyKey},
+		{map[string]string{"k": string(make([]byte, MaxEntryMetaSize))}, ErrEntryMetaTooLarge},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewBlockWriter(&buf)
+		w.EnableEntryMeta()
+		w.WriteHeader()
+		if err := w.WriteBlock(&Block{Path: "f", Type: BlockEntryMeta, Metadata: test.metadata}); !errors.Is(err, test.expected) {
+			t.Errorf("%v: %v, expected %v", test.expected, err, test.expected)
+		}
+		if buf.Len() != len(FileHeaderV3) {
+			t.Errorf("%v: rejected block left %d bytes after the header", test.expected, buf.Len()-len(FileHeaderV3))
+		}
+	}
+}
+
+func TestChecksumErrorLocatesDamage(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewBlockWriter(&buf)
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	write := func(path string, data string) {
+		for _, b := range []*Block{
+			{Path: path, Type: BlockStartOfFile, Mode: 0644},
+			{Path: path, Type: BlockData, Data: []byte(data)},
+			{Path: path, Type: BlockEndOfFile},
+		} {
+			if err := w.WriteBlock(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write("intact", "intact")
+	if err := w.WriteChecksum(); err != nil {
+		t.Fatal(err)
+	}
+	verified := w.Offset()
+	write("b", "b")
+	for i := 0; i < 150; i++ {
+		write(fmt.Sprintf("c%d", i), "damage me")
+	}
+	damaged := w.Offset()
+	if err := w.WriteChecksum(); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+	archive[bytes.LastIndex(archive, []byte("damage me"))] ^= 1
+
+	var checksumErr *ChecksumError
+	err := readUntilError(archive)
+	if !errors.As(err, &checksumErr) || !errors.Is(err, ErrCrcMismatch) {
+		t.Fatalf("reading a damaged archive returned %v, expected a *ChecksumError", err)
+	}
+	if checksumErr.VerifiedOffset != verified || checksumErr.Offset != damaged {
+		t.Errorf("damage reported between offsets %d and %d, expected %d and %d", checksumErr.VerifiedOffset, checksumErr.Offset, verified, damaged)
+	}
+	if checksumErr.PathCount != 151 || len(checksumErr.Paths) != 100 || checksumErr.Paths[0] != "b" || checksumErr.Paths[99] != "c98" {
+		t.Errorf("damage reported in %d paths, listing %q", checksumErr.PathCount, checksumErr.Paths)
+	}
+	if message := err.Error(); !strings.Contains(message, "affecting approximately 151 entries: b, c0,") || !strings.Contains(message, ", c98, and 51 more") {
+		t.Errorf("error message is %q", message)
+	}
+}
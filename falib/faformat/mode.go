@@ -0,0 +1,78 @@
+package faformat
+
+import "os"
+
+// File type and special bits of a POSIX st_mode, which is how modes are stored
+// from version 2 of the format.  os.FileMode uses its own layout, which only
+// Go understands.
+const (
+	posixTypeMask  = 0170000
+	posixSocket    = 0140000
+	posixSymlink   = 0120000
+	posixRegular   = 0100000
+	posixBlock     = 0060000
+	posixDirectory = 0040000
+	posixChar      = 0020000
+	posixFifo      = 0010000
+	posixSetuid    = 0004000
+	posixSetgid    = 0002000
+	posixSticky    = 0001000
+)
+
+func modeToPosix(mode os.FileMode) uint32 {
+	retval := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		retval |= posixSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		retval |= posixSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		retval |= posixSticky
+	}
+	switch {
+	case mode&os.ModeDir != 0:
+		retval |= posixDirectory
+	case mode&os.ModeSymlink != 0:
+		retval |= posixSymlink
+	case mode&os.ModeNamedPipe != 0:
+		retval |= posixFifo
+	case mode&os.ModeSocket != 0:
+		retval |= posixSocket
+	case mode&os.ModeCharDevice != 0:
+		retval |= posixChar
+	case mode&os.ModeDevice != 0:
+		retval |= posixBlock
+	default:
+		retval |= posixRegular
+	}
+	return retval
+}
+
+func modeFromPosix(mode uint32) os.FileMode {
+	retval := os.FileMode(mode & 0777)
+	if mode&posixSetuid != 0 {
+		retval |= os.ModeSetuid
+	}
+	if mode&posixSetgid != 0 {
+		retval |= os.ModeSetgid
+	}
+	if mode&posixSticky != 0 {
+		retval |= os.ModeSticky
+	}
+	switch mode & posixTypeMask {
+	case posixDirectory:
+		retval |= os.ModeDir
+	case posixSymlink:
+		retval |= os.ModeSymlink
+	case posixFifo:
+		retval |= os.ModeNamedPipe
+	case posixSocket:
+		retval |= os.ModeSocket
+	case posixChar:
+		retval |= os.ModeDevice | os.ModeCharDevice
+	case posixBlock:
+		retval |= os.ModeDevice
+	}
+	return retval
+}
@@ -0,0 +1,91 @@
+package faformat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+)
+
+var modeTests = []struct {
+	mode  os.FileMode
+	posix uint32
+}{
+	{0644, 0100644},
+	{os.ModeSetuid | 0755, 0104755},
+	{os.ModeSetgid | 0755, 0102755},
+	{os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0700, 0107700},
+	{os.ModeDir | 0755, 0040755},
+	{os.ModeDir | os.ModeSticky | 0777, 0041777},
+	{os.ModeDir | os.ModeSetgid | 0775, 0042775},
+	{os.ModeSymlink | 0777, 0120777},
+	{os.ModeNamedPipe | 0600, 0010600},
+	{os.ModeSocket | 0755, 0140755},
+	{os.ModeDevice | 0660, 0060660},
+	{os.ModeDevice | os.ModeCharDevice | 0666, 0020666},
+}
+
+func TestModeToPosix(t *testing.T) {
+	for _, test := range modeTests {
+		if posix := modeToPosix(test.mode); posix != test.posix {
+			t.Errorf("%v is stored as %#o, expected %#o", test.mode, posix, test.posix)
+		}
+		if mode := modeFromPosix(test.posix); mode != test.mode {
+			t.Errorf("%#o is read as %v, expected %v", test.posix, mode, test.mode)
+		}
+	}
+}
+
+func TestModeRoundTrip(t *testing.T) {
+	for _, test := range modeTests {
+		blockType := BlockStartOfFile
+		if test.mode.IsDir() {
+			blockType = BlockDirectory
+		}
+		archive := writeBlocks(t, nil, &Block{Path: "entry", Type: blockType, Uid: 1, Gid: 2, Mode: test.mode})
+		r := NewBlockReader(bytes.NewReader(archive))
+		if err := r.ReadHeader(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Mode != test.mode {
+			t.Errorf("%v was read back as %v", test.mode, b.Mode)
+		}
+	}
+}
+
+func TestVersion1ModesAreGoFileModes(t *testing.T) {
+	// Version 1 archives stored os.FileMode as it was; there's no writer for
+	// them any more, so one is made by rewriting a version 2 archive.
+	mode := os.ModeDir | os.ModeSetgid | os.ModeSticky | 0775
+	var buf bytes.Buffer
+	w := NewBlockWriter(&buf)
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteBlock(&Block{Path: "dir", Type: BlockDirectory, Mode: mode}); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+	copy(archive, FileHeaderV1)
+	binary.BigEndian.PutUint32(archive[len(archive)-4:], uint32(mode))
+
+	r := NewBlockReader(bytes.NewReader(archive))
+	if err := r.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Mode != mode {
+		t.Errorf("version 1 mode was read as %v, expected %v", b.Mode, mode)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected the end of the archive, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package faformat
+
+import (
+	"hash"
+	"io"
+)
+
+// Default size and number of the buffers used by a concurrent BlockWriter.
+const (
+	DefaultWriteBufferSize  = 64 << 10
+	DefaultWriteBufferCount = 4
+)
+
+// An io.Writer that collects data into buffers, which are hashed on one
+// goroutine and then written to output on another, so that a slow output
+// doesn't hold up either the hashing or the caller until every buffer is in
+// use.  The hash may only be used by others after sync.
+type hashPipe struct {
+	hash   hash.Hash64
+	output io.Writer
+	buf    []byte
+	full   chan []byte
+	hashed chan []byte
+	free   chan []byte
+	synced chan error
+	closed bool
+	// The first write error; only used by the writing goroutine.
+	err error
+}
+
+func newHashPipe(hash hash.Hash64, output io.Writer, bufferSize int, bufferCount int) *hashPipe {
+	if bufferSize <= 0 {
+		bufferSize = DefaultWriteBufferSize
+	}
+	if bufferCount < 2 {
+		bufferCount = DefaultWriteBufferCount
+	}
+	retval := &hashPipe{}
+	retval.hash = hash
+	retval.output = output
+	retval.buf = make([]byte, 0, bufferSize)
+	retval.full = make(chan []byte, bufferCount)
+	retval.hashed = make(chan []byte, bufferCount)
+	retval.free = make(chan []byte, bufferCount)
+	for i := 1; i < bufferCount; i++ {
+		retval.free <- make([]byte, 0, bufferSize)
+	}
+	retval.synced = make(chan error)
+	go retval.hashBuffers()
+	go retval.writeBuffers()
+	return retval
+}
+
+func (p *hashPipe) hashBuffers() {
+	for buf := range p.full {
+		// A nil buffer is a request from sync, which is passed along.
+		if buf != nil {
+			p.hash.Write(buf)
+		}
+		p.hashed <- buf
+	}
+	close(p.hashed)
+}
+
+func (p *hashPipe) writeBuffers() {
+	for buf := range p.hashed {
+		if buf == nil {
+			p.synced <- p.err
+			continue
+		}
+		if p.err == nil {
+			_, p.err = p.output.Write(buf)
+		}
+		p.free <- buf[:0]
+	}
+}
+
+func (p *hashPipe) Write(data []byte) (int, error) {
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n := len(data)
+	for len(data) > 0 {
+		if len(p.buf) == cap(p.buf) {
+			p.send()
+		}
+		copied := copy(p.buf[len(p.buf):cap(p.buf)], data)
+		p.buf = p.buf[:len(p.buf)+copied]
+		data = data[copied:]
+	}
+	return n, nil
+}
+
+// Passes the current buffer on to be hashed, and takes a free one, waiting
+// for one to be written if necessary.
+func (p *hashPipe) send() {
+	p.full <- p.buf
+	p.buf = <-p.free
+}
+
+// Waits until everything written has been hashed and written to output.
+func (p *hashPipe) sync() error {
+	if p.closed {
+		return nil
+	}
+	if len(p.buf) > 0 {
+		p.send()
+	}
+	p.full <- nil
+	return <-p.synced
+}
+
+func (p *hashPipe) close() error {
+	err := p.sync()
+	if !p.closed {
+		p.closed = true
+		close(p.full)
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package faformat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"testing"
+	"time"
+)
+
+// An output that blocks every write until it's opened.
+type gatedWriter struct {
+	open chan bool
+	buf  bytes.Buffer
+}
+
+func (w *gatedWriter) Write(data []byte) (int, error) {
+	<-w.open
+	return w.buf.Write(data)
+}
+
+// An output that takes delay for every write, like a remote destination.
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w slowWriter) Write(data []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(data), nil
+}
+
+// An output that fails every write.
+type brokenWriter struct {
+	err error
+}
+
+func (w brokenWriter) Write(data []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestHashPipeWritesAhead(t *testing.T) {
+	output := &gatedWriter{open: make(chan bool)}
+	hash := crc64.New(crc64.MakeTable(crc64.ECMA))
+	p := newHashPipe(hash, output, 1024, 4)
+	data := bytes.Repeat([]byte("0123456789"), 300)
+
+	// With the output stalled on the first buffer, the other three take
+	// the rest.
+	done := make(chan bool)
+	go func() {
+		p.Write(data)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writing less than the buffers hold waited for the output")
+	}
+
+	close(output.open)
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.buf.Bytes(), data) {
+		t.Errorf("output has %d bytes that differ from the %d written", output.buf.Len(), len(data))
+	}
+	if hash.Sum64() != crc64.Checksum(data, crc64.MakeTable(crc64.ECMA)) {
+		t.Error("hash doesn't match the data written")
+	}
+}
+
+func TestHashPipeReportsWriteErrors(t *testing.T) {
+	broken := errors.New("broken pipe")
+	p := newHashPipe(crc64.New(crc64.MakeTable(crc64.ECMA)), brokenWriter{broken}, 16, 2)
+	data := make([]byte, 100)
+	// Writes carry on being accepted after the output has failed, rather
+	// than blocking, so that the caller finds out at the next sync.
+	for i := 0; i < 10; i++ {
+		if _, err := p.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.sync(); err != broken {
+		t.Errorf("sync returned %v, expected the write error", err)
+	}
+	if err := p.close(); err != broken {
+		t.Errorf("close returned %v, expected the write error", err)
+	}
+	if _, err := p.Write(data); err == nil {
+		t.Error("write after close succeeded")
+	}
+}
+
+// Writes files through a concurrent writer to an output that takes 200µs
+// per write, whatever its size, as a pipe to a remote host might.  Once the
+// output is the bottleneck, more buffers only absorb bursts, while larger
+// ones mean fewer writes.
+func BenchmarkSlowOutput(b *testing.B) {
+	for _, buffers := range []struct{ size, count int }{
+		{64 << 10, 2},
+		{64 << 10, 4},
+		{64 << 10, 8},
+		{1 << 20, 4},
+	} {
+		b.Run(fmt.Sprintf("%dK/%d", buffers.size>>10, buffers.count), func(b *testing.B) {
+			w := NewConcurrentBlockWriter(slowWriter{200 * time.Microsecond}, buffers.size, buffers.count)
+			if err := w.WriteHeader(); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(64 * 4096)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := writeFile(w, "file", 4096); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package faformat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+)
+
+// An io.Reader implementation that also keeps a crc64 as it reads, unless
+// its hasher is nil.  Fancy!
+type hashingReader struct {
+	innerReader io.Reader
+	hasher      hash.Hash64
+	offset      int64
+}
+
+func (r *hashingReader) Read(buf []byte) (int, error) {
+	n, err := r.innerReader.Read(buf)
+	if err == nil && r.hasher != nil {
+		r.hasher.Write(buf[:n])
+	}
+	r.offset += int64(n)
+	return n, err
+}
+
+// Reads the blocks of an archive in order, verifying checksum blocks as
+// they're reached.  Errors are returned as *BlockError.
+type BlockReader struct {
+	in      *hashingReader
+	started bool
+	version int
+	// Location of the most recent block, for errors.
+	where BlockError
+	// The offset just past the most recently verified checksum block, or
+	// the header, and the paths of the entries read since then.
+	verifiedOffset int64
+	recentPaths    []string
+	recentCount    int
+	recentSeen     map[string]bool
+}
+
+func NewBlockReader(r io.Reader) *BlockReader {
+	retval := &BlockReader{}
+	retval.in = &hashingReader{bufio.NewReader(r), crc64.New(crc64.MakeTable(crc64.ECMA)), 0}
+	retval.where.BlockType = -1
+	return retval
+}
+
+// Reads and checks the archive header.  Next calls this if it hasn't been
+// called already.
+func (r *BlockReader) ReadHeader() error {
+	r.started = true
+	fileHeader := make([]byte, len(FileHeader))
+	_, err := io.ReadFull(r.in, fileHeader)
+	if err != nil {
+		return r.Wrap(err)
+	}
+	r.verifiedOffset = r.in.offset
+	if bytes.Equal(fileHeader, FileHeader) {
+		r.version = Version
+	} else if bytes.Equal(fileHeader, FileHeaderV3) {
+		r.version = VersionEntryMeta
+	} else if bytes.Equal(fileHeader, FileHeaderV4) {
+		r.version = VersionDataAt
+	} else if bytes.Equal(fileHeader, FileHeaderV1) {
+		r.version = 1
+	} else {
+		return r.Wrap(ErrFileHeaderMismatch)
+	}
+	return nil
+}
+
+// Stops the reader computing the archive's checksum, for speed when its
+// integrity doesn't matter.  Checksum blocks are still read and returned by
+// Next, but aren't verified.  Must be called before anything is read.
+func (r *BlockReader) SkipChecksums() {
+	r.in.hasher = nil
+}
+
+// The format version of the archive, once its header has been read.
+func (r *BlockReader) Version() int {
+	return r.version
+}
+
+// Returns the next block, or io.EOF at the end of the archive.  A returned
+// checksum block has already been verified, unless SkipChecksums was called.
+// The Block and its Data are newly allocated for each call.
+func (r *BlockReader) Next() (*Block, error) {
+	if !r.started {
+		err := r.ReadHeader()
+		if err != nil {
+			return nil, err
+		}
+	}
+	b, err := r.next()
+	if err == io.EOF {
+		return nil, err
+	} else if err != nil {
+		return nil, r.Wrap(err)
+	}
+	return b, nil
+}
+
+// The number of bytes of the archive read so far.
+func (r *BlockReader) Offset() int64 {
+	return r.in.offset
+}
+
+// Wraps err with the location of the most recent block, for reporting
+// errors found by the caller while handling it.
+func (r *BlockReader) Wrap(err error) error {
+	where := r.where
+	where.Err = err
+	return &where
+}
+
+func (r *BlockReader) next() (*Block, error) {
+	in := r.in
+	b := &Block{}
+	r.where.Offset = in.offset
+	r.where.BlockType = -1
+
+	var pathSize uint16
+	err := binary.Read(in, binary.BigEndian, &pathSize)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, pathSize)
+	_, err = io.ReadFull(in, buf)
+	if err == io.EOF {
+		// The archive ended part way through the block.
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	b.Path = string(buf)
+	if b.Path != "" {
+		r.where.Path = b.Path
+		r.notePath(b.Path)
+	}
+	err = CheckPath(b.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	typeByte := make([]byte, 1)
+	_, err = io.ReadFull(in, typeByte)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	b.Type = BlockType(typeByte[0])
+	r.where.BlockType = int(b.Type)
+
+	switch b.Type {
+	case BlockStartOfFile, BlockDirectory:
+		var uid uint32
+		var gid uint32
+		err = binary.Read(in, binary.BigEndian, &uid)
+		if err == nil {
+			err = binary.Read(in, binary.BigEndian, &gid)
+		}
+		var mode uint32
+		if err == nil {
+			err = binary.Read(in, binary.BigEndian, &mode)
+		}
+		b.Uid = int(uid)
+		b.Gid = int(gid)
+		if r.version == 1 {
+			b.Mode = os.FileMode(mode)
+		} else {
+			b.Mode = modeFromPosix(mode)
+		}
+	case BlockEndOfFile:
+		// Nothing to read aside from the block type
+	case BlockData, BlockDataAt:
+		if b.Type == BlockDataAt && r.version < VersionDataAt {
+			err = ErrUnrecognizedBlockType
+			break
+		} else if b.Type == BlockDataAt {
+			var offset uint64
+			err = binary.Read(in, binary.BigEndian, &offset)
+			b.Offset = int64(offset)
+		}
+		var blockSize uint16
+		if err == nil {
+			err = binary.Read(in, binary.BigEndian, &blockSize)
+		}
+		if err == nil && (b.Offset < 0 || b.Offset > math.MaxInt64-int64(blockSize)) {
+			// Offsets of 1<<63 or more have become negative.
+			err = ErrDataOffsetRange
+		}
+		if err == nil {
+			b.Data = make([]byte, blockSize)
+			_, err = io.ReadFull(in, b.Data)
+		}
+	case BlockAttributes:
+		err = binary.Read(in, binary.BigEndian, &b.Attributes)
+	case BlockEntryMeta:
+		if r.version < VersionEntryMeta {
+			err = ErrUnrecognizedBlockType
+		} else {
+			b.Metadata, err = readEntryMeta(in)
+		}
+	case BlockChecksum:
+		var expectedChecksum uint64
+		if in.hasher == nil {
+			err = binary.Read(in, binary.BigEndian, &expectedChecksum)
+			break
+		}
+		currentChecksum := in.hasher.Sum64()
+		err = binary.Read(in, binary.BigEndian, &expectedChecksum)
+		if err == nil && expectedChecksum != currentChecksum {
+			err = &ChecksumError{r.verifiedOffset, r.where.Offset, expectedChecksum, currentChecksum, r.recentPaths, r.recentCount}
+		} else if err == nil {
+			r.verifiedOffset = in.offset
+			r.recentPaths = nil
+			r.recentCount = 0
+			r.recentSeen = nil
+		}
+	default:
+		err = ErrUnrecognizedBlockType
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// The most paths a ChecksumError lists.
+const maxChecksumErrorPaths = 100
+
+// Records an entry read since the last checksum block, for ChecksumError.
+func (r *BlockReader) notePath(path string) {
+	if n := len(r.recentPaths); n > 0 && r.recentPaths[n-1] == path {
+		return
+	} else if r.recentSeen == nil {
+		r.recentSeen = make(map[string]bool)
+	} else if r.recentSeen[path] {
+		return
+	}
+	r.recentSeen[path] = true
+	r.recentCount++
+	if len(r.recentPaths) < maxChecksumErrorPaths {
+		r.recentPaths = append(r.recentPaths, path)
+	}
+}
@@ -0,0 +1,275 @@
+package faformat
+
+import (
+	"encoding"
+	"encoding/binary"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+)
+
+// Writes the blocks of an archive, keeping the checksum for checksum blocks.
+// Nothing is buffered, so output should usually be a bufio.Writer.  Errors
+// are returned as *BlockError.
+type BlockWriter struct {
+	counter    *countingWriter
+	hash       hash.Hash64
+	output     io.Writer
+	blockCount int
+	// The most recent entry path written, for errors from blocks without
+	// one.
+	lastPath string
+	// Set by EnableEntryMeta and EnableDataAt.
+	entryMeta bool
+	dataAt    bool
+	// Set for a concurrent BlockWriter.
+	pipe *hashPipe
+}
+
+func NewBlockWriter(output io.Writer) *BlockWriter {
+	retval := &BlockWriter{}
+	retval.hash = crc64.New(crc64.MakeTable(crc64.ECMA))
+	retval.counter = &countingWriter{output, 0}
+	retval.output = io.MultiWriter(retval.counter, retval.hash)
+	return retval
+}
+
+// Like NewBlockWriter, but blocks are collected into bufferCount buffers of
+// bufferSize bytes, which are checksummed and then written to output on
+// other goroutines, so that the caller can go on to the next blocks in the
+// meantime.  Zero uses DefaultWriteBufferSize and DefaultWriteBufferCount.
+// Write errors are returned from a later WriteChecksum, ChecksumState or
+// Close.  Close must be called once the archive is finished.
+func NewConcurrentBlockWriter(output io.Writer, bufferSize int, bufferCount int) *BlockWriter {
+	retval := &BlockWriter{}
+	retval.hash = crc64.New(crc64.MakeTable(crc64.ECMA))
+	retval.pipe = newHashPipe(retval.hash, output, bufferSize, bufferCount)
+	retval.counter = &countingWriter{retval.pipe, 0}
+	retval.output = retval.counter
+	return retval
+}
+
+// Allows BlockEntryMeta blocks to be written, by writing a version 3 header
+// rather than version 2.  Must be called before WriteHeader, or before
+// Resume for an archive that was started with it.
+func (w *BlockWriter) EnableEntryMeta() {
+	w.entryMeta = true
+}
+
+// Allows BlockDataAt blocks to be written, as well as BlockEntryMeta blocks,
+// by writing a version 4 header.  Must be called before WriteHeader, or
+// before Resume for an archive that was started with it.
+func (w *BlockWriter) EnableDataAt() {
+	w.dataAt = true
+	w.entryMeta = true
+}
+
+// The format version of the header that WriteHeader writes.
+func (w *BlockWriter) Version() int {
+	if w.dataAt {
+		return VersionDataAt
+	} else if w.entryMeta {
+		return VersionEntryMeta
+	}
+	return Version
+}
+
+// Writes the archive header, which must come before any blocks.
+func (w *BlockWriter) WriteHeader() error {
+	header := FileHeader
+	if w.dataAt {
+		header = FileHeaderV4
+	} else if w.entryMeta {
+		header = FileHeaderV3
+	}
+	_, err := w.output.Write(header)
+	if err != nil {
+		return &BlockError{0, "", -1, err}
+	}
+	return nil
+}
+
+// Writes a block.  For a checksum block, only Type is used.
+func (w *BlockWriter) WriteBlock(b *Block) error {
+	if b.Type == BlockChecksum {
+		return w.WriteChecksum()
+	}
+	offset := w.counter.count
+	if b.Type == BlockEntryMeta && !w.entryMeta {
+		return &BlockError{offset, b.Path, int(b.Type), ErrEntryMetaDisabled}
+	} else if b.Type == BlockDataAt && !w.dataAt {
+		return &BlockError{offset, b.Path, int(b.Type), ErrDataAtDisabled}
+	}
+	if b.Path != "" {
+		w.lastPath = b.Path
+	}
+	err := b.write(w.output)
+	if err != nil {
+		return &BlockError{offset, w.lastPath, int(b.Type), err}
+	}
+	w.blockCount += 1
+	return nil
+}
+
+// Writes a checksum block covering everything written so far.  For a
+// concurrent BlockWriter, everything up to the end of the checksum block has
+// been written to output when it returns.
+func (w *BlockWriter) WriteChecksum() error {
+	offset := w.counter.count
+	// file path length... zero
+	err := binary.Write(w.output, binary.BigEndian, uint16(0))
+	if err == nil {
+		blockType := []byte{byte(BlockChecksum)}
+		_, err = w.output.Write(blockType)
+	}
+	if err == nil {
+		err = w.sync()
+	}
+	if err == nil {
+		err = binary.Write(w.output, binary.BigEndian, w.hash.Sum64())
+	}
+	if err == nil {
+		err = w.sync()
+	}
+	if err != nil {
+		return &BlockError{offset, w.lastPath, int(BlockChecksum), err}
+	}
+	w.blockCount = 0
+	return nil
+}
+
+// The number of bytes written so far, including any written before Resume.
+func (w *BlockWriter) Offset() int64 {
+	return w.counter.count
+}
+
+// The number of blocks written since the last checksum block.
+func (w *BlockWriter) BlocksSinceChecksum() int {
+	return w.blockCount
+}
+
+// Returns the internal state of the checksum, which Resume uses to carry on
+// an archive from this point.
+func (w *BlockWriter) ChecksumState() []byte {
+	w.sync()
+	state, err := w.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		panic("Internal error: unable to save checksum state")
+	}
+	return state
+}
+
+// Carries on an archive whose first offset bytes, including the header, have
+// already been written, with checksumState as returned by ChecksumState at
+// that point.
+func (w *BlockWriter) Resume(offset int64, checksumState []byte) error {
+	err := w.sync()
+	if err != nil {
+		return err
+	}
+	err = w.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(checksumState)
+	if err != nil {
+		return err
+	}
+	w.counter.count = offset
+	w.blockCount = 0
+	return nil
+}
+
+// Finishes writing to output and stops the goroutine of a concurrent
+// BlockWriter, returning any write error; does nothing for one created with
+// NewBlockWriter.  Doesn't write a checksum block or close output.
+func (w *BlockWriter) Close() error {
+	if w.pipe == nil {
+		return nil
+	}
+	if err := w.pipe.close(); err != nil {
+		return &BlockError{w.counter.count, w.lastPath, -1, err}
+	}
+	return nil
+}
+
+// Waits until everything written so far has been hashed and written to
+// output, so that the checksum can be used.
+func (w *BlockWriter) sync() error {
+	if w.pipe == nil {
+		return nil
+	}
+	return w.pipe.sync()
+}
+
+func (b *Block) write(output io.Writer) error {
+	filePath := []byte(b.Path)
+	if len(filePath) > 0xFFFF {
+		return ErrPathTooLong
+	} else if b.Type == BlockEntryMeta {
+		// Checked before anything is written, so that the archive isn't
+		// left with part of a block.
+		if _, err := entryMetaSize(b.Metadata); err != nil {
+			return err
+		}
+	} else if b.Type == BlockDataAt && (b.Offset < 0 || b.Offset > math.MaxInt64-int64(len(b.Data))) {
+		return ErrDataOffsetRange
+	}
+	err := binary.Write(output, binary.BigEndian, uint16(len(filePath)))
+	if err == nil {
+		_, err = output.Write(filePath)
+	}
+	if err == nil {
+		blockType := []byte{byte(b.Type)}
+		_, err = output.Write(blockType)
+	}
+	if err == nil {
+		switch b.Type {
+		case BlockDirectory, BlockStartOfFile:
+			err = binary.Write(output, binary.BigEndian, uint32(b.Uid))
+			if err == nil {
+				err = binary.Write(output, binary.BigEndian, uint32(b.Gid))
+			}
+			if err == nil {
+				err = binary.Write(output, binary.BigEndian, modeToPosix(b.Mode))
+			}
+		case BlockEndOfFile:
+			// Nothing to write aside from the block type
+		case BlockData:
+			if len(b.Data) > 0xFFFF {
+				return ErrBlockTooLarge
+			}
+			err = binary.Write(output, binary.BigEndian, uint16(len(b.Data)))
+			if err == nil {
+				_, err = output.Write(b.Data)
+			}
+		case BlockDataAt:
+			if len(b.Data) > 0xFFFF {
+				return ErrBlockTooLarge
+			}
+			err = binary.Write(output, binary.BigEndian, uint64(b.Offset))
+			if err == nil {
+				err = binary.Write(output, binary.BigEndian, uint16(len(b.Data)))
+			}
+			if err == nil {
+				_, err = output.Write(b.Data)
+			}
+		case BlockAttributes:
+			err = binary.Write(output, binary.BigEndian, b.Attributes)
+		case BlockEntryMeta:
+			err = writeEntryMeta(output, b.Metadata)
+		default:
+			return ErrUnrecognizedBlockType
+		}
+	}
+	return err
+}
+
+// An io.Writer that counts the bytes written through it.
+type countingWriter struct {
+	innerWriter io.Writer
+	count       int64
+}
+
+func (w *countingWriter) Write(buf []byte) (int, error) {
+	n, err := w.innerWriter.Write(buf)
+	w.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,84 @@
+package faformat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// Writes a file of 64 blocks of blockSize bytes.
+func writeFile(w *BlockWriter, path string, blockSize int) error {
+	data := bytes.Repeat([]byte{'x'}, blockSize)
+	if err := w.WriteBlock(&Block{Path: path, Type: BlockStartOfFile, Mode: 0644}); err != nil {
+		return err
+	}
+	for i := 0; i < 64; i++ {
+		if err := w.WriteBlock(&Block{Path: path, Type: BlockData, Data: data}); err != nil {
+			return err
+		}
+	}
+	return w.WriteBlock(&Block{Path: path, Type: BlockEndOfFile})
+}
+
+func TestConcurrentBlockWriterMatches(t *testing.T) {
+	var serial, concurrent bytes.Buffer
+	for _, w := range []*BlockWriter{NewBlockWriter(&serial), NewConcurrentBlockWriter(&concurrent, 4096, 2)} {
+		if err := w.WriteHeader(); err != nil {
+			t.Fatal(err)
+		}
+		for i, blockSize := range []int{1, 4096, 65535} {
+			if err := writeFile(w, fmt.Sprintf("file%d", i), blockSize); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.WriteChecksum(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(serial.Bytes(), concurrent.Bytes()) {
+		t.Errorf("concurrent writer wrote %d bytes that differ from the serial writer's %d", concurrent.Len(), serial.Len())
+	}
+}
+
+// Compares hashing on the caller's goroutine with NewConcurrentBlockWriter's
+// hashing on its own, writing to io.Discard so that only the writer's own
+// work is measured.  A checksum block is written after every 16 files, about
+// as often as the archiver's default interval of 1000 blocks.  The concurrent
+// writer only pulls ahead with a spare CPU.
+func BenchmarkBlockWriter(b *testing.B) {
+	for _, blockSize := range []int{4096, 65535} {
+		for _, writer := range []struct {
+			name string
+			new  func(io.Writer) *BlockWriter
+		}{
+			{"serial", NewBlockWriter},
+			{"concurrent", func(output io.Writer) *BlockWriter { return NewConcurrentBlockWriter(output, 0, 0) }},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", writer.name, blockSize), func(b *testing.B) {
+				w := writer.new(io.Discard)
+				if err := w.WriteHeader(); err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(64 * blockSize))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := writeFile(w, "file", blockSize); err != nil {
+						b.Fatal(err)
+					}
+					if i%16 == 15 {
+						if err := w.WriteChecksum(); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+	}
+}
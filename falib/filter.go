@@ -0,0 +1,28 @@
+package falib
+
+import "os"
+
+// The result of an Archiver's Filter function for a single file or directory.
+type FilterDecision int
+
+const (
+	// Archive the entry normally; include patterns and other options still
+	// apply.
+	FilterInclude FilterDecision = iota
+	// Don't archive the entry.  An excluded directory is still scanned, and
+	// its directory entry is written only if something beneath it is
+	// archived, so that the archive can be extracted correctly.
+	FilterExclude
+	// Don't archive the entry, and don't scan beneath it if it's a
+	// directory.
+	FilterPrune
+)
+
+// A function deciding whether a path should be archived.  It receives the
+// path as it will be stored in the archive, and the result of Lstat on it.
+//
+// Filter functions are called concurrently from every directory scanner
+// goroutine (see Archiver.DirReaderCount), and so must be safe for concurrent
+// use.  They are called in the middle of directory scanning, so a slow filter
+// will slow down archiving.
+type Filter func(path string, info os.FileInfo) FilterDecision
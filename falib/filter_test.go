@@ -0,0 +1,50 @@
+package falib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFilterExcludedDirectories(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"skipped/a":          "a",
+		"skipped/deep/b":     "b",
+		"kept/c":             "c",
+		"kept/deep/keep.txt": "d",
+		"pruned/e":           "e",
+	})
+
+	// Directories are excluded, so they're only archived if a .txt file
+	// beneath them is.
+	a := NewArchiverTemplate()
+	a.Filter = func(path string, info os.FileInfo) FilterDecision {
+		if filepath.Base(path) == "pruned" {
+			return FilterPrune
+		} else if filepath.Ext(path) == ".txt" {
+			return FilterInclude
+		}
+		return FilterExclude
+	}
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := a.RunTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ExtractToMapLimit(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"tree", "tree/kept", "tree/kept/deep", "tree/kept/deep/keep.txt"}
+	if paths := entryPaths(entries); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("archived %v, expected %v", paths, expected)
+	}
+	if len(a.pendingDirs) != 0 {
+		t.Errorf("directories still pending after the run: %v", a.pendingDirs)
+	}
+}
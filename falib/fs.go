@@ -0,0 +1,138 @@
+package falib
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Creates an Archiver that reads from fsys rather than the operating
+// system's filesystem; see Archiver.FS.  output may be nil for an Archiver
+// that's only run with RunTo.
+func NewArchiverFS(output io.Writer, fsys fs.FS) *Archiver {
+	retval := NewArchiver(output)
+	retval.FS = fsys
+	return retval
+}
+
+// Converts a path built with filepath into the form fs.FS expects.
+func fsName(name string) string {
+	return filepath.ToSlash(filepath.Clean(name))
+}
+
+func (a *Archiver) openFile(fsFilePath string) (fs.File, error) {
+	if a.FS != nil {
+		return a.FS.Open(fsName(fsFilePath))
+	}
+	var file *os.File
+	var err error
+	if a.NoAtime {
+		file, err = openNoAtime(longPath(fsFilePath))
+	} else {
+		file, err = os.Open(longPath(fsFilePath))
+	}
+	if err != nil {
+		// Avoid returning a non-nil fs.File holding a nil *os.File.
+		return nil, err
+	}
+	return file, nil
+}
+
+func (a *Archiver) stat(fsFilePath string) (os.FileInfo, error) {
+	if a.FS != nil {
+		return fs.Stat(a.FS, fsName(fsFilePath))
+	}
+	return os.Stat(longPath(fsFilePath))
+}
+
+// Like stat, but doesn't follow symbolic links on the operating system's
+// filesystem.  fs.FS has no equivalent, so links are followed there.
+func (a *Archiver) lstat(fsFilePath string) (os.FileInfo, error) {
+	if a.FS != nil {
+		return fs.Stat(a.FS, fsName(fsFilePath))
+	}
+	return os.Lstat(longPath(fsFilePath))
+}
+
+// Returns the FileInfo for a directory entry.  On the operating system's
+// filesystem, the entry's Info is an lstat of the file; an fs.FS is stat'ed
+// instead, so that links are followed as they are by lstat.
+func (a *Archiver) entryInfo(entry fs.DirEntry, fsFilePath string) (os.FileInfo, error) {
+	if a.FS != nil {
+		return a.lstat(fsFilePath)
+	}
+	return entry.Info()
+}
+
+// Returns true if the scanner needs more than a directory entry's type to
+// decide what to do with it: its size, inode, or device, or a Filter that's
+// passed the FileInfo.
+func (a *Archiver) needsInfo(isDir bool) bool {
+	if a.Filter != nil {
+		return true
+	} else if isDir {
+		return a.OneFileSystem
+	}
+	return a.InodeOrder || a.MinFileSize > 0 || a.MaxFileSize > 0 ||
+		(a.LargeFileReaderCount > 0 && a.LargeFileThreshold > 0)
+}
+
+// Returns true, and counts the link as skipped, if SkipRootLinks is set and
+// a path passed to AddDir or AddFile is a symbolic link.  Links aren't
+// visible through an fs.FS, so none are skipped there.
+func (a *Archiver) skipRootLink(fsFilePath string, filePath string) bool {
+	if !a.SkipRootLinks || a.FS != nil {
+		return false
+	}
+	fileInfo, err := a.lstat(fsFilePath)
+	if err != nil || !isLink(fileInfo.Mode()) {
+		return false
+	}
+	a.log(PhaseScan).Verbose("skipping symbolic link", filePath)
+	atomic.AddInt64(&a.stats.SkippedSymlinks, 1)
+	return true
+}
+
+// Returns true if the file is the archive being written, or one of the
+// files it's being written to.  Only files with the same name as an output
+// are stat'ed, if they haven't been already.
+func (a *Archiver) isOutput(fsFilePath string, name string, fileInfo os.FileInfo) bool {
+	for _, outputInfo := range a.outputInfos {
+		if name != outputInfo.Name() {
+			continue
+		}
+		if fileInfo == nil {
+			var err error
+			fileInfo, err = a.lstat(fsFilePath)
+			if err != nil {
+				return false
+			}
+		}
+		if os.SameFile(fileInfo, outputInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the file's uid, gid, mode and attributes.
+func (a *Archiver) getModeOwnership(file fs.File, filePath string) (int, int, os.FileMode, uint32) {
+	fi, err := file.Stat()
+	if err != nil {
+		a.log(PhaseScan).Warning("file stat error; uid/gid/mode will be incorrect:", err.Error())
+		a.problems.add(filePath, "stat", err)
+		return 0, 0, 0, 0
+	}
+	return a.infoModeOwnership(fi, PhaseScan)
+}
+
+// Reads up to n entries from an open directory.
+func readDir(dir fs.File, n int) ([]fs.DirEntry, error) {
+	readDirFile, ok := dir.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: "", Err: ErrNotDirectory}
+	}
+	return readDirFile.ReadDir(n)
+}
@@ -0,0 +1,164 @@
+package falib
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Names of the directories version-control systems keep their metadata in,
+// skipped with ExcludeVCS.  Git also uses a .git file in worktrees and
+// submodules.
+var vcsNames = map[string]bool{
+	".git": true,
+	".hg":  true,
+	".svn": true,
+	".bzr": true,
+}
+
+const gitignoreName = ".gitignore"
+
+// The .gitignore rules in force in a directory, for ExcludeVCSIgnores: those
+// of its own .gitignore, after those of the directories above it, back to
+// the directory passed to AddDir.  A nil *gitignore ignores nothing.
+type gitignore struct {
+	rules []gitignoreRule
+}
+
+type gitignoreRule struct {
+	// The archive path of the directory whose .gitignore the rule is from,
+	// with forward slashes.
+	base string
+	// The pattern split on slashes, where "**" matches any number of path
+	// elements.  A pattern without a slash only matches the final element.
+	elements []string
+	anchored bool
+	negate   bool
+	dirOnly  bool
+}
+
+// Returns the rules in force beneath the directory at dirPath, adding those
+// read from its .gitignore to g's.  g itself is left unchanged, since it's
+// shared with the directory's siblings.
+func (g *gitignore) extend(dirPath string, r io.Reader) *gitignore {
+	var added []gitignoreRule
+	base := filepath.ToSlash(dirPath)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if rule, ok := parseGitignoreLine(base, scanner.Text()); ok {
+			added = append(added, rule)
+		}
+	}
+	if len(added) == 0 {
+		return g
+	}
+	retval := &gitignore{}
+	if g != nil {
+		retval.rules = append(retval.rules, g.rules...)
+	}
+	retval.rules = append(retval.rules, added...)
+	return retval
+}
+
+func parseGitignoreLine(base string, line string) (gitignoreRule, bool) {
+	rule := gitignoreRule{base: base}
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || line[0] == '#' {
+		return rule, false
+	}
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	rule.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return rule, false
+	}
+	rule.elements = strings.Split(line, "/")
+	return rule, true
+}
+
+// Returns true if the file or directory at filePath, an archive path beneath
+// every rule's base, is ignored.  As with git, the last matching rule wins.
+func (g *gitignore) ignored(filePath string, isDir bool) bool {
+	if g == nil {
+		return false
+	}
+	filePath = filepath.ToSlash(filePath)
+	retval := false
+	for _, rule := range g.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.matches(filePath) {
+			retval = !rule.negate
+		}
+	}
+	return retval
+}
+
+func (r gitignoreRule) matches(filePath string) bool {
+	if !r.anchored {
+		match, err := path.Match(r.elements[0], path.Base(filePath))
+		return err == nil && match
+	}
+	relative := filePath
+	if r.base != "." && r.base != "" {
+		relative = strings.TrimPrefix(filePath, r.base+"/")
+	}
+	return matchElements(r.elements, strings.Split(relative, "/"))
+}
+
+// Matches path elements against pattern elements, where "**" matches zero or
+// more elements.
+func matchElements(pattern []string, elements []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elements); i++ {
+				if matchElements(pattern[1:], elements[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elements) == 0 {
+			return false
+		}
+		match, err := path.Match(pattern[0], elements[0])
+		if err != nil || !match {
+			return false
+		}
+		pattern = pattern[1:]
+		elements = elements[1:]
+	}
+	return len(elements) == 0
+}
+
+// Reads the directory's .gitignore, if it has one, and returns the rules in
+// force beneath it.
+func (a *Archiver) readGitignore(fsDirectoryPath string, directoryPath string, parent *gitignore) *gitignore {
+	file, err := a.open(filepath.Join(fsDirectoryPath, gitignoreName), false, PhaseScan)
+	if err != nil {
+		return parent
+	}
+	defer a.closeFile(file)
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(file); err != nil {
+		a.log(PhaseScan).Warning("unable to read", filepath.Join(directoryPath, gitignoreName)+":", err.Error())
+		return parent
+	}
+	return parent.extend(directoryPath, &buf)
+}
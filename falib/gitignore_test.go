@@ -0,0 +1,141 @@
+package falib
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitignoreRules(t *testing.T) {
+	var root *gitignore
+	root = root.extend("repo", strings.NewReader("# comment\n\nbuild/\n*.log\n!keep.log\n/only-top\ndoc/**/*.txt\n"))
+	sub := root.extend(filepath.Join("repo", "src"), strings.NewReader("generated\n"))
+	tests := []struct {
+		g        *gitignore
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{root, "repo/build", true, true},
+		{root, "repo/build", false, false},
+		{root, "repo/a/b/build", true, true},
+		{root, "repo/debug.log", false, true},
+		{root, "repo/a/keep.log", false, false},
+		{root, "repo/only-top", false, true},
+		{root, "repo/a/only-top", false, false},
+		{root, "repo/doc/a/b/c.txt", false, true},
+		{root, "repo/doc/c.txt", false, true},
+		{root, "repo/other/doc/c.txt", false, false},
+		{root, "repo/src/generated", true, false},
+		{sub, "repo/src/generated", true, true},
+		{sub, "repo/src/x.log", false, true},
+		{nil, "repo/x.log", false, false},
+	}
+	for _, test := range tests {
+		if ignored := test.g.ignored(filepath.FromSlash(test.path), test.isDir); ignored != test.expected {
+			t.Errorf("%s (directory %v): ignored %v, expected %v", test.path, test.isDir, ignored, test.expected)
+		}
+	}
+}
+
+// Runs git in dir, skipping the test if git isn't installed.
+func runGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "commit.gpgsign=false"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, output)
+	}
+}
+
+func TestExcludeVCS(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		".gitignore":             "build/\n*.log\n!keep.log\n",
+		"build/out.o":            "object",
+		"src/main.go":            "package main",
+		"src/debug.log":          "log",
+		"src/keep.log":           "log",
+		"src/.gitignore":         "generated/\n",
+		"src/generated/x.go":     "package generated",
+		"lib/.hg/store/data":     "hg",
+		"lib/.svn/entries":       "svn",
+		"lib/file":               "file",
+		"sub/.git":               "gitdir: ../.git/modules/sub\n",
+		"sub/vendored/README.md": "readme",
+	})
+	runGit(t, dir, "init", "-q")
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "-q", "-m", "fixture")
+
+	kept := []string{
+		"repo", "repo/.gitignore", "repo/lib", "repo/lib/file", "repo/src", "repo/src/.gitignore",
+		"repo/src/keep.log", "repo/src/main.go", "repo/sub", "repo/sub/vendored", "repo/sub/vendored/README.md",
+	}
+	vcs := []string{"repo/.git", "repo/lib/.hg", "repo/lib/.svn", "repo/sub/.git"}
+	ignored := []string{"repo/build", "repo/src/debug.log", "repo/src/generated"}
+	tests := []struct {
+		excludeVCS        bool
+		excludeVCSIgnores bool
+		skippedVCS        int64
+		skippedGitignore  int64
+		absent            []string
+	}{
+		{false, false, 0, 0, nil},
+		{true, false, 4, 0, vcs},
+		{false, true, 0, 3, ignored},
+		{true, true, 4, 3, append(append([]string(nil), vcs...), ignored...)},
+	}
+	for _, test := range tests {
+		a := NewArchiverTemplate()
+		a.ExcludeVCS = test.excludeVCS
+		a.ExcludeVCSIgnores = test.excludeVCSIgnores
+		if err := a.AddDirAs(dir, "repo"); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := a.RunTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := ExtractToMapLimit(&buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("ExcludeVCS %v, ExcludeVCSIgnores %v", test.excludeVCS, test.excludeVCSIgnores)
+		for _, path := range kept {
+			if _, ok := entries[path]; !ok {
+				t.Errorf("%s: %s wasn't archived", name, path)
+			}
+		}
+		absent := make(map[string]bool)
+		for _, path := range test.absent {
+			absent[path] = true
+			if _, ok := entries[path]; ok {
+				t.Errorf("%s: %s was archived", name, path)
+			}
+		}
+		// Nothing beneath a skipped directory is archived either.
+		for path := range entries {
+			for skipped := range absent {
+				if strings.HasPrefix(path, skipped+"/") {
+					t.Errorf("%s: %s was archived beneath %s", name, path, skipped)
+				}
+			}
+		}
+		if _, ok := entries["repo/.git/HEAD"]; !ok && !test.excludeVCS {
+			t.Errorf("%s: the repository's .git/HEAD wasn't archived", name)
+		}
+		stats := a.Stats()
+		if stats.SkippedVCS != test.skippedVCS || stats.SkippedGitignore != test.skippedGitignore {
+			t.Errorf("%s: skipped %d for version control and %d for .gitignore, expected %d and %d",
+				name, stats.SkippedVCS, stats.SkippedGitignore, test.skippedVCS, test.skippedGitignore)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package falib
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Describes an entry found by Inspect.
+type EntryInfo struct {
+	Path  string
+	IsDir bool
+	EntryMeta
+	// Bytes of file data, and the number of data blocks holding it; 0 for
+	// directories.
+	Size   int64
+	Blocks int
+	// Byte offset in the archive of the entry's start or directory block,
+	// and of the end of its last block.
+	Offset    int64
+	EndOffset int64
+	// Set if the archive ended before the file's end block.
+	Truncated bool
+	// Key/value pairs stored with the entry; see Header.Metadata.
+	Metadata map[string]string
+}
+
+// Describes a whole archive inspected by Inspect.
+type ArchiveInfo struct {
+	// The format version, from the archive's header.
+	Version     int
+	Files       int
+	Directories int
+	// Entries whose paths aren't in Unicode NFC, and so may not match
+	// names created on most Linux systems; see Normalization.
+	NonNFCPaths int
+	// Bytes of file data in the archive.
+	DataSize int64
+	// Number of checksum blocks, all of which were verified, and the most
+	// blocks found before or between them.
+	Checksums        int
+	ChecksumInterval int
+	// Size of the archive in bytes.
+	Size int64
+	// Key/value pairs describing the archive; see Unarchiver.Metadata.
+	Metadata map[string]string
+}
+
+// Options for Inspect and InspectFunc.
+type InspectOptions struct {
+	// If set, backslashes in archive paths are treated as path separators;
+	// see Unarchiver.BackslashPaths.
+	BackslashPaths bool
+	// If set, called with the archive's metadata, if it has any, before any
+	// entries.  An error it returns stops the inspection and is returned.
+	ArchiveMetadata func(metadata map[string]string) error
+}
+
+// Reads a whole archive, verifying its checksums, and describes its entries
+// in the order they start in the archive.  Nothing is extracted.  For large
+// archives, InspectFunc avoids holding every entry in memory.
+func Inspect(r io.Reader, opts InspectOptions) ([]EntryInfo, ArchiveInfo, error) {
+	var entries []EntryInfo
+	info, err := InspectFunc(r, opts, func(entry EntryInfo) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	return entries, info, err
+}
+
+// Like Inspect, but calls fn with each entry as it's completed, rather than
+// returning them.  Archives written concurrently interleave their files, so
+// entries may be completed in a different order than they start.  An error
+// returned by fn stops the inspection and is returned.  The ArchiveInfo
+// describes the archive as far as it was read.
+func InspectFunc(r io.Reader, opts InspectOptions, fn func(EntryInfo) error) (ArchiveInfo, error) {
+	var info ArchiveInfo
+	reader := faformat.NewBlockReader(r)
+	err := reader.ReadHeader()
+	if err != nil {
+		return info, err
+	}
+	info.Version = reader.Version()
+
+	// Files whose end block hasn't been read yet, by path.
+	open := make(map[string]*EntryInfo)
+	var attributes, metadata *faformat.Block
+	blocksSinceChecksum := 0
+	for {
+		offset := reader.Offset()
+		b, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			info.Size = reader.Offset()
+			return info, err
+		}
+		if opts.BackslashPaths && strings.Contains(b.Path, "\\") {
+			b.Path = strings.Replace(b.Path, "\\", "/", -1)
+		}
+
+		previousAttributes, previousMetadata := attributes, metadata
+		attributes, metadata = nil, nil
+		if b.Type == faformat.BlockChecksum {
+			info.Checksums++
+			blocksSinceChecksum = 0
+		} else {
+			blocksSinceChecksum++
+			if blocksSinceChecksum > info.ChecksumInterval {
+				info.ChecksumInterval = blocksSinceChecksum
+			}
+		}
+
+		switch b.Type {
+		case faformat.BlockEntryMeta:
+			if b.Path != "" {
+				metadata = b
+			} else {
+				info.Metadata = b.Metadata
+				if opts.ArchiveMetadata != nil {
+					err = opts.ArchiveMetadata(b.Metadata)
+				}
+			}
+		case faformat.BlockAttributes:
+			attributes = b
+			// Entry metadata comes before the attributes.
+			metadata = previousMetadata
+		case faformat.BlockStartOfFile, faformat.BlockDirectory:
+			isDir := b.Type == faformat.BlockDirectory
+			entry := &EntryInfo{Path: b.Path, IsDir: isDir, EntryMeta: EntryMeta{b.Uid, b.Gid, b.Mode, 0}}
+			entry.Offset = offset
+			entry.EndOffset = reader.Offset()
+			if previousAttributes != nil && previousAttributes.Path == b.Path {
+				entry.Attributes = previousAttributes.Attributes
+			}
+			if previousMetadata != nil && previousMetadata.Path == b.Path {
+				entry.Metadata = previousMetadata.Metadata
+			}
+			if !norm.NFC.IsNormalString(b.Path) {
+				info.NonNFCPaths++
+			}
+			if !isDir {
+				open[b.Path] = entry
+				continue
+			}
+			info.Directories++
+			err = fn(*entry)
+		case faformat.BlockEndOfFile:
+			entry := open[b.Path]
+			if entry == nil {
+				continue
+			}
+			delete(open, b.Path)
+			entry.EndOffset = reader.Offset()
+			info.Files++
+			err = fn(*entry)
+		case faformat.BlockData, faformat.BlockDataAt:
+			if entry := open[b.Path]; entry != nil {
+				entry.Size += int64(len(b.Data))
+				entry.Blocks++
+				info.DataSize += int64(len(b.Data))
+			}
+		}
+		if err != nil {
+			info.Size = reader.Offset()
+			return info, err
+		}
+	}
+	info.Size = reader.Offset()
+
+	var truncated []*EntryInfo
+	for _, entry := range open {
+		truncated = append(truncated, entry)
+	}
+	sort.Slice(truncated, func(i, j int) bool { return truncated[i].Offset < truncated[j].Offset })
+	for _, entry := range truncated {
+		entry.Truncated = true
+		info.Files++
+		err = fn(*entry)
+		if err != nil {
+			return info, err
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,119 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+func TestInspect(t *testing.T) {
+	archive := writeRawArchive(t, false,
+		&faformat.Block{Path: "dir", Type: faformat.BlockDirectory, Mode: os.ModeDir | 0755, Uid: 1, Gid: 2},
+		&faformat.Block{Path: "dir/a", Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: "dir/b", Type: faformat.BlockStartOfFile, Mode: 0600},
+		&faformat.Block{Path: "dir/a", Type: faformat.BlockData, Data: []byte("alpha")},
+		&faformat.Block{Path: "dir/b", Type: faformat.BlockData, Data: []byte("bravo")},
+		&faformat.Block{Path: "dir/b", Type: faformat.BlockEndOfFile},
+		&faformat.Block{Path: "dir/a", Type: faformat.BlockData, Data: []byte("bet")},
+		&faformat.Block{Path: "dir/a", Type: faformat.BlockEndOfFile},
+		&faformat.Block{Path: "empty", Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: "empty", Type: faformat.BlockEndOfFile})
+
+	entries, info, err := Inspect(bytes.NewReader(archive), InspectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		path   string
+		isDir  bool
+		mode   os.FileMode
+		size   int64
+		blocks int
+	}{
+		{"dir", true, os.ModeDir | 0755, 0, 0},
+		{"dir/a", false, 0644, 8, 2},
+		{"dir/b", false, 0600, 5, 1},
+		{"empty", false, 0644, 0, 0},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("inspected %d entries, expected %d", len(entries), len(expected))
+	}
+	for i, e := range expected {
+		entry := entries[i]
+		if entry.Path != e.path || entry.IsDir != e.isDir || entry.Mode != e.mode || entry.Size != e.size || entry.Blocks != e.blocks || entry.Truncated {
+			t.Errorf("entry %d is %+v, expected %+v", i, entry, e)
+		}
+		if entry.EndOffset <= entry.Offset || entry.EndOffset > int64(len(archive)) {
+			t.Errorf("%s runs from %d to %d in an archive of %d bytes", entry.Path, entry.Offset, entry.EndOffset, len(archive))
+		}
+		if i > 0 && entry.Offset <= entries[i-1].Offset {
+			t.Errorf("%s starts at %d, not after %s at %d", entry.Path, entry.Offset, entries[i-1].Path, entries[i-1].Offset)
+		}
+	}
+	if entries[0].Uid != 1 || entries[0].Gid != 2 {
+		t.Errorf("dir owned by %d:%d, expected 1:2", entries[0].Uid, entries[0].Gid)
+	}
+	// a ends after b, though it starts before it.
+	if entries[1].EndOffset <= entries[2].EndOffset {
+		t.Errorf("dir/a ends at %d, before dir/b at %d", entries[1].EndOffset, entries[2].EndOffset)
+	}
+
+	if info.Version != faformat.Version || info.Files != 3 || info.Directories != 1 || info.DataSize != 13 {
+		t.Errorf("archive described as %+v", info)
+	}
+	// Every block but the header is before the one checksum.
+	if info.Checksums != 1 || info.ChecksumInterval != 10 {
+		t.Errorf("%d checksums at most %d blocks apart, expected 1 after 10", info.Checksums, info.ChecksumInterval)
+	}
+	if info.Size != int64(len(archive)) {
+		t.Errorf("archive size is %d, expected %d", info.Size, len(archive))
+	}
+}
+
+func TestInspectTruncatedFile(t *testing.T) {
+	archive := writeRawArchive(t, false,
+		&faformat.Block{Path: "complete", Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: "complete", Type: faformat.BlockEndOfFile},
+		&faformat.Block{Path: "cut", Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: "cut", Type: faformat.BlockData, Data: []byte("data")})
+	entries, info, err := Inspect(bytes.NewReader(archive), InspectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Truncated || !entries[1].Truncated || entries[1].Size != 4 {
+		t.Errorf("inspected %+v, expected cut to be truncated after 4 bytes", entries)
+	}
+	if info.Files != 2 {
+		t.Errorf("%d files counted, expected 2", info.Files)
+	}
+
+	// An archive cut off part way through a block reports what was
+	// completed before it.
+	var completed []string
+	_, err = InspectFunc(bytes.NewReader(archive[:len(archive)-20]), InspectOptions{}, func(entry EntryInfo) error {
+		completed = append(completed, entry.Path)
+		return nil
+	})
+	if err == nil {
+		t.Error("inspecting an archive cut off part way through a block succeeded")
+	}
+	if len(completed) != 1 || completed[0] != "complete" {
+		t.Errorf("completed %q before the archive ended, expected only complete", completed)
+	}
+}
+
+func TestInspectFuncStops(t *testing.T) {
+	archive := writeArchive(t, "a", "1", "b", "2", "c", "3")
+	stop := errors.New("stop")
+	calls := 0
+	_, err := InspectFunc(bytes.NewReader(archive), InspectOptions{}, func(entry EntryInfo) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("InspectFunc returned %v after %d calls, expected the callback's error after 1", err, calls)
+	}
+}
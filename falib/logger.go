@@ -1,6 +1,254 @@
 package falib
 
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
 type Logger interface {
 	Verbose(v ...interface{})
 	Warning(v ...interface{})
 }
+
+// Optionally implemented by a Logger to handle the verbose message naming
+// each file and directory as it's archived or extracted.  Otherwise, the
+// path is passed to Verbose.
+type EntryLogger interface {
+	Logger
+	Entry(path string, isDir bool)
+}
+
+// The phase of a run that a message comes from.
+type Phase int
+
+const (
+	// The directory scanners, finding what to archive.
+	PhaseScan Phase = iota + 1
+	// The file readers.
+	PhaseRead
+	// Writing the archive.
+	PhaseWrite
+	// Reading an archive and extracting its contents.
+	PhaseExtract
+)
+
+var phaseNames = map[Phase]string{PhaseScan: "scan", PhaseRead: "read", PhaseWrite: "write", PhaseExtract: "extract"}
+
+func (p Phase) String() string {
+	return phaseNames[p]
+}
+
+// Optionally implemented by a Logger to be told which phase of the run each
+// message comes from.  Archivers and Unarchivers call these methods instead
+// of Verbose and Warning when they're available.
+type PhaseLogger interface {
+	Logger
+	PhaseVerbose(phase Phase, v ...interface{})
+	PhaseWarning(phase Phase, v ...interface{})
+}
+
+// Returns a Logger that passes phase along to l, if it's a PhaseLogger.
+func phaseLogger(l Logger, phase Phase) Logger {
+	if phased, ok := l.(PhaseLogger); ok {
+		return phasedLogger{phased, phase}
+	}
+	return l
+}
+
+type phasedLogger struct {
+	logger PhaseLogger
+	phase  Phase
+}
+
+func (l phasedLogger) Verbose(v ...interface{}) { l.logger.PhaseVerbose(l.phase, v...) }
+func (l phasedLogger) Warning(v ...interface{}) { l.logger.PhaseWarning(l.phase, v...) }
+
+func (l phasedLogger) Entry(path string, isDir bool) {
+	if entryLogger, ok := l.logger.(EntryLogger); ok {
+		entryLogger.Entry(path, isDir)
+	} else {
+		l.Verbose(path)
+	}
+}
+
+// Returns the Archiver's Logger, passing phase along to it.
+func (a *Archiver) log(phase Phase) Logger {
+	return phaseLogger(a.Logger, phase)
+}
+
+// Returns the Unarchiver's Logger, passing PhaseExtract along to it.
+func (u *Unarchiver) log() Logger {
+	return phaseLogger(u.Logger, PhaseExtract)
+}
+
+func logEntry(l Logger, path string, isDir bool) {
+	if entryLogger, ok := l.(EntryLogger); ok {
+		entryLogger.Entry(path, isDir)
+	} else {
+		l.Verbose(path)
+	}
+}
+
+// A Logger that discards everything.  Archivers and Unarchivers use it until
+// another Logger is assigned.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Verbose(v ...interface{}) {}
+func (nopLogger) Warning(v ...interface{}) {}
+
+// Returns a Logger that writes warnings, and verbose messages if verbose is
+// set, to w, one per line.  Strings and errors among the arguments are
+// escaped with Quote, so that unusual file names can't corrupt the output.
+func StdLogger(w io.Writer, verbose bool) Logger {
+	return &stdLogger{log.New(w, "", 0), verbose, true}
+}
+
+// Like StdLogger, but writes the arguments exactly as they are, for output
+// that's read by tools expecting raw file names.
+func RawStdLogger(w io.Writer, verbose bool) Logger {
+	return &stdLogger{log.New(w, "", 0), verbose, false}
+}
+
+type stdLogger struct {
+	logger  *log.Logger
+	verbose bool
+	quote   bool
+}
+
+func (l *stdLogger) Verbose(v ...interface{}) {
+	if l.verbose {
+		l.logger.Println(l.args(v)...)
+	}
+}
+
+func (l *stdLogger) Warning(v ...interface{}) {
+	l.logger.Println(l.args(v)...)
+}
+
+func (l *stdLogger) args(v []interface{}) []interface{} {
+	if !l.quote {
+		return v
+	}
+	retval := make([]interface{}, len(v))
+	for i, arg := range v {
+		switch arg := arg.(type) {
+		case string:
+			retval[i] = Quote(arg)
+		case error:
+			retval[i] = Quote(arg.Error())
+		default:
+			retval[i] = arg
+		}
+	}
+	return retval
+}
+
+// Returns a Logger that prefixes each message to l with the time, in RFC
+// 3339 form, and the phase of the run it comes from, if it's known, eg.
+// "2024-06-01T02:03:04Z [read] file open error: ...".
+func TimestampLogger(l Logger) Logger {
+	return &timestampLogger{l}
+}
+
+type timestampLogger struct {
+	logger Logger
+}
+
+func (l *timestampLogger) Verbose(v ...interface{}) { l.PhaseVerbose(0, v...) }
+func (l *timestampLogger) Warning(v ...interface{}) { l.PhaseWarning(0, v...) }
+
+func (l *timestampLogger) PhaseVerbose(phase Phase, v ...interface{}) {
+	l.logger.Verbose(l.prefix(phase, v)...)
+}
+
+func (l *timestampLogger) PhaseWarning(phase Phase, v ...interface{}) {
+	l.logger.Warning(l.prefix(phase, v)...)
+}
+
+func (l *timestampLogger) prefix(phase Phase, v []interface{}) []interface{} {
+	prefix := time.Now().Format(time.RFC3339)
+	if phase != 0 {
+		prefix += " [" + phase.String() + "]"
+	}
+	return append([]interface{}{prefix}, v...)
+}
+
+// A Logger that, rather than naming every file and directory, reports how
+// many there have been, the rate and the current directory at most once per
+// interval.  Other messages are passed to the Logger it wraps, and so are
+// the reports, as verbose messages.
+type ProgressLogger struct {
+	Logger
+	interval time.Duration
+
+	lock       sync.Mutex
+	started    time.Time
+	lastReport time.Time
+	lastCount  int64
+	files      int64
+	dirs       int64
+	current    string
+}
+
+func NewProgressLogger(logger Logger, interval time.Duration) *ProgressLogger {
+	retval := &ProgressLogger{}
+	retval.Logger = logger
+	retval.interval = interval
+	retval.started = time.Now()
+	retval.lastReport = retval.started
+	return retval
+}
+
+// Passes the phase to the Logger it wraps, if it's a PhaseLogger.
+func (l *ProgressLogger) PhaseVerbose(phase Phase, v ...interface{}) {
+	phaseLogger(l.Logger, phase).Verbose(v...)
+}
+
+func (l *ProgressLogger) PhaseWarning(phase Phase, v ...interface{}) {
+	phaseLogger(l.Logger, phase).Warning(v...)
+}
+
+func (l *ProgressLogger) Entry(entryPath string, isDir bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if isDir {
+		l.dirs++
+		l.current = entryPath
+	} else {
+		l.files++
+		l.current = path.Dir(entryPath)
+	}
+	now := time.Now()
+	if now.Sub(l.lastReport) >= l.interval {
+		l.Logger.Verbose(l.counts(now.Sub(l.lastReport), l.files+l.dirs-l.lastCount)+"; in", l.current)
+		l.lastReport = now
+		l.lastCount = l.files + l.dirs
+	}
+}
+
+// Reports the totals for the whole run; call it once the run has finished.
+func (l *ProgressLogger) Finish() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	elapsed := time.Since(l.started)
+	l.Logger.Verbose(l.counts(elapsed, l.files+l.dirs) + fmt.Sprintf("; %.1fs in total", elapsed.Seconds()))
+}
+
+// Describes the counts so far, and the rate of count entries in elapsed.
+// Must be called with lock held.
+func (l *ProgressLogger) counts(elapsed time.Duration, count int64) string {
+	counts := fmt.Sprintf("%d files", l.files)
+	if l.dirs > 0 {
+		counts += fmt.Sprintf(", %d directories", l.dirs)
+	}
+	if elapsed > 0 {
+		counts += fmt.Sprintf(", %.0f/s", float64(count)/elapsed.Seconds())
+	}
+	return counts
+}
@@ -0,0 +1,213 @@
+package falib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestProgressLogger(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("dir%d/file%d", i%5, i)] = "data"
+	}
+	writeTree(t, dir, files)
+
+	archive := func(interval time.Duration) []string {
+		var buf bytes.Buffer
+		progress := NewProgressLogger(StdLogger(&buf, true), interval)
+		a := NewArchiverTemplate()
+		a.Logger = progress
+		if err := a.AddDirAs(dir, "tree"); err != nil {
+			t.Fatal(err)
+		}
+		a.AddFileAs(filepath.Join(dir, "missing"), "missing")
+		if err := a.RunTo(io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		progress.Finish()
+		return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	}
+
+	// Only the warning and the totals, rather than a line per entry.  The
+	// missing file counts, since it's reported as it's opened.
+	lines := archive(time.Hour)
+	if len(lines) != 2 || !strings.Contains(lines[0], "missing") || !strings.HasPrefix(lines[1], "51 files, 6 directories") {
+		t.Errorf("logged %q, expected a warning and the totals", lines)
+	}
+	// With no interval, every entry is reported, with the directory it's in.
+	lines = archive(0)
+	reports := 0
+	for _, line := range lines {
+		if strings.Contains(line, "; in ") {
+			reports++
+		}
+	}
+	if reports != 57 || !strings.HasPrefix(lines[len(lines)-1], "51 files, 6 directories") {
+		t.Errorf("logged %d reports, ending %q; expected one per entry, and the totals", reports, lines[len(lines)-1])
+	}
+}
+
+// Archives 10,000 empty files, logging to an OS pipe, as -v and
+// -verbose-summary do on stderr.
+func BenchmarkVerboseOutput(b *testing.B) {
+	dir := b.TempDir()
+	for i := 0; i < 10000; i++ {
+		if i%100 == 0 {
+			if err := os.Mkdir(filepath.Join(dir, fmt.Sprint(i/100)), 0755); err != nil {
+				b.Fatal(err)
+			}
+		}
+		file, err := os.Create(filepath.Join(dir, fmt.Sprint(i/100), fmt.Sprint(i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		file.Close()
+	}
+
+	for _, test := range []struct {
+		name   string
+		logger func(w io.Writer) Logger
+	}{
+		{"none", func(w io.Writer) Logger { return NopLogger }},
+		{"every entry", func(w io.Writer) Logger { return StdLogger(w, true) }},
+		{"summary", func(w io.Writer) Logger { return NewProgressLogger(StdLogger(w, true), 5*time.Second) }},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer r.Close()
+			go io.Copy(io.Discard, r)
+			a := NewArchiverTemplate()
+			a.Logger = test.logger(w)
+			if err := a.AddDirAs(dir, "tree"); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := a.RunTo(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			w.Close()
+		})
+	}
+}
+
+// A Logger that records the phase each message was passed with.
+type phaseRecorder struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (r *phaseRecorder) Verbose(v ...interface{}) { r.PhaseVerbose(0, v...) }
+func (r *phaseRecorder) Warning(v ...interface{}) { r.PhaseWarning(0, v...) }
+
+func (r *phaseRecorder) PhaseVerbose(phase Phase, v ...interface{}) {}
+
+func (r *phaseRecorder) PhaseWarning(phase Phase, v ...interface{}) {
+	r.lock.Lock()
+	r.messages = append(r.messages, fmt.Sprintf("%s: %s", phase, fmt.Sprint(v...)))
+	r.lock.Unlock()
+}
+
+// A filesystem in which the named files and directories can't be opened.
+type unopenableFS struct {
+	fstest.MapFS
+	names map[string]bool
+}
+
+func (fsys unopenableFS) Open(name string) (fs.File, error) {
+	if fsys.names[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return fsys.MapFS.Open(name)
+}
+
+func TestWarningPhases(t *testing.T) {
+	fsys := unopenableFS{fstest.MapFS{
+		"root/ok":          &fstest.MapFile{Data: []byte("data")},
+		"root/secret":      &fstest.MapFile{Data: []byte("data")},
+		"root/private/key": &fstest.MapFile{Data: []byte("data")},
+	}, map[string]bool{"root/secret": true, "root/private": true}}
+	recorder := &phaseRecorder{}
+	a := NewArchiverTemplate()
+	a.FS = fsys
+	a.Logger = recorder
+	if err := a.AddDir("root"); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+	var scan, read int
+	for _, message := range recorder.messages {
+		if strings.HasPrefix(message, "scan: ") && strings.Contains(message, "root/private") {
+			scan++
+		} else if strings.HasPrefix(message, "read: ") && strings.Contains(message, "root/secret") {
+			read++
+		} else {
+			t.Errorf("unexpected warning %q", message)
+		}
+	}
+	if scan != 1 || read != 1 {
+		t.Errorf("warned %q, expected one from the scan and one from the reads", recorder.messages)
+	}
+
+	recorder = &phaseRecorder{}
+	u := NewUnarchiverWithSink(&archive, failingSink{})
+	u.Logger = recorder
+	u.Run()
+	if len(recorder.messages) == 0 {
+		t.Error("no warnings from a sink that can't create files")
+	}
+	for _, message := range recorder.messages {
+		if !strings.HasPrefix(message, "extract: ") {
+			t.Errorf("warning %q not from the extract phase", message)
+		}
+	}
+}
+
+// A sink that can't create any file.
+type failingSink struct {
+	nopSink
+}
+
+func (failingSink) CreateFile(path string, meta EntryMeta) (io.WriteCloser, error) {
+	return nil, &os.PathError{Op: "create", Path: path, Err: os.ErrPermission}
+}
+
+func TestTimestampLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := TimestampLogger(StdLogger(&buf, true))
+	l.Warning("plain")
+	phaseLogger(l, PhaseRead).Warning("file open error:", "a")
+	phaseLogger(l, PhaseExtract).Verbose("b")
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	expected := []string{"plain", "[read] file open error: a", "[extract] b"}
+	if len(lines) != len(expected) {
+		t.Fatalf("logged %q, expected %d lines", buf.String(), len(expected))
+	}
+	for i, line := range lines {
+		stamp, rest, _ := strings.Cut(line, " ")
+		if _, err := time.Parse(time.RFC3339, stamp); err != nil {
+			t.Errorf("line %q doesn't start with an RFC 3339 time: %v", line, err)
+		}
+		if rest != expected[i] {
+			t.Errorf("logged %q after the time, expected %q", rest, expected[i])
+		}
+	}
+}
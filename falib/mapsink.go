@@ -0,0 +1,105 @@
+package falib
+
+import (
+	"io"
+	"sync"
+)
+
+// A file or directory extracted by ExtractToMap.  Data is nil for directories.
+type Entry struct {
+	EntryMeta
+	Data []byte
+}
+
+// Default limit on the total size of the files extracted by ExtractToMap.
+const DefaultExtractToMapLimit = 64 << 20
+
+// Extracts an archive into memory, returning each entry by its path in the
+// archive.  Fails with ErrExtractLimit if the files total more than
+// DefaultExtractToMapLimit bytes.
+func ExtractToMap(r io.Reader) (map[string]Entry, error) {
+	return ExtractToMapLimit(r, DefaultExtractToMapLimit)
+}
+
+// Like ExtractToMap, but with a limit of maxSize bytes in total; 0 means no
+// limit other than memory, so a file archived in ranges can make it allocate
+// up to the largest offset the archive names.  Offsets are checked against
+// the limit before anything is allocated for them.
+func ExtractToMapLimit(r io.Reader, maxSize int64) (map[string]Entry, error) {
+	sink := &mapSink{entries: make(map[string]Entry), maxSize: maxSize}
+	unarchiver := NewUnarchiverWithSink(r, sink)
+	unarchiver.ErrorPolicy = FailFast
+	err := unarchiver.Run()
+	if err != nil {
+		return nil, err
+	}
+	return sink.entries, nil
+}
+
+type mapSink struct {
+	lock    sync.Mutex
+	entries map[string]Entry
+	maxSize int64
+	size    int64
+}
+
+func (s *mapSink) CreateDir(path string, meta EntryMeta) error {
+	s.lock.Lock()
+	s.entries[path] = Entry{meta, nil}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *mapSink) CreateFile(path string, meta EntryMeta) (io.WriteCloser, error) {
+	return &mapFile{sink: s, path: path, meta: meta}, nil
+}
+
+// Reserves n more bytes of the size limit.
+func (s *mapSink) grow(n int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.maxSize > 0 && n > s.maxSize-s.size {
+		return ErrExtractLimit
+	}
+	s.size += n
+	return nil
+}
+
+type mapFile struct {
+	sink *mapSink
+	path string
+	meta EntryMeta
+	data []byte
+}
+
+func (f *mapFile) Write(buf []byte) (int, error) {
+	return f.WriteAt(buf, int64(len(f.data)))
+}
+
+// The largest slice length; a file can't be held in memory beyond it.
+const maxSliceLen = int64(^uint(0) >> 1)
+
+func (f *mapFile) WriteAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 || offset > maxSliceLen-int64(len(buf)) {
+		return 0, ErrDataOffsetRange
+	}
+	end := offset + int64(len(buf))
+	if end > int64(len(f.data)) {
+		err := f.sink.grow(end - int64(len(f.data)))
+		if err != nil {
+			return 0, err
+		}
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[offset:], buf), nil
+}
+
+func (f *mapFile) Close() error {
+	if f.data == nil {
+		f.data = []byte{}
+	}
+	f.sink.lock.Lock()
+	f.sink.entries[f.path] = Entry{f.meta, f.data}
+	f.sink.lock.Unlock()
+	return nil
+}
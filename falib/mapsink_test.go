@@ -0,0 +1,74 @@
+package falib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+func TestMapFileOffsets(t *testing.T) {
+	sink := &mapSink{entries: make(map[string]Entry), maxSize: 1 << 20}
+	f := &mapFile{sink: sink, path: "f"}
+	for _, offset := range []int64{-8, math.MaxInt64 - 2} {
+		if _, err := f.WriteAt([]byte("data"), offset); !errors.Is(err, ErrDataOffsetRange) {
+			t.Errorf("writing at %d gave %v, expected ErrDataOffsetRange", offset, err)
+		}
+	}
+
+	// Beyond the limit, nothing is allocated, even where the size limit's
+	// arithmetic would overflow.
+	for _, offset := range []int64{1 << 20, 1 << 40, math.MaxInt64 - 4} {
+		if _, err := f.WriteAt([]byte("data"), offset); !errors.Is(err, ErrExtractLimit) {
+			t.Errorf("writing at %d gave %v, expected ErrExtractLimit", offset, err)
+		}
+	}
+	if len(f.data) != 0 || sink.size != 0 {
+		t.Errorf("rejected writes grew the file to %d bytes, and the sink to %d", len(f.data), sink.size)
+	}
+
+	if _, err := f.WriteAt([]byte("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.data) != "\x00\x00\x00\x00data" || sink.size != 8 {
+		t.Errorf("file is %q, with %d bytes reserved", f.data, sink.size)
+	}
+}
+
+// A version 4 archive with a file whose only data block is at offset, which
+// the writer refuses to write.
+func craftedDataAtArchive(offset uint64) []byte {
+	var buf bytes.Buffer
+	w := faformat.NewBlockWriter(&buf)
+	w.EnableDataAt()
+	w.WriteHeader()
+	w.WriteBlock(&faformat.Block{Path: "f", Type: faformat.BlockStartOfFile, Mode: 0644})
+	w.WriteBlock(&faformat.Block{Path: "f", Type: faformat.BlockDataAt, Data: []byte("12345678")})
+	archive := buf.Bytes()
+	// The offset comes before the data and its length.
+	binary.BigEndian.PutUint64(archive[len(archive)-8-2-8:], offset)
+	return archive
+}
+
+func TestCraftedDataAtOffset(t *testing.T) {
+	for _, offset := range []uint64{1 << 63, math.MaxUint64 - 7} {
+		archive := craftedDataAtArchive(offset)
+		if _, err := ExtractToMapLimit(bytes.NewReader(archive), 0); !errors.Is(err, ErrDataOffsetRange) {
+			t.Errorf("extracting offset %#x gave %v, expected ErrDataOffsetRange", offset, err)
+		}
+
+		r := NewReader(bytes.NewReader(archive))
+		if _, err := r.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r); !errors.Is(err, ErrDataOffsetRange) {
+			t.Errorf("reading offset %#x gave %v, expected ErrDataOffsetRange", offset, err)
+		}
+		r.Close()
+	}
+}
@@ -0,0 +1,115 @@
+package falib
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Prepares a list of patterns for matching, case-folding them if requested.
+func foldPatterns(patterns []string, caseInsensitive bool) []string {
+	retval := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		if caseInsensitive {
+			pattern = strings.ToLower(pattern)
+		}
+		retval = append(retval, pattern)
+	}
+	return retval
+}
+
+// Splits exclude patterns, prepared by foldPatterns, by how they're applied.
+// A pattern with a trailing slash matches only directories, and is returned
+// without the slash in dirPatterns; the rest are returned in patterns.  Of
+// those, a pattern ending in "/*" or "/**" matches everything in the
+// directories matching the rest of the pattern, which is returned in
+// contentsPatterns, so that those directories needn't be read at all.
+func splitExcludePatterns(excludes []string) (patterns []string, dirPatterns []string, contentsPatterns []string) {
+	for _, pattern := range excludes {
+		if strings.HasSuffix(pattern, "/") {
+			if pattern = strings.TrimRight(pattern, "/"); pattern != "" {
+				dirPatterns = append(dirPatterns, pattern)
+			}
+			continue
+		}
+		patterns = append(patterns, pattern)
+		for _, suffix := range []string{"/**", "/*"} {
+			if strings.HasSuffix(pattern, suffix) {
+				contentsPatterns = append(contentsPatterns, strings.TrimSuffix(pattern, suffix))
+				break
+			}
+		}
+	}
+	return
+}
+
+// Checks whether the complete filePath, rather than just its final element,
+// matches any of the given patterns.
+func matchesPathAny(patterns []string, filePath string, caseInsensitive bool) bool {
+	if caseInsensitive {
+		filePath = strings.ToLower(filePath)
+	}
+	for _, pattern := range patterns {
+		match, err := filepath.Match(pattern, filePath)
+		if err == nil && match {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether filePath matches any of the given patterns.  A pattern
+// matches the complete path, or with baseNames, just its final element, so
+// that simple patterns like "core.*" work at any depth.  Patterns are
+// expected to have been prepared by foldPatterns.
+func matchesAny(patterns []string, filePath string, caseInsensitive bool, baseNames bool) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	if caseInsensitive {
+		filePath = strings.ToLower(filePath)
+	}
+	fileName := filepath.Base(filePath)
+	for _, pattern := range patterns {
+		match, err := filepath.Match(pattern, filePath)
+		if err == nil && match {
+			return true
+		}
+		if baseNames {
+			match, err = filepath.Match(pattern, fileName)
+			if err == nil && match {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const cacheDirTagName = "CACHEDIR.TAG"
+
+// Every CACHEDIR.TAG file must begin with this signature to be considered
+// valid; see http://www.brynosaurus.com/cachedir/spec.html
+var cacheDirTagSignature = []byte("Signature: 8a477f597d28d172789f06886806bc55")
+
+// Checks whether the given directory has been tagged as a cache directory.
+func (a *Archiver) isCacheDir(directoryPath string) bool {
+	file, err := a.open(filepath.Join(directoryPath, cacheDirTagName), false, PhaseScan)
+	if err != nil {
+		return false
+	}
+	defer a.closeFile(file)
+
+	buf := make([]byte, len(cacheDirTagSignature))
+	_, err = io.ReadFull(file, buf)
+	return err == nil && bytes.Equal(buf, cacheDirTagSignature)
+}
+
+// Checks whether the given directory contains the named ignore marker file.
+func (a *Archiver) hasIgnoreMarker(directoryPath string, marker string) bool {
+	_, err := a.lstat(filepath.Join(directoryPath, marker))
+	return err == nil
+}
@@ -0,0 +1,251 @@
+package falib
+
+import (
+	"bytes"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMatchesAny(t *testing.T) {
+	tests := []struct {
+		pattern         string
+		filePath        string
+		caseInsensitive bool
+		baseNames       bool
+		expected        bool
+	}{
+		{"core.*", "core.1", false, false, true},
+		{"core.*", "a/core.1", false, false, false},
+		{"core.*", "a/core.1", false, true, true},
+		{"*/core.*", "a/core.1", false, false, true},
+		{"Thumbs.db", "a/THUMBS.DB", false, true, false},
+		{"Thumbs.db", "a/THUMBS.DB", true, true, true},
+		{"Thumbs.db", "a/THUMBS.DB", true, false, false},
+		{"a/thumbs.db", "A/Thumbs.db", true, false, true},
+	}
+	for _, test := range tests {
+		patterns := foldPatterns([]string{filepath.FromSlash(test.pattern)}, test.caseInsensitive)
+		match := matchesAny(patterns, filepath.FromSlash(test.filePath), test.caseInsensitive, test.baseNames)
+		if match != test.expected {
+			t.Errorf("%q against %q (case-insensitive %v, base names %v): %v, expected %v",
+				test.pattern, test.filePath, test.caseInsensitive, test.baseNames, match, test.expected)
+		}
+	}
+}
+
+// Returns the sorted paths of the entries.
+func entryPaths(entries map[string]Entry) []string {
+	var retval []string
+	for path := range entries {
+		retval = append(retval, path)
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+func TestExcludeMatchesWholePathByDefault(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"core.1": "", "a/core.2": "", "a/b": ""})
+
+	for _, baseNames := range []bool{false, true} {
+		a := NewArchiverTemplate()
+		a.ExcludePatterns = []string{"core.*"}
+		a.MatchBaseNames = baseNames
+		if err := a.AddDirContentsAs(dir, "."); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := a.RunTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := ExtractToMapLimit(&buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"a", "a/b", "a/core.2"}
+		if baseNames {
+			expected = []string{"a", "a/b"}
+		}
+		if paths := entryPaths(entries); !reflect.DeepEqual(paths, expected) {
+			t.Errorf("MatchBaseNames %v: archived %v, expected %v", baseNames, paths, expected)
+		}
+	}
+}
+
+func TestExtractSelection(t *testing.T) {
+	dir := t.TempDir()
+	if insensitive, _ := caseInsensitiveDir(dir); insensitive {
+		t.Skip("needs a case-sensitive filesystem")
+	}
+	writeTree(t, dir, map[string]string{
+		"etc/app.conf":       "conf",
+		"etc/APP.CONF":       "upper",
+		"etc/init/x":         "x",
+		"data/Thumbs.db":     "thumbs",
+		"data/sub/THUMBS.DB": "thumbs",
+		"data/sub/photo":     "photo",
+		"empty/":             "",
+	})
+	a := NewArchiverTemplate()
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		setup    func(u *Unarchiver)
+		expected []string
+	}{
+		{"include", func(u *Unarchiver) {
+			u.IncludePatterns = []string{"tree/etc/*.conf"}
+		}, []string{"tree", "tree/etc", "tree/etc/app.conf"}},
+		{"include ignoring case", func(u *Unarchiver) {
+			u.IncludePatterns = []string{"tree/etc/*.conf"}
+			u.MatchCaseInsensitive = true
+		}, []string{"tree", "tree/etc", "tree/etc/APP.CONF", "tree/etc/app.conf"}},
+		{"include directory", func(u *Unarchiver) {
+			u.IncludePatterns = []string{"tree/etc/init"}
+		}, []string{"tree", "tree/etc", "tree/etc/init", "tree/etc/init/x"}},
+		{"exclude base names ignoring case", func(u *Unarchiver) {
+			u.ExcludePatterns = []string{"thumbs.db", "tree/etc", "empty/"}
+			u.MatchCaseInsensitive = true
+			u.MatchBaseNames = true
+		}, []string{"tree", "tree/data", "tree/data/sub", "tree/data/sub/photo"}},
+		{"exclude is case-sensitive by default", func(u *Unarchiver) {
+			u.ExcludePatterns = []string{"tree/data/*/thumbs.db", "tree/etc", "tree/empty"}
+		}, []string{"tree", "tree/data", "tree/data/Thumbs.db", "tree/data/sub", "tree/data/sub/THUMBS.DB", "tree/data/sub/photo"}},
+	}
+	for _, test := range tests {
+		sink := &mapSink{entries: make(map[string]Entry)}
+		u := NewUnarchiverWithSink(bytes.NewReader(archive.Bytes()), sink)
+		u.ErrorPolicy = FailFast
+		test.setup(u)
+		if err := u.Run(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if paths := entryPaths(sink.entries); !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%s: extracted %v, expected %v", test.name, paths, test.expected)
+		}
+	}
+}
+
+// A filesystem that records the directories read from it.
+type readRecordingFS struct {
+	fstest.MapFS
+	lock sync.Mutex
+	read []string
+}
+
+type readRecordingDir struct {
+	fs.ReadDirFile
+	fsys *readRecordingFS
+	name string
+}
+
+func (d readRecordingDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.fsys.lock.Lock()
+	d.fsys.read = append(d.fsys.read, d.name)
+	d.fsys.lock.Unlock()
+	return d.ReadDirFile.ReadDir(n)
+}
+
+func (fsys *readRecordingFS) Open(name string) (fs.File, error) {
+	file, err := fsys.MapFS.Open(name)
+	if dir, ok := file.(fs.ReadDirFile); ok && err == nil {
+		return readRecordingDir{dir, fsys, name}, nil
+	}
+	return file, err
+}
+
+// Returns true if the directory was read.
+func (fsys *readRecordingFS) wasRead(name string) bool {
+	fsys.lock.Lock()
+	defer fsys.lock.Unlock()
+	for _, read := range fsys.read {
+		if read == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExcludePrunesDirectories(t *testing.T) {
+	tests := []struct {
+		patterns  []string
+		baseNames bool
+		expected  []string
+		// Directories that are excluded, or archived empty, without being
+		// read.
+		unread []string
+	}{
+		// A plain pattern matches a directory or a file.
+		{[]string{"node_modules"}, false,
+			[]string{"src", "src/a", "src/a/main", "src/a/node_modules", "src/a/node_modules/y", "src/b", "src/b/main", "src/b/node_modules"},
+			[]string{"root/node_modules"}},
+		{[]string{"node_modules"}, true,
+			[]string{"src", "src/a", "src/a/main", "src/b", "src/b/main"},
+			[]string{"root/node_modules", "root/src/a/node_modules"}},
+		// With a trailing slash, only directories.
+		{[]string{"node_modules/"}, true,
+			[]string{"src", "src/a", "src/a/main", "src/b", "src/b/main", "src/b/node_modules"},
+			[]string{"root/node_modules", "root/src/a/node_modules"}},
+		{[]string{"src/*/node_modules/"}, false,
+			[]string{"node_modules", "node_modules/x", "src", "src/a", "src/a/main", "src/b", "src/b/main", "src/b/node_modules"},
+			[]string{"root/src/a/node_modules"}},
+		// A trailing "/*" or "/**" matches the contents, so the directory
+		// is archived empty, and a file of the same name is kept.
+		{[]string{"src/*/node_modules/*"}, false,
+			[]string{"node_modules", "node_modules/x", "src", "src/a", "src/a/main", "src/a/node_modules", "src/b", "src/b/main", "src/b/node_modules"},
+			[]string{"root/src/a/node_modules"}},
+		{[]string{"*/node_modules/**"}, false,
+			[]string{"node_modules", "node_modules/x", "src", "src/a", "src/a/main", "src/a/node_modules", "src/a/node_modules/y", "src/b", "src/b/main", "src/b/node_modules"},
+			nil},
+		{[]string{"node_modules/**"}, false,
+			[]string{"node_modules", "src", "src/a", "src/a/main", "src/a/node_modules", "src/a/node_modules/y", "src/b", "src/b/main", "src/b/node_modules"},
+			[]string{"root/node_modules"}},
+	}
+	for _, test := range tests {
+		fsys := &readRecordingFS{MapFS: fstest.MapFS{
+			"root/node_modules/x":       {Data: []byte("x")},
+			"root/src/a/node_modules/y": {Data: []byte("y")},
+			"root/src/a/main":           {Data: []byte("a")},
+			"root/src/b/node_modules":   {Data: []byte("file")},
+			"root/src/b/main":           {Data: []byte("b")},
+		}}
+		a := NewArchiverTemplate()
+		a.FS = fsys
+		a.ExcludePatterns = test.patterns
+		a.MatchBaseNames = test.baseNames
+		if err := a.AddDirContentsAs("root", "."); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := a.RunTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := ExtractToMapLimit(&buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paths := entryPaths(entries); !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%q (base names %v): archived %v, expected %v", test.patterns, test.baseNames, paths, test.expected)
+		}
+		if !fsys.wasRead("root/src/a") {
+			t.Errorf("%q (base names %v): root/src/a wasn't read", test.patterns, test.baseNames)
+		}
+		for _, dir := range test.unread {
+			if fsys.wasRead(dir) {
+				t.Errorf("%q (base names %v): %s was read", test.patterns, test.baseNames, dir)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+//go:build !windows
+// +build !windows
+
+package falib
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// MetadataOnly puts back the modes recorded in the archive without touching
+// the files' contents, creating missing directories but not missing files,
+// and not following a link where a file is expected.
+func TestMetadataOnly(t *testing.T) {
+	archive := writeRawArchive(t, false,
+		&faformat.Block{Path: "dir", Type: faformat.BlockDirectory, Mode: os.ModeDir | 0750},
+		&faformat.Block{Path: "dir/kept", Type: faformat.BlockStartOfFile, Mode: 0640},
+		&faformat.Block{Path: "dir/kept", Type: faformat.BlockData, Data: []byte("archived")},
+		&faformat.Block{Path: "dir/kept", Type: faformat.BlockEndOfFile},
+		&faformat.Block{Path: "dir/deleted", Type: faformat.BlockStartOfFile, Mode: 0640},
+		&faformat.Block{Path: "dir/deleted", Type: faformat.BlockData, Data: []byte("archived")},
+		&faformat.Block{Path: "dir/deleted", Type: faformat.BlockEndOfFile},
+		&faformat.Block{Path: "dir/link", Type: faformat.BlockStartOfFile, Mode: 0600},
+		&faformat.Block{Path: "dir/link", Type: faformat.BlockEndOfFile},
+		&faformat.Block{Path: "empty", Type: faformat.BlockDirectory, Mode: os.ModeDir | 0700})
+
+	target := t.TempDir()
+	outside := t.TempDir()
+	writeTree(t, target, map[string]string{"dir/kept": "restored by other means"})
+	writeTree(t, outside, map[string]string{"target": "outside"})
+	chdir(t, target)
+	if err := os.Chmod("dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod("dir/kept", 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(outside+"/target", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside+"/target", "dir/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	u := NewUnarchiver(bytes.NewReader(archive))
+	u.MetadataOnly = true
+	u.IgnoreOwners = true
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for path, mode := range map[string]os.FileMode{"dir": os.ModeDir | 0750, "dir/kept": 0640, "empty": os.ModeDir | 0700, outside + "/target": 0644} {
+		if info, err := os.Stat(path); err != nil {
+			t.Error(err)
+		} else if info.Mode() != mode {
+			t.Errorf("%s has mode %v, expected %v", path, info.Mode(), mode)
+		}
+	}
+	if contents, _ := os.ReadFile("dir/kept"); string(contents) != "restored by other means" {
+		t.Errorf("dir/kept was overwritten with %q", contents)
+	}
+	if _, err := os.Lstat("dir/deleted"); !os.IsNotExist(err) {
+		t.Errorf("dir/deleted was recreated: %v", err)
+	}
+	if missing := u.Stats().MissingFiles; missing != 1 {
+		t.Errorf("%d files reported missing, expected 1", missing)
+	}
+	problems, _ := u.Problems()
+	found := false
+	for _, problem := range problems {
+		found = found || problem.Path == "dir/link"
+	}
+	if !found {
+		t.Errorf("problems %v, expected one for the link at dir/link", problems)
+	}
+}
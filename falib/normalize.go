@@ -0,0 +1,26 @@
+package falib
+
+import "golang.org/x/text/unicode/norm"
+
+// A Unicode normalization form applied to paths.  macOS stores file names
+// decomposed (NFD), while most Linux software writes them composed (NFC), so
+// names that look identical may not match once an archive moves between the
+// two.
+type Normalization int
+
+const (
+	// Paths are used exactly as they are.
+	NormalizeNone Normalization = iota
+	NormalizeNFC
+	NormalizeNFD
+)
+
+func (n Normalization) apply(path string) string {
+	switch n {
+	case NormalizeNFC:
+		return norm.NFC.String(path)
+	case NormalizeNFD:
+		return norm.NFD.String(path)
+	}
+	return path
+}
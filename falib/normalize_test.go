@@ -0,0 +1,67 @@
+package falib
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestNormalizePaths(t *testing.T) {
+	// "café" as macOS stores it, with the accent as a combining character.
+	nfd := norm.NFD.String("café")
+	nfc := norm.NFC.String("café")
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{nfd + "/" + nfd: "data"})
+
+	archive := func(normalize Normalization) []byte {
+		a := NewArchiverTemplate()
+		a.NormalizePaths = normalize
+		if err := a.AddDirContentsAs(dir, "."); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := a.RunTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	extract := func(archive []byte, normalize Normalization) map[string]Entry {
+		sink := &mapSink{entries: make(map[string]Entry)}
+		u := NewUnarchiverWithSink(bytes.NewReader(archive), sink)
+		u.NormalizePaths = normalize
+		if err := u.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return sink.entries
+	}
+
+	asIs := archive(NormalizeNone)
+	if _, info, err := Inspect(bytes.NewReader(asIs), InspectOptions{}); err != nil || info.NonNFCPaths != 2 {
+		t.Errorf("archive stored as it is has %d non-NFC paths, %v; expected 2", info.NonNFCPaths, err)
+	}
+	composed := archive(NormalizeNFC)
+	if _, info, err := Inspect(bytes.NewReader(composed), InspectOptions{}); err != nil || info.NonNFCPaths != 0 {
+		t.Errorf("archive stored as NFC has %d non-NFC paths, %v", info.NonNFCPaths, err)
+	}
+
+	for _, test := range []struct {
+		archive   []byte
+		normalize Normalization
+		name      string
+	}{
+		{asIs, NormalizeNone, nfd},
+		{asIs, NormalizeNFC, nfc},
+		{composed, NormalizeNone, nfc},
+		{composed, NormalizeNFD, nfd},
+	} {
+		entries := extract(test.archive, test.normalize)
+		if _, ok := entries[test.name+"/"+test.name]; !ok || len(entries) != 2 {
+			var paths []string
+			for path := range entries {
+				paths = append(paths, path)
+			}
+			t.Errorf("extracting with normalization %d gave %q, expected %q", test.normalize, paths, test.name+"/"+test.name)
+		}
+	}
+}
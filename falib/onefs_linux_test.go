@@ -0,0 +1,145 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+// A directory in a stubbed filesystem on the given device.
+func dirOnDevice(device uint64) *fstest.MapFile {
+	return &fstest.MapFile{Mode: fs.ModeDir | 0755, Sys: &syscall.Stat_t{Dev: device}}
+}
+
+// A filesystem whose root directory can be read, but not stat'ed.
+type rootStatErrorFS struct {
+	fstest.MapFS
+}
+
+type statErrorDir struct {
+	fs.ReadDirFile
+}
+
+func (d statErrorDir) Stat() (fs.FileInfo, error) {
+	return nil, errors.New("stat failed")
+}
+
+func (f rootStatErrorFS) Open(name string) (fs.File, error) {
+	file, err := f.MapFS.Open(name)
+	if err == nil && name == "root" {
+		return statErrorDir{file.(fs.ReadDirFile)}, nil
+	}
+	return file, err
+}
+
+// Archives root from fsys with OneFileSystem set, and returns the paths
+// archived.
+func archiveOneFileSystem(t *testing.T, fsys fs.FS) []string {
+	t.Helper()
+	a := NewArchiverTemplate()
+	a.FS = fsys
+	a.OneFileSystem = true
+	if err := a.AddDir("root"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := a.RunTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ExtractToMapLimit(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entryPaths(entries)
+}
+
+func TestOneFileSystemSkipsMountPoints(t *testing.T) {
+	fsys := fstest.MapFS{
+		"root":             dirOnDevice(1),
+		"root/same":        dirOnDevice(1),
+		"root/same/file":   &fstest.MapFile{Data: []byte("file")},
+		"root/mounted":     dirOnDevice(2),
+		"root/mounted/big": &fstest.MapFile{Data: []byte("elsewhere")},
+	}
+	expected := []string{"root", "root/same", "root/same/file"}
+	if paths := archiveOneFileSystem(t, fsys); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("archived %v, expected %v", paths, expected)
+	}
+}
+
+func TestOneFileSystemWithoutRootDevice(t *testing.T) {
+	// Without the root's device, nothing is taken for a mount point, rather
+	// than everything.
+	expected := []string{"root", "root/a", "root/a/file", "root/b"}
+	for name, fsys := range map[string]fs.FS{
+		"no device": fstest.MapFS{
+			"root":        &fstest.MapFile{Mode: fs.ModeDir | 0755},
+			"root/a":      dirOnDevice(1),
+			"root/a/file": &fstest.MapFile{Data: []byte("file")},
+			"root/b":      dirOnDevice(2),
+		},
+		"stat error": rootStatErrorFS{fstest.MapFS{
+			"root":        dirOnDevice(1),
+			"root/a":      dirOnDevice(1),
+			"root/a/file": &fstest.MapFile{Data: []byte("file")},
+			"root/b":      dirOnDevice(2),
+		}},
+	} {
+		if paths := archiveOneFileSystem(t, fsys); !reflect.DeepEqual(paths, expected) {
+			t.Errorf("%s: archived %v, expected %v", name, paths, expected)
+		}
+	}
+}
+
+func TestOneFileSystemSkipsBindMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounts need root")
+	}
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"tree/file": "file", "tree/mnt/": ""})
+	// A tmpfs, so that the mount is on a different device even when the
+	// temporary directory is already on one.
+	mounted := filepath.Join(dir, "mounted")
+	if err := os.Mkdir(mounted, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", mounted, "tmpfs", 0, ""); err != nil {
+		t.Skip("unable to mount a tmpfs:", err)
+	}
+	defer syscall.Unmount(mounted, 0)
+	writeTree(t, mounted, map[string]string{"elsewhere": "elsewhere"})
+	mnt := filepath.Join(dir, "tree", "mnt")
+	if err := syscall.Mount(mounted, mnt, "", syscall.MS_BIND, ""); err != nil {
+		t.Skip("unable to bind mount:", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+
+	for _, oneFileSystem := range []bool{false, true} {
+		a := NewArchiverTemplate()
+		a.OneFileSystem = oneFileSystem
+		if err := a.AddDirAs(filepath.Join(dir, "tree"), "tree"); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := a.RunTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := ExtractToMapLimit(&buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"tree", "tree/file", "tree/mnt", "tree/mnt/elsewhere"}
+		if oneFileSystem {
+			expected = []string{"tree", "tree/file"}
+		}
+		if paths := entryPaths(entries); !reflect.DeepEqual(paths, expected) {
+			t.Errorf("OneFileSystem %v: archived %v, expected %v", oneFileSystem, paths, expected)
+		}
+	}
+}
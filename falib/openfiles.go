@@ -0,0 +1,139 @@
+package falib
+
+import (
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Open files and directories are left for the rest of the process, such as
+// the archive itself, its state file and the standard streams, when
+// MaxOpenFiles is set from the process's limit.
+const openFilesHeadroom = 32
+
+// How long an open that failed because too many files were open waits
+// before trying again, and how many times it tries before giving up.
+const (
+	openRetryDelay = 100 * time.Millisecond
+	openRetries    = 100
+)
+
+// Returns the default for Archiver.MaxOpenFiles: the process's limit on open
+// files, less openFilesHeadroom, or 0 if there's no limit.
+func defaultMaxOpenFiles() int {
+	limit := openFilesLimit()
+	if limit <= 0 {
+		return 0
+	} else if limit-openFilesHeadroom < minOpenFiles {
+		return minOpenFiles
+	}
+	return limit - openFilesHeadroom
+}
+
+// The fewest files the archiver can work with: a directory being scanned,
+// and a file being read from it.
+const minOpenFiles = 2
+
+// Limits the files and directories the archiver has open at once.
+// Directories can't take the last slot, so that however many are being
+// scanned, a file reader can always open the files queued from them.
+type openFileLimit struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	// The most that may be open at once, or 0 for no limit.
+	max  int
+	used int
+	peak int
+}
+
+// Sets the limit, ready for a new run.
+func (l *openFileLimit) reset(max int) {
+	l.lock.Lock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.lock)
+	}
+	if max > 0 && max < minOpenFiles {
+		max = minOpenFiles
+	}
+	l.max = max
+	l.used = 0
+	l.peak = 0
+	l.lock.Unlock()
+}
+
+func (l *openFileLimit) acquire(isDir bool) {
+	l.lock.Lock()
+	for l.max > 0 && (l.used >= l.max || (isDir && l.used >= l.max-1)) {
+		l.cond.Wait()
+	}
+	l.used++
+	if l.used > l.peak {
+		l.peak = l.used
+	}
+	l.lock.Unlock()
+}
+
+func (l *openFileLimit) release() {
+	l.lock.Lock()
+	l.used--
+	l.cond.Broadcast()
+	l.lock.Unlock()
+}
+
+// Releases a slot whose open failed because the process ran out of files,
+// lowering the limit to the number that are still open, so that the others
+// wait for one of them to be closed rather than failing too.  Returns true
+// if the limit was lowered.
+func (l *openFileLimit) exhausted() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.used--
+	l.cond.Broadcast()
+	if l.used >= minOpenFiles && (l.max == 0 || l.used < l.max) {
+		l.max = l.used
+		return true
+	}
+	return false
+}
+
+// Returns the most that have been open at once since the last reset.
+func (l *openFileLimit) getPeak() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.peak
+}
+
+// Returns true if err is from an open that failed because too many files
+// were open, in this process or the whole system.
+func tooManyOpenFiles(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && (pathErr.Err == syscall.EMFILE || pathErr.Err == syscall.ENFILE)
+}
+
+// Opens a file or directory, for the given phase, once MaxOpenFiles allows
+// it; it must be closed with closeFile.  If too many files are open anyway,
+// as when other processes share the limit, the limit is lowered and the open
+// is retried.
+func (a *Archiver) open(fsFilePath string, isDir bool, phase Phase) (fs.File, error) {
+	for attempt := 0; ; attempt++ {
+		a.openFiles.acquire(isDir)
+		file, err := a.openFile(fsFilePath)
+		if err == nil {
+			return file, nil
+		} else if !tooManyOpenFiles(err) || attempt >= openRetries {
+			a.openFiles.release()
+			return nil, err
+		}
+		if a.openFiles.exhausted() {
+			a.log(phase).Warning("too many open files; opening fewer at once")
+		}
+		time.Sleep(openRetryDelay)
+	}
+}
+
+func (a *Archiver) closeFile(file fs.File) {
+	file.Close()
+	a.openFiles.release()
+}
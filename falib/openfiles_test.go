@@ -0,0 +1,129 @@
+package falib
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+// A filesystem that allows only limit files to be open at once, failing
+// other opens with EMFILE as the operating system would; a limit of 0 allows
+// any number.  It records the most that were open at once.
+type limitedFS struct {
+	fstest.MapFS
+	limit int
+
+	lock  sync.Mutex
+	open  int
+	peak  int
+	fails int
+}
+
+type limitedFile struct {
+	fs.File
+	fsys *limitedFS
+	once sync.Once
+}
+
+type limitedDir struct {
+	*limitedFile
+}
+
+func (d limitedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	return d.File.(fs.ReadDirFile).ReadDir(n)
+}
+
+func (f *limitedFile) Close() error {
+	f.once.Do(func() {
+		f.fsys.lock.Lock()
+		f.fsys.open--
+		f.fsys.lock.Unlock()
+	})
+	return f.File.Close()
+}
+
+func (fsys *limitedFS) Open(name string) (fs.File, error) {
+	fsys.lock.Lock()
+	if fsys.limit > 0 && fsys.open >= fsys.limit {
+		fsys.fails++
+		fsys.lock.Unlock()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EMFILE}
+	}
+	fsys.open++
+	if fsys.open > fsys.peak {
+		fsys.peak = fsys.open
+	}
+	fsys.lock.Unlock()
+
+	file, err := fsys.MapFS.Open(name)
+	if err != nil {
+		fsys.lock.Lock()
+		fsys.open--
+		fsys.lock.Unlock()
+		return nil, err
+	}
+	limited := &limitedFile{File: file, fsys: fsys}
+	if _, ok := file.(fs.ReadDirFile); ok {
+		return limitedDir{limited}, nil
+	}
+	return limited, nil
+}
+
+func newLimitedFS(limit int) *limitedFS {
+	fsys := &limitedFS{MapFS: fstest.MapFS{}, limit: limit}
+	for i := 0; i < 200; i++ {
+		fsys.MapFS[fmt.Sprintf("root/%d/%d/%d", i%4, i%20, i)] = &fstest.MapFile{Data: []byte("data")}
+	}
+	return fsys
+}
+
+// Archives the 200 files in fsys, returning the Archiver.
+func archiveLimited(t *testing.T, fsys *limitedFS, maxOpenFiles int) *Archiver {
+	t.Helper()
+	a := NewArchiverTemplate()
+	a.FS = fsys
+	a.MaxOpenFiles = maxOpenFiles
+	if err := a.AddDir("root"); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if problems, count := a.Problems(); count != 0 {
+		t.Errorf("problems archiving: %v", problems)
+	}
+	entries, err := ExtractToMap(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The files, the root, and its 4 and then 20 subdirectories.
+	if len(entries) != 225 {
+		t.Errorf("archived %d entries, expected 225", len(entries))
+	}
+	return a
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	for _, max := range []int{2, 5} {
+		fsys := newLimitedFS(0)
+		a := archiveLimited(t, fsys, max)
+		if fsys.peak > max || a.Stats().PeakOpenFiles > max {
+			t.Errorf("MaxOpenFiles %d: %d open at once, with %d reported", max, fsys.peak, a.Stats().PeakOpenFiles)
+		}
+	}
+}
+
+// With no limit of its own, the archiver runs into the process's, and opens
+// fewer files at once rather than skipping those it can't open.
+func TestTooManyOpenFilesRetried(t *testing.T) {
+	fsys := newLimitedFS(4)
+	archiveLimited(t, fsys, 0)
+	if fsys.fails == 0 {
+		t.Error("no opens failed; the test needs a lower limit")
+	}
+}
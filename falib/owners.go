@@ -0,0 +1,71 @@
+package falib
+
+import (
+	"os/user"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Remembers which uids and gids exist on this system, for FallbackUid and
+// FallbackGid, so that each is only looked up once.
+type ownerCache struct {
+	lock   sync.Mutex
+	users  map[int]bool
+	groups map[int]bool
+}
+
+// Returns true if the id is missing from the user or group database.  Ids
+// that can't be looked up for any other reason, as when the platform doesn't
+// support it, are assumed to exist.
+func (c *ownerCache) unknown(id int, isGroup bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.users == nil {
+		c.users = make(map[int]bool)
+		c.groups = make(map[int]bool)
+	}
+	cache := c.users
+	if isGroup {
+		cache = c.groups
+	}
+	if known, ok := cache[id]; ok {
+		return !known
+	}
+
+	var unknown bool
+	if isGroup {
+		_, err := user.LookupGroupId(strconv.Itoa(id))
+		_, unknown = err.(user.UnknownGroupIdError)
+	} else {
+		_, err := user.LookupId(strconv.Itoa(id))
+		_, unknown = err.(user.UnknownUserIdError)
+	}
+	cache[id] = !unknown
+	return unknown
+}
+
+// Returns the uid and gid to give an entry, replacing those that are unknown
+// or above MaxOwnerId with FallbackUid and FallbackGid.
+func (u *Unarchiver) mapOwner(uid int, gid int) (int, int) {
+	remapped := false
+	if u.FallbackUid >= 0 && uid != u.FallbackUid && u.unknownOwner(uid, false) {
+		uid = u.FallbackUid
+		remapped = true
+	}
+	if u.FallbackGid >= 0 && gid != u.FallbackGid && u.unknownOwner(gid, true) {
+		gid = u.FallbackGid
+		remapped = true
+	}
+	if remapped {
+		atomic.AddInt64(&u.stats.OwnersRemapped, 1)
+	}
+	return uid, gid
+}
+
+func (u *Unarchiver) unknownOwner(id int, isGroup bool) bool {
+	if u.MaxOwnerId >= 0 && id > u.MaxOwnerId {
+		return true
+	}
+	return u.owners.unknown(id, isGroup)
+}
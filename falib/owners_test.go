@@ -0,0 +1,57 @@
+package falib
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestMapOwner(t *testing.T) {
+	for _, test := range []struct {
+		name                     string
+		fallbackUid, fallbackGid int
+		maxOwnerId               int
+		uid, gid                 int
+		mappedUid, mappedGid     int
+		remapped                 bool
+	}{
+		{"no fallback", -1, -1, -1, 4242, 4343, 4242, 4343, false},
+		{"known", 1000, 1000, -1, 1000, 100, 1000, 100, false},
+		{"unknown uid", 1000, 1000, -1, 4242, 100, 1000, 100, true},
+		{"unknown both", 1000, 1000, -1, 4242, 4343, 1000, 1000, true},
+		{"gid only", -1, 50, -1, 4242, 4343, 4242, 50, true},
+		{"already the fallback", 4242, -1, -1, 4242, 100, 4242, 100, false},
+		{"above max", -1, 50, 0, 0, 100, 0, 50, true},
+		{"root at max", 1000, 1000, 0, 0, 0, 0, 0, false},
+	} {
+		u := NewUnarchiverWithSink(nil, nopSink{})
+		u.FallbackUid = test.fallbackUid
+		u.FallbackGid = test.fallbackGid
+		u.MaxOwnerId = test.maxOwnerId
+		// Stands in for this system's user and group databases.
+		u.owners.users = map[int]bool{0: true, 1000: true, 4242: false}
+		u.owners.groups = map[int]bool{0: true, 100: true, 4343: false}
+		uid, gid := u.mapOwner(test.uid, test.gid)
+		if uid != test.mappedUid || gid != test.mappedGid {
+			t.Errorf("%s: %d:%d mapped to %d:%d, expected %d:%d", test.name, test.uid, test.gid, uid, gid, test.mappedUid, test.mappedGid)
+		}
+		if remapped := u.stats.OwnersRemapped == 1; remapped != test.remapped {
+			t.Errorf("%s: counted %d remapped, expected %v", test.name, u.stats.OwnersRemapped, test.remapped)
+		}
+	}
+}
+
+func TestOwnerCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no numeric uids and gids")
+	}
+	var cache ownerCache
+	if cache.unknown(0, false) || cache.unknown(0, true) {
+		t.Error("root is unknown")
+	}
+	if !cache.unknown(2147483000, false) || !cache.unknown(2147483000, true) {
+		t.Error("an unused id is known")
+	}
+	if len(cache.users) != 2 || len(cache.groups) != 2 {
+		t.Errorf("cached %v and %v, expected both ids of each", cache.users, cache.groups)
+	}
+}
@@ -0,0 +1,47 @@
+package falib
+
+import (
+	"bytes"
+	"os"
+)
+
+// Writes a file over an existing copy of it, only writing the parts that
+// differ, so that resuming an interrupted extraction doesn't rewrite the
+// files that were already restored.
+type patchingWriter struct {
+	file *os.File
+	// End of the data written so far.
+	size    int64
+	differs bool
+	scratch []byte
+}
+
+func (w *patchingWriter) WriteAt(buf []byte, offset int64) (int, error) {
+	if end := offset + int64(len(buf)); end > w.size {
+		w.size = end
+	}
+	if cap(w.scratch) < len(buf) {
+		w.scratch = make([]byte, len(buf))
+	}
+	existing := w.scratch[:len(buf)]
+	n, _ := w.file.ReadAt(existing, offset)
+	if n == len(buf) && bytes.Equal(existing, buf) {
+		return len(buf), nil
+	}
+	w.differs = true
+	return w.file.WriteAt(buf, offset)
+}
+
+// Discards anything in the existing file beyond the data written, and
+// returns true if the file was already identical.
+func (w *patchingWriter) finish() (bool, error) {
+	fileInfo, err := w.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fileInfo.Size() != w.size {
+		w.differs = true
+		err = w.file.Truncate(w.size)
+	}
+	return !w.differs, err
+}
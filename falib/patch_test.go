@@ -0,0 +1,82 @@
+package falib
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestResumeExtraction(t *testing.T) {
+	large := strings.Repeat("0123456789", 10000)
+	archive := writeArchive(t,
+		"same", "already restored",
+		"short", large,
+		"changed", "original",
+		"long", "cut",
+		"missing", "new")
+
+	chdir(t, t.TempDir())
+	for name, contents := range map[string]string{
+		"same":    "already restored",
+		"short":   large[:len(large)/2],
+		"changed": "modified",
+		"long":    "cut down to size",
+	} {
+		if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u := NewUnarchiver(bytes.NewReader(archive))
+	u.Resume = true
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"same":    "already restored",
+		"short":   large,
+		"changed": "original",
+		"long":    "cut",
+		"missing": "new",
+	} {
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			t.Error(err)
+		} else if string(contents) != expected {
+			t.Errorf("%s has %d bytes after resuming, expected %d", name, len(contents), len(expected))
+		}
+	}
+	if present := u.Stats().AlreadyPresent; present != 1 {
+		t.Errorf("%d files already present, expected 1", present)
+	}
+}
+
+func TestResumeInterruptedExtraction(t *testing.T) {
+	large := strings.Repeat("0123456789", 10000)
+	archive := writeArchive(t, "a", "first", "b", large, "c", "last")
+	chdir(t, t.TempDir())
+
+	// Cut off partway through b.
+	interrupted := archive[:bytes.Index(archive, []byte(large))+len(large)/2]
+	if err := NewUnarchiver(bytes.NewReader(interrupted)).Run(); err == nil {
+		t.Fatal("extracting a truncated archive succeeded")
+	}
+
+	u := NewUnarchiver(bytes.NewReader(archive))
+	u.Resume = true
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"a": "first", "b": large, "c": "last"} {
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			t.Error(err)
+		} else if string(contents) != expected {
+			t.Errorf("%s has %d bytes after resuming, expected %d", name, len(contents), len(expected))
+		}
+	}
+	if present := u.Stats().AlreadyPresent; present != 1 {
+		t.Errorf("%d files already present, expected only a", present)
+	}
+}
@@ -0,0 +1,9 @@
+package falib
+
+import "github.com/replicon/fast-archiver/falib/faformat"
+
+// Checks that a path is safe to store in, or extract from, an archive: it
+// must be relative, and must not refer to a parent directory.
+func checkArchivePath(path string) error {
+	return faformat.CheckPath(path)
+}
@@ -0,0 +1,44 @@
+package falib
+
+import "sync/atomic"
+
+// Stops the archiver from reading directories and files until Resume is
+// called.  Reads in progress finish their current block, and once those
+// blocks have been written the output is checksummed and flushed, so the
+// archive written so far is consistent while the archiver is paused.
+func (a *Archiver) Pause() {
+	a.pauseLock.Lock()
+	atomic.StoreInt32(&a.pausedFlag, 1)
+	a.pauseLock.Unlock()
+
+	// Wakes the block writer in case it's idle; if a request is already
+	// pending, that one will do.
+	select {
+	case a.pauseFlush <- true:
+	default:
+	}
+}
+
+// Continues a paused archiver.
+func (a *Archiver) Resume() {
+	a.pauseLock.Lock()
+	atomic.StoreInt32(&a.pausedFlag, 0)
+	a.pauseCond.Broadcast()
+	a.pauseLock.Unlock()
+}
+
+func (a *Archiver) isPaused() bool {
+	return atomic.LoadInt32(&a.pausedFlag) != 0
+}
+
+// Blocks while the archiver is paused.
+func (a *Archiver) waitIfPaused() {
+	if !a.isPaused() {
+		return
+	}
+	a.pauseLock.Lock()
+	for a.isPaused() {
+		a.pauseCond.Wait()
+	}
+	a.pauseLock.Unlock()
+}
@@ -0,0 +1,190 @@
+//go:build !windows
+// +build !windows
+
+package falib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// Archives dir's contents and extracts them into a new directory, returning
+// its path.
+func extractCopy(t *testing.T, dir string, setup func(u *Unarchiver)) string {
+	t.Helper()
+	a := NewArchiverTemplate()
+	if err := a.AddDirContentsAs(dir, "."); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	chdir(t, target)
+	u := NewUnarchiver(bytes.NewReader(archive.Bytes()))
+	if setup != nil {
+		setup(u)
+	}
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func TestSpecialModesRoundTrip(t *testing.T) {
+	if os.Geteuid() != 0 {
+		// Others can't set setgid for a group they're not in.
+		t.Skip("setting special mode bits needs root")
+	}
+	modes := map[string]os.FileMode{
+		"setuid":        os.ModeSetuid | 0755,
+		"setgid":        os.ModeSetgid | 0750,
+		"all":           os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0700,
+		"sticky-dir":    os.ModeDir | os.ModeSticky | 0777,
+		"setgid-dir":    os.ModeDir | os.ModeSetgid | 0775,
+		"setgid-dir/in": os.ModeSetgid | 0755,
+	}
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"setuid": "", "setgid": "", "all": "", "sticky-dir/": "", "setgid-dir/in": "",
+	})
+	// Deepest first, so that a directory's mode can't stop its contents
+	// being changed.
+	for _, name := range []string{"setgid-dir/in", "setuid", "setgid", "all", "sticky-dir", "setgid-dir"} {
+		if err := os.Chmod(filepath.Join(dir, filepath.FromSlash(name)), modes[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := extractCopy(t, dir, nil)
+	for name, mode := range modes {
+		info, err := os.Lstat(filepath.Join(target, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+		} else if info.Mode() != mode {
+			t.Errorf("%s extracted with mode %v, expected %v", name, info.Mode(), mode)
+		}
+	}
+}
+
+func TestDirectoryModesIgnoreUmask(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"open/private/": "", "open/file": "file", "existing/": ""})
+	modes := map[string]os.FileMode{"open/private": 0750, "open": 0777, "existing": 0775}
+	for _, name := range []string{"open/private", "open", "existing"} {
+		if err := os.Chmod(filepath.Join(dir, filepath.FromSlash(name)), modes[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := syscall.Umask(077)
+	defer syscall.Umask(previous)
+	for _, ignorePerms := range []bool{false, true} {
+		target := extractCopy(t, dir, func(u *Unarchiver) {
+			u.IgnorePerms = ignorePerms
+			// Already there, with a mode of its own.
+			if err := os.Mkdir("existing", 0700); err != nil {
+				t.Fatal(err)
+			}
+		})
+		for name, mode := range modes {
+			if ignorePerms {
+				// Left to Mkdir and the umask, and an existing directory is
+				// left alone.
+				mode = 0700
+			}
+			info, err := os.Stat(filepath.Join(target, filepath.FromSlash(name)))
+			if err != nil {
+				t.Error(err)
+			} else if info.Mode().Perm() != mode {
+				t.Errorf("IgnorePerms %v: %s extracted with mode %v, expected %v", ignorePerms, name, info.Mode().Perm(), mode)
+			}
+		}
+	}
+}
+
+// Windows file attributes are kept in the archive, but ignored when
+// extracting elsewhere.
+func TestAttributesIgnored(t *testing.T) {
+	var archive bytes.Buffer
+	w := NewWriter(&archive)
+	hdr := Header{Path: "hidden", EntryMeta: EntryMeta{Mode: 0644, Attributes: faformat.AttributeHidden | faformat.AttributeReadOnly}}
+	if err := w.WriteHeader(&hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("contents")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(bytes.NewReader(archive.Bytes()))
+	if read, err := r.Next(); err != nil || read.Attributes != hdr.Attributes {
+		t.Errorf("read back attributes %#x, %v; expected %#x", read.Attributes, err, hdr.Attributes)
+	}
+	r.Close()
+
+	chdir(t, t.TempDir())
+	u := NewUnarchiver(bytes.NewReader(archive.Bytes()))
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if problems, _ := u.Problems(); len(problems) != 0 {
+		t.Errorf("problems extracting: %v", problems)
+	}
+	info, err := os.Stat("hidden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0644 {
+		t.Errorf("extracted with mode %v, expected the archived 0644", info.Mode())
+	}
+}
+
+func TestModeOverrides(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"dir/file": "file"})
+	for name, mode := range map[string]os.FileMode{"dir": 0700, "dir/file": 0600} {
+		if err := os.Chmod(filepath.Join(dir, filepath.FromSlash(name)), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := syscall.Umask(077)
+	defer syscall.Umask(previous)
+	fileMode := os.FileMode(0644)
+	dirMode := os.ModeSetgid | os.ModeSticky | 0770
+	for _, test := range []struct {
+		fileOverride, dirOverride *os.FileMode
+		ignorePerms               bool
+		file, dir                 os.FileMode
+	}{
+		// Special bits are applied exactly, whatever the umask.
+		{&fileMode, &dirMode, false, 0644, os.ModeDir | dirMode},
+		{nil, &dirMode, false, 0600, os.ModeDir | dirMode},
+		// The file override still applies with IgnorePerms, and the
+		// directory is left to the umask.
+		{&fileMode, nil, true, 0644, os.ModeDir | 0700},
+	} {
+		target := extractCopy(t, dir, func(u *Unarchiver) {
+			u.FileModeOverride = test.fileOverride
+			u.DirModeOverride = test.dirOverride
+			u.IgnorePerms = test.ignorePerms
+		})
+		for name, mode := range map[string]os.FileMode{"dir": test.dir, "dir/file": test.file} {
+			info, err := os.Stat(filepath.Join(target, filepath.FromSlash(name)))
+			if err != nil {
+				t.Error(err)
+			} else if info.Mode() != mode {
+				t.Errorf("%s extracted with mode %v, expected %v", name, info.Mode(), mode)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package falib
+
+import (
+	"os"
+	"sync"
+)
+
+// A non-fatal error that occurred during a run, such as a file that couldn't
+// be read or a failed chown.  Problems are also reported to the Logger.
+type Problem struct {
+	Path string
+	// The operation that failed, eg. "open", "read" or "chown".
+	Op  string
+	Err error
+}
+
+func (p Problem) Error() string {
+	if _, ok := p.Err.(*os.PathError); ok {
+		// Already includes the operation and path.
+		return p.Err.Error()
+	}
+	return p.Op + " " + p.Path + ": " + p.Err.Error()
+}
+
+func (p Problem) Unwrap() error {
+	return p.Err
+}
+
+// How a run responds to non-fatal problems.
+type ErrorPolicy int
+
+const (
+	// Report each problem and carry on; the run only fails on errors that
+	// make the archive itself unusable.
+	ContinueOnError ErrorPolicy = iota
+	// Stop the run at the first problem, and return it from Run.  Together
+	// with a nil error from Run, this guarantees that everything was
+	// archived or extracted.
+	FailFast
+)
+
+// Default limit on the number of problems kept by a run.
+const defaultMaxProblems = 1000
+
+// Collects problems from concurrent goroutines, keeping at most max of them
+// but counting all of them.  Under FailFast, the first problem also closes
+// the failed channel.
+type problemList struct {
+	lock     sync.Mutex
+	max      int
+	policy   ErrorPolicy
+	problems []Problem
+	count    int
+	failed   chan bool
+	failure  error
+}
+
+func (l *problemList) reset(max int, policy ErrorPolicy) {
+	l.lock.Lock()
+	l.max = max
+	l.policy = policy
+	l.problems = nil
+	l.count = 0
+	l.failed = make(chan bool)
+	l.failure = nil
+	l.lock.Unlock()
+}
+
+func (l *problemList) add(path string, op string, err error) {
+	l.lock.Lock()
+	problem := Problem{path, op, err}
+	if l.max <= 0 || len(l.problems) < l.max {
+		l.problems = append(l.problems, problem)
+	}
+	l.count += 1
+	if l.policy == FailFast && l.failure == nil {
+		l.failure = problem
+		close(l.failed)
+	}
+	l.lock.Unlock()
+}
+
+// Returns true once a problem has stopped the run.
+func (l *problemList) aborted() bool {
+	select {
+	case <-l.failed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the problem that stopped the run, if any.
+func (l *problemList) failureErr() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.failure
+}
+
+func (l *problemList) get() ([]Problem, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]Problem(nil), l.problems...), l.count
+}
@@ -0,0 +1,44 @@
+package falib
+
+import (
+	"fmt"
+	"path/filepath"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Escapes the parts of s that could corrupt a log or listing, or control a
+// terminal, much as GNU tar does: control characters, other non-printable
+// characters, and bytes that aren't valid UTF-8 are written as \xNN, one for
+// each byte.  Backslashes are doubled so that the result is unambiguous,
+// except on Windows, where they separate paths.  Strings that need no
+// escaping are returned unchanged.
+func Quote(s string) string {
+	var buf []byte
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		escape := (r == utf8.RuneError && size == 1) || !unicode.IsPrint(r)
+		if !escape && !(r == '\\' && filepath.Separator != '\\') {
+			if buf != nil {
+				buf = append(buf, s[i:i+size]...)
+			}
+			i += size
+			continue
+		}
+		if buf == nil {
+			buf = append(buf, s[:i]...)
+		}
+		if escape {
+			for j := i; j < i+size; j++ {
+				buf = append(buf, fmt.Sprintf("\\x%02x", s[j])...)
+			}
+		} else {
+			buf = append(buf, '\\', '\\')
+		}
+		i += size
+	}
+	if buf == nil {
+		return s
+	}
+	return string(buf)
+}
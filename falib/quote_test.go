@@ -0,0 +1,53 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	backslash := `back\\slash`
+	if filepath.Separator == '\\' {
+		backslash = `back\slash`
+	}
+	for _, test := range []struct {
+		name, quoted string
+	}{
+		{"plain/file.txt", "plain/file.txt"},
+		{"-leading-dash", "-leading-dash"},
+		{"café/日本語", "café/日本語"},
+		{"line\nbreak", `line\x0abreak`},
+		{"carriage\rreturn", `carriage\x0dreturn`},
+		{"tab\there", `tab\x09here`},
+		{"\x1b[31mred\x1b[0m", `\x1b[31mred\x1b[0m`},
+		{"bell\a", `bell\x07`},
+		{"invalid\xff\xfeutf8", `invalid\xff\xfeutf8`},
+		// A truncated multi-byte sequence is escaped byte by byte.
+		{"truncated\xe6\x97", `truncated\xe6\x97`},
+		// C1 controls and other non-printable runes, as UTF-8.
+		{"c1\u0085", `c1\xc2\x85`},
+		{"zero\u200bwidth", `zero\xe2\x80\x8bwidth`},
+		{`back\slash`, backslash},
+	} {
+		if quoted := Quote(test.name); quoted != test.quoted {
+			t.Errorf("%q quoted as %s, expected %s", test.name, quoted, test.quoted)
+		}
+	}
+}
+
+func TestStdLoggerQuotes(t *testing.T) {
+	var quoted, raw bytes.Buffer
+	for _, l := range []Logger{StdLogger(&quoted, true), RawStdLogger(&raw, true)} {
+		l.Verbose("skipping", "a\nb")
+		l.Warning("error:", errors.New("open \x1b]0;title\a: denied"), 3)
+	}
+	expected := "skipping a\\x0ab\nerror: open \\x1b]0;title\\x07: denied 3\n"
+	if quoted.String() != expected {
+		t.Errorf("StdLogger wrote %q, expected %q", quoted.String(), expected)
+	}
+	if expected := "skipping a\nb\nerror: open \x1b]0;title\a: denied 3\n"; raw.String() != expected {
+		t.Errorf("RawStdLogger wrote %q, expected %q", raw.String(), expected)
+	}
+}
@@ -0,0 +1,345 @@
+package falib
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// Describes an entry returned by Reader.Next.
+type Header struct {
+	Path  string
+	IsDir bool
+	EntryMeta
+	// Key/value pairs stored with the entry, in archives written with
+	// Writer.EnableMetadata or Archiver.MetadataFor; nil if there are none.
+	Metadata map[string]string
+}
+
+// Default amount of file data a Reader spools in memory before using
+// temporary files.
+const defaultSpoolMemory = 16 << 20
+
+// Reads the entries of an archive one at a time, in the order they start in
+// the archive, like archive/tar's Reader.  Next advances to the next entry,
+// and Read reads the contents of the current file.  Unlike the Unarchiver,
+// nothing is written to disk, other than spool files, and the caller decides
+// where entries go.
+//
+// An archive written concurrently interleaves the data of many files, so
+// the data of files after the current one has to be held until they're
+// reached.  This requires Spool; without it, only archives written in
+// Deterministic mode, where each file's data is contiguous, can be read.
+type Reader struct {
+	// If set, data for files other than the current one is kept until the
+	// file is reached: in memory, up to SpoolMemory bytes in total, and
+	// then in temporary files in SpoolDir (or the default temporary
+	// directory, if empty).  Files archived as byte ranges are always
+	// spooled in full before they can be read.
+	Spool       bool
+	SpoolDir    string
+	SpoolMemory int64
+
+	in      *faformat.BlockReader
+	eof     bool
+	err     error
+	current *readerEntry
+	// Entries that have started in the archive but haven't been returned by
+	// Next yet.
+	pending []*readerEntry
+	// Files whose end block hasn't been read yet, by path.
+	open    map[string]*readerEntry
+	memUsed int64
+	// The most recent attributes and entry metadata blocks, for the entry
+	// that follows them.
+	attributes *faformat.Block
+	metadata   *faformat.Block
+}
+
+type readerEntry struct {
+	hdr Header
+	// Data read from the archive before it could be returned by Read.
+	spool *spool
+	// Data from the most recent block, not yet returned by Read.
+	buf []byte
+	// Whether the end of the entry has been read from the archive.
+	done bool
+	// Whether the file was archived as byte ranges.
+	ranged bool
+	// Set when the caller has moved on, so the rest of the data is dropped.
+	discard bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	retval := &Reader{}
+	retval.SpoolMemory = defaultSpoolMemory
+	retval.in = faformat.NewBlockReader(r)
+	retval.open = make(map[string]*readerEntry)
+	return retval
+}
+
+// Advances to the next entry, skipping the rest of the current one.  Returns
+// io.EOF at the end of the archive.
+func (r *Reader) Next() (*Header, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if e := r.current; e != nil {
+		e.discard = true
+		e.buf = nil
+		for !e.done && !r.eof {
+			err := r.readBlock()
+			if err != nil {
+				return nil, err
+			}
+		}
+		e.spool.close()
+		r.current = nil
+		if !e.done {
+			return nil, r.fail(io.ErrUnexpectedEOF)
+		}
+	}
+
+	for len(r.pending) == 0 && !r.eof {
+		err := r.readBlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(r.pending) == 0 {
+		return nil, io.EOF
+	}
+	r.current = r.pending[0]
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+	hdr := r.current.hdr
+	return &hdr, nil
+}
+
+// Reads the contents of the current file.  Returns io.EOF at the end of the
+// file, and immediately for a directory.
+func (r *Reader) Read(buf []byte) (int, error) {
+	e := r.current
+	if e == nil || e.hdr.IsDir {
+		return 0, io.EOF
+	}
+	for {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if len(e.buf) > 0 {
+			n := copy(buf, e.buf)
+			e.buf = e.buf[n:]
+			return n, nil
+		}
+		if e.spool.unread() > 0 && (!e.ranged || e.done) {
+			n, err := e.spool.read(buf)
+			if err != nil {
+				return n, r.fail(err)
+			}
+			return n, nil
+		}
+		if e.done {
+			return 0, io.EOF
+		}
+		err := r.readBlock()
+		if err != nil {
+			return 0, err
+		}
+		if r.eof && !e.done {
+			return 0, r.fail(io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+// Removes any spool files.  The Reader can't be used afterwards.
+func (r *Reader) Close() error {
+	if r.current != nil {
+		r.current.spool.close()
+		r.current = nil
+	}
+	for _, e := range r.pending {
+		e.spool.close()
+	}
+	r.pending = nil
+	if r.err == nil {
+		r.err = os.ErrClosed
+	}
+	return nil
+}
+
+// Records an error, which is returned from every later call, with its
+// location in the archive.
+func (r *Reader) fail(err error) error {
+	if r.err == nil {
+		if _, ok := err.(*BlockError); !ok {
+			err = r.in.Wrap(err)
+		}
+		r.err = err
+	}
+	return r.err
+}
+
+// Reads and handles the next block of the archive, setting eof at the end.
+func (r *Reader) readBlock() error {
+	b, err := r.in.Next()
+	if err == io.EOF {
+		r.eof = true
+		return nil
+	} else if err != nil {
+		return r.fail(err)
+	}
+
+	attributes, metadata := r.attributes, r.metadata
+	r.attributes, r.metadata = nil, nil
+	switch b.Type {
+	case faformat.BlockEntryMeta:
+		r.metadata = b
+	case faformat.BlockAttributes:
+		r.attributes = b
+		// Entry metadata comes before the attributes.
+		r.metadata = metadata
+	case faformat.BlockStartOfFile, faformat.BlockDirectory:
+		isDir := b.Type == faformat.BlockDirectory
+		e := &readerEntry{hdr: Header{b.Path, isDir, EntryMeta{b.Uid, b.Gid, b.Mode, 0}, nil}}
+		if attributes != nil && attributes.Path == b.Path {
+			e.hdr.Attributes = attributes.Attributes
+		}
+		if metadata != nil && metadata.Path == b.Path {
+			e.hdr.Metadata = metadata.Metadata
+		}
+		if isDir {
+			e.done = true
+		} else {
+			r.open[b.Path] = e
+		}
+		r.pending = append(r.pending, e)
+	case faformat.BlockEndOfFile:
+		if e := r.open[b.Path]; e != nil {
+			e.done = true
+			delete(r.open, b.Path)
+		}
+	case faformat.BlockData, faformat.BlockDataAt:
+		if e := r.open[b.Path]; e != nil {
+			err = r.fileData(e, b.Data, b.Offset, b.Type == faformat.BlockDataAt)
+			if err != nil {
+				return r.fail(err)
+			}
+		}
+	}
+	return nil
+}
+
+// Handles a block of data for a file, passing it straight to Read if it's
+// next in the current file, and otherwise spooling it.
+func (r *Reader) fileData(e *readerEntry, data []byte, offset int64, ranged bool) error {
+	if e.discard {
+		return nil
+	}
+	if e == r.current && !ranged && !e.ranged && e.spool.unread() == 0 {
+		e.buf = data
+		return nil
+	}
+	if !r.Spool {
+		return ErrInterleaved
+	}
+	if e.spool == nil {
+		e.spool = &spool{r: r}
+	}
+	if ranged {
+		e.ranged = true
+	} else {
+		offset = e.spool.size
+	}
+	return e.spool.writeAt(data, offset)
+}
+
+// File data held by a Reader until it's read; in memory, or in a temporary
+// file once the Reader's memory limit is reached.
+type spool struct {
+	r       *Reader
+	mem     []byte
+	file    *os.File
+	size    int64
+	readOff int64
+}
+
+func (s *spool) unread() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.size - s.readOff
+}
+
+func (s *spool) writeAt(buf []byte, offset int64) error {
+	if offset < 0 || offset > math.MaxInt64-int64(len(buf)) {
+		return ErrDataOffsetRange
+	}
+	end := offset + int64(len(buf))
+	if s.file == nil && end > int64(len(s.mem)) {
+		growth := end - int64(len(s.mem))
+		if growth > s.r.SpoolMemory-s.r.memUsed {
+			file, err := ioutil.TempFile(s.r.SpoolDir, "fast-archiver-spool-")
+			if err != nil {
+				return err
+			}
+			_, err = file.Write(s.mem)
+			if err != nil {
+				file.Close()
+				os.Remove(file.Name())
+				return err
+			}
+			s.r.memUsed -= int64(len(s.mem))
+			s.mem = nil
+			s.file = file
+		} else {
+			s.mem = append(s.mem, make([]byte, growth)...)
+			s.r.memUsed += growth
+		}
+	}
+	if s.file != nil {
+		_, err := s.file.WriteAt(buf, offset)
+		if err != nil {
+			return err
+		}
+	} else {
+		copy(s.mem[offset:], buf)
+	}
+	if end > s.size {
+		s.size = end
+	}
+	return nil
+}
+
+func (s *spool) read(buf []byte) (int, error) {
+	if int64(len(buf)) > s.unread() {
+		buf = buf[:s.unread()]
+	}
+	if s.file != nil {
+		n, err := s.file.ReadAt(buf, s.readOff)
+		s.readOff += int64(n)
+		if err == io.EOF && n == len(buf) {
+			err = nil
+		}
+		return n, err
+	}
+	n := copy(buf, s.mem[s.readOff:])
+	s.readOff += int64(n)
+	return n, nil
+}
+
+func (s *spool) close() {
+	if s == nil {
+		return
+	}
+	s.r.memUsed -= int64(len(s.mem))
+	s.mem = nil
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
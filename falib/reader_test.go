@@ -0,0 +1,190 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// Writes an archive of the given blocks, with a version 4 header if dataAt
+// is set.
+func writeRawArchive(t *testing.T, dataAt bool, blocks ...*faformat.Block) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := faformat.NewBlockWriter(&buf)
+	if dataAt {
+		w.EnableDataAt()
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blocks {
+		if err := w.WriteBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteChecksum(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Reads every entry from r, returning their headers and the contents of
+// those that are files.
+func readAll(r *Reader) ([]Header, map[string]string, error) {
+	var headers []Header
+	contents := make(map[string]string)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return headers, contents, nil
+		} else if err != nil {
+			return headers, contents, err
+		}
+		headers = append(headers, *hdr)
+		if !hdr.IsDir {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return headers, contents, err
+			}
+			contents[hdr.Path] = string(data)
+		}
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	large := strings.Repeat("abcdefgh", 20000)
+	headers := []Header{
+		{Path: "dir", IsDir: true, EntryMeta: EntryMeta{Uid: 1, Gid: 2, Mode: 0755}},
+		{Path: "dir/large", EntryMeta: EntryMeta{Uid: 3, Gid: 4, Mode: 0600}, Metadata: map[string]string{"oid": "16384"}},
+		{Path: "dir/empty", EntryMeta: EntryMeta{Mode: 0644}},
+		{Path: "small", EntryMeta: EntryMeta{Mode: 0640}, Metadata: map[string]string{"label": "x"}},
+	}
+	contents := map[string]string{"dir/large": large, "dir/empty": "", "small": "small"}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.EnableMetadata = true
+	for i := range headers {
+		if err := w.WriteHeader(&headers[i]); err != nil {
+			t.Fatal(err)
+		}
+		if headers[i].IsDir {
+			continue
+		}
+		if _, err := w.Write([]byte(contents[headers[i].Path])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	defer r.Close()
+	readHeaders, readContents, err := readAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range headers {
+		if headers[i].IsDir {
+			headers[i].Mode |= os.ModeDir
+		}
+	}
+	if !reflect.DeepEqual(readHeaders, headers) {
+		t.Errorf("read headers %+v, expected %+v", readHeaders, headers)
+	}
+	if !reflect.DeepEqual(readContents, contents) {
+		t.Errorf("read contents differ from those written")
+	}
+}
+
+func TestReaderInterleaved(t *testing.T) {
+	archive := writeRawArchive(t, false,
+		&faformat.Block{Path: "a", Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: "b", Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: "b", Type: faformat.BlockData, Data: []byte("b1")},
+		&faformat.Block{Path: "a", Type: faformat.BlockData, Data: []byte("a1")},
+		&faformat.Block{Path: "b", Type: faformat.BlockData, Data: []byte("b2")},
+		&faformat.Block{Path: "b", Type: faformat.BlockEndOfFile},
+		&faformat.Block{Path: "a", Type: faformat.BlockData, Data: []byte("a2")},
+		&faformat.Block{Path: "a", Type: faformat.BlockEndOfFile})
+
+	r := NewReader(bytes.NewReader(archive))
+	if _, _, err := readAll(r); !errors.Is(err, ErrInterleaved) {
+		t.Errorf("reading interleaved files without Spool gave %v, expected ErrInterleaved", err)
+	}
+	r.Close()
+
+	r = NewReader(bytes.NewReader(archive))
+	r.Spool = true
+	defer r.Close()
+	_, contents, err := readAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"a": "a1a2", "b": "b1b2"}; !reflect.DeepEqual(contents, expected) {
+		t.Errorf("read %v, expected %v", contents, expected)
+	}
+}
+
+func TestReaderDataAtSpooling(t *testing.T) {
+	// f's ranges arrive out of order, interleaved with g's, and f's
+	// spooled data outgrows SpoolMemory, so it moves to a temporary file.
+	archive := writeRawArchive(t, true,
+		&faformat.Block{Path: "f", Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: "g", Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: "f", Type: faformat.BlockDataAt, Offset: 8, Data: []byte("89ab")},
+		&faformat.Block{Path: "g", Type: faformat.BlockDataAt, Offset: 2, Data: []byte("23")},
+		&faformat.Block{Path: "f", Type: faformat.BlockDataAt, Offset: 0, Data: []byte("0123")},
+		&faformat.Block{Path: "g", Type: faformat.BlockDataAt, Offset: 0, Data: []byte("01")},
+		&faformat.Block{Path: "f", Type: faformat.BlockDataAt, Offset: 4, Data: []byte("4567")},
+		&faformat.Block{Path: "g", Type: faformat.BlockEndOfFile},
+		&faformat.Block{Path: "f", Type: faformat.BlockEndOfFile})
+
+	r := NewReader(bytes.NewReader(archive))
+	if _, _, err := readAll(r); !errors.Is(err, ErrInterleaved) {
+		t.Errorf("reading ranges without Spool gave %v, expected ErrInterleaved", err)
+	}
+	r.Close()
+
+	spoolDir := t.TempDir()
+	r = NewReader(bytes.NewReader(archive))
+	r.Spool = true
+	r.SpoolDir = spoolDir
+	r.SpoolMemory = 6
+	_, contents, err := readAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"f": "0123456789ab", "g": "0123"}; !reflect.DeepEqual(contents, expected) {
+		t.Errorf("read %v, expected %v", contents, expected)
+	}
+	r.Close()
+	if files, _ := ioutil.ReadDir(spoolDir); len(files) != 0 {
+		t.Errorf("%d spool files left after Close", len(files))
+	}
+}
+
+func TestSpoolOffsets(t *testing.T) {
+	r := NewReader(nil)
+	r.SpoolMemory = 16
+	s := &spool{r: r}
+	defer s.close()
+	for _, offset := range []int64{-8, math.MaxInt64 - 2} {
+		if err := s.writeAt([]byte("data"), offset); !errors.Is(err, ErrDataOffsetRange) {
+			t.Errorf("writing at %d gave %v, expected ErrDataOffsetRange", offset, err)
+		}
+	}
+	if s.size != 0 || len(s.mem) != 0 || s.file != nil {
+		t.Errorf("rejected writes left %d bytes spooled", s.size)
+	}
+}
@@ -0,0 +1,192 @@
+package falib
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// The progress of an interrupted archive, loaded from the state file written
+// by an Archiver with StateFile set.
+//
+// The state file is a log: a "V" line with the format version in the
+// archive's header, a "C" line for each entry once it has been completely
+// written, an "O" line for each file that was partly written at a
+// checkpoint, and a "K" line for each checkpoint, recording the size of the
+// archive and the state of its checksum when the checksum block was written.
+// Only the lines before the last checkpoint are trusted.  State files without
+// a "V" line are from version 1.
+type ResumeState struct {
+	// Size of the archive at the last checkpoint; the archive must be
+	// truncated to this size before resuming.
+	Offset int64
+
+	// The format version in the archive's header.
+	version   int
+	hash      []byte
+	completed map[string]bool
+	open      []string
+}
+
+var errBadStateFile = errors.New("malformed resume state file")
+
+// Reads a state file.  If the file has no checkpoint, the returned state has
+// an Offset of zero, and the archive must be started again from the
+// beginning.
+func LoadResumeState(path string) (*ResumeState, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	retval := &ResumeState{completed: make(map[string]bool)}
+	version := 1
+	var completed []string
+	var open []string
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// Anything after the last newline is a partly written line from
+			// an interrupted run.
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		line = line[:len(line)-1]
+		if len(line) < 2 || line[1] != ' ' {
+			return nil, errBadStateFile
+		}
+
+		switch line[0] {
+		case 'V':
+			version, err = strconv.Atoi(line[2:])
+			if err != nil {
+				return nil, errBadStateFile
+			}
+		case 'C', 'O':
+			// Paths are quoted, so that they can't contain newlines.
+			entryPath, err := strconv.Unquote(line[2:])
+			if err != nil {
+				return nil, errBadStateFile
+			}
+			if line[0] == 'C' {
+				completed = append(completed, entryPath)
+			} else {
+				open = append(open, entryPath)
+			}
+		case 'K':
+			var hashHex string
+			_, err := fmt.Sscanf(line[2:], "%d %s", &retval.Offset, &hashHex)
+			if err != nil {
+				return nil, errBadStateFile
+			}
+			retval.hash, err = hex.DecodeString(hashHex)
+			if err != nil {
+				return nil, errBadStateFile
+			}
+			for _, entryPath := range completed {
+				retval.completed[entryPath] = true
+			}
+			completed = nil
+			retval.open = open
+			open = nil
+		default:
+			return nil, errBadStateFile
+		}
+	}
+
+	if retval.Offset == 0 || version < faformat.Version || version > faformat.VersionDataAt {
+		// An archive in a version of the format that this release doesn't
+		// write can't be carried on.
+		return &ResumeState{completed: make(map[string]bool)}, nil
+	}
+	retval.version = version
+	return retval, nil
+}
+
+// Whether the entry was completely written before the last checkpoint.
+func (s *ResumeState) isCompleted(entryPath string) bool {
+	return s != nil && s.completed[entryPath]
+}
+
+// Records the progress of an archive as it's written.  Only used by the
+// archive writer goroutine.
+type stateLog struct {
+	file *os.File
+	out  *bufio.Writer
+	// Entries completed since the last checkpoint.
+	completed []string
+	// Files whose start block has been written, but not their end block.
+	open map[string]bool
+}
+
+// Creates the state file for an archive in the given format version,
+// carrying over the progress recorded in resume, if any.  The new file only
+// replaces the old one once it's complete, so the old progress isn't lost if
+// this run is interrupted straight away.
+func newStateLog(path string, version int, resume *ResumeState) (*stateLog, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	retval := &stateLog{file: file, out: bufio.NewWriter(file), open: make(map[string]bool)}
+	fmt.Fprintf(retval.out, "V %d\n", version)
+	if resume != nil && resume.Offset > 0 {
+		for entryPath := range resume.completed {
+			retval.completed = append(retval.completed, entryPath)
+		}
+		for _, entryPath := range resume.open {
+			retval.open[entryPath] = true
+		}
+		err = retval.checkpoint(resume.Offset, resume.hash)
+	}
+	if err == nil {
+		err = retval.out.Flush()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return retval, nil
+}
+
+// Notes a block that has been written to the archive.
+func (l *stateLog) blockWritten(b block) {
+	switch b.blockType {
+	case blockTypeStartOfFile:
+		l.open[b.filePath] = true
+	case blockTypeEndOfFile:
+		delete(l.open, b.filePath)
+		l.completed = append(l.completed, b.filePath)
+	case blockTypeDirectory:
+		l.completed = append(l.completed, b.filePath)
+	}
+}
+
+// Records that the archive, up to offset, has been written and flushed.
+func (l *stateLog) checkpoint(offset int64, hashState []byte) error {
+	for _, entryPath := range l.completed {
+		fmt.Fprintf(l.out, "C %s\n", strconv.Quote(entryPath))
+	}
+	l.completed = l.completed[:0]
+	for entryPath := range l.open {
+		fmt.Fprintf(l.out, "O %s\n", strconv.Quote(entryPath))
+	}
+	fmt.Fprintf(l.out, "K %d %s\n", offset, hex.EncodeToString(hashState))
+	return l.out.Flush()
+}
+
+func (l *stateLog) close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,169 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// An output that keeps what's written to it, until limit bytes have been
+// written, then fails as an interrupted run would.
+type interruptedOutput struct {
+	bytes.Buffer
+	limit int
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func (o *interruptedOutput) Write(buf []byte) (int, error) {
+	if o.Len()+len(buf) > o.limit {
+		n, _ := o.Buffer.Write(buf[:o.limit-o.Len()])
+		return n, errInterrupted
+	}
+	return o.Buffer.Write(buf)
+}
+
+// Writes a tree of 30 files of 100 blocks each, enough for several
+// checkpoints, returning their contents by archive path.
+func writeResumeTree(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	expected := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("%02d", i)
+		files[name] = strings.Repeat(name, 800)
+		expected["tree/"+name] = files[name]
+	}
+	writeTree(t, dir, files)
+	return expected
+}
+
+func newResumeArchiver(t *testing.T, dir string, stateFile string) *Archiver {
+	a := NewArchiverTemplate()
+	a.BlockSize = 16
+	a.OutputBufferSize = 4096
+	a.StateFile = stateFile
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// Interrupts an archive partway, returning its output truncated to the last
+// checkpoint, and the state to resume it from.
+func interruptArchive(t *testing.T, a *Archiver) ([]byte, *ResumeState) {
+	output := &interruptedOutput{limit: 40000}
+	if err := a.RunTo(output); !errors.Is(err, errInterrupted) {
+		t.Fatalf("interrupted run returned %v", err)
+	}
+	state, err := LoadResumeState(a.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Offset == 0 || state.Offset > int64(output.Len()) {
+		t.Fatalf("checkpoint at offset %d, after interrupting at %d", state.Offset, output.Len())
+	}
+	return output.Bytes()[:state.Offset], state
+}
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	expected := writeResumeTree(t, dir)
+	stateFile := filepath.Join(t.TempDir(), "state")
+
+	partial, state := interruptArchive(t, newResumeArchiver(t, dir, stateFile))
+
+	a := newResumeArchiver(t, dir, stateFile)
+	a.ResumeFrom = state
+	resumed := bytes.NewBuffer(partial)
+	if err := a.RunTo(resumed); err != nil {
+		t.Fatal(err)
+	}
+	if files := a.Stats().Files; files == 0 || files >= 30 {
+		t.Errorf("resumed run archived %d files, expected those after the checkpoint", files)
+	}
+
+	entries, err := ExtractToMap(bytes.NewReader(resumed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, contents := range expected {
+		entry, ok := entries[path]
+		if !ok {
+			t.Errorf("%s is missing from the resumed archive", path)
+		} else if string(entry.Data) != contents {
+			t.Errorf("%s has %d bytes, expected %d", path, len(entry.Data), len(contents))
+		}
+	}
+}
+
+func TestResumeRejectsOtherVersion(t *testing.T) {
+	dir := t.TempDir()
+	writeResumeTree(t, dir)
+	stateFile := filepath.Join(t.TempDir(), "state")
+
+	first := newResumeArchiver(t, dir, stateFile)
+	first.MetadataFor = func(path string) map[string]string { return nil }
+	partial, state := interruptArchive(t, first)
+	contents, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(contents, []byte("V 3\n")) {
+		t.Errorf("state file for a version 3 archive starts %q", contents[:4])
+	}
+
+	a := newResumeArchiver(t, dir, stateFile)
+	a.ResumeFrom = state
+	if err := a.RunTo(bytes.NewBuffer(partial)); err != ErrResumeVersion {
+		t.Fatalf("resuming a version 3 archive as version 2 returned %v, expected ErrResumeVersion", err)
+	}
+	// The state file is left for a run with the right options.
+	if reloaded, err := LoadResumeState(stateFile); err != nil || reloaded.Offset != state.Offset {
+		t.Errorf("state file reloaded with offset %v, error %v; expected %d", reloaded.Offset, err, state.Offset)
+	}
+}
+
+func TestLoadResumeState(t *testing.T) {
+	for _, test := range []struct {
+		contents  string
+		offset    int64
+		completed map[string]bool
+		open      []string
+		err       error
+	}{
+		// Only the lines before the last checkpoint are trusted, and a
+		// partly written line is ignored.
+		{"V 2\nC \"a\"\nO \"b\"\nK 100 00\nC \"b\"\nO \"c\"\nK 2", 100, map[string]bool{"a": true}, []string{"b"}, nil},
+		{"V 4\nC \"a\"\nK 100 00\nC \"b\"\nK 200 01\n", 200, map[string]bool{"a": true, "b": true}, nil, nil},
+		{"V 2\nC \"line\\nbreak\"\nK 100 00\n", 100, map[string]bool{"line\nbreak": true}, nil, nil},
+		// No checkpoint, so the archive starts again.
+		{"V 2\nC \"a\"\n", 0, map[string]bool{}, nil, nil},
+		// Versions this release doesn't write can't be carried on.
+		{"C \"a\"\nK 100 00\n", 0, map[string]bool{}, nil, nil},
+		{"V 5\nC \"a\"\nK 100 00\n", 0, map[string]bool{}, nil, nil},
+		{"V x\n", 0, nil, nil, errBadStateFile},
+		{"C a\n", 0, nil, nil, errBadStateFile},
+		{"K 100 zz\n", 0, nil, nil, errBadStateFile},
+		{"X \"a\"\n", 0, nil, nil, errBadStateFile},
+	} {
+		path := filepath.Join(t.TempDir(), "state")
+		if err := os.WriteFile(path, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		state, err := LoadResumeState(path)
+		if err != test.err {
+			t.Errorf("%q: error %v, expected %v", test.contents, err, test.err)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if state.Offset != test.offset || !reflect.DeepEqual(state.completed, test.completed) || !reflect.DeepEqual(state.open, test.open) {
+			t.Errorf("%q: offset %d, completed %v, open %v; expected %d, %v, %v", test.contents, state.Offset, state.completed, state.open, test.offset, test.completed, test.open)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package falib
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Links given as roots are followed, and archived under their own names,
+// unless SkipRootLinks is set; links found while scanning are always
+// skipped.
+func TestRootLinks(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"real/dir/f": "f", "real/file": "file", "plain": "plain"})
+	chdir(t, dir)
+	for link, target := range map[string]string{
+		"dirlink":        "real/dir",
+		"filelink":       "real/file",
+		"real/dir/inner": "../file",
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		skipRootLinks bool
+		expected      []string
+		skipped       int64
+	}{
+		{false, []string{"dirlink", "dirlink/f", "filelink", "plain"}, 1},
+		{true, []string{"plain"}, 2},
+	} {
+		a := NewArchiverTemplate()
+		a.SkipRootLinks = test.skipRootLinks
+		if err := a.AddDir("dirlink"); err != nil {
+			t.Fatal(err)
+		}
+		a.AddFile("filelink")
+		a.AddFile("plain")
+		var buf bytes.Buffer
+		if err := a.RunTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := ExtractToMap(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paths := entryPaths(entries); !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("SkipRootLinks %v: archived %v, expected %v", test.skipRootLinks, paths, test.expected)
+		}
+		if entry, ok := entries["filelink"]; ok && string(entry.Data) != "file" {
+			t.Errorf("filelink archived as %q, expected the target's contents", entry.Data)
+		}
+		if skipped := a.Stats().SkippedSymlinks; skipped != test.skipped {
+			t.Errorf("SkipRootLinks %v: %d links skipped, expected %d", test.skipRootLinks, skipped, test.skipped)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package falib
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// A path passed to AddDir or AddFile.
+type root struct {
+	// The path on the filesystem, made absolute unless it's in an fs.FS.
+	fsPath string
+	// The path stored in the archive.
+	path  string
+	isDir bool
+	// Set, under addLock, when a root added later covers this one.
+	skipped bool
+}
+
+// Returns true if other is archived as part of r: it's the same path, or
+// it's beneath r and stored at the corresponding path in the archive.
+func (r *root) covers(other *root) bool {
+	if r.fsPath == other.fsPath {
+		return r.path == other.path
+	} else if !r.isDir {
+		return false
+	}
+	rel, err := filepath.Rel(r.fsPath, other.fsPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	return filepath.Join(r.path, rel) == other.path
+}
+
+// Returned, when StrictRoots is set, for a path passed to AddDir or AddFile
+// that's already archived as part of another.
+type OverlappingRootError struct {
+	// The path being added.
+	Path string
+	// The path it overlaps with.
+	Other string
+}
+
+func (e *OverlappingRootError) Error() string {
+	return fmt.Sprintf("%s overlaps with %s, which was also added", e.Path, e.Other)
+}
+
+// Records a path passed to AddDir or AddFile.  Returns nil if it's already
+// covered by an earlier root, so it shouldn't be scanned; earlier roots that
+// it covers are marked to be skipped.  With StrictRoots, an overlap is
+// returned as an *OverlappingRootError instead, and is also returned by
+// Run.
+func (a *Archiver) addRoot(fsPath string, archivePath string, isDir bool) (*root, error) {
+	retval := &root{filepath.Clean(fsPath), archivePath, isDir, false}
+	if a.FS == nil {
+		if absPath, err := filepath.Abs(fsPath); err == nil {
+			retval.fsPath = absPath
+		}
+	}
+
+	a.addLock.Lock()
+	defer a.addLock.Unlock()
+	if a.addsRejected() {
+		return nil, ErrArchiverReused
+	}
+	if a.roots == nil {
+		a.roots = make(map[string][]*root)
+	}
+
+	// An earlier root that's the same path, or one of its parents.
+	for dir := retval.fsPath; ; dir = filepath.Dir(dir) {
+		for _, other := range a.roots[dir] {
+			if other.covers(retval) {
+				return nil, a.overlappingRoot(retval, other)
+			}
+		}
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+
+	// Earlier roots beneath this one.
+	if isDir {
+		for _, others := range a.roots {
+			for _, other := range others {
+				if !other.skipped && retval.covers(other) {
+					if err := a.overlappingRoot(other, retval); err != nil {
+						return nil, err
+					}
+					other.skipped = true
+				}
+			}
+		}
+	}
+
+	a.roots[retval.fsPath] = append(a.roots[retval.fsPath], retval)
+	return retval, nil
+}
+
+// Reports that r is archived as part of other.  Must be called with addLock
+// held.
+func (a *Archiver) overlappingRoot(r *root, other *root) error {
+	if a.StrictRoots {
+		err := &OverlappingRootError{r.path, other.path}
+		if a.rootError == nil {
+			a.rootError = err
+		}
+		return err
+	}
+	if r.path == other.path {
+		a.log(PhaseScan).Warning("skipping duplicate path", r.path)
+	} else {
+		a.log(PhaseScan).Warning("skipping", r.path+", which is archived as part of", other.path)
+	}
+	a.overlappingRoots++
+	return nil
+}
+
+// Returns true if a root added later covers r.
+func (a *Archiver) rootSkipped(r *root) bool {
+	if r == nil {
+		return false
+	}
+	a.addLock.Lock()
+	defer a.addLock.Unlock()
+	return r.skipped
+}
@@ -0,0 +1,157 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+func TestOverlappingRoots(t *testing.T) {
+	chdir(t, t.TempDir())
+	writeTree(t, ".", map[string]string{"dir/a": "a", "dir/sub/b": "b", "other/c": "c"})
+	all := []string{"dir", "dir/a", "dir/sub", "dir/sub/b"}
+	tests := []struct {
+		dirs, files []string
+		expected    []string
+		overlapping int64
+	}{
+		{[]string{"dir", "dir/sub", "dir"}, nil, all, 2},
+		{[]string{"dir/sub", "dir"}, nil, all, 1},
+		{[]string{"./dir", "dir"}, nil, all, 1},
+		{[]string{"dir", "dir/./sub/../sub"}, nil, all, 1},
+		{[]string{"dir/sub", "dir/sub/"}, nil, []string{"b", "dir/sub", "dir/sub/b"}, 0},
+		{[]string{"dir/", "./dir/"}, nil, []string{"a", "sub", "sub/b"}, 1},
+		{[]string{"dir/sub"}, []string{"dir/sub/b"}, []string{"dir/sub", "dir/sub/b"}, 1},
+		{[]string{"dir/sub"}, []string{"dir/a", "./dir/a"}, all, 1},
+		// Stored at different paths, so archived twice on purpose.
+		{[]string{"dir", "dir/"}, nil, []string{"a", "dir", "dir/a", "dir/sub", "dir/sub/b", "sub", "sub/b"}, 0},
+		{[]string{"dir", "other"}, nil, append(all, "other", "other/c"), 0},
+	}
+	for _, test := range tests {
+		a := NewArchiverTemplate()
+		for _, dir := range test.dirs {
+			if err := a.AddDir(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, file := range test.files {
+			a.AddFile(file)
+		}
+		var archive bytes.Buffer
+		if err := a.RunTo(&archive); err != nil {
+			t.Fatal(err)
+		}
+		entries, _, err := Inspect(bytes.NewReader(archive.Bytes()), InspectOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, entry := range entries {
+			paths = append(paths, entry.Path)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%q %q: archived %q, expected %q", test.dirs, test.files, paths, test.expected)
+		}
+		if overlapping := a.Stats().OverlappingRoots; overlapping != test.overlapping {
+			t.Errorf("%q %q: %d overlapping roots, expected %d", test.dirs, test.files, overlapping, test.overlapping)
+		}
+	}
+}
+
+func TestStrictRoots(t *testing.T) {
+	chdir(t, t.TempDir())
+	writeTree(t, ".", map[string]string{"dir/sub/b": "b"})
+	for _, order := range [][]string{{"dir", "dir/sub"}, {"dir/sub", "dir"}, {"dir", "./dir"}} {
+		a := NewArchiverTemplate()
+		a.StrictRoots = true
+		if err := a.AddDir(order[0]); err != nil {
+			t.Fatal(err)
+		}
+		var overlap *OverlappingRootError
+		if err := a.AddDir(order[1]); !errors.As(err, &overlap) {
+			t.Errorf("adding %q after %q returned %v, expected an *OverlappingRootError", order[1], order[0], err)
+		}
+		if err := a.RunTo(&bytes.Buffer{}); !errors.As(err, &overlap) {
+			t.Errorf("running after adding %q returned %v, expected an *OverlappingRootError", order, err)
+		}
+	}
+
+	// A duplicate file is found once the run starts.
+	a := NewArchiverTemplate()
+	a.StrictRoots = true
+	a.AddFile("dir/sub/b")
+	a.AddFile("dir/sub/b")
+	var overlap *OverlappingRootError
+	if err := a.RunTo(&bytes.Buffer{}); !errors.As(err, &overlap) || overlap.Path != "dir/sub/b" {
+		t.Errorf("archiving a file twice returned %v, expected an *OverlappingRootError", err)
+	}
+}
+
+// A root given with a trailing slash stores its contents at the top of the
+// archive, which is what excludes and the filter see, and what's checked for
+// paths that escape it, rather than the path it was given as.
+func TestTrailingSlashRoots(t *testing.T) {
+	base := t.TempDir()
+	writeTree(t, base, map[string]string{
+		"data/a":         "a",
+		"data/tmp/x":     "x",
+		"data/sub/keep":  "keep",
+		"data/sub/tmp/y": "y",
+		"work/":          "",
+	})
+	chdir(t, filepath.Join(base, "work"))
+	all := []string{"a", "sub", "sub/keep", "sub/tmp", "sub/tmp/y", "tmp", "tmp/x"}
+	for _, test := range []struct {
+		root     string
+		excludes []string
+		prune    string
+		expected []string
+		err      error
+	}{
+		{"../data/", nil, "", all, nil},
+		{filepath.Join(base, "data") + string(filepath.Separator), nil, "", all, nil},
+		{"../data/", []string{"tmp/"}, "", []string{"a", "sub", "sub/keep", "sub/tmp", "sub/tmp/y"}, nil},
+		{"../data/", []string{"*/tmp"}, "", []string{"a", "sub", "sub/keep", "tmp", "tmp/x"}, nil},
+		{"../data/", []string{"data/tmp"}, "", all, nil},
+		{"../data/", nil, "sub", []string{"a", "tmp", "tmp/x"}, nil},
+		{"../data/sub/", []string{"tmp"}, "", []string{"keep"}, nil},
+		{"../data", nil, "", nil, faformat.ErrParentDirectoryPath},
+	} {
+		a := NewArchiverTemplate()
+		a.ExcludePatterns = test.excludes
+		if test.prune != "" {
+			prune := test.prune
+			a.Filter = func(path string, info os.FileInfo) FilterDecision {
+				if path == prune {
+					return FilterPrune
+				}
+				return FilterInclude
+			}
+		}
+		err := a.AddDir(test.root)
+		var archive bytes.Buffer
+		if err == nil {
+			err = a.RunTo(&archive)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s %q: returned %v, expected %v", test.root, test.excludes, err, test.err)
+			continue
+		} else if err != nil {
+			continue
+		}
+		entries, err := ExtractToMap(&archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paths := entryPaths(entries); !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%s %q: archived %q, expected %q", test.root, test.excludes, paths, test.expected)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package falib
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+)
+
+var scanFiles = flag.Int("scan-files", 100000, "files in the directory BenchmarkScan archives")
+
+// A filesystem that counts the files stat'ed, as the scanner would lstat
+// them on the operating system's filesystem.
+type statCountingFS struct {
+	fstest.MapFS
+	stats int64
+}
+
+func (fsys *statCountingFS) Stat(name string) (fs.FileInfo, error) {
+	atomic.AddInt64(&fsys.stats, 1)
+	return fsys.MapFS.Stat(name)
+}
+
+func TestScanStatsOnlyWhenNeeded(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		setup func(a *Archiver)
+		stats int64
+	}{
+		{"defaults", func(a *Archiver) {}, 0},
+		{"min size", func(a *Archiver) { a.MinFileSize = 1 }, 100},
+		{"filter", func(a *Archiver) {
+			a.Filter = func(path string, info os.FileInfo) FilterDecision { return FilterInclude }
+		}, 110},
+		{"one filesystem", func(a *Archiver) { a.OneFileSystem = true }, 10},
+	} {
+		fsys := &statCountingFS{MapFS: fstest.MapFS{}}
+		for i := 0; i < 100; i++ {
+			fsys.MapFS[fmt.Sprintf("root/%d/%d", i/10, i)] = &fstest.MapFile{Data: []byte("data")}
+		}
+		a := NewArchiverTemplate()
+		a.FS = fsys
+		test.setup(a)
+		if err := a.AddDir("root"); err != nil {
+			t.Fatal(err)
+		}
+		// Only the entries beneath root are counted.
+		fsys.stats = 0
+		if err := a.RunTo(io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if fsys.stats != test.stats {
+			t.Errorf("%s: %d entries stat'ed, expected %d", test.name, fsys.stats, test.stats)
+		}
+	}
+}
+
+// Archives a directory of empty files, by default taking each file's type
+// from its directory entry, and with MaxFileSize set, which lstats every
+// file for its size.  Run with -scan-files 1000000 for a directory of a
+// million files.
+func BenchmarkScan(b *testing.B) {
+	dir := b.TempDir()
+	for i := 0; i < *scanFiles; i++ {
+		file, err := os.Create(filepath.Join(dir, fmt.Sprint(i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		file.Close()
+	}
+
+	for _, test := range []struct {
+		name        string
+		maxFileSize int64
+	}{
+		{"entry type", 0},
+		{"lstat", 1 << 40},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			a := NewArchiverTemplate()
+			a.MaxFileSize = test.maxFileSize
+			if err := a.AddDirAs(dir, "tree"); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := a.RunTo(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(*scanFiles)*float64(b.N)/b.Elapsed().Seconds(), "files/s")
+		})
+	}
+}
+
+// A filesystem whose opened files count the times they're stat'ed.
+type fileStatCountingFS struct {
+	fstest.MapFS
+	stats int64
+}
+
+type fileStatCounter struct {
+	fs.File
+	fsys *fileStatCountingFS
+}
+
+func (f fileStatCounter) Stat() (fs.FileInfo, error) {
+	atomic.AddInt64(&f.fsys.stats, 1)
+	return f.File.Stat()
+}
+
+func (fsys *fileStatCountingFS) Open(name string) (fs.File, error) {
+	file, err := fsys.MapFS.Open(name)
+	// Directories are left alone, since they have to be read.
+	if err != nil || fsys.MapFS[name] == nil {
+		return file, err
+	}
+	return fileStatCounter{file, fsys}, nil
+}
+
+// Files whose FileInfo was looked up while scanning aren't stat'ed again
+// when they're opened, unless FreshMetadata is set.
+func TestOpenedFilesStatOnce(t *testing.T) {
+	const files = 50
+	stats := func(setup func(a *Archiver)) int64 {
+		fsys := &fileStatCountingFS{MapFS: fstest.MapFS{}}
+		for i := 0; i < files; i++ {
+			fsys.MapFS[fmt.Sprintf("root/%d", i)] = &fstest.MapFile{Data: []byte("data"), Mode: 0640}
+		}
+		a := NewArchiverTemplate()
+		a.FS = fsys
+		setup(a)
+		if err := a.AddDir("root"); err != nil {
+			t.Fatal(err)
+		}
+		var archive bytes.Buffer
+		if err := a.RunTo(&archive); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := ExtractToMap(bytes.NewReader(archive.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry, ok := entries["root/0"]; !ok || entry.Mode != 0640 {
+			t.Errorf("root/0 archived as %+v, expected mode 0640", entry)
+		}
+		return fsys.stats
+	}
+
+	unscanned := stats(func(a *Archiver) {})
+	if scanned := stats(func(a *Archiver) { a.MinFileSize = 1 }); scanned != unscanned-files {
+		t.Errorf("%d stats of opened files with their FileInfo from the scan, expected %d", scanned, unscanned-files)
+	}
+	fresh := stats(func(a *Archiver) {
+		a.MinFileSize = 1
+		a.FreshMetadata = true
+	})
+	if fresh != unscanned {
+		t.Errorf("%d stats of opened files with FreshMetadata, expected %d", fresh, unscanned)
+	}
+}
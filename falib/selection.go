@@ -0,0 +1,126 @@
+package falib
+
+import (
+	"path"
+	"path/filepath"
+)
+
+// Chooses the entries to extract, for the Unarchiver's IncludePatterns and
+// ExcludePatterns.  A nil *pathSelection selects everything.
+type pathSelection struct {
+	includes        []string
+	excludes        []string
+	excludeDirs     []string
+	caseInsensitive bool
+	baseNames       bool
+	// Directories that weren't selected themselves, held back until an entry
+	// beneath them is, so that only the directories leading to selected
+	// entries are extracted.
+	pending map[string]block
+}
+
+func (u *Unarchiver) newPathSelection() *pathSelection {
+	if len(u.IncludePatterns) == 0 && len(u.ExcludePatterns) == 0 {
+		return nil
+	}
+	retval := &pathSelection{}
+	retval.includes = foldPatterns(u.IncludePatterns, u.MatchCaseInsensitive)
+	excludes, excludeDirs, _ := splitExcludePatterns(foldPatterns(u.ExcludePatterns, u.MatchCaseInsensitive))
+	retval.excludes = excludes
+	retval.excludeDirs = excludeDirs
+	retval.caseInsensitive = u.MatchCaseInsensitive
+	retval.baseNames = u.MatchBaseNames
+	retval.pending = make(map[string]block)
+	return retval
+}
+
+// Returns true if the file or directory starting with b should be
+// extracted.  A directory that isn't selected, but isn't excluded either, is
+// held back, in case anything beneath it is selected; see parents.
+func (s *pathSelection) selected(b block) bool {
+	if s == nil {
+		return true
+	}
+	filePath := b.filePath
+	isDir := b.blockType == blockTypeDirectory
+	if s.excluded(filePath, isDir) {
+		return false
+	} else if len(s.includes) == 0 || s.included(filePath) {
+		return true
+	}
+	if isDir {
+		s.pending[filePath] = b
+	}
+	return false
+}
+
+// Like selected, but without holding back directories: returns true if the
+// entry might be extracted.
+func (s *pathSelection) mayExtract(filePath string, isDir bool) bool {
+	if s == nil {
+		return true
+	} else if s.excluded(filePath, isDir) {
+		return false
+	}
+	return isDir || len(s.includes) == 0 || s.included(filePath)
+}
+
+// Returns the held back directories above filePath, outermost first, which
+// have to be extracted before it.  They're only returned once.
+func (s *pathSelection) parents(filePath string) []block {
+	if s == nil || len(s.pending) == 0 {
+		return nil
+	}
+	var retval []block
+	for dir := path.Dir(filePath); dir != "."; dir = path.Dir(dir) {
+		if b, ok := s.pending[dir]; ok {
+			retval = append([]block{b}, retval...)
+			delete(s.pending, dir)
+		}
+	}
+	if b, ok := s.pending["."]; ok {
+		retval = append([]block{b}, retval...)
+		delete(s.pending, ".")
+	}
+	return retval
+}
+
+// Returns true if the directory at filePath is being held back.
+func (s *pathSelection) held(filePath string) bool {
+	_, ok := s.pending[filePath]
+	return ok
+}
+
+// Checks whether the path, or any of the directories above it, matches an
+// exclude pattern.
+func (s *pathSelection) excluded(filePath string, isDir bool) bool {
+	for {
+		osPath := filepath.FromSlash(filePath)
+		if matchesAny(s.excludes, osPath, s.caseInsensitive, s.baseNames) {
+			return true
+		} else if isDir && matchesAny(s.excludeDirs, osPath, s.caseInsensitive, s.baseNames) {
+			return true
+		}
+		parent := path.Dir(filePath)
+		if parent == filePath || parent == "." {
+			return false
+		}
+		filePath = parent
+		isDir = true
+	}
+}
+
+// Checks whether the path, or any of the directories above it, matches an
+// include pattern.
+func (s *pathSelection) included(filePath string) bool {
+	for {
+		if matchesAny(s.includes, filepath.FromSlash(filePath), s.caseInsensitive, s.baseNames) {
+			return true
+		}
+		parent := path.Dir(filePath)
+		if parent == filePath || parent == "." {
+			return false
+		}
+		filePath = parent
+	}
+}
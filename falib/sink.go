@@ -0,0 +1,313 @@
+package falib
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// The ownership and permissions of an entry, as recorded in the archive.
+type EntryMeta struct {
+	Uid  int
+	Gid  int
+	Mode os.FileMode
+	// Windows file attributes, such as faformat.AttributeHidden.
+	Attributes uint32
+}
+
+// Receives the files and directories extracted by an Unarchiver.  Paths are
+// relative paths from the archive, after PathTransform, separated by forward
+// slashes on every platform, and a directory is always created before its
+// contents.  Methods are called concurrently for different paths.
+type Sink interface {
+	// Returning an error stops the extraction.
+	CreateDir(path string, meta EntryMeta) error
+
+	// Returns a writer for the file's contents, which is closed once the
+	// whole file has been written, or when the extraction stops.  Large
+	// files may be archived as ranges that are read in any order; these are
+	// written with WriteAt, so the writer must implement io.WriterAt to
+	// extract them.  Returning an error skips the file.
+	CreateFile(path string, meta EntryMeta) (io.WriteCloser, error)
+}
+
+// Optionally implemented by a Sink that needs to do work once extraction has
+// finished, such as committing or discarding an upload.  Finish is called
+// with the error that Run is about to return, or nil if the whole archive
+// was extracted; an error returned by Finish is returned from Run.
+type SinkFinisher interface {
+	Finish(err error) error
+}
+
+// Discards everything; used for DryRun.
+type nopSink struct{}
+
+func (nopSink) CreateDir(path string, meta EntryMeta) error {
+	return nil
+}
+
+func (nopSink) CreateFile(path string, meta EntryMeta) (io.WriteCloser, error) {
+	return nopFile{}, nil
+}
+
+type nopFile struct{}
+
+func (nopFile) Write(buf []byte) (int, error)              { return len(buf), nil }
+func (nopFile) WriteAt(buf []byte, off int64) (int, error) { return len(buf), nil }
+func (nopFile) Close() error                               { return nil }
+
+// Used for MetadataOnly: directories are created as usual, but files are
+// only updated if they already exist, and no data is written to them.
+type metadataSink struct {
+	osSink
+}
+
+func (s metadataSink) CreateFile(path string, meta EntryMeta) (io.WriteCloser, error) {
+	u := s.u
+	path = filepath.FromSlash(path)
+	info, err := os.Lstat(longPath(path))
+	if err != nil {
+		return nil, err
+	} else if !info.Mode().IsRegular() {
+		return nil, &os.PathError{Op: "update", Path: path, Err: ErrNotRegularFile}
+	}
+
+	if s.restoreOwner() {
+		uid, gid := u.mapOwner(meta.Uid, meta.Gid)
+		err = os.Chown(longPath(path), uid, gid)
+		if err != nil {
+			u.log().Warning("Unable to chown file to", uid, "/", gid, ":", err.Error())
+			u.problems.add(path, "chown", err)
+			u.events.send(ChownFailed{path, err})
+		}
+	}
+	if mode, setMode := s.entryMode(meta.Mode, false); setMode {
+		err = os.Chmod(longPath(path), mode)
+		if err != nil {
+			u.log().Warning("Unable to chmod file to", mode, ":", err.Error())
+			u.problems.add(path, "chmod", err)
+		}
+	}
+	s.restoreAttributes(path, meta.Attributes)
+	return skippedFile{}, nil
+}
+
+// Discards a file's data without counting it as written.
+type skippedFile struct{}
+
+func (skippedFile) Write(buf []byte) (int, error)              { return 0, nil }
+func (skippedFile) WriteAt(buf []byte, off int64) (int, error) { return 0, nil }
+func (skippedFile) Close() error                               { return nil }
+
+// The default Sink, which extracts into the current directory.  Options such
+// as IgnoreOwners, Resume and DropCaches are taken from the Unarchiver.
+type osSink struct {
+	u *Unarchiver
+}
+
+func (s osSink) CreateDir(path string, meta EntryMeta) error {
+	u := s.u
+	path = filepath.FromSlash(path)
+	mode, setMode := s.entryMode(meta.Mode, true)
+	err := os.Mkdir(longPath(path), mode)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	if setMode && chmodDirs {
+		// Mkdir applies the umask, and leaves an existing directory alone.
+		err = os.Chmod(longPath(path), mode)
+		if err != nil {
+			u.log().Warning("Directory chmod error:", err.Error())
+			u.problems.add(path, "chmod", err)
+		}
+	}
+	if s.restoreOwner() {
+		uid, gid := u.mapOwner(meta.Uid, meta.Gid)
+		err = os.Chown(longPath(path), uid, gid)
+		if err != nil {
+			u.log().Warning("Directory chown error:", err.Error())
+			u.problems.add(path, "chown", err)
+			u.events.send(ChownFailed{path, err})
+		}
+	}
+	s.restoreAttributes(path, meta.Attributes)
+	return nil
+}
+
+func (s osSink) CreateFile(path string, meta EntryMeta) (io.WriteCloser, error) {
+	u := s.u
+	path = filepath.FromSlash(path)
+	w := &osFileWriter{sink: s, u: u, path: path, attributes: meta.Attributes}
+	w.mode, w.setMode = s.entryMode(meta.Mode, false)
+	if u.Resume {
+		file, err := os.OpenFile(longPath(path), os.O_RDWR, 0)
+		if err == nil {
+			w.file = file
+			w.patch = &patchingWriter{file: file}
+		}
+	}
+	if w.file == nil {
+		file, err := os.Create(longPath(path))
+		if err != nil {
+			return nil, err
+		}
+		w.file = file
+		w.buffered = bufio.NewWriterSize(file, u.FileBufferSize)
+	}
+
+	if s.restoreOwner() {
+		uid, gid := u.mapOwner(meta.Uid, meta.Gid)
+		err := w.file.Chown(uid, gid)
+		if err != nil {
+			u.log().Warning("Unable to chown file to", uid, "/", gid, ":", err.Error())
+			u.problems.add(path, "chown", err)
+			u.events.send(ChownFailed{path, err})
+		}
+	}
+	if w.setMode && !chmodAfterClose {
+		w.restoreMode()
+	}
+	return w, nil
+}
+
+// Returns the mode to give an entry with the archived mode, and whether it
+// should be applied once the entry exists; the mode overrides take priority
+// over IgnorePerms.
+func (s osSink) entryMode(mode os.FileMode, isDir bool) (os.FileMode, bool) {
+	override := s.u.FileModeOverride
+	if isDir {
+		override = s.u.DirModeOverride
+	}
+	if override != nil {
+		mode = *override
+	} else if s.u.IgnorePerms {
+		return os.ModeDir | 0755, false
+	}
+	mode = restoredMode(mode)
+	if isDir {
+		mode |= os.ModeDir
+	}
+	return mode, true
+}
+
+// Returns true if ownership should be restored.  Where the platform doesn't
+// support it, the skipped entries are counted in Stats().OwnershipSkipped
+// rather than each being reported.
+func (s osSink) restoreOwner() bool {
+	if s.u.IgnoreOwners {
+		return false
+	} else if !canChown {
+		if atomic.AddInt64(&s.u.stats.OwnershipSkipped, 1) == 1 {
+			s.u.log().Verbose("file ownership can't be restored on this platform")
+		}
+		return false
+	}
+	return true
+}
+
+// Applies file attributes, which are only recorded by archives made on
+// Windows, and only restored there.
+func (s osSink) restoreAttributes(path string, attributes uint32) {
+	if attributes == 0 {
+		return
+	}
+	mask := ^uint32(0)
+	if s.u.IgnorePerms {
+		mask &^= faformat.AttributeReadOnly
+	}
+	err := restoreAttributes(path, attributes, mask)
+	if err != nil {
+		s.u.log().Warning("Unable to set file attributes:", err.Error())
+		s.u.problems.add(path, "attributes", err)
+	}
+}
+
+// A file being extracted by osSink.
+type osFileWriter struct {
+	sink     osSink
+	u        *Unarchiver
+	path     string
+	file     *os.File
+	buffered *bufio.Writer
+	// Set when resuming over an existing file, in which case all data is
+	// written through it.
+	patch      *patchingWriter
+	offset     int64
+	mode       os.FileMode
+	setMode    bool
+	attributes uint32
+}
+
+func (w *osFileWriter) Write(buf []byte) (int, error) {
+	if w.patch != nil {
+		n, err := w.patch.WriteAt(buf, w.offset)
+		w.offset += int64(n)
+		return n, err
+	}
+	return w.buffered.Write(buf)
+}
+
+// Offset data blocks may arrive in any order, so they're written in place
+// rather than through the buffered writer.
+func (w *osFileWriter) WriteAt(buf []byte, offset int64) (int, error) {
+	if w.patch != nil {
+		return w.patch.WriteAt(buf, offset)
+	}
+	return w.file.WriteAt(buf, offset)
+}
+
+func (w *osFileWriter) Close() error {
+	var err error
+	if w.patch != nil {
+		var unchanged bool
+		unchanged, err = w.patch.finish()
+		if err == nil && unchanged {
+			w.u.log().Verbose("file already present:", w.path)
+			atomic.AddInt64(&w.u.stats.AlreadyPresent, 1)
+		}
+	} else {
+		err = w.buffered.Flush()
+	}
+	if w.u.DropCaches {
+		// Dirty pages can't be dropped, so they must be written first.
+		w.file.Sync()
+		dropCache(w.file, 0, 0)
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if chmodAfterClose && w.setMode {
+		w.restoreMode()
+	}
+	w.sink.restoreAttributes(w.path, w.attributes)
+	return err
+}
+
+// Closes a file that wasn't completely extracted, leaving any existing
+// contents beyond what was written in place for a later resume.
+func (w *osFileWriter) abandon() {
+	w.file.Close()
+	if chmodAfterClose && w.setMode {
+		w.restoreMode()
+	}
+	w.sink.restoreAttributes(w.path, w.attributes)
+}
+
+// Applies the file's mode, through the open file unless chmodAfterClose is
+// set.
+func (w *osFileWriter) restoreMode() {
+	var err error
+	if chmodAfterClose {
+		err = os.Chmod(longPath(w.path), w.mode)
+	} else {
+		err = w.file.Chmod(w.mode)
+	}
+	if err != nil {
+		w.u.log().Warning("Unable to chmod file to", w.mode, ":", err.Error())
+		w.u.problems.add(w.path, "chmod", err)
+	}
+}
@@ -0,0 +1,237 @@
+package falib
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters describing the work done by an Archiver.  Values are only
+// guaranteed to be complete once Run has returned.
+type ArchiverStats struct {
+	SkippedBySize   int64
+	SkippedByMarker int64
+	SkippedSymlinks int64
+	// Sockets, FIFOs and device files.
+	SkippedSpecial int64
+	// Directories on virtual filesystems; see Archiver.IncludeVirtualFS.
+	SkippedVirtualFS int64
+	// Version-control metadata, and paths ignored by .gitignore files; see
+	// Archiver.ExcludeVCS and ExcludeVCSIgnores.
+	SkippedVCS       int64
+	SkippedGitignore int64
+	// Files and directories skipped by exclude or include patterns, or by
+	// Filter.
+	Excluded int64
+	// Files and directories that couldn't be opened or listed.
+	Errors int64
+	// Files whose contents are incomplete in the archive because of read
+	// errors.
+	DamagedFiles int64
+	// Files and directories that were deleted after being found, when
+	// IgnoreVanished is set.
+	Vanished int64
+	// Files that were larger when reading finished than when they were
+	// opened; only the size observed at open was archived.
+	GrowingFiles int64
+	// Files that ended before the size observed when they were opened.
+	TruncatedFiles int64
+	// Files whose size or modification time changed while they were being
+	// read, even after being read again when RereadChanged is set.
+	ChangedFiles int64
+	// Whether the archiver is paused.
+	Paused bool
+	// Paths of files that were abandoned because they exceeded
+	// FileReadTimeout.
+	TimedOutFiles []string
+	// Paths passed to AddDir or AddFile that were skipped because they're
+	// archived as part of another; see Archiver.StrictRoots.
+	OverlappingRoots int64
+	// Files and directories written to the archive, the bytes of file data
+	// read for them, and the bytes of archive written.
+	Files        int64
+	Directories  int64
+	BytesRead    int64
+	BytesWritten int64
+	// The time since Run started, or the length of the run once it's
+	// finished, and the time the directory scanners, file readers and
+	// writer spent working rather than waiting, summed across goroutines.
+	Elapsed   time.Duration
+	ScanTime  time.Duration
+	ReadTime  time.Duration
+	WriteTime time.Duration
+	// The most files and directories open at once; see
+	// Archiver.MaxOpenFiles.
+	PeakOpenFiles int
+	// Set if Archiver.Diagnostics is set.
+	Diagnostics *DiagnosticsReport
+}
+
+// Returns a snapshot of the archiver's statistics; safe to call while Run is
+// in progress.
+func (a *Archiver) Stats() ArchiverStats {
+	a.timedOutFilesLock.Lock()
+	timedOutFiles := append([]string(nil), a.stats.TimedOutFiles...)
+	a.timedOutFilesLock.Unlock()
+	a.addLock.Lock()
+	overlappingRoots := a.overlappingRoots
+	a.addLock.Unlock()
+	var diagnostics *DiagnosticsReport
+	var elapsed time.Duration
+	var busy [stageCount]time.Duration
+	if a.diag != nil {
+		elapsed, busy = a.diag.times()
+		if a.Diagnostics {
+			diagnostics = a.diag.report(a)
+		}
+	}
+
+	return ArchiverStats{
+		SkippedBySize:    atomic.LoadInt64(&a.stats.SkippedBySize),
+		SkippedByMarker:  atomic.LoadInt64(&a.stats.SkippedByMarker),
+		SkippedSymlinks:  atomic.LoadInt64(&a.stats.SkippedSymlinks),
+		SkippedSpecial:   atomic.LoadInt64(&a.stats.SkippedSpecial),
+		SkippedVirtualFS: atomic.LoadInt64(&a.stats.SkippedVirtualFS),
+		SkippedVCS:       atomic.LoadInt64(&a.stats.SkippedVCS),
+		SkippedGitignore: atomic.LoadInt64(&a.stats.SkippedGitignore),
+		Excluded:         atomic.LoadInt64(&a.stats.Excluded),
+		Errors:           atomic.LoadInt64(&a.stats.Errors),
+		DamagedFiles:     atomic.LoadInt64(&a.stats.DamagedFiles),
+		Vanished:         atomic.LoadInt64(&a.stats.Vanished),
+		GrowingFiles:     atomic.LoadInt64(&a.stats.GrowingFiles),
+		TruncatedFiles:   atomic.LoadInt64(&a.stats.TruncatedFiles),
+		ChangedFiles:     atomic.LoadInt64(&a.stats.ChangedFiles),
+		TimedOutFiles:    timedOutFiles,
+		Paused:           a.isPaused(),
+		OverlappingRoots: overlappingRoots,
+		Files:            atomic.LoadInt64(&a.stats.Files),
+		Directories:      atomic.LoadInt64(&a.stats.Directories),
+		BytesRead:        atomic.LoadInt64(&a.stats.BytesRead),
+		BytesWritten:     atomic.LoadInt64(&a.stats.BytesWritten),
+		Elapsed:          elapsed,
+		ScanTime:         busy[stageScan],
+		ReadTime:         busy[stageRead] + busy[stageLargeRead],
+		WriteTime:        busy[stageWrite],
+		PeakOpenFiles:    a.openFiles.getPeak(),
+		Diagnostics:      diagnostics,
+	}
+}
+
+func (a *Archiver) addTimedOutFile(filePath string) {
+	a.timedOutFilesLock.Lock()
+	a.stats.TimedOutFiles = append(a.stats.TimedOutFiles, filePath)
+	a.timedOutFilesLock.Unlock()
+}
+
+// Returns the non-fatal problems from the most recent run, up to
+// MaxProblems, and the total number of problems, which is larger if some
+// weren't kept.
+func (a *Archiver) Problems() ([]Problem, int) {
+	return a.problems.get()
+}
+
+// Counters describing the work done by an Unarchiver.
+type UnarchiverStats struct {
+	// Files that were already identical at the destination, when Resume is
+	// set.
+	AlreadyPresent int64
+	// Files and directories whose ownership wasn't restored because the
+	// platform doesn't support it, such as Windows.
+	OwnershipSkipped int64
+	// Files in the archive that weren't found at the destination, when
+	// Unarchiver.MetadataOnly is set.
+	MissingFiles int64
+	// Files and directories given Unarchiver.FallbackUid or FallbackGid in
+	// place of an unknown owner.
+	OwnersRemapped int64
+	// Directories archived more than once with the same metadata, which were
+	// only extracted once, and those archived with different metadata; see
+	// Unarchiver.StrictDirectories.
+	DuplicateDirectories int64
+	DirectoryConflicts   int64
+	// Entries whose paths differ only in case from an earlier entry's; see
+	// Unarchiver.CaseCollisions.
+	CaseCollisions int64
+	// The most file data held in memory at once; see
+	// Unarchiver.MaxBufferedBytes.
+	PeakBufferedBytes int64
+	// Checksum blocks verified, and those read without being verified
+	// because Unarchiver.SkipChecksums is set.
+	ChecksumsVerified int64
+	ChecksumsSkipped  int64
+	// Files and directories extracted, the bytes of archive read, and the
+	// bytes of file data written.
+	Files        int64
+	Directories  int64
+	BytesRead    int64
+	BytesWritten int64
+	// The time since Run started, or the length of the run once it's
+	// finished; the time spent reading and verifying the archive; and the
+	// time spent creating and writing files and directories, summed across
+	// goroutines.
+	Elapsed   time.Duration
+	ReadTime  time.Duration
+	WriteTime time.Duration
+}
+
+// Returns a snapshot of the unarchiver's statistics; safe to call while Run
+// is in progress.
+func (u *Unarchiver) Stats() UnarchiverStats {
+	return UnarchiverStats{
+		AlreadyPresent:       atomic.LoadInt64(&u.stats.AlreadyPresent),
+		OwnershipSkipped:     atomic.LoadInt64(&u.stats.OwnershipSkipped),
+		MissingFiles:         atomic.LoadInt64(&u.stats.MissingFiles),
+		OwnersRemapped:       atomic.LoadInt64(&u.stats.OwnersRemapped),
+		DuplicateDirectories: atomic.LoadInt64(&u.stats.DuplicateDirectories),
+		DirectoryConflicts:   atomic.LoadInt64(&u.stats.DirectoryConflicts),
+		CaseCollisions:       atomic.LoadInt64(&u.stats.CaseCollisions),
+		PeakBufferedBytes:    u.buffered.getPeak(),
+		ChecksumsVerified:    atomic.LoadInt64(&u.stats.ChecksumsVerified),
+		ChecksumsSkipped:     atomic.LoadInt64(&u.stats.ChecksumsSkipped),
+		Files:                atomic.LoadInt64(&u.stats.Files),
+		Directories:          atomic.LoadInt64(&u.stats.Directories),
+		BytesRead:            atomic.LoadInt64(&u.stats.BytesRead),
+		BytesWritten:         atomic.LoadInt64(&u.stats.BytesWritten),
+		Elapsed:              u.timer.elapsed(),
+		ReadTime:             time.Duration(atomic.LoadInt64((*int64)(&u.stats.ReadTime))),
+		WriteTime:            time.Duration(atomic.LoadInt64((*int64)(&u.stats.WriteTime))),
+	}
+}
+
+// Adds the time since start to one of the Stats durations.
+func addTime(d *time.Duration, start time.Time) {
+	atomic.AddInt64((*int64)(d), int64(time.Since(start)))
+}
+
+// Measures the length of a run; safe for concurrent use.
+type runTimer struct {
+	lock    sync.Mutex
+	started time.Time
+	stopped time.Time
+}
+
+func (t *runTimer) start() {
+	t.lock.Lock()
+	t.started = time.Now()
+	t.stopped = time.Time{}
+	t.lock.Unlock()
+}
+
+func (t *runTimer) stop() {
+	t.lock.Lock()
+	t.stopped = time.Now()
+	t.lock.Unlock()
+}
+
+// Returns the time since the run started, or its length once it's stopped,
+// or 0 if it hasn't started.
+func (t *runTimer) elapsed() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.started.IsZero() {
+		return 0
+	} else if t.stopped.IsZero() {
+		return time.Since(t.started)
+	}
+	return t.stopped.Sub(t.started)
+}
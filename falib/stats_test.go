@@ -0,0 +1,44 @@
+package falib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunTotals(t *testing.T) {
+	dir := t.TempDir()
+	large := strings.Repeat("0123456789", 100000)
+	writeTree(t, dir, map[string]string{"a": "alpha", "sub/b": large, "sub/empty/": ""})
+
+	a := NewArchiverTemplate()
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+	stats := a.Stats()
+	dataSize := int64(len("alpha") + len(large))
+	if stats.Files != 2 || stats.Directories != 3 || stats.BytesRead != dataSize || stats.BytesWritten != int64(archive.Len()) {
+		t.Errorf("archived %d files, %d directories, read %d bytes and wrote %d; expected 2, 3, %d and %d",
+			stats.Files, stats.Directories, stats.BytesRead, stats.BytesWritten, dataSize, archive.Len())
+	}
+	if stats.Elapsed <= 0 || stats.ReadTime <= 0 || stats.WriteTime > stats.Elapsed {
+		t.Errorf("archived in %v, reading for %v and writing for %v", stats.Elapsed, stats.ReadTime, stats.WriteTime)
+	}
+
+	u := NewUnarchiverWithSink(bytes.NewReader(archive.Bytes()), &mapSink{entries: make(map[string]Entry)})
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	extracted := u.Stats()
+	if extracted.Files != 2 || extracted.Directories != 3 || extracted.BytesRead != int64(archive.Len()) || extracted.BytesWritten != dataSize {
+		t.Errorf("extracted %d files, %d directories, read %d bytes and wrote %d; expected 2, 3, %d and %d",
+			extracted.Files, extracted.Directories, extracted.BytesRead, extracted.BytesWritten, archive.Len(), dataSize)
+	}
+	if extracted.Elapsed <= 0 || extracted.ReadTime <= 0 {
+		t.Errorf("extracted in %v, reading for %v", extracted.Elapsed, extracted.ReadTime)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build !windows
+// +build !windows
+
+package falib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestSkippedEntriesAreCounted(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "a", "b.tmp": "b", "sub/c.tmp": "c", "sub/d": "d"})
+	for _, name := range []string{"link", "sub/link"} {
+		if err := os.Symlink("a", filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewArchiverTemplate()
+	a.ExcludePatterns = []string{"*.tmp"}
+	a.MatchBaseNames = true
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := a.RunTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	stats := a.Stats()
+	if stats.SkippedSymlinks != 2 || stats.SkippedSpecial != 1 || stats.Excluded != 2 || stats.Errors != 0 {
+		t.Errorf("skipped %d symlinks, %d special files, %d excluded and %d errors; expected 2, 1, 2 and 0",
+			stats.SkippedSymlinks, stats.SkippedSpecial, stats.Excluded, stats.Errors)
+	}
+	if stats.Files != 2 || stats.Directories != 2 {
+		t.Errorf("archived %d files and %d directories, expected 2 and 2", stats.Files, stats.Directories)
+	}
+	entries, err := ExtractToMapLimit(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"tree", "tree/a", "tree/sub", "tree/sub/d"}
+	if paths := entryPaths(entries); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("archived %v, expected %v", paths, expected)
+	}
+}
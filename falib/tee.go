@@ -0,0 +1,96 @@
+package falib
+
+import (
+	"io"
+	"sync"
+)
+
+// Writes an archive to several outputs at once, such as a local file and a
+// pipe to another host, like io.MultiWriter.  Each write goes to every
+// output concurrently, and returns once they've all finished with it, so
+// the slowest output sets the pace, rather than data piling up in memory
+// for it.
+type TeeWriter struct {
+	// If set, an output that fails is dropped with a warning, and writing
+	// continues to the others; writes only fail once every output has.
+	// Otherwise, the first error fails every write from then on.
+	DropFailed bool
+
+	Logger Logger
+
+	outputs []teeOutput
+	err     error
+}
+
+type teeOutput struct {
+	name   string
+	writer io.Writer
+}
+
+func NewTeeWriter() *TeeWriter {
+	retval := &TeeWriter{}
+	retval.Logger = NopLogger
+	return retval
+}
+
+// Adds an output, named in warnings about it.
+func (t *TeeWriter) Add(name string, output io.Writer) {
+	t.outputs = append(t.outputs, teeOutput{name, output})
+}
+
+func (t *TeeWriter) Write(buf []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	errs := make([]error, len(t.outputs))
+	if len(t.outputs) == 1 {
+		errs[0] = writeAll(t.outputs[0].writer, buf)
+	} else {
+		var wg sync.WaitGroup
+		for i, output := range t.outputs {
+			wg.Add(1)
+			go func(i int, output io.Writer) {
+				errs[i] = writeAll(output, buf)
+				wg.Done()
+			}(i, output.writer)
+		}
+		wg.Wait()
+	}
+
+	var remaining []teeOutput
+	for i, output := range t.outputs {
+		if errs[i] == nil {
+			remaining = append(remaining, output)
+		} else if !t.DropFailed {
+			t.err = errs[i]
+			return 0, t.err
+		} else {
+			phaseLogger(t.Logger, PhaseWrite).Warning("dropping output", output.name+":", errs[i].Error())
+			t.err = errs[i]
+		}
+	}
+	t.outputs = remaining
+	if len(remaining) == 0 {
+		return 0, t.err
+	}
+	t.err = nil
+	return len(buf), nil
+}
+
+// Returns the outputs that haven't been dropped.
+func (t *TeeWriter) writers() []io.Writer {
+	var retval []io.Writer
+	for _, output := range t.outputs {
+		retval = append(retval, output.writer)
+	}
+	return retval
+}
+
+// Writes all of buf, or returns an error saying why it couldn't.
+func writeAll(output io.Writer, buf []byte) error {
+	n, err := output.Write(buf)
+	if err == nil && n < len(buf) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errOutputFailed = errors.New("output failed")
+
+func TestTeeWriter(t *testing.T) {
+	var a, b bytes.Buffer
+	tee := NewTeeWriter()
+	tee.Add("a", &a)
+	tee.Add("b", &b)
+	tee.Add("failing", &failingWriter{5, errOutputFailed})
+	if n, err := tee.Write([]byte("first")); n != 5 || err != nil {
+		t.Fatalf("first write returned %d, %v", n, err)
+	}
+	// By default, the failure fails this write and every one after it.
+	if _, err := tee.Write([]byte("second")); err != errOutputFailed {
+		t.Errorf("write to a failing output returned %v", err)
+	}
+	if _, err := tee.Write([]byte("third")); err != errOutputFailed {
+		t.Errorf("write after a failure returned %v", err)
+	}
+
+	a.Reset()
+	b.Reset()
+	var log bytes.Buffer
+	tee = NewTeeWriter()
+	tee.DropFailed = true
+	tee.Logger = StdLogger(&log, false)
+	tee.Add("a", &a)
+	tee.Add("failing", &failingWriter{5, errOutputFailed})
+	tee.Add("b", &failingWriter{11, errOutputFailed})
+	for _, s := range []string{"first", "second", "third"} {
+		if n, err := tee.Write([]byte(s)); n != len(s) || err != nil {
+			t.Errorf("write of %s returned %d, %v, expected the others to carry on", s, n, err)
+		}
+	}
+	if a.String() != "firstsecondthird" {
+		t.Errorf("remaining output got %q", a.String())
+	}
+	if warnings := log.String(); !strings.Contains(warnings, "dropping output failing: output failed") || !strings.Contains(warnings, "dropping output b:") {
+		t.Errorf("warned %q, expected both failed outputs named", warnings)
+	}
+	// Once every output has failed, so does the tee.
+	tee = NewTeeWriter()
+	tee.DropFailed = true
+	tee.Add("failing", &failingWriter{0, errOutputFailed})
+	if _, err := tee.Write([]byte("x")); err != errOutputFailed {
+		t.Errorf("write with every output failed returned %v", err)
+	}
+}
+
+// Writes don't return until the slowest output has taken them, so that it
+// holds up the archive rather than data being buffered for it.
+func TestTeeWriterWaitsForSlowOutput(t *testing.T) {
+	var fast bytes.Buffer
+	tee := NewTeeWriter()
+	tee.Add("fast", &fast)
+	tee.Add("slow", rateWriter{1 << 20})
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		if _, err := tee.Write(make([]byte, 32<<10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("256 KiB written in %v to an output taking 1 MiB/s", elapsed)
+	}
+	if fast.Len() != 256<<10 {
+		t.Errorf("fast output got %d bytes", fast.Len())
+	}
+}
+
+// An archive written to several outputs is the same in each.
+func TestArchiveToTee(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "alpha", "b/c": strings.Repeat("charlie", 100000)})
+	var a, b bytes.Buffer
+	tee := NewTeeWriter()
+	tee.Add("a", &a)
+	tee.Add("b", &b)
+	archiver := NewArchiverTemplate()
+	if err := archiver.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.RunTo(tee); err != nil {
+		t.Fatal(err)
+	}
+	if a.Len() == 0 || !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Errorf("outputs of %d and %d bytes differ", a.Len(), b.Len())
+	}
+	entries, err := ExtractToMap(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("extracted %d entries from the tee's output, expected 4", len(entries))
+	}
+}
@@ -2,29 +2,17 @@ package falib
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
-	"hash"
-	"hash/crc64"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"sync"
-)
-
-// An io.Reader implementation that also keeps a crc64 as it reads.  Fancy!
-type hashingReader struct {
-	innerReader io.Reader
-	hasher      hash.Hash64
-}
+	"sync/atomic"
+	"time"
 
-func (r hashingReader) Read(buf []byte) (int, error) {
-	n, err := r.innerReader.Read(buf)
-	if err == nil {
-		r.hasher.Write(buf[:n])
-	}
-	return n, err
-}
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
 
 type Unarchiver struct {
 	Logger       Logger
@@ -32,198 +20,794 @@ type Unarchiver struct {
 	IgnoreOwners bool
 	DryRun       bool
 
-	file io.Reader
+	// If set, files or directories are given this mode, including any
+	// setuid, setgid and sticky bits, rather than the one in the archive.
+	// They take priority over IgnorePerms.
+	FileModeOverride *os.FileMode
+	DirModeOverride  *os.FileMode
+
+	// If set, each file is synced to disk once it has been written and its
+	// pages are dropped from the page cache.  This keeps extraction from
+	// evicting more useful data, at the cost of waiting for each file to be
+	// written to disk.  Only supported on 64-bit Linux.
+	DropCaches bool
+
+	// If set, files that already exist are compared with the archive as it's
+	// read, and only the parts that differ are written, so that an
+	// interrupted extraction can be resumed by extracting the same archive
+	// again.  Files that were already complete are counted in
+	// Stats().AlreadyPresent.
+	Resume bool
+
+	// If set, Run stops with an *ExistingPathError, before writing to it,
+	// when an entry would be extracted over a file or directory that was
+	// already in the current directory, so that extracting in the wrong
+	// place doesn't overwrite anything.  The entries in the first thousand
+	// blocks or megabyte of the archive are checked before anything is
+	// extracted, and up to ten collisions among them are listed.  The
+	// archive has no index, so any later collision is found as entries are
+	// read; entries before it have been extracted, but only to paths that
+	// didn't exist.  Only each top-level name is checked, with a single
+	// Lstat.  Has no effect with Resume or MetadataOnly, which are meant for
+	// existing files.
+	RefuseExisting bool
+
+	// If set, no file data is written: directories are created, and the
+	// ownership, permissions and attributes of files that already exist are
+	// set from the archive.  Files that don't exist are reported and counted
+	// in Stats().MissingFiles.  The archive records no timestamps, so none
+	// are restored.  Resume and DropCaches have no effect.
+	MetadataOnly bool
+
+	// If set, a directory archived more than once with different ownership,
+	// permissions or attributes, as when it's under two roots, stops Run
+	// with a *DirectoryConflictError.  Otherwise the later entry is applied
+	// with a warning, and counted in Stats().DirectoryConflicts.  Exact
+	// duplicates are only extracted once either way.
+	StrictDirectories bool
+
+	// If 0 or more, files and directories owned by a uid or gid that doesn't
+	// exist on this system, or that's greater than MaxOwnerId when that's 0
+	// or more, are given FallbackUid or FallbackGid instead, such as when
+	// restoring an archive from a decommissioned host.  Entries given a
+	// fallback are counted in Stats().OwnersRemapped.  All default to -1,
+	// which keeps the archived ids.
+	FallbackUid int
+	FallbackGid int
+	MaxOwnerId  int
+
+	// If non-empty, only files matching at least one of IncludePatterns, or
+	// beneath a directory that matches one, are extracted, along with the
+	// directories above them.  Files and directories matching
+	// ExcludePatterns, or beneath a directory that does, are skipped; an
+	// exclude pattern with a trailing slash only matches directories.
+	// Patterns are matched against paths as stored in the archive, before
+	// PathTransform, in the same way as the Archiver's, including
+	// MatchCaseInsensitive and MatchBaseNames.
+	IncludePatterns      []string
+	ExcludePatterns      []string
+	MatchCaseInsensitive bool
+	MatchBaseNames       bool
+
+	// If set, called with the path of every file and directory in the archive
+	// to determine the path it's extracted to.  Returning false skips the
+	// entry.  Transformed paths must still be relative, and must not refer
+	// to a parent directory.
+	PathTransform func(string) (string, bool)
+
+	// If set, backslashes in archive paths are treated as path separators.
+	// Archives written on Windows by older versions stored paths with
+	// backslashes, which would otherwise be extracted as part of the file
+	// name on other platforms.
+	BackslashPaths bool
+
+	// If set, paths are converted to this Unicode normalization form before
+	// they're extracted, after PathTransform.
+	NormalizePaths Normalization
+
+	// Whether to check for entries whose paths differ only in case, which
+	// overwrite each other on a case-insensitive filesystem.  By default,
+	// the current directory is checked for case-sensitivity when extracting
+	// into it.  A colliding entry is extracted with CaseCollisionSuffix
+	// appended to its name, or if that's empty, Run fails with a
+	// *CaseCollisionError.  Collisions are counted in
+	// Stats().CaseCollisions.
+	CaseCollisions      CaseCollisions
+	CaseCollisionSuffix string
+
+	// If set, typed events describing the extraction are sent to this
+	// channel, in addition to being logged.  Run never blocks on a full
+	// channel; EventOverflow determines what happens to events that don't
+	// fit.  Run doesn't close the channel.
+	Events        chan<- Event
+	EventOverflow EventOverflow
+
+	// The maximum number of problems kept for Problems(); 0 keeps them all.
+	MaxProblems int
+
+	// Size of the buffer the archive is read through.  Defaults to 1 MiB.
+	InputBufferSize int
+
+	// Size of the buffer each extracted file is written through.  One is
+	// allocated for every file being extracted at once, so it defaults to
+	// a more modest 64 KiB.  Only applies to the default sink.
+	FileBufferSize int
+
+	// The number of blocks queued for each file's writer; defaults to 1.
+	// Larger queues let the archive be read ahead of files that are written
+	// slowly, as when it arrives over a fast network onto a slow disk, up to
+	// MaxBufferedBytes.
+	FileQueueSize int
+
+	// If greater than zero, files are written by this many goroutines, each
+	// writing the files given to it in turn, with a queue of FileQueueSize
+	// blocks.  Otherwise, a goroutine is started for each file being
+	// extracted, and files of a single block are written by the goroutine
+	// reading the archive, which is quicker when writing keeps up with it.
+	WriterCount int
+
+	// The most file data held in memory at once, waiting to be written by
+	// the goroutines extracting each file; 0 is unlimited.  Reading the
+	// archive stops while the limit is reached, so that slow writes hold it
+	// up rather than using more memory.  A single block larger than the limit
+	// is still let through once nothing else is buffered.  The buffers of
+	// FileBufferSize aren't included.  The peak is reported in
+	// Stats().PeakBufferedBytes.
+	MaxBufferedBytes int64
+
+	// Whether a problem, such as a file that can't be created or chowned,
+	// stops the run.  Defaults to ContinueOnError.
+	ErrorPolicy ErrorPolicy
+
+	// If set, the archive's checksums aren't computed or compared, which
+	// saves the CPU time of a CRC64 over every byte, but extracts corrupted
+	// data without complaint.  Only for restores that don't matter, such as
+	// into test environments.  The checksum blocks skipped are counted in
+	// Stats().ChecksumsSkipped, so that a restore can be checked for it.
+	SkipChecksums bool
+
+	file     io.Reader
+	sink     Sink
+	events   *eventSender
+	problems problemList
+	stats    UnarchiverStats
+	timer    runTimer
+	buffered byteBudget
+	owners   ownerCache
+
+	metadataLock sync.Mutex
+	metadata     map[string]string
 }
 
+// Number of tracked file writers at which finished ones are pruned.
+const maxTrackedWriters = 1024
+
+// The most blocks, and file data, read ahead to look for collisions with
+// existing files before anything is extracted, with RefuseExisting.
+const (
+	maxLeadingBlocks = 1000
+	maxLeadingBytes  = 1 << 20
+)
+
+// Default sizes of the buffers that archives are written and read through,
+// and that each extracted file is written through.
+const (
+	defaultStreamBufferSize = 1 << 20
+	defaultFileBufferSize   = 64 << 10
+)
+
 func NewUnarchiver(file io.Reader) *Unarchiver {
 	retval := &Unarchiver{}
-	retval.file = bufio.NewReader(file)
+	retval.Logger = NopLogger
+	retval.MaxProblems = defaultMaxProblems
+	retval.file = file
+	retval.InputBufferSize = defaultStreamBufferSize
+	retval.FileBufferSize = defaultFileBufferSize
+	retval.FileQueueSize = 1
+	retval.FallbackUid = -1
+	retval.FallbackGid = -1
+	retval.MaxOwnerId = -1
+	return retval
+}
+
+// Creates an Unarchiver that extracts into sink rather than the current
+// directory.  IgnorePerms, IgnoreOwners, the fallback owners, the mode
+// overrides, DryRun, DropCaches, Resume and MetadataOnly only apply to the
+// default sink, and have no effect here.
+func NewUnarchiverWithSink(file io.Reader, sink Sink) *Unarchiver {
+	retval := NewUnarchiver(file)
+	retval.sink = sink
 	return retval
 }
 
 func (u *Unarchiver) Run() error {
+	sink := u.sink
+	if sink == nil && u.DryRun {
+		sink = nopSink{}
+	} else if sink == nil && u.MetadataOnly {
+		sink = metadataSink{osSink{u}}
+	} else if sink == nil {
+		sink = osSink{u}
+	}
+
+	err := u.run(sink)
+	if failure := u.problems.failureErr(); failure != nil {
+		err = failure
+	}
+	if finisher, ok := sink.(SinkFinisher); ok {
+		if finishErr := finisher.Finish(err); err == nil {
+			err = finishErr
+		}
+	}
+	return err
+}
+
+// Extracts the archive.  Errors are returned as *BlockError, with the location
+// of the block being processed.
+func (u *Unarchiver) run(sink Sink) error {
 	var workInProgress sync.WaitGroup
-	fileOutputChan := make(map[string]chan block)
+	fileOutputChan := make(map[string]chan fileBlock)
+	// Output paths of files currently being extracted, and the archive path
+	// being extracted to each of them.
+	outputPaths := make(map[string]string)
+	activeOutputs := make(map[string]bool)
+	// Closed by each file's writer when it has finished, so that a later
+	// entry for the same output path doesn't truncate the file while the
+	// earlier writer is still using it.
+	writersDone := make(map[string]chan bool)
+
+	u.events = newEventSender(u.Events, u.EventOverflow)
+	u.problems.reset(u.MaxProblems, u.ErrorPolicy)
+	u.stats = UnarchiverStats{}
+	u.setMetadata(nil)
+	u.timer.start()
+	defer u.timer.stop()
+	u.buffered.reset(u.MaxBufferedBytes)
+
+	reader := faformat.NewBlockReader(bufio.NewReaderSize(u.file, u.InputBufferSize))
+	if u.SkipChecksums {
+		reader.SkipChecksums()
+	}
 
-	reader := hashingReader{u.file, crc64.New(crc64.MakeTable(crc64.ECMA))}
+	// With WriterCount set, files are given to the writers in turn.
+	var writers []chan fileBlock
+	nextWriter := 0
+	for i := 0; i < u.WriterCount; i++ {
+		c := make(chan fileBlock, u.FileQueueSize)
+		writers = append(writers, c)
+		workInProgress.Add(1)
+		go u.writeFiles(sink, c, &workInProgress)
+	}
+	// On every return, the writers are stopped, abandoning any files still
+	// being written, and waited for, so that none are still writing when
+	// the sink is finished.
+	defer func() {
+		if writers == nil {
+			for _, c := range fileOutputChan {
+				if c != nil {
+					close(c)
+				}
+			}
+		}
+		for _, c := range writers {
+			close(c)
+		}
+		workInProgress.Wait()
+		u.events.close()
+	}()
 
-	fileHeader := make([]byte, 8)
-	_, err := io.ReadFull(reader, fileHeader)
+	err := reader.ReadHeader()
 	if err != nil {
 		return err
-	} else if !bytes.Equal(fileHeader, fastArchiverHeader) {
-		return ErrFileHeaderMismatch
 	}
 
-	for {
-		var pathSize uint16
-		err = binary.Read(reader, binary.BigEndian, &pathSize)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
+	var folder *caseFolder
+	if u.checkCase(sink) {
+		folder = newCaseFolder(u.CaseCollisionSuffix)
+	}
+	dirs := newDirectorySet()
+	var existing *existingChecker
+	if _, ok := sink.(osSink); ok && u.RefuseExisting && !u.Resume {
+		existing = newExistingChecker()
+	}
+
+	selection := u.newPathSelection()
 
-		buf := make([]byte, pathSize)
-		_, err = io.ReadFull(reader, buf)
+	// Creates a directory, unless it's a duplicate.  Returns an error that
+	// stops the run.
+	extractDir := func(b block) error {
+		outputPath, ok, err := u.outputPath(b.filePath, true, folder)
+		if err == nil && ok {
+			err = existing.check(outputPath)
+		}
 		if err != nil {
 			return err
+		} else if !ok {
+			u.events.send(EntrySkipped{b.filePath, "excluded by path transform"})
+			return nil
 		}
-		filePath := string(buf)
-		if strings.HasPrefix(filePath, "/") {
-			return ErrAbsoluteDirectoryPath
+
+		meta := EntryMeta{b.uid, b.gid, b.mode, b.attributes}
+		create, err := dirs.add(outputPath, meta)
+		if err != nil && u.StrictDirectories {
+			return err
+		} else if err != nil {
+			u.log().Warning("Directory conflict:", err.Error()+"; using the later entry")
+			atomic.AddInt64(&u.stats.DirectoryConflicts, 1)
+		} else if !create {
+			u.log().Verbose("duplicate directory entry:", outputPath)
+			atomic.AddInt64(&u.stats.DuplicateDirectories, 1)
+			return nil
 		}
 
-		blockType := make([]byte, 1)
-		_, err = io.ReadFull(reader, blockType)
+		begun := time.Now()
+		err = sink.CreateDir(outputPath, meta)
+		addTime(&u.stats.WriteTime, begun)
 		if err != nil {
 			return err
 		}
-
-		if blockType[0] == byte(blockTypeStartOfFile) {
-			var uid uint32
-			var gid uint32
-			var mode os.FileMode
-
-			err = binary.Read(reader, binary.BigEndian, &uid)
-			if err != nil {
+		atomic.AddInt64(&u.stats.Directories, 1)
+		return nil
+	}
+	// Creates the directories above filePath that were held back by the
+	// include patterns.
+	extractParents := func(filePath string) error {
+		for _, parent := range selection.parents(filePath) {
+			if err := extractDir(parent); err != nil {
 				return err
 			}
+		}
+		return nil
+	}
 
-			err = binary.Read(reader, binary.BigEndian, &gid)
-			if err != nil {
-				return err
-			}
+	// Attributes from an attributes block, for the entry that follows it.
+	var attributesPath string
+	var attributes uint32
 
-			err = binary.Read(reader, binary.BigEndian, &mode)
+	// Blocks read ahead by smallFile, and the error that stopped it, to be
+	// handled before reading any more of the archive.
+	var pending []block
+	var pendingErr error
+	readBlock := func() (block, error) {
+		if len(pending) > 0 {
+			b := pending[0]
+			pending = pending[1:]
+			return b, nil
+		} else if pendingErr != nil {
+			return block{}, pendingErr
+		}
+		for {
+			begun := time.Now()
+			formatBlock, err := reader.Next()
+			addTime(&u.stats.ReadTime, begun)
+			atomic.StoreInt64(&u.stats.BytesRead, reader.Offset())
 			if err != nil {
-				return err
+				return block{}, err
 			}
-
-			c := make(chan block, 1)
-			fileOutputChan[filePath] = c
-			workInProgress.Add(1)
-			go u.writeFile(c, &workInProgress)
-			c <- block{filePath, 0, nil, blockTypeStartOfFile, int(uid), int(gid), mode}
-		} else if blockType[0] == byte(blockTypeEndOfFile) {
-			c := fileOutputChan[filePath]
-			c <- block{filePath, 0, nil, blockTypeEndOfFile, 0, 0, 0}
-			close(c)
-			delete(fileOutputChan, filePath)
-		} else if blockType[0] == byte(blockTypeData) {
-			var blockSize uint16
-			err = binary.Read(reader, binary.BigEndian, &blockSize)
+			b := blockFromFormat(formatBlock)
+			if u.BackslashPaths && strings.Contains(b.filePath, "\\") {
+				b.filePath = strings.Replace(b.filePath, "\\", "/", -1)
+				err = checkArchivePath(b.filePath)
+				if err != nil {
+					return block{}, reader.Wrap(err)
+				}
+			}
+			if b.blockType == blockTypeEntryMeta && b.filePath == "" {
+				u.setMetadata(formatBlock.Metadata)
+				continue
+			} else if b.blockType == blockTypeEntryMeta {
+				// Only reported, so there's nothing more to do with it.
+				u.events.send(EntryMetadata{b.filePath, formatBlock.Metadata})
+				continue
+			}
+			return b, nil
+		}
+	}
+	// Reads ahead to find whether the file starting at filePath consists of
+	// at most one data block and its end, so that it can be written without
+	// starting a writer goroutine.  If so, returns its data blocks and the
+	// end block; otherwise, the blocks read are left for the loop below.
+	smallFile := func(filePath string) ([]block, bool) {
+		var blocks []block
+		for len(blocks) < 2 {
+			b, err := readBlock()
 			if err != nil {
-				return err
+				pendingErr = err
+				break
 			}
+			blocks = append(blocks, b)
+			if b.filePath != filePath {
+				break
+			} else if b.blockType == blockTypeEndOfFile {
+				return blocks, true
+			} else if b.blockType != blockTypeData {
+				break
+			}
+		}
+		pending = append(blocks, pending...)
+		return nil, false
+	}
 
-			blockData := make([]byte, blockSize)
-			_, err = io.ReadFull(reader, blockData)
+	// The archive has no index, but its roots' entries come first, so the
+	// entries at the start are checked before anything is extracted, and
+	// their collisions reported together.
+	if existing != nil {
+		var leading []block
+		var leadingBytes int64
+		for len(leading) < maxLeadingBlocks && leadingBytes < maxLeadingBytes {
+			b, err := readBlock()
 			if err != nil {
-				return err
+				pendingErr = err
+				break
+			}
+			leading = append(leading, b)
+			leadingBytes += int64(b.numBytes)
+		}
+		pending = leading
+		var paths []string
+		for _, b := range leading {
+			isDir := b.blockType == blockTypeDirectory
+			if !isDir && b.blockType != blockTypeStartOfFile {
+				continue
+			} else if !selection.mayExtract(b.filePath, isDir) {
+				continue
+			}
+			outputPath, ok, err := u.transformPath(b.filePath)
+			if err == nil && ok {
+				paths = append(paths, u.NormalizePaths.apply(outputPath))
 			}
+		}
+		if err := existing.checkAll(paths); err != nil {
+			// Not wrapped with the reader's position, which is wherever
+			// reading ahead stopped.
+			return err
+		}
+	}
 
-			c := fileOutputChan[filePath]
-			c <- block{filePath, blockSize, blockData, blockTypeData, 0, 0, 0}
-		} else if blockType[0] == byte(blockTypeDirectory) {
-			var uid uint32
-			var gid uint32
-			var mode os.FileMode
+	for {
+		if u.problems.aborted() {
+			break
+		}
 
-			err = binary.Read(reader, binary.BigEndian, &uid)
-			if err != nil {
-				return err
+		b, err := readBlock()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		filePath := b.filePath
+		if b.blockType == blockTypeStartOfFile || b.blockType == blockTypeDirectory {
+			if attributesPath == filePath {
+				b.attributes = attributes
 			}
-			err = binary.Read(reader, binary.BigEndian, &gid)
-			if err != nil {
-				return err
+			attributesPath = ""
+		}
+
+		switch b.blockType {
+		case blockTypeStartOfFile:
+			if !selection.selected(b) {
+				u.events.send(EntrySkipped{filePath, "excluded by pattern"})
+				fileOutputChan[filePath] = nil
+				continue
+			} else if err := extractParents(filePath); err != nil {
+				return reader.Wrap(err)
+			}
+			outputPath, ok, err := u.outputPath(filePath, false, folder)
+			if err == nil && ok {
+				err = existing.check(outputPath)
 			}
-			err = binary.Read(reader, binary.BigEndian, &mode)
 			if err != nil {
-				return err
+				return reader.Wrap(err)
+			} else if !ok {
+				u.events.send(EntrySkipped{filePath, "excluded by path transform"})
+				fileOutputChan[filePath] = nil
+				continue
+			} else if activeOutputs[outputPath] {
+				u.log().Warning("skipping duplicate file", filePath, "extracting to", outputPath)
+				u.events.send(EntrySkipped{filePath, "duplicate output path " + outputPath})
+				fileOutputChan[filePath] = nil
+				continue
 			}
+			activeOutputs[outputPath] = true
+			outputPaths[filePath] = outputPath
 
-			if u.IgnorePerms {
-				mode = os.ModeDir | 0755
+			if done, ok := writersDone[outputPath]; ok {
+				<-done
 			}
 
-			if u.DryRun {
+			if writers != nil {
+				// Handled below, with the others.
+			} else if blocks, ok := smallFile(filePath); ok {
+				delete(writersDone, outputPath)
+				delete(activeOutputs, outputPath)
+				delete(outputPaths, filePath)
+				w := fileWriter{u: u, sink: sink}
+				b.filePath = outputPath
+				w.write(b)
+				for _, b := range blocks {
+					b.filePath = outputPath
+					w.write(b)
+				}
 				continue
 			}
 
-			err = os.Mkdir(filePath, mode)
-			if err != nil && !os.IsExist(err) {
-				return err
+			done := make(chan bool)
+			writersDone[outputPath] = done
+
+			var c chan fileBlock
+			if writers != nil {
+				c = writers[nextWriter]
+				nextWriter = (nextWriter + 1) % len(writers)
+			} else {
+				c = make(chan fileBlock, u.FileQueueSize)
+				workInProgress.Add(1)
+				go u.writeFiles(sink, c, &workInProgress)
 			}
-			if !u.IgnoreOwners {
-				err = os.Chown(filePath, int(uid), int(gid))
-				if err != nil {
-					u.Logger.Warning("Directory chown error:", err.Error())
+			fileOutputChan[filePath] = c
+			b.filePath = outputPath
+			c <- fileBlock{b, done}
+		case blockTypeEndOfFile:
+			c := fileOutputChan[filePath]
+			delete(fileOutputChan, filePath)
+			if c == nil {
+				continue
+			}
+			b.filePath = outputPaths[filePath]
+			c <- fileBlock{b, nil}
+			if writers == nil {
+				close(c)
+			}
+			delete(activeOutputs, outputPaths[filePath])
+			delete(outputPaths, filePath)
+			if len(writersDone) >= maxTrackedWriters {
+				pruneFinishedWriters(writersDone)
+			}
+		case blockTypeData, blockTypeDataAt:
+			c := fileOutputChan[filePath]
+			if c != nil {
+				b.filePath = outputPaths[filePath]
+				u.buffered.acquire(int64(b.numBytes))
+				c <- fileBlock{b, nil}
+			}
+		case blockTypeDirectory:
+			if !selection.selected(b) {
+				if !selection.held(filePath) {
+					u.events.send(EntrySkipped{filePath, "excluded by pattern"})
 				}
+				continue
+			}
+			err := extractParents(filePath)
+			if err == nil {
+				err = extractDir(b)
+			}
+			if err != nil {
+				return reader.Wrap(err)
+			}
+		case blockTypeAttributes:
+			attributesPath = filePath
+			attributes = b.attributes
+		case blockTypeChecksum:
+			if u.SkipChecksums {
+				atomic.AddInt64(&u.stats.ChecksumsSkipped, 1)
+			} else {
+				atomic.AddInt64(&u.stats.ChecksumsVerified, 1)
+				u.events.send(ChecksumVerified{reader.Offset()})
 			}
-		} else if blockType[0] == byte(blockTypeChecksum) {
-			currentChecksum := reader.hasher.Sum64()
+		}
+	}
 
-			var expectedChecksum uint64
-			binary.Read(reader, binary.BigEndian, &expectedChecksum)
+	return nil
+}
 
-			if expectedChecksum != currentChecksum {
-				return ErrCrcMismatch
-			}
-		} else {
-			return ErrUnrecognizedBlockType
+// Returns the path to extract an entry to: the path from the archive, after
+// PathTransform and NormalizePaths, and renamed if it collides with an
+// earlier entry when folder is set.
+func (u *Unarchiver) outputPath(filePath string, isDir bool, folder *caseFolder) (string, bool, error) {
+	outputPath, ok, err := u.transformPath(filePath)
+	if err != nil || !ok {
+		return outputPath, ok, err
+	}
+	outputPath = u.NormalizePaths.apply(outputPath)
+	if folder == nil {
+		return outputPath, true, nil
+	}
+	resolved, collided, err := folder.resolve(outputPath, isDir)
+	if collided {
+		atomic.AddInt64(&u.stats.CaseCollisions, 1)
+		if err == nil {
+			u.log().Warning(filePath, "differs only in case from an earlier entry; extracting it to", resolved)
 		}
 	}
+	return resolved, err == nil, err
+}
 
-	workInProgress.Wait()
+// Returns true if paths should be checked for case collisions.
+func (u *Unarchiver) checkCase(sink Sink) bool {
+	switch u.CaseCollisions {
+	case CaseCollisionsAlways:
+		return true
+	case CaseCollisionsNever:
+		return false
+	}
+	switch sink.(type) {
+	case osSink, metadataSink:
+	default:
+		return false
+	}
+	insensitive, err := caseInsensitiveDir(".")
+	if err != nil {
+		u.log().Warning("unable to determine whether the target directory is case-sensitive:", err.Error())
+		return false
+	}
+	return insensitive
+}
 
-	return nil
+// Applies PathTransform to a path read from the archive.  Returns false if
+// the entry should be skipped, or an error if the transformed path is unsafe.
+func (u *Unarchiver) transformPath(filePath string) (string, bool, error) {
+	if u.PathTransform == nil {
+		return filePath, true, nil
+	}
+	outputPath, ok := u.PathTransform(filePath)
+	if !ok || outputPath == "" {
+		return "", false, nil
+	}
+	outputPath = path.Clean(filepath.ToSlash(outputPath))
+	return outputPath, true, checkArchivePath(outputPath)
 }
 
-func (u *Unarchiver) writeFile(blockSource chan block, workInProgress *sync.WaitGroup) {
-	var file *os.File = nil
-	var bufferedFile *bufio.Writer
-	for block := range blockSource {
-		if block.blockType == blockTypeStartOfFile {
-			u.Logger.Verbose(block.filePath)
+// Returns the non-fatal problems from the most recent run, up to
+// MaxProblems, and the total number of problems, which is larger if some
+// weren't kept.
+func (u *Unarchiver) Problems() ([]Problem, int) {
+	return u.problems.get()
+}
 
-			if u.DryRun {
-				continue
-			}
+// Returns the key/value pairs describing the archive, such as the host and
+// version of fast-archiver that wrote it, or nil if it has none; see
+// Archiver.ArchiveMetadata.  They're stored straight after the archive's
+// header, so they're available as soon as Run has read the first block.
+func (u *Unarchiver) Metadata() map[string]string {
+	u.metadataLock.Lock()
+	defer u.metadataLock.Unlock()
+	return u.metadata
+}
 
-			tmp, err := os.Create(block.filePath)
-			if err != nil {
-				u.Logger.Warning("File create error:", err.Error())
-				file = nil
-				continue
-			}
-			file = tmp
-			bufferedFile = bufio.NewWriter(file)
+func (u *Unarchiver) setMetadata(metadata map[string]string) {
+	u.metadataLock.Lock()
+	u.metadata = metadata
+	u.metadataLock.Unlock()
+}
 
-			if !u.IgnoreOwners {
-				err = file.Chown(block.uid, block.gid)
-				if err != nil {
-					u.Logger.Warning("Unable to chown file to", block.uid, "/", block.gid, ":", err.Error())
-				}
-			}
-			if !u.IgnorePerms {
-				err = file.Chmod(block.mode)
-				if err != nil {
-					u.Logger.Warning("Unable to chmod file to", block.mode, ":", err.Error())
-				}
-			}
-		} else if file == nil {
-			// do nothing; file couldn't be opened for write
-		} else if block.blockType == blockTypeEndOfFile {
-			bufferedFile.Flush()
-			file.Close()
-			file = nil
-		} else {
-			_, err := bufferedFile.Write(block.buffer[:block.numBytes])
-			if err != nil {
-				u.Logger.Warning("File write error:", err.Error())
-			}
+// Returns the number of events discarded because the Events channel was full.
+func (u *Unarchiver) DroppedEvents() int64 {
+	if u.events == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&u.events.dropped)
+}
+
+// Removes the writers that have finished, to bound the memory used to track
+// them.
+func pruneFinishedWriters(writersDone map[string]chan bool) {
+	for outputPath, done := range writersDone {
+		select {
+		case <-done:
+			delete(writersDone, outputPath)
+		default:
+		}
+	}
+}
+
+// A block for a file's writer.  The start of each file carries a channel
+// that's closed once the file has been written.
+type fileBlock struct {
+	block
+	done chan bool
+}
+
+// Writes the files whose blocks are sent to blockSource, until it's closed.
+// Files whose end never arrived, because the run was stopped, are released.
+func (u *Unarchiver) writeFiles(sink Sink, blockSource chan fileBlock, workInProgress *sync.WaitGroup) {
+	writers := make(map[string]*fileWriter)
+	for b := range blockSource {
+		w := writers[b.filePath]
+		if b.blockType == blockTypeStartOfFile {
+			w = &fileWriter{u: u, sink: sink, done: b.done}
+			writers[b.filePath] = w
 		}
+		w.write(b.block)
+		if b.blockType == blockTypeData || b.blockType == blockTypeDataAt {
+			u.buffered.release(int64(b.numBytes))
+		} else if b.blockType == blockTypeEndOfFile {
+			delete(writers, b.filePath)
+			close(w.done)
+		}
+	}
+	for _, w := range writers {
+		w.stop()
+		close(w.done)
 	}
 	workInProgress.Done()
 }
+
+// Writes the blocks of a single file to a Sink.
+type fileWriter struct {
+	u      *Unarchiver
+	sink   Sink
+	file   io.WriteCloser
+	fileAt io.WriterAt
+	// Closed by writeFiles once the file has been written.
+	done chan bool
+}
+
+func (w *fileWriter) write(block block) {
+	u := w.u
+	defer addTime(&u.stats.WriteTime, time.Now())
+	if block.blockType == blockTypeStartOfFile {
+		logEntry(u.log(), block.filePath, false)
+
+		file, err := w.sink.CreateFile(block.filePath, EntryMeta{block.uid, block.gid, block.mode, block.attributes})
+		if err != nil && u.MetadataOnly && os.IsNotExist(err) {
+			u.log().Warning("File missing:", block.filePath)
+			u.problems.add(block.filePath, "missing", err)
+			atomic.AddInt64(&u.stats.MissingFiles, 1)
+			w.file = nil
+			return
+		} else if err != nil {
+			u.log().Warning("File create error:", err.Error())
+			u.problems.add(block.filePath, "create", err)
+			u.events.send(EntrySkipped{block.filePath, err.Error()})
+			w.file = nil
+			return
+		}
+		w.file = file
+		w.fileAt, _ = file.(io.WriterAt)
+		atomic.AddInt64(&u.stats.Files, 1)
+		u.events.send(FileStarted{block.filePath})
+	} else if w.file == nil {
+		// do nothing; file couldn't be opened for write
+	} else if block.blockType == blockTypeEndOfFile {
+		err := w.file.Close()
+		w.file = nil
+		if err != nil {
+			u.log().Warning("File write error:", err.Error())
+			u.problems.add(block.filePath, "write", err)
+		}
+		u.events.send(FileCompleted{block.filePath})
+	} else if block.blockType == blockTypeDataAt {
+		if w.fileAt == nil {
+			// Reported once, rather than for every block of the file.
+			u.log().Warning("File write error:", ErrSinkNotWriterAt.Error())
+			u.problems.add(block.filePath, "write", ErrSinkNotWriterAt)
+			w.fileAt = nopFile{}
+		}
+		n, err := w.fileAt.WriteAt(block.buffer[:block.numBytes], block.offset)
+		atomic.AddInt64(&u.stats.BytesWritten, int64(n))
+		if err != nil {
+			u.log().Warning("File write error:", err.Error())
+			u.problems.add(block.filePath, "write", err)
+		}
+	} else {
+		n, err := w.file.Write(block.buffer[:block.numBytes])
+		atomic.AddInt64(&u.stats.BytesWritten, int64(n))
+		if err != nil {
+			u.log().Warning("File write error:", err.Error())
+			u.problems.add(block.filePath, "write", err)
+		}
+	}
+}
+
+// Releases a file whose end block never arrived, because the run was
+// stopped.
+func (w *fileWriter) stop() {
+	if w.file == nil {
+		return
+	}
+	if abandoner, ok := w.file.(interface{ abandon() }); ok {
+		abandoner.abandon()
+	} else {
+		w.file.Close()
+	}
+	w.file = nil
+}
@@ -0,0 +1,560 @@
+package falib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// A sink whose files are slow to write, recording how many were still open
+// when Finish was called.
+type slowSink struct {
+	nopSink
+	lock           sync.Mutex
+	open           int
+	openAtFinish   int
+	finished       bool
+	writtenAtClose []int
+}
+
+type slowSinkFile struct {
+	sink    *slowSink
+	written int
+}
+
+func (s *slowSink) CreateFile(path string, meta EntryMeta) (io.WriteCloser, error) {
+	s.lock.Lock()
+	s.open++
+	s.lock.Unlock()
+	return &slowSinkFile{sink: s}, nil
+}
+
+func (f *slowSinkFile) Write(buf []byte) (int, error) {
+	time.Sleep(20 * time.Millisecond)
+	f.written += len(buf)
+	return len(buf), nil
+}
+
+func (f *slowSinkFile) Close() error {
+	f.sink.lock.Lock()
+	f.sink.open--
+	f.sink.writtenAtClose = append(f.sink.writtenAtClose, f.written)
+	f.sink.lock.Unlock()
+	return nil
+}
+
+func (s *slowSink) Finish(err error) error {
+	s.lock.Lock()
+	s.openAtFinish = s.open
+	s.finished = true
+	s.lock.Unlock()
+	return nil
+}
+
+func TestRunWaitsForWritersOnError(t *testing.T) {
+	// A file whose data blocks are followed by a block of an unknown type,
+	// so that the run fails while the file is still being written.
+	var buf bytes.Buffer
+	w := faformat.NewBlockWriter(&buf)
+	w.WriteHeader()
+	w.WriteBlock(&faformat.Block{Path: "f", Type: faformat.BlockStartOfFile, Mode: 0644})
+	for i := 0; i < 5; i++ {
+		w.WriteBlock(&faformat.Block{Path: "f", Type: faformat.BlockData, Data: []byte("data")})
+	}
+	buf.Write([]byte{0, 1, 'f', 42})
+
+	for _, writerCount := range []int{0, 2} {
+		sink := &slowSink{}
+		u := NewUnarchiverWithSink(bytes.NewReader(buf.Bytes()), sink)
+		u.WriterCount = writerCount
+		if err := u.Run(); !errors.Is(err, ErrUnrecognizedBlockType) {
+			t.Fatalf("WriterCount %d: Run returned %v, expected ErrUnrecognizedBlockType", writerCount, err)
+		}
+		if !sink.finished || sink.openAtFinish != 0 {
+			t.Errorf("WriterCount %d: %d files still open when the sink was finished", writerCount, sink.openAtFinish)
+		}
+		if len(sink.writtenAtClose) != 1 || sink.writtenAtClose[0] != 20 {
+			t.Errorf("WriterCount %d: files closed after writing %v bytes, expected the 20 read before the error", writerCount, sink.writtenAtClose)
+		}
+	}
+}
+
+func TestBackslashPaths(t *testing.T) {
+	archive := writeRawArchive(t, false,
+		&faformat.Block{Path: `dir\sub`, Type: faformat.BlockDirectory, Mode: os.ModeDir | 0755},
+		&faformat.Block{Path: `dir\sub\file`, Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: `dir\sub\file`, Type: faformat.BlockData, Data: []byte("data")},
+		&faformat.Block{Path: `dir\sub\file`, Type: faformat.BlockEndOfFile})
+
+	extract := func(archive []byte, backslashPaths bool) ([]string, error) {
+		sink := &mapSink{entries: make(map[string]Entry)}
+		u := NewUnarchiverWithSink(bytes.NewReader(archive), sink)
+		u.BackslashPaths = backslashPaths
+		err := u.Run()
+		var paths []string
+		for path := range sink.entries {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		return paths, err
+	}
+
+	// Without BackslashPaths, a backslash is just part of a name.
+	paths, err := extract(archive, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if expected := []string{`dir\sub`, `dir\sub\file`}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("extracted %q, expected %q", paths, expected)
+	}
+	paths, err = extract(archive, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if expected := []string{"dir/sub", "dir/sub/file"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("extracted %q with BackslashPaths, expected %q", paths, expected)
+	}
+
+	// The translated path is checked again, so it can't escape.
+	escaping := writeRawArchive(t, false,
+		&faformat.Block{Path: `dir\..\..\escape`, Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: `dir\..\..\escape`, Type: faformat.BlockEndOfFile})
+	if _, err := extract(escaping, true); !errors.Is(err, ErrParentDirectoryPath) {
+		t.Errorf("extracting a path that escapes through backslashes gave %v, expected ErrParentDirectoryPath", err)
+	}
+}
+
+// Single-block files are written inline, so the blocks read ahead to find
+// them have to go back to any file they belong to.
+func TestInlineAndInterleavedFiles(t *testing.T) {
+	start := func(path string) *faformat.Block {
+		return &faformat.Block{Path: path, Type: faformat.BlockStartOfFile, Mode: 0644}
+	}
+	data := func(path string, data string) *faformat.Block {
+		return &faformat.Block{Path: path, Type: faformat.BlockData, Data: []byte(data)}
+	}
+	end := func(path string) *faformat.Block {
+		return &faformat.Block{Path: path, Type: faformat.BlockEndOfFile}
+	}
+	archive := writeRawArchive(t, false,
+		start("empty"), end("empty"),
+		start("one"), data("one", "1"), end("one"),
+		start("two"), data("two", "2a"), data("two", "2b"), end("two"),
+		// A single-block file inside another file.
+		start("outer"), data("outer", "o1"),
+		start("inner"), data("inner", "i"), end("inner"),
+		data("outer", "o2"), end("outer"),
+		// Files whose starts come before each other's data.
+		start("x"), start("y"), data("x", "x"), end("x"), data("y", "y"), end("y"),
+		// A file that's empty but for its start, just before the next.
+		start("z"), start("last"), end("z"), data("last", "last"), end("last"))
+
+	sink := &mapSink{entries: make(map[string]Entry)}
+	if err := NewUnarchiverWithSink(bytes.NewReader(archive), sink).Run(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"empty": "",
+		"one":   "1",
+		"two":   "2a2b",
+		"outer": "o1o2",
+		"inner": "i",
+		"x":     "x",
+		"y":     "y",
+		"z":     "",
+		"last":  "last",
+	}
+	for path, contents := range expected {
+		if entry, ok := sink.entries[path]; !ok {
+			t.Errorf("%s wasn't extracted", path)
+		} else if string(entry.Data) != contents {
+			t.Errorf("%s extracted as %q, expected %q", path, entry.Data, contents)
+		}
+	}
+	if len(sink.entries) != len(expected) {
+		t.Errorf("extracted %d entries, expected %d", len(sink.entries), len(expected))
+	}
+}
+
+// A sink whose files take delay for each write, as a slow disk or network
+// filesystem might.
+type delaySink struct {
+	Sink
+	delay time.Duration
+}
+
+type delayFile struct {
+	io.WriteCloser
+	delay time.Duration
+}
+
+func (s delaySink) CreateFile(path string, meta EntryMeta) (io.WriteCloser, error) {
+	file, err := s.Sink.CreateFile(path, meta)
+	return delayFile{file, s.delay}, err
+}
+
+func (f delayFile) Write(buf []byte) (int, error) {
+	time.Sleep(f.delay)
+	return f.WriteCloser.Write(buf)
+}
+
+// Restores 1,000 files of 1 KiB, each a single block that's written inline
+// rather than by a goroutine of its own.  With a sink that sleeps for each
+// file, inline writes aren't overlapped with each other, so the time is the
+// sum of the sleeps, which may each be much longer than the 50µs asked for.
+func BenchmarkRestoreSmallFiles(b *testing.B) {
+	var archive bytes.Buffer
+	w := NewWriter(&archive)
+	data := bytes.Repeat([]byte("x"), 1024)
+	for i := 0; i < 1000; i++ {
+		if err := w.WriteHeader(&Header{Path: fmt.Sprintf("dir%d/file%d", i/100, i), EntryMeta: EntryMeta{Mode: 0644}}); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		sink Sink
+	}{
+		{"discard", nopSink{}},
+		{"slow sink", delaySink{nopSink{}, 50 * time.Microsecond}},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			b.SetBytes(int64(archive.Len()))
+			for i := 0; i < b.N; i++ {
+				u := NewUnarchiverWithSink(bytes.NewReader(archive.Bytes()), test.sink)
+				if err := u.Run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Restores interleaved files to a slow sink, which would otherwise leave
+// their data queued for the writers.
+func TestMaxBufferedBytes(t *testing.T) {
+	const files, blocks = 8, 8
+	var interleaved []*faformat.Block
+	for i := 0; i < files; i++ {
+		interleaved = append(interleaved, &faformat.Block{Path: fmt.Sprint(i), Type: faformat.BlockStartOfFile, Mode: 0644})
+	}
+	for j := 0; j < blocks; j++ {
+		for i := 0; i < files; i++ {
+			interleaved = append(interleaved, &faformat.Block{Path: fmt.Sprint(i), Type: faformat.BlockData, Data: bytes.Repeat([]byte{byte(i)}, 4096)})
+		}
+	}
+	for i := 0; i < files; i++ {
+		interleaved = append(interleaved, &faformat.Block{Path: fmt.Sprint(i), Type: faformat.BlockEndOfFile})
+	}
+
+	extract := func(archive []byte, limit int64) (map[string]Entry, int64) {
+		sink := &mapSink{entries: make(map[string]Entry)}
+		u := NewUnarchiverWithSink(bytes.NewReader(archive), delaySink{sink, time.Millisecond})
+		u.MaxBufferedBytes = limit
+		if err := u.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return sink.entries, u.Stats().PeakBufferedBytes
+	}
+
+	archive := writeRawArchive(t, false, interleaved...)
+	if _, peak := extract(archive, 0); peak <= 16<<10 {
+		t.Errorf("peak of %d bytes buffered without a limit; the test needs more", peak)
+	}
+	entries, peak := extract(archive, 16<<10)
+	if peak == 0 || peak > 16<<10 {
+		t.Errorf("peak of %d bytes buffered, expected at most %d", peak, 16<<10)
+	}
+	for i := 0; i < files; i++ {
+		if data := entries[fmt.Sprint(i)].Data; !bytes.Equal(data, bytes.Repeat([]byte{byte(i)}, blocks*4096)) {
+			t.Errorf("file %d extracted with %d bytes, expected %d of %d", i, len(data), blocks*4096, i)
+		}
+	}
+
+	// A block larger than the whole limit still gets through.
+	archive = writeRawArchive(t, false,
+		&faformat.Block{Path: "large", Type: faformat.BlockStartOfFile, Mode: 0644},
+		&faformat.Block{Path: "large", Type: faformat.BlockData, Data: make([]byte, 65535)},
+		&faformat.Block{Path: "large", Type: faformat.BlockData, Data: make([]byte, 65535)},
+		&faformat.Block{Path: "large", Type: faformat.BlockEndOfFile})
+	if entries, _ := extract(archive, 16<<10); len(entries["large"].Data) != 2*65535 {
+		t.Errorf("large extracted with %d bytes, expected %d", len(entries["large"].Data), 2*65535)
+	}
+}
+
+// Counts the reads passed on to an io.Reader.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(buf []byte) (int, error) {
+	c.reads++
+	return c.r.Read(buf)
+}
+
+// Extracts an archive from an OS pipe, discarding its contents, with input
+// buffers of different sizes; reads/op is the number of read system calls.
+// A pipe holds 64 KiB on Linux, which limits how much each read returns.
+func BenchmarkInputBufferSize(b *testing.B) {
+	var archive bytes.Buffer
+	w := NewWriter(&archive)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<20/16)
+	for i := 0; i < 16; i++ {
+		if err := w.WriteHeader(&Header{Path: fmt.Sprintf("file%d", i), EntryMeta: EntryMeta{Mode: 0644}}); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(archive.Len()))
+			reads := 0
+			for i := 0; i < b.N; i++ {
+				r, w, err := os.Pipe()
+				if err != nil {
+					b.Fatal(err)
+				}
+				go func() {
+					w.Write(archive.Bytes())
+					w.Close()
+				}()
+				input := &countingReader{r: r}
+				u := NewUnarchiverWithSink(input, nopSink{})
+				u.InputBufferSize = size
+				err = u.Run()
+				r.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				reads += input.reads
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// An input that takes delay for each read, as a pipe from a distant host
+// might.
+type delayReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (d delayReader) Read(buf []byte) (int, error) {
+	time.Sleep(d.delay)
+	return d.r.Read(buf)
+}
+
+// Extracts 32 files of 64 KiB from a slow input to a fast sink, and from a
+// fast input to a slow sink, turning each of the extraction knobs in turn.
+// A larger InputBufferSize helps the slow input by reading less often.  A
+// larger FileQueueSize helps the slow sink by letting the archive be read
+// ahead of its writes; since these files are archived one after another,
+// more WriterCount alone doesn't, as each file's queue fills before the next
+// is reached.  FileBufferSize only applies to the default sink, so it's left
+// to benchextract.sh.
+func BenchmarkExtractTuning(b *testing.B) {
+	var archive bytes.Buffer
+	w := NewWriter(&archive)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10/16)
+	for i := 0; i < 32; i++ {
+		if err := w.WriteHeader(&Header{Path: fmt.Sprintf("file%d", i), EntryMeta: EntryMeta{Mode: 0644}}); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, scenario := range []struct {
+		name       string
+		readDelay  time.Duration
+		writeDelay time.Duration
+	}{
+		{"slow input", time.Millisecond, 0},
+		{"slow sink", 0, 100 * time.Microsecond},
+	} {
+		for _, knob := range []struct {
+			name  string
+			setup func(u *Unarchiver)
+		}{
+			{"defaults", func(u *Unarchiver) {}},
+			{"input buffer 64KiB", func(u *Unarchiver) { u.InputBufferSize = 64 << 10 }},
+			{"input buffer 8MiB", func(u *Unarchiver) { u.InputBufferSize = 8 << 20 }},
+			{"file queue 64", func(u *Unarchiver) { u.FileQueueSize = 64 }},
+			{"writers 1", func(u *Unarchiver) { u.WriterCount = 1 }},
+			{"writers 8", func(u *Unarchiver) { u.WriterCount = 8 }},
+			{"writers 8 file queue 64", func(u *Unarchiver) {
+				u.WriterCount = 8
+				u.FileQueueSize = 64
+			}},
+		} {
+			b.Run(scenario.name+"/"+knob.name, func(b *testing.B) {
+				b.SetBytes(int64(archive.Len()))
+				for i := 0; i < b.N; i++ {
+					var input io.Reader = bytes.NewReader(archive.Bytes())
+					if scenario.readDelay > 0 {
+						input = delayReader{input, scenario.readDelay}
+					}
+					var sink Sink = nopSink{}
+					if scenario.writeDelay > 0 {
+						sink = delaySink{sink, scenario.writeDelay}
+					}
+					u := NewUnarchiverWithSink(input, sink)
+					knob.setup(u)
+					if err := u.Run(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSkipChecksums(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<20/16)
+	archive := writeArchive(t, "a", "alpha", "large", string(data))
+	archive[bytes.Index(archive, []byte("alpha"))] ^= 1
+
+	extract := func(skip bool) (*mapSink, UnarchiverStats, int, error) {
+		sink := &mapSink{entries: make(map[string]Entry)}
+		events := make(chan Event, 1000)
+		u := NewUnarchiverWithSink(bytes.NewReader(archive), sink)
+		u.SkipChecksums = skip
+		u.Events = events
+		err := u.Run()
+		close(events)
+		verified := 0
+		for event := range events {
+			if _, ok := event.(ChecksumVerified); ok {
+				verified++
+			}
+		}
+		return sink, u.Stats(), verified, err
+	}
+
+	var checksumErr *faformat.ChecksumError
+	if _, stats, _, err := extract(false); !errors.As(err, &checksumErr) || stats.ChecksumsSkipped != 0 {
+		t.Errorf("extracting a damaged archive returned %v, with %d checksums skipped", err, stats.ChecksumsSkipped)
+	}
+	sink, stats, verified, err := extract(true)
+	if err != nil {
+		t.Fatalf("extracting a damaged archive without checksums returned %v", err)
+	}
+	if stats.ChecksumsVerified != 0 || stats.ChecksumsSkipped == 0 || verified != 0 {
+		t.Errorf("%d checksums verified, %d skipped and %d events, expected only skipped", stats.ChecksumsVerified, stats.ChecksumsSkipped, verified)
+	}
+	// The checksum blocks are still read, so the rest of the archive is in
+	// step.
+	if string(sink.entries["a"].Data) != "`lpha" || !bytes.Equal(sink.entries["large"].Data, data) {
+		t.Errorf("extracted a as %q and large with %d bytes", sink.entries["a"].Data, len(sink.entries["large"].Data))
+	}
+}
+
+// Extracts 16 MiB with and without checking its checksums.
+func BenchmarkSkipChecksums(b *testing.B) {
+	var archive bytes.Buffer
+	w := NewWriter(&archive)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<20/16)
+	for i := 0; i < 16; i++ {
+		if err := w.WriteHeader(&Header{Path: fmt.Sprintf("file%d", i), EntryMeta: EntryMeta{Mode: 0644}}); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("skip=%v", skip), func(b *testing.B) {
+			b.SetBytes(int64(archive.Len()))
+			for i := 0; i < b.N; i++ {
+				u := NewUnarchiverWithSink(bytes.NewReader(archive.Bytes()), nopSink{})
+				u.SkipChecksums = skip
+				if err := u.Run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Counts the directories a Sink is asked to create.
+type dirCountingSink struct {
+	*mapSink
+	dirs int
+}
+
+func (s *dirCountingSink) CreateDir(path string, meta EntryMeta) error {
+	s.dirs++
+	return s.mapSink.CreateDir(path, meta)
+}
+
+func TestDuplicateDirectories(t *testing.T) {
+	archive := writeRawArchive(t, false,
+		&faformat.Block{Path: "same", Type: faformat.BlockDirectory, Mode: os.ModeDir | 0755},
+		&faformat.Block{Path: "differs", Type: faformat.BlockDirectory, Mode: os.ModeDir | 0755},
+		&faformat.Block{Path: "same", Type: faformat.BlockDirectory, Mode: os.ModeDir | 0755},
+		&faformat.Block{Path: "differs", Type: faformat.BlockDirectory, Mode: os.ModeDir | 0700, Uid: 7, Gid: 7})
+
+	// An exact duplicate is skipped, and a conflict is warned about and
+	// takes the later entry.
+	var log bytes.Buffer
+	sink := &dirCountingSink{mapSink: &mapSink{entries: make(map[string]Entry)}}
+	u := NewUnarchiverWithSink(bytes.NewReader(archive), sink)
+	u.Logger = StdLogger(&log, false)
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if sink.dirs != 3 {
+		t.Errorf("created directories %d times, expected same once and differs twice", sink.dirs)
+	}
+	if stats := u.Stats(); stats.DuplicateDirectories != 1 || stats.DirectoryConflicts != 1 {
+		t.Errorf("%d duplicates and %d conflicts, expected 1 of each", stats.DuplicateDirectories, stats.DirectoryConflicts)
+	}
+	if meta := sink.entries["differs"].EntryMeta; meta.Uid != 7 || meta.Mode != os.ModeDir|0700 {
+		t.Errorf("differs extracted as %+v, expected the later 7:7 0700", meta)
+	}
+	if expected := "differs is archived more than once with different metadata: 0:0 drwxr-xr-x, then 7:7 drwx------"; !strings.Contains(log.String(), expected) {
+		t.Errorf("warned %q, expected both values", log.String())
+	}
+
+	u = NewUnarchiverWithSink(bytes.NewReader(archive), nopSink{})
+	u.StrictDirectories = true
+	err := u.Run()
+	var conflict *DirectoryConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrDirectoryConflict) {
+		t.Fatalf("Run returned %v, expected a *DirectoryConflictError", err)
+	}
+	if conflict.Path != "differs" || conflict.Existing.Mode != os.ModeDir|0755 || conflict.Conflict.Uid != 7 {
+		t.Errorf("conflict is %+v", conflict)
+	}
+}
@@ -0,0 +1,54 @@
+package falib
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// Opens a file for reading without updating its access time.  O_NOATIME is
+// only permitted for the file's owner (or with CAP_FOWNER), so this falls
+// back to a regular open when it's refused.
+func openNoAtime(name string) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOATIME, 0)
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EPERM {
+		return os.Open(name)
+	}
+	return file, err
+}
+
+// Filesystems whose contents are generated by the kernel, by their statfs
+// magic numbers from linux/magic.h.  devtmpfs isn't among them, as it
+// reports itself as tmpfs; its device files are skipped anyway.
+var virtualFilesystems = map[uint32]string{
+	0x9fa0:     "proc",
+	0x62656572: "sysfs",
+	0x64626720: "debugfs",
+	0x74726163: "tracefs",
+	0x73636673: "securityfs",
+	0x27e0eb:   "cgroup",
+	0x63677270: "cgroup2",
+	0x1cd1:     "devpts",
+	0x6165676c: "pstore",
+	0xcafe4a11: "bpf",
+	0xde5e81e4: "efivarfs",
+	0x62656570: "configfs",
+	0x65735543: "fusectl",
+	0x42494e4d: "binfmt_misc",
+	0x19800202: "mqueue",
+}
+
+// Returns the name of the virtual filesystem, such as proc or sysfs, that
+// the open directory is on, if it's on one.
+func virtualFilesystem(dir fs.File) (string, bool) {
+	osDir, ok := dir.(*os.File)
+	if !ok {
+		return "", false
+	}
+	var statfs syscall.Statfs_t
+	if err := syscall.Fstatfs(int(osDir.Fd()), &statfs); err != nil {
+		return "", false
+	}
+	name, ok := virtualFilesystems[uint32(statfs.Type)]
+	return name, ok
+}
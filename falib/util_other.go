@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package falib
+
+import (
+	"io/fs"
+	"os"
+)
+
+// O_NOATIME is only available on Linux; elsewhere, files are opened normally.
+func openNoAtime(name string) (*os.File, error) {
+	return os.Open(name)
+}
+
+// Virtual filesystems such as /proc are only recognized on Linux.
+func virtualFilesystem(dir fs.File) (string, bool) {
+	return "", false
+}
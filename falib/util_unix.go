@@ -1,3 +1,6 @@
+//go:build !windows
+// +build !windows
+
 package falib
 
 import (
@@ -5,22 +8,76 @@ import (
 	"syscall"
 )
 
-func (a *Archiver) getModeOwnership(file *os.File) (int, int, os.FileMode) {
+// Returns the uid, gid, mode and attributes from a FileInfo, warning in the
+// given phase if they can't be found.  File attributes are only recorded on
+// Windows.
+func (a *Archiver) infoModeOwnership(fi os.FileInfo, phase Phase) (int, int, os.FileMode, uint32) {
 	var uid int = 0
 	var gid int = 0
-	var mode os.FileMode = 0
-	fi, err := file.Stat()
-	if err != nil {
-		a.Logger.Warning("file stat error; uid/gid/mode will be incorrect:", err.Error())
-	} else {
-		mode = fi.Mode()
-		stat_t := fi.Sys().(*syscall.Stat_t)
-		if stat_t != nil {
-			uid = int(stat_t.Uid)
-			gid = int(stat_t.Gid)
-		} else {
-			a.Logger.Warning("unable to find file uid/gid")
-		}
+	stat_t, ok := fi.Sys().(*syscall.Stat_t)
+	if ok && stat_t != nil {
+		uid = int(stat_t.Uid)
+		gid = int(stat_t.Gid)
+	} else if a.FS == nil {
+		a.log(phase).Warning("unable to find file uid/gid")
+	}
+	return uid, gid, fi.Mode(), 0
+}
+
+// Returns the device id of the filesystem containing the file.
+func fileDevice(fi os.FileInfo) (uint64, bool) {
+	stat_t, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat_t == nil {
+		return 0, false
+	}
+	return uint64(stat_t.Dev), true
+}
+
+// Returns the inode number of the file.
+func fileInode(fi os.FileInfo) (uint64, bool) {
+	stat_t, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat_t == nil {
+		return 0, false
+	}
+	return uint64(stat_t.Ino), true
+}
+
+// Extracted files and directories are given the ownership recorded in the
+// archive.
+const canChown = true
+
+// The mode can be applied to a file while it's being written.
+const chmodAfterClose = false
+
+// Directories are given their archived mode once they're created.
+const chmodDirs = true
+
+// Converts a mode from an archive into the one given to an extracted entry.
+func restoredMode(mode os.FileMode) os.FileMode {
+	return mode
+}
+
+// File attributes only exist on Windows, so they're ignored elsewhere.
+func restoreAttributes(path string, attributes uint32, mask uint32) error {
+	return nil
+}
+
+// Paths need no conversion before they're passed to the operating system.
+func longPath(path string) string {
+	return path
+}
+
+// Returns true if the mode is that of a symbolic link.
+func isLink(mode os.FileMode) bool {
+	return mode&os.ModeSymlink != 0
+}
+
+// Returns the process's limit on open files, or 0 if it's unlimited or
+// unknown.
+func openFilesLimit() int {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil || rlimit.Cur > 1<<30 {
+		return 0
 	}
-	return uid, gid, mode
+	return int(rlimit.Cur)
 }
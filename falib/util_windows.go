@@ -1,13 +1,110 @@
 package falib
 
-import "os"
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 
-func (a *Archiver) getModeOwnership(file *os.File) (uid int, gid int, mode os.FileMode) {
-	fi, err := file.Stat()
-	if err != nil {
-		a.Logger.Warning("file stat error; uid/gid/mode will be incorrect:", err.Error())
-	} else {
-		mode = fi.Mode()
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// The file attributes that are archived and restored.
+const archivedAttributes = faformat.AttributeReadOnly | faformat.AttributeHidden | faformat.AttributeSystem
+
+// Returns the uid, gid, mode and attributes from a FileInfo.  Ownership isn't
+// available on Windows, so uid and gid are always 0.
+func (a *Archiver) infoModeOwnership(fi os.FileInfo, phase Phase) (uid int, gid int, mode os.FileMode, attributes uint32) {
+	mode = fi.Mode()
+	if data, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok && data != nil {
+		attributes = data.FileAttributes & archivedAttributes
 	}
 	return
 }
+
+// Device ids aren't available on Windows, so every file is treated as being
+// on the same filesystem.
+func fileDevice(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// Inode numbers aren't available from os.FileInfo on Windows.
+func fileInode(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// Returns true if the mode is that of a symbolic link or a junction.
+// Junctions are reported as irregular directories rather than as links, and
+// following them can archive the same tree twice, or loop forever where one
+// points at its own parent.
+func isLink(mode os.FileMode) bool {
+	return mode&os.ModeSymlink != 0 || (mode.IsDir() && mode&os.ModeIrregular != 0)
+}
+
+// Windows has no uid/gid ownership, so extracted files and directories keep
+// the ownership they're created with.
+const canChown = false
+
+// Chmod sets the read-only attribute, which would stop a file from being
+// written, so it's applied once the file is closed.
+const chmodAfterClose = true
+
+// Windows has no umask to undo, and the read-only attribute that Chmod would
+// set on a directory is used by Explorer to mark customized folders rather
+// than to prevent changes, so directory modes aren't applied.
+const chmodDirs = false
+
+// Windows only has a read-only attribute, which Chmod sets when the owner
+// write bit is clear.  Archives from other platforms may carry bits such as
+// setuid that have no meaning here, so only the permissions are kept.
+func restoredMode(mode os.FileMode) os.FileMode {
+	return mode & (os.ModeDir | os.ModePerm)
+}
+
+// Sets the attributes in mask to those given, leaving the file's other
+// attributes alone.
+func restoreAttributes(path string, attributes uint32, mask uint32) error {
+	mask &= archivedAttributes
+	pathp, err := syscall.UTF16PtrFromString(longPath(path))
+	if err != nil {
+		return err
+	}
+	current, err := syscall.GetFileAttributes(pathp)
+	if err != nil {
+		return err
+	}
+	updated := current&^mask | attributes&mask
+	if updated == current {
+		return nil
+	}
+	return syscall.SetFileAttributes(pathp, updated)
+}
+
+// Paths at least this long are given the extended-length prefix; shorter ones
+// are left as they are, so that they appear in error messages as given.  The
+// limit is MAX_PATH less room for an 8.3 file name, which applies when
+// creating directories.
+const longPathThreshold = 248
+
+// Converts a path into the extended-length form, \\?\C:\..., that lets the
+// Windows API use paths longer than MAX_PATH.  The prefix turns off the
+// resolution of relative paths, so the path is made absolute first.
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) || strings.HasPrefix(path, `\\.\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil || len(abs) < longPathThreshold {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		// \\server\share\... becomes \\?\UNC\server\share\...
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// Windows has no limit on open files comparable to RLIMIT_NOFILE.
+func openFilesLimit() int {
+	return 0
+}
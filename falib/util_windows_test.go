@@ -0,0 +1,230 @@
+package falib
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+func TestRestoredModeKeepsPermissions(t *testing.T) {
+	for _, test := range []struct {
+		archived, restored os.FileMode
+	}{
+		{0644, 0644},
+		{os.ModeSetuid | os.ModeSetgid | 0755, 0755},
+		{os.ModeDir | os.ModeSticky | 0777, os.ModeDir | 0777},
+	} {
+		if mode := restoredMode(test.archived); mode != test.restored {
+			t.Errorf("mode %v restored as %v, expected %v", test.archived, mode, test.restored)
+		}
+	}
+}
+
+// Extracts an archive written on Linux, with ownership and modes that
+// Windows can't represent.
+func TestExtractLinuxArchive(t *testing.T) {
+	var archive bytes.Buffer
+	w := NewWriter(&archive)
+	for _, hdr := range []Header{
+		{Path: "dir", IsDir: true, EntryMeta: EntryMeta{Uid: 1000, Gid: 1000, Mode: os.ModeSetgid | 0750}},
+		{Path: "dir/readonly", EntryMeta: EntryMeta{Uid: 1000, Gid: 1000, Mode: 0444}},
+		{Path: "dir/setuid", EntryMeta: EntryMeta{Mode: os.ModeSetuid | 0755}},
+	} {
+		hdr := hdr
+		if err := w.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if !hdr.IsDir {
+			if _, err := w.Write([]byte(hdr.Path)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	chdir(t, t.TempDir())
+	// The read-only file has to be made writable again to be removed.
+	defer os.Chmod(`dir\readonly`, 0644)
+	u := NewUnarchiver(bytes.NewReader(archive.Bytes()))
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if problems, _ := u.Problems(); len(problems) != 0 {
+		t.Errorf("problems extracting: %v", problems)
+	}
+	// Ownership is skipped, and counted, rather than failing for every entry.
+	if skipped := u.Stats().OwnershipSkipped; skipped != 3 {
+		t.Errorf("ownership skipped for %d entries, expected 3", skipped)
+	}
+
+	// The contents are written before the read-only attribute is set.
+	contents, err := os.ReadFile(`dir\readonly`)
+	if err != nil || string(contents) != "dir/readonly" {
+		t.Errorf("read-only file contains %q, %v", contents, err)
+	}
+	for path, readOnly := range map[string]bool{`dir\readonly`: true, `dir\setuid`: false} {
+		pathp, err := syscall.UTF16PtrFromString(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attributes, err := syscall.GetFileAttributes(pathp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (attributes&syscall.FILE_ATTRIBUTE_READONLY != 0) != readOnly {
+			t.Errorf("%s has attributes %#x; expected read-only to be %v", path, attributes, readOnly)
+		}
+	}
+}
+
+// Sets attributes on path, in addition to those it has.
+func setAttributes(t *testing.T, path string, attributes uint32) {
+	t.Helper()
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := syscall.GetFileAttributes(pathp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.SetFileAttributes(pathp, current|attributes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAttributesRoundTrip(t *testing.T) {
+	source := t.TempDir()
+	writeTree(t, source, map[string]string{"hidden": "h", "readonly": "r", "system": "s", "plain": "p", "dir/": ""})
+	chdir(t, source)
+	setAttributes(t, "hidden", syscall.FILE_ATTRIBUTE_HIDDEN)
+	setAttributes(t, "readonly", syscall.FILE_ATTRIBUTE_READONLY)
+	setAttributes(t, "system", syscall.FILE_ATTRIBUTE_SYSTEM)
+	setAttributes(t, "dir", syscall.FILE_ATTRIBUTE_HIDDEN)
+	// Read-only files have to be made writable again to be removed.
+	defer os.Chmod(filepath.Join(source, "readonly"), 0644)
+
+	a := NewArchiverTemplate()
+	if err := a.AddDirContentsAs(".", "."); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]uint32{
+		"hidden":   faformat.AttributeHidden,
+		"readonly": faformat.AttributeReadOnly,
+		"system":   faformat.AttributeSystem,
+		"plain":    0,
+		"dir":      faformat.AttributeHidden,
+	}
+	r := NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if attributes, ok := expected[hdr.Path]; ok && hdr.Attributes != attributes {
+			t.Errorf("%s archived with attributes %#x, expected %#x", hdr.Path, hdr.Attributes, attributes)
+		}
+	}
+	r.Close()
+
+	target := t.TempDir()
+	chdir(t, target)
+	defer os.Chmod(filepath.Join(target, "readonly"), 0644)
+	u := NewUnarchiver(bytes.NewReader(archive.Bytes()))
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for path, attributes := range expected {
+		pathp, err := syscall.UTF16PtrFromString(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := syscall.GetFileAttributes(pathp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored&archivedAttributes != attributes {
+			t.Errorf("%s restored with attributes %#x, expected %#x", path, restored&archivedAttributes, attributes)
+		}
+	}
+}
+
+func TestPathsStoredWithForwardSlashes(t *testing.T) {
+	source := t.TempDir()
+	writeTree(t, source, map[string]string{"dir/sub/file": "data"})
+	a := NewArchiverTemplate()
+	if err := a.AddDirAs(source, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ExtractToMap(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"tree/dir", "tree/dir/sub", "tree/dir/sub/file"} {
+		if _, ok := entries[path]; !ok {
+			t.Errorf("%s isn't in the archive", path)
+		}
+	}
+}
+
+// Junctions are reported as irregular directories rather than as links, both
+// by Lstat and by the directory entries the scanner reads.
+func TestJunctionsSkipped(t *testing.T) {
+	source := t.TempDir()
+	writeTree(t, source, map[string]string{"target/file": "data"})
+	junction := filepath.Join(source, "junction")
+	if output, err := exec.Command("cmd", "/c", "mklink", "/J", junction, filepath.Join(source, "target")).CombinedOutput(); err != nil {
+		t.Skipf("unable to create a junction: %v %s", err, output)
+	}
+	info, err := os.Lstat(junction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isLink(info.Mode()) {
+		t.Errorf("junction has mode %v, which isn't treated as a link", info.Mode())
+	}
+
+	a := NewArchiverTemplate()
+	if err := a.AddDirAs(source, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := a.RunTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ExtractToMap(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["tree/target/file"]; !ok {
+		t.Error("tree/target/file isn't in the archive")
+	}
+	for path := range entries {
+		if strings.HasPrefix(path, "tree/junction") {
+			t.Errorf("%s archived through the junction", path)
+		}
+	}
+	if skipped := a.Stats().SkippedSymlinks; skipped != 1 {
+		t.Errorf("%d links skipped, expected the junction", skipped)
+	}
+}
@@ -0,0 +1,58 @@
+package falib
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestVirtualFilesystem(t *testing.T) {
+	for path, expected := range map[string]string{"/proc": "proc", "/sys": "sysfs", t.TempDir(): ""} {
+		dir, err := os.Open(path)
+		if err != nil {
+			t.Log(err)
+			continue
+		}
+		name, ok := virtualFilesystem(dir)
+		dir.Close()
+		if name != expected || ok != (expected != "") {
+			t.Errorf("%s is on %q, %v; expected %q", path, name, ok, expected)
+		}
+	}
+}
+
+func TestVirtualFilesystemsSkipped(t *testing.T) {
+	const source = "/proc/sys/fs/inotify"
+	if _, err := os.Stat(source + "/max_user_watches"); err != nil {
+		t.Skip(err)
+	}
+	for _, include := range []bool{false, true} {
+		a := NewArchiverTemplate()
+		a.IncludeVirtualFS = include
+		if err := a.AddDirAs(source, "inotify"); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := a.RunTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := ExtractToMap(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if include {
+			if _, ok := entries["inotify/max_user_watches"]; !ok {
+				t.Errorf("IncludeVirtualFS archived %v, expected the directory's contents", entryPaths(entries))
+			}
+			continue
+		}
+		// The directory is archived, but empty.
+		if paths := entryPaths(entries); !reflect.DeepEqual(paths, []string{"inotify"}) {
+			t.Errorf("archived %v, expected only the directory", paths)
+		}
+		if skipped := a.Stats().SkippedVirtualFS; skipped != 1 {
+			t.Errorf("%d virtual filesystems skipped, expected 1", skipped)
+		}
+	}
+}
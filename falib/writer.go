@@ -0,0 +1,267 @@
+package falib
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// Default number of blocks between checksum blocks.
+const defaultChecksumInterval = 1000
+
+// Writes an archive entry by entry, like archive/tar's Writer, for archives
+// whose contents don't come from a filesystem.  WriteHeader starts each
+// entry, and Write supplies the contents of the current file.  The Archiver
+// writes its archives through a Writer, too.
+type Writer struct {
+	// The maximum number of bytes of file data in each data block.
+	// Defaults to 4096.
+	BlockSize uint16
+
+	// Number of blocks between checksum blocks.  Defaults to 1000.  Each
+	// checksum block is deferred until the next end file or directory
+	// block, so that it falls on an entry boundary.
+	ChecksumInterval int
+
+	// If set, the archive is written in version 3 of the format, which can
+	// store Header.Metadata, but can't be read by versions of fast-archiver
+	// before it.  Must be set before the first entry is written.
+	EnableMetadata bool
+
+	// Key/value pairs describing the whole archive, such as the host that
+	// wrote it, written straight after the header; see
+	// Unarchiver.Metadata.  Like EnableMetadata, setting it writes version
+	// 3 of the format.  Must be set before the first entry is written.
+	ArchiveMetadata map[string]string
+
+	// Called after each checksum block is written.
+	onChecksum func() error
+	// Set by the Archiver when it may write offset data blocks, which need
+	// version 4 of the format.
+	dataAt bool
+
+	buffered *bufio.Writer
+	blocks   *faformat.BlockWriter
+	started  bool
+	closed   bool
+	err      error
+	// The file being written by Write, if any, and its data that hasn't yet
+	// filled a block.
+	current string
+	pending []byte
+}
+
+func NewWriter(output io.Writer) *Writer {
+	buffered := bufio.NewWriter(output)
+	retval := newWriter(buffered, 0, 0)
+	retval.buffered = buffered
+	return retval
+}
+
+// Creates a Writer that writes straight to output, leaving any buffering and
+// flushing to the caller.  Blocks are checksummed and written on other
+// goroutines, through bufferCount buffers of bufferSize bytes, which stop
+// when blocks.Close is called.
+func newWriter(output io.Writer, bufferSize int, bufferCount int) *Writer {
+	retval := &Writer{}
+	retval.BlockSize = 4096
+	retval.ChecksumInterval = defaultChecksumInterval
+	retval.blocks = faformat.NewConcurrentBlockWriter(output, bufferSize, bufferCount)
+	return retval
+}
+
+// Starts a new entry, ending the current file, if any.  For a file, its
+// contents are then written with Write.
+func (w *Writer) WriteHeader(hdr *Header) error {
+	if err := w.endFile(); err != nil {
+		return err
+	}
+	if err := checkArchivePath(hdr.Path); err != nil {
+		return err
+	}
+	if hdr.IsDir {
+		return w.writeEntryBlock(block{hdr.Path, 0, nil, blockTypeDirectory, hdr.Uid, hdr.Gid, hdr.Mode | os.ModeDir, 0, hdr.Attributes}, hdr.Metadata)
+	}
+	err := w.writeEntryBlock(block{hdr.Path, 0, nil, blockTypeStartOfFile, hdr.Uid, hdr.Gid, hdr.Mode, 0, hdr.Attributes}, hdr.Metadata)
+	if err == nil {
+		w.current = hdr.Path
+	}
+	return err
+}
+
+// Writes to the current file.
+func (w *Writer) Write(buf []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriteAfterClose
+	} else if w.current == "" {
+		return 0, ErrWriteWithoutHeader
+	}
+	written := 0
+	for len(buf) > 0 {
+		n := int(w.BlockSize) - len(w.pending)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		w.pending = append(w.pending, buf[:n]...)
+		buf = buf[n:]
+		if len(w.pending) == int(w.BlockSize) {
+			if err := w.flushData(); err != nil {
+				return written, err
+			}
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Ends the current file, and writes a final checksum block.  Doesn't close
+// the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	err := w.endFile()
+	if err == nil {
+		err = w.writeChecksum()
+	}
+	if closeErr := w.blocks.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && w.buffered != nil {
+		err = w.buffered.Flush()
+	}
+	w.closed = true
+	if w.err == nil {
+		w.err = err
+	}
+	return err
+}
+
+func (w *Writer) flushData() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	err := w.writeBlock(block{w.current, uint16(len(w.pending)), w.pending, blockTypeData, 0, 0, 0, 0, 0})
+	w.pending = w.pending[:0]
+	return err
+}
+
+func (w *Writer) endFile() error {
+	if w.current == "" {
+		return nil
+	}
+	err := w.flushData()
+	if err == nil {
+		err = w.writeBlock(block{w.current, 0, nil, blockTypeEndOfFile, 0, 0, 0, 0, 0})
+	}
+	w.current = ""
+	return err
+}
+
+// Enables the format features that the writer's settings need, which
+// determine the version of the archive's header.
+func (w *Writer) enableFeatures() {
+	if w.EnableMetadata || len(w.ArchiveMetadata) > 0 {
+		w.blocks.EnableEntryMeta()
+	}
+	if w.dataAt {
+		w.blocks.EnableDataAt()
+	}
+}
+
+// Continues an archive whose first offset bytes have already been written,
+// with hashState being the state of the checksum at that point.
+func (w *Writer) resume(offset int64, hashState []byte) error {
+	w.started = true
+	w.enableFeatures()
+	return w.blocks.Resume(offset, hashState)
+}
+
+// Writes the archive header, unless it has already been written.
+func (w *Writer) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	w.enableFeatures()
+	w.err = w.blocks.WriteHeader()
+	if w.err == nil && len(w.ArchiveMetadata) > 0 {
+		w.err = w.blocks.WriteBlock(&faformat.Block{Type: faformat.BlockEntryMeta, Metadata: w.ArchiveMetadata})
+	}
+	return w.err
+}
+
+// Writes a block, followed by a checksum block if one is due and the block
+// ends an entry.  Paths are stored with forward slashes, whatever the
+// platform's separator.
+func (w *Writer) writeBlock(b block) error {
+	return w.writeEntryBlock(b, nil)
+}
+
+// Like writeBlock, but a start file or directory block is preceded by an
+// entry metadata block holding metadata, if it isn't empty.
+func (w *Writer) writeEntryBlock(b block, metadata map[string]string) error {
+	if w.err != nil {
+		return w.err
+	} else if w.closed {
+		return ErrWriteAfterClose
+	} else if err := w.start(); err != nil {
+		return err
+	}
+	b.filePath = filepath.ToSlash(b.filePath)
+	if len(metadata) > 0 && (b.blockType == blockTypeStartOfFile || b.blockType == blockTypeDirectory) {
+		// Checked before anything is written, so that an entry whose
+		// metadata can't be stored is rejected without failing the rest of
+		// the archive.
+		if !w.EnableMetadata {
+			return faformat.ErrEntryMetaDisabled
+		} else if err := faformat.CheckEntryMeta(metadata); err != nil {
+			return err
+		}
+		meta := &faformat.Block{Path: b.filePath, Type: faformat.BlockEntryMeta, Metadata: metadata}
+		err := w.blocks.WriteBlock(meta)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+	}
+	if b.attributes != 0 && (b.blockType == blockTypeStartOfFile || b.blockType == blockTypeDirectory) {
+		// Written directly, so that a checksum block can't come between the
+		// attributes and their entry.
+		attributes := block{b.filePath, 0, nil, blockTypeAttributes, 0, 0, 0, 0, b.attributes}
+		err := w.blocks.WriteBlock(attributes.format())
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+	}
+	err := w.blocks.WriteBlock(b.format())
+	if err != nil {
+		w.err = err
+		return w.err
+	}
+	endsEntry := b.blockType == blockTypeEndOfFile || b.blockType == blockTypeDirectory
+	if endsEntry && w.blocks.BlocksSinceChecksum() >= w.ChecksumInterval {
+		return w.writeChecksum()
+	}
+	return nil
+}
+
+// Writes a checksum block covering everything written so far.
+func (w *Writer) writeChecksum() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	err := w.blocks.WriteChecksum()
+	if err != nil {
+		w.err = err
+		return w.err
+	}
+	if w.onChecksum != nil {
+		return w.onChecksum()
+	}
+	return nil
+}
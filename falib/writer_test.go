@@ -0,0 +1,149 @@
+package falib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/replicon/fast-archiver/falib/faformat"
+)
+
+// An empty archive with the archive metadata {"goos": "linux", "tag": "v1"},
+// as written by Writer: a version 3 header, the metadata block with its
+// empty path, and the final checksum block.
+var goldenMetadataArchive = []byte{
+	0x89, 'F', 'A', '3', 0x0D, 0x0A, 0x1A, 0x0A,
+	// Entry metadata block: no path, type 7, two pairs sorted by key.
+	0x00, 0x00, 0x07, 0x00, 0x02,
+	0x00, 0x04, 'g', 'o', 'o', 's', 0x00, 0x05, 'l', 'i', 'n', 'u', 'x',
+	0x00, 0x03, 't', 'a', 'g', 0x00, 0x02, 'v', '1',
+	// Checksum block: no path, type 4, and the ECMA CRC64 of everything
+	// before it.
+	0x00, 0x00, 0x04,
+	0x84, 0x47, 0x80, 0xe6, 0x03, 0x7f, 0x48, 0x1b,
+}
+
+func TestArchiveMetadataGolden(t *testing.T) {
+	metadata := map[string]string{"goos": "linux", "tag": "v1"}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.ArchiveMetadata = metadata
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), goldenMetadataArchive) {
+		t.Errorf("archive is\n%#v\nexpected\n%#v", buf.Bytes(), goldenMetadataArchive)
+	}
+
+	u := NewUnarchiverWithSink(bytes.NewReader(goldenMetadataArchive), nopSink{})
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u.Metadata(), metadata) {
+		t.Errorf("Metadata() is %v, expected %v", u.Metadata(), metadata)
+	}
+}
+
+func TestNoArchiveMetadataWritesVersion2(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WriteHeader(&Header{Path: "f", EntryMeta: EntryMeta{Mode: 0644}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x89, 'F', 'A', '2', 0x0D, 0x0A, 0x1A, 0x0A}
+	if !bytes.HasPrefix(buf.Bytes(), expected) {
+		t.Errorf("header is %q, expected %q", buf.Bytes()[:8], expected)
+	}
+
+	u := NewUnarchiverWithSink(bytes.NewReader(buf.Bytes()), nopSink{})
+	if err := u.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if u.Metadata() != nil {
+		t.Errorf("Metadata() is %v, expected nil", u.Metadata())
+	}
+}
+
+// Checks that every checksum block in archive directly follows the end of a
+// file or a directory, or another checksum block, as the final one can, and
+// returns the number of checksum blocks.
+func checkChecksumBoundaries(t *testing.T, archive []byte) int {
+	t.Helper()
+	r := faformat.NewBlockReader(bytes.NewReader(archive))
+	if err := r.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	checksums := 0
+	previous := faformat.BlockChecksum
+	for {
+		b, err := r.Next()
+		if err == io.EOF {
+			return checksums
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if b.Type == faformat.BlockChecksum {
+			checksums++
+			switch previous {
+			case faformat.BlockEndOfFile, faformat.BlockDirectory, faformat.BlockChecksum:
+			default:
+				t.Errorf("checksum block %d at offset %d follows a block of type %d rather than the end of an entry", checksums, r.Offset(), previous)
+			}
+		}
+		previous = b.Type
+	}
+}
+
+func TestChecksumsOnEntryBoundaries(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.ChecksumInterval = 4
+	blockSize := int(w.BlockSize)
+	data := bytes.Repeat([]byte("x"), 10*blockSize)
+	for i := 0; i < 10; i++ {
+		if err := w.WriteHeader(&Header{Path: fmt.Sprintf("dir%d", i), IsDir: true, EntryMeta: EntryMeta{Mode: 0755}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteHeader(&Header{Path: fmt.Sprintf("dir%d/file", i), EntryMeta: EntryMeta{Mode: 0644}}); err != nil {
+			t.Fatal(err)
+		}
+		// Up to a few times the interval, so that checksums fall due
+		// mid-file.
+		if _, err := w.Write(data[:i*blockSize+i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if checksums := checkChecksumBoundaries(t, buf.Bytes()); checksums < 10 {
+		t.Errorf("%d checksum blocks, expected at least one per file", checksums)
+	}
+}
+
+func TestArchiverChecksumsOnEntryBoundaries(t *testing.T) {
+	// Enough blocks for several checksums at the default interval, from
+	// files read concurrently, so that their blocks are interleaved.
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for i := 0; i < 400; i++ {
+		files[fmt.Sprintf("d%d/f%d", i%7, i)] = string(bytes.Repeat([]byte("y"), i*97))
+	}
+	writeTree(t, dir, files)
+	a := NewArchiverTemplate()
+	if err := a.AddDirAs(dir, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := a.RunTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if checksums := checkChecksumBoundaries(t, buf.Bytes()); checksums < 3 {
+		t.Errorf("%d checksum blocks, expected at least 3", checksums)
+	}
+}
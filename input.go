@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"log"
+	"os"
+)
+
+// The archive to extract or list: stdin, or the files given with -i, read
+// one after another as a single archive, as when a stream has been split
+// into chunks.  Each file is opened once the one before it has been read.
+type input struct {
+	names []string
+	file  *os.File
+	// The index in names of the next file to open.
+	next int
+	// The offset in the archive at which each file opened so far starts.
+	starts []int64
+	offset int64
+}
+
+// Opens the archive to extract or list, from stdin if no names are given.
+// The files are checked up front, so that a missing one is reported before
+// anything is extracted.
+func openInput(logger *log.Logger, names []string) *input {
+	retval := &input{}
+	if len(names) == 0 {
+		retval.file = os.Stdin
+		return retval
+	}
+	for _, name := range names {
+		if _, err := os.Stat(name); err != nil {
+			logger.Fatalln("Error opening input file:", quote(err.Error()))
+		}
+	}
+	retval.names = names
+	return retval
+}
+
+func (in *input) Read(buf []byte) (int, error) {
+	for {
+		if in.file == nil {
+			if in.next >= len(in.names) {
+				return 0, io.EOF
+			}
+			file, err := os.Open(in.names[in.next])
+			if err != nil {
+				return 0, err
+			}
+			in.file = file
+			in.starts = append(in.starts, in.offset)
+			in.next++
+		}
+		n, err := in.file.Read(buf)
+		in.offset += int64(n)
+		if err != io.EOF || in.names == nil {
+			return n, err
+		}
+		in.file.Close()
+		in.file = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (in *input) Close() error {
+	if in.file == nil {
+		return nil
+	}
+	return in.file.Close()
+}
+
+// Describes an error reading the archive, adding the file and offset within
+// it where the error occurred, if the archive is split across several files.
+func (in *input) describe(err error) string {
+	retval := quote(err.Error())
+	blockErr, ok := err.(*falib.BlockError)
+	if !ok || len(in.names) < 2 || len(in.starts) == 0 {
+		return retval
+	}
+	i := len(in.starts) - 1
+	for i > 0 && in.starts[i] > blockErr.Offset {
+		i--
+	}
+	return retval + fmt.Sprintf(", in %s at offset %d", quote(in.names[i]), blockErr.Offset-in.starts[i])
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Archives don't record modification times, so the long listing shows this
+// in their place, padded to the width of a "2006-01-02 15:04" time.
+const missingTime = "-               "
+
+// Formats a mode as ls -l does, eg. "drwxr-x---", including the setuid,
+// setgid and sticky bits.
+func modeString(mode os.FileMode, isDir bool) string {
+	const rwx = "rwxrwxrwx"
+	buf := []byte("----------")
+	if isDir {
+		buf[0] = 'd'
+	}
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) != 0 {
+			buf[i+1] = rwx[i]
+		}
+	}
+	special := func(bit os.FileMode, i int, set byte) {
+		if mode&bit == 0 {
+			return
+		} else if buf[i] == '-' {
+			buf[i] = set - 'a' + 'A'
+		} else {
+			buf[i] = set
+		}
+	}
+	special(os.ModeSetuid, 3, 's')
+	special(os.ModeSetgid, 6, 's')
+	special(os.ModeSticky, 9, 't')
+	return string(buf)
+}
+
+// Formats an entry's metadata for the long listing, eg. "{label=x, oid=1}",
+// sorted by key.
+func metadataString(metadata map[string]string) string {
+	var pairs []string
+	for key, value := range metadata {
+		pairs = append(pairs, quote(key)+"="+quote(value))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// Describes an archive's metadata, eg. "archive {created=..., goarch=amd64}".
+func describeArchive(metadata map[string]string) string {
+	return "archive " + metadataString(metadata)
+}
+
+// How list mode prints each entry.
+const (
+	// Just the path.
+	listShort = iota
+	// The long form of tar -tv.
+	listLong
+	// A JSON object per line, followed by a summary object.
+	listJSON
+)
+
+// An entry in the JSON listing.  Archives don't record modification times
+// or file hashes, so those are never present.
+type jsonEntry struct {
+	Path string `json:"path"`
+	// "file" or "directory".
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	// In octal, including the setuid, setgid and sticky bits, eg. "0755".
+	Mode       string            `json:"mode"`
+	Uid        int               `json:"uid"`
+	Gid        int               `json:"gid"`
+	Attributes uint32            `json:"attributes,omitempty"`
+	Truncated  bool              `json:"truncated,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// The first line of the JSON listing, for an archive with metadata.
+type jsonArchive struct {
+	// Always "archive".
+	Type     string            `json:"type"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// The last line of the JSON listing, written once the whole archive has been
+// read and verified.
+type jsonSummary struct {
+	// Always "summary", to tell it apart from the entries.
+	Type        string `json:"type"`
+	Version     int    `json:"version"`
+	Files       int    `json:"files"`
+	Directories int    `json:"directories"`
+	DataSize    int64  `json:"data_size"`
+	ArchiveSize int64  `json:"archive_size"`
+	Checksums   int    `json:"checksums"`
+}
+
+// Returns the permission, setuid, setgid and sticky bits of a mode, as a
+// POSIX mode in octal.
+func octalMode(mode os.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+// How list mode orders entries when -sort is given.
+const (
+	sortNone = iota
+	// By path.
+	sortName
+	// Largest first, then by path.
+	sortSize
+)
+
+// Returns true if a is listed before b.
+func listedBefore(sortBy int, reverse bool, a *falib.EntryInfo, b *falib.EntryInfo) bool {
+	if reverse {
+		a, b = b, a
+	}
+	if sortBy == sortSize && a.Size != b.Size {
+		return a.Size > b.Size
+	}
+	return a.Path < b.Path
+}
+
+// Holds the first entries in listing order, with the last of them on top, so
+// that it can be dropped when an earlier one is found.
+type entryHeap struct {
+	entries []falib.EntryInfo
+	sortBy  int
+	reverse bool
+}
+
+func (h *entryHeap) Len() int { return len(h.entries) }
+func (h *entryHeap) Less(i, j int) bool {
+	return listedBefore(h.sortBy, h.reverse, &h.entries[j], &h.entries[i])
+}
+func (h *entryHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *entryHeap) Push(x interface{}) { h.entries = append(h.entries, x.(falib.EntryInfo)) }
+func (h *entryHeap) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
+
+// Writes the entries of an archive, one per line, in the order they're
+// completed unless they're sorted.  The long form follows tar -tv: mode,
+// owner/group, size, modification time and path, then any metadata.  Owners
+// are numeric, since archives only store ids.  As with tar, the owner and
+// size column widens to fit the longest value seen so far.
+type lister struct {
+	out    *bufio.Writer
+	format int
+	// Combined width of the owner/group and size columns.
+	ownerSizeWidth int
+
+	// When sorting, entries are held until the archive has been read.  If
+	// top is non-zero, only the first top entries in order are kept;
+	// otherwise, at most limit entries can be held, or any number if it's
+	// 0.
+	sortBy int
+	top    int
+	limit  int
+	sorted entryHeap
+}
+
+func newLister(out io.Writer, format int) *lister {
+	retval := &lister{}
+	retval.out = bufio.NewWriter(out)
+	retval.format = format
+	retval.ownerSizeWidth = 19
+	return retval
+}
+
+// Lists the archive's metadata before its entries, except in the short form,
+// which only lists paths.
+func (l *lister) archiveMetadata(metadata map[string]string) error {
+	switch l.format {
+	case listLong:
+		_, err := fmt.Fprintln(l.out, describeArchive(metadata))
+		return err
+	case listJSON:
+		return l.writeJSON(jsonArchive{"archive", metadata})
+	}
+	return nil
+}
+
+// Lists entries in sorted order, once the archive has been read.
+func (l *lister) sort(sortBy int, reverse bool, top int, limit int) {
+	l.sortBy = sortBy
+	l.top = top
+	l.limit = limit
+	l.sorted.sortBy = sortBy
+	l.sorted.reverse = reverse
+}
+
+// Lists an entry, or holds it to be sorted.
+func (l *lister) entry(entry falib.EntryInfo) error {
+	if l.sortBy == sortNone {
+		return l.print(entry)
+	} else if l.top > 0 {
+		heap.Push(&l.sorted, entry)
+		if l.sorted.Len() > l.top {
+			heap.Pop(&l.sorted)
+		}
+		return nil
+	} else if l.limit > 0 && l.sorted.Len() >= l.limit {
+		return fmt.Errorf("more than %d entries to sort; raise -sort-limit, or use -top to list only the first entries", l.limit)
+	}
+	l.sorted.entries = append(l.sorted.entries, entry)
+	return nil
+}
+
+func (l *lister) print(entry falib.EntryInfo) error {
+	if l.format == listJSON {
+		entryType := "file"
+		if entry.IsDir {
+			entryType = "directory"
+		}
+		return l.writeJSON(jsonEntry{entry.Path, entryType, entry.Size, octalMode(entry.Mode), entry.Uid, entry.Gid, entry.Attributes, entry.Truncated, entry.Metadata})
+	}
+
+	path := quote(entry.Path)
+	if entry.IsDir && !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	if l.format == listShort {
+		_, err := fmt.Fprintln(l.out, path)
+		return err
+	}
+
+	owner := strconv.Itoa(entry.Uid) + "/" + strconv.Itoa(entry.Gid)
+	size := strconv.FormatInt(entry.Size, 10)
+	width := len(owner) + 1 + len(size)
+	if width > l.ownerSizeWidth {
+		l.ownerSizeWidth = width
+	}
+	padding := strings.Repeat(" ", l.ownerSizeWidth-width+1)
+	if entry.Truncated {
+		path += " (truncated)"
+	}
+	if len(entry.Metadata) > 0 {
+		path += " " + metadataString(entry.Metadata)
+	}
+	_, err := fmt.Fprintf(l.out, "%s %s%s%s %s %s\n", modeString(entry.Mode, entry.IsDir), owner, padding, size, missingTime, path)
+	return err
+}
+
+// Ends the listing once the archive has been read without error, listing
+// any sorted entries.
+func (l *lister) finish(info falib.ArchiveInfo) error {
+	entries := l.sorted.entries
+	sort.Slice(entries, func(i, j int) bool {
+		return listedBefore(l.sorted.sortBy, l.sorted.reverse, &entries[i], &entries[j])
+	})
+	for _, entry := range entries {
+		if err := l.print(entry); err != nil {
+			return err
+		}
+	}
+	if l.format != listJSON {
+		return nil
+	}
+	return l.writeJSON(jsonSummary{"summary", info.Version, info.Files, info.Directories, info.DataSize, info.Size, info.Checksums})
+}
+
+func (l *lister) writeJSON(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	_, err = l.out.Write(line)
+	return err
+}
+
+func (l *lister) flush() error {
+	return l.out.Flush()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"github.com/replicon/fast-archiver/falib"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// A fixture archive with archive and entry metadata, special mode bits, and
+// owners of different widths.
+func fixtureArchive(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := falib.NewWriter(&buf)
+	w.EnableMetadata = true
+	w.ArchiveMetadata = map[string]string{"tag": "fixture"}
+	entries := []struct {
+		header falib.Header
+		data   string
+	}{
+		{falib.Header{Path: "etc", IsDir: true, EntryMeta: falib.EntryMeta{Mode: 0750}}, ""},
+		{falib.Header{Path: "etc/passwd", EntryMeta: falib.EntryMeta{Mode: 0644}}, "root:x:0:0\n"},
+		{falib.Header{Path: "bin", IsDir: true, EntryMeta: falib.EntryMeta{Mode: 0755}}, ""},
+		{falib.Header{Path: "bin/su", EntryMeta: falib.EntryMeta{Mode: os.ModeSetuid | 0755}}, "#!/bin/sh\n"},
+		{falib.Header{Path: "bin/wall", EntryMeta: falib.EntryMeta{Gid: 5, Mode: os.ModeSetgid | 0644}}, ""},
+		{falib.Header{Path: "tmp", IsDir: true, EntryMeta: falib.EntryMeta{Mode: os.ModeSticky | 0777}}, ""},
+		{falib.Header{Path: "home/user", IsDir: true, EntryMeta: falib.EntryMeta{Uid: 1000, Gid: 1000, Mode: 0700}}, ""},
+		{falib.Header{Path: "home/user/notes with spaces", EntryMeta: falib.EntryMeta{Uid: 1000, Gid: 1000, Mode: 0600},
+			Metadata: map[string]string{"label": "x", "oid": "1"}}, string(bytes.Repeat([]byte("n"), 70000))},
+	}
+	for _, entry := range entries {
+		if err := w.WriteHeader(&entry.header); err != nil {
+			t.Fatal(err)
+		}
+		if entry.data == "" {
+			continue
+		}
+		if _, err := w.Write([]byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Lists archive in the given format, followed by entries, as if they had
+// come after the archive's own.
+func listArchive(t *testing.T, archive []byte, format int, extra ...falib.EntryInfo) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	l := newLister(&out, format)
+	opts := falib.InspectOptions{ArchiveMetadata: l.archiveMetadata}
+	info, err := falib.InspectFunc(bytes.NewReader(archive), opts, l.entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range extra {
+		if err := l.entry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.finish(info); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// Compares output with the golden file testdata/name, or rewrites it with
+// -update.
+func checkGolden(t *testing.T, name string, output []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, output, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, expected) {
+		t.Errorf("%s differs; output is\n%s", name, output)
+	}
+}
+
+func TestListGolden(t *testing.T) {
+	archive := fixtureArchive(t)
+	checkGolden(t, "list.golden", listArchive(t, archive, listShort))
+	checkGolden(t, "list-long.golden", listArchive(t, archive, listLong))
+	checkGolden(t, "list-json.golden", listArchive(t, archive, listJSON))
+}
+
+func TestListLongWidensColumns(t *testing.T) {
+	// Entries with ids and sizes too wide for the default columns, which
+	// later entries are then aligned with.
+	archive := fixtureArchive(t)
+	extra := []falib.EntryInfo{
+		{Path: "huge", EntryMeta: falib.EntryMeta{Uid: 2000000000, Gid: 2000000000, Mode: 0644}, Size: 1 << 50},
+		{Path: "after", EntryMeta: falib.EntryMeta{Mode: 0644}, Size: 1},
+	}
+	checkGolden(t, "list-long-wide.golden", listArchive(t, archive, listLong, extra...))
+}
+
+func TestListLongVersion2(t *testing.T) {
+	// An archive without metadata, as earlier versions wrote, has no
+	// archive line, and no metadata after any entry.
+	var buf bytes.Buffer
+	w := falib.NewWriter(&buf)
+	if err := w.WriteHeader(&falib.Header{Path: "dir", IsDir: true, EntryMeta: falib.EntryMeta{Mode: 0755}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(&falib.Header{Path: "dir/file", EntryMeta: falib.EntryMeta{Mode: 0644}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "list-long-v2.golden", listArchive(t, buf.Bytes(), listLong))
+}
+
+// Each line is a JSON object, so paths that would break a line-based format
+// are escaped, and fields that are usually empty are included when they're
+// set.
+func TestListJSONLines(t *testing.T) {
+	extra := []falib.EntryInfo{
+		{Path: "line\nbreak \"quoted\"", EntryMeta: falib.EntryMeta{Mode: 0644, Attributes: 1}, Size: 5, Truncated: true},
+	}
+	output := listArchive(t, fixtureArchive(t), listJSON, extra...)
+	lines := strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")
+	objects := make([]map[string]interface{}, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &objects[i]); err != nil {
+			t.Fatalf("line %d, %q: %v", i+1, line, err)
+		}
+	}
+	if len(objects) != 11 {
+		t.Fatalf("listed %d objects, expected the archive, 9 entries and the summary", len(objects))
+	}
+	if objects[0]["type"] != "archive" || objects[10]["type"] != "summary" {
+		t.Errorf("listing starts with %v and ends with %v", objects[0], objects[10])
+	}
+	entry := objects[9]
+	if entry["path"] != extra[0].Path || entry["truncated"] != true || entry["attributes"] != 1.0 || entry["mode"] != "0644" {
+		t.Errorf("listed %v for %+v", entry, extra[0])
+	}
+	if _, ok := objects[1]["truncated"]; ok {
+		t.Errorf("listed %v, with truncated for a complete entry", objects[1])
+	}
+}
+
+func TestListSorted(t *testing.T) {
+	archive := fixtureArchive(t)
+	list := func(sortBy int, reverse bool, top int, limit int) ([]string, error) {
+		var out bytes.Buffer
+		l := newLister(&out, listShort)
+		l.sort(sortBy, reverse, top, limit)
+		info, err := falib.InspectFunc(bytes.NewReader(archive), falib.InspectOptions{}, l.entry)
+		if err != nil {
+			return nil, err
+		}
+		if err := l.finish(info); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.flush(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"), nil
+	}
+
+	byName := []string{"bin/", "bin/su", "bin/wall", "etc/", "etc/passwd", "home/user/", "home/user/notes with spaces", "tmp/"}
+	bySize := []string{"home/user/notes with spaces", "etc/passwd", "bin/su", "bin/", "bin/wall", "etc/", "home/user/", "tmp/"}
+	reversed := func(paths []string) []string {
+		var retval []string
+		for i := len(paths) - 1; i >= 0; i-- {
+			retval = append(retval, paths[i])
+		}
+		return retval
+	}
+	for _, test := range []struct {
+		name     string
+		sortBy   int
+		reverse  bool
+		top      int
+		expected []string
+	}{
+		{"name", sortName, false, 0, byName},
+		{"name reversed", sortName, true, 0, reversed(byName)},
+		{"size", sortSize, false, 0, bySize},
+		{"size reversed", sortSize, true, 0, reversed(bySize)},
+		{"top 3 by size", sortSize, false, 3, bySize[:3]},
+		{"top 2 by name reversed", sortName, true, 2, reversed(byName)[:2]},
+		{"top more than the entries", sortName, false, 100, byName},
+	} {
+		listed, err := list(test.sortBy, test.reverse, test.top, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(listed, test.expected) {
+			t.Errorf("%s: listed %q, expected %q", test.name, listed, test.expected)
+		}
+	}
+
+	// The limit applies only when every entry is held.
+	if _, err := list(sortName, false, 0, 5); err == nil || !strings.Contains(err.Error(), "more than 5 entries to sort") {
+		t.Errorf("sorting more entries than the limit returned %v", err)
+	}
+	if listed, err := list(sortName, false, 3, 5); err != nil || len(listed) != 3 {
+		t.Errorf("listing the top 3 under a limit of 5 returned %q, %v", listed, err)
+	}
+}
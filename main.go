@@ -1,32 +1,56 @@
 package main
 
 import (
-	"flag"
+	"errors"
 	"fmt"
 	"github.com/replicon/fast-archiver/falib"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var tag string
 var rev string
 
-type MultiLevelLogger struct {
-	logger  *log.Logger
-	verbose bool
+// Escapes file names and error messages before they're printed; see
+// falib.Quote.  -no-quote replaces it with one that leaves them as they are.
+var quote = falib.Quote
+
+// Exit status for a run that completed, but with files that couldn't be
+// archived or extracted completely.  Fatal errors exit with status 1.
+const exitProblems = 2
+
+// A flag.Value that collects each occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-func (l *MultiLevelLogger) Verbose(v ...interface{}) {
-	if l.verbose {
-		l.logger.Println(v...)
-	}
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
-func (l *MultiLevelLogger) Warning(v ...interface{}) {
-	l.logger.Println(v...)
+
+// Starts each message written by a log.Logger with the time, as
+// falib.TimestampLogger does.
+type timestampWriter struct {
+	w io.Writer
+}
+
+func (t timestampWriter) Write(buf []byte) (int, error) {
+	line := append([]byte(time.Now().Format(time.RFC3339)+" "), buf...)
+	if _, err := t.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
 }
 
 type sink bool
@@ -35,109 +59,691 @@ func (s sink) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// Parses a size such as "512", "10K", "4M" or "10G" into a number of bytes.
+// Suffixes are binary multiples and case-insensitive.  An empty string is
+// treated as zero.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	suffix := ""
+	if multiplier != 1 {
+		s, suffix = s[:len(s)-1], s[len(s)-1:]
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	} else if value < 0 {
+		return 0, fmt.Errorf("size must not be negative: %d", value)
+	} else if value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size is too large: %s", s+suffix)
+	}
+	return value * multiplier, nil
+}
+
+// Returns the metadata recorded in each archive unless -no-metadata is given:
+// the version of fast-archiver and the host that wrote it, and when.  The
+// host and time are left out of deterministic archives, so that the same tree
+// archived on two hosts, or at two times, gives the same bytes.
+func archiveMetadata(deterministic bool) map[string]string {
+	retval := map[string]string{"goos": runtime.GOOS, "goarch": runtime.GOARCH}
+	if tag != "" {
+		retval["tag"] = tag
+	}
+	if rev != "" {
+		retval["rev"] = rev
+	}
+	if deterministic {
+		return retval
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		retval["hostname"] = hostname
+	}
+	retval["created"] = time.Now().UTC().Format(time.RFC3339)
+	return retval
+}
+
+// Formats a number of bytes with the binary suffixes parseSize accepts, eg.
+// "4.5M".
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// Describes the work done by a run for -totals.  The rate is of dataBytes,
+// the file data read when creating or written when extracting.
+func totalsLine(files int64, directories int64, bytesRead int64, bytesWritten int64, dataBytes int64, elapsed time.Duration) string {
+	retval := fmt.Sprintf("%d files, %d directories; read %s, wrote %s in %.1fs", files, directories, formatSize(bytesRead), formatSize(bytesWritten), elapsed.Seconds())
+	if elapsed > 0 {
+		retval += fmt.Sprintf(", %s/s", formatSize(int64(float64(dataBytes)/elapsed.Seconds())))
+	}
+	return retval
+}
+
+// Parses the value of a buffer size flag, exiting if it's invalid.
+func bufferSize(logger *log.Logger, name string, value string) int {
+	size, err := parseSize(value)
+	if err != nil {
+		logger.Fatalln("Invalid "+name+":", quote(err.Error()))
+	} else if size <= 0 || size > math.MaxInt32 {
+		logger.Fatalln(name, "must be between 1 and 2G")
+	}
+	return int(size)
+}
+
+// Parses an octal mode such as "0644" or "2775", with the setuid, setgid and
+// sticky bits in their usual places.
+func parseMode(s string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	} else if value > 07777 {
+		return 0, fmt.Errorf("mode must be at most 7777: %s", s)
+	}
+	mode := os.FileMode(value & 0777)
+	if value&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if value&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if value&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// Parses a uid:gid pair for -unknown-owner; either may be left empty, in
+// which case it's returned as -1.
+func parseOwner(s string) (int, int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("owner must be uid:gid: %s", s)
+	}
+	ids := []int{-1, -1}
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return 0, 0, err
+		}
+		ids[i] = int(id)
+	}
+	return ids[0], ids[1], nil
+}
+
+// Writes each digest to a file beside the output named for its algorithm,
+// eg. archive.fa.sha256, in the format of sha256sum and its relatives.
+func writeChecksums(logger *log.Logger, fileName string, digests map[string]string) {
+	for algorithm, digest := range digests {
+		line := digest + "  " + filepath.Base(fileName) + "\n"
+		if err := ioutil.WriteFile(fileName+"."+algorithm, []byte(line), 0666); err != nil {
+			logger.Fatalln("Error writing checksum:", quote(err.Error()))
+		}
+	}
+}
+
+// Opens an interrupted archive to be continued, discarding anything written
+// after the last checkpoint.
+func openForResume(fileName string, offset int64) (*os.File, error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err == nil && fileInfo.Size() < offset {
+		err = fmt.Errorf("%s is shorter than the recorded progress", fileName)
+	}
+	if err == nil {
+		err = file.Truncate(offset)
+	}
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Prints a single summary of everything the archiver skipped; individual
+// paths are only listed in verbose mode.
+func printSkipSummary(logger falib.Logger, stats falib.ArchiverStats) {
+	counts := []struct {
+		count int64
+		what  string
+	}{
+		{stats.SkippedSymlinks, "symbolic links"},
+		{stats.SkippedSpecial, "special files"},
+		{stats.SkippedVirtualFS, "virtual filesystems"},
+		{stats.Excluded, "excluded"},
+		{stats.SkippedBySize, "by size"},
+		{stats.SkippedByMarker, "directories by ignore marker"},
+		{stats.SkippedVCS, "version control metadata"},
+		{stats.SkippedGitignore, "ignored by .gitignore"},
+		{stats.Vanished, "deleted while archiving"},
+		{stats.OverlappingRoots, "arguments already archived as part of another"},
+		{stats.Errors, "unreadable"},
+	}
+	var parts []string
+	for _, c := range counts {
+		if c.count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", c.count, c.what))
+		}
+	}
+	if len(parts) > 0 {
+		logger.Warning("skipped:", strings.Join(parts, ", "))
+	}
+}
+
+// Returns a logger for falib's messages on stderr, escaping file names
+// unless -no-quote is given, and timestamped with -log-timestamps.
+func (o *options) baseLogger(verbose bool) falib.Logger {
+	newLogger := falib.StdLogger
+	if *o.noQuote {
+		newLogger = falib.RawStdLogger
+	}
+	if *o.logTimestamps {
+		return falib.TimestampLogger(newLogger(os.Stderr, verbose))
+	}
+	return newLogger(os.Stderr, verbose)
+}
+
+// Returns the logger for a create or extract run, which prints progress
+// lines rather than every name with -verbose-summary.
+func (o *options) runLogger() falib.Logger {
+	if !*o.verboseSummary {
+		return o.baseLogger(*o.verbose)
+	}
+	o.progress = falib.NewProgressLogger(o.baseLogger(true), *o.summaryInterval)
+	return o.progress
+}
+
+// Parses -normalize, exiting if it's invalid.
+func (o *options) normalization(logger *log.Logger) falib.Normalization {
+	switch strings.ToLower(*o.normalize) {
+	case "":
+	case "nfc":
+		return falib.NormalizeNFC
+	case "nfd":
+		return falib.NormalizeNFD
+	default:
+		logger.Fatalln("normalize must be nfc or nfd")
+	}
+	return 0
+}
+
 func main() {
-	flag.Usage = func() {
-		if tag != "" || rev != "" {
-			fmt.Fprintf(os.Stderr, "%s (tag: %s, rev: %s)\n", os.Args[0], tag, rev)
-		} else {
-			fmt.Fprintf(os.Stderr, "%s\n", os.Args[0])
-		}
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		flag.PrintDefaults()
-	}
-
-	extract := flag.Bool("x", false, "extract archive")
-	create := flag.Bool("c", false, "create archive")
-	inputFileName := flag.String("i", "", "input file for extraction; defaults to stdin (-x only)")
-	outputFileName := flag.String("o", "", "output file for creation; defaults to stdout (-c only)")
-	requestedBlockSize := flag.Uint("block-size", 4096, "internal block-size (-c only)")
-	dirReaderCount := flag.Int("dir-readers", 16, "number of simultaneous directory readers (-c only)")
-	fileReaderCount := flag.Int("file-readers", 16, "number of simultaneous file readers (-c only)")
-	directoryScanQueueSize := flag.Int("queue-dir", 128, "queue size for scanning directories (-c only)")
-	fileReadQueueSize := flag.Int("queue-read", 128, "queue size for reading files (-c only)")
-	blockQueueSize := flag.Int("queue-write", 128, "queue size for archive write (-c only); increasing can cause increased memory usage")
-	multiCpu := flag.Int("multicpu", 1, "maximum number of CPUs that can be executing simultaneously")
-	exclude := flag.String("exclude", "", "file patterns to exclude (eg. core.*); can be path list separated (eg. : in Linux) for multiple excludes (-c only)")
-	verbose := flag.Bool("v", false, "verbose output on stderr")
-	dryRun := flag.Bool("n", false, "dry run; show what would be done, but do not write anything")
-	ignorePerms := flag.Bool("ignore-perms", false, "ignore permissions when restoring files (-x only)")
-	ignoreOwners := flag.Bool("ignore-owners", false, "ignore owners when restoring files (-x only)")
-	flag.Parse()
-
-	runtime.GOMAXPROCS(*multiCpu)
+	mode, o := parseCommandLine(os.Args[1:])
+
+	runtime.GOMAXPROCS(*o.multiCpu)
 	logger := log.New(os.Stderr, "", 0)
 
-	if *requestedBlockSize > math.MaxUint16 {
-		logger.Fatalln("block-size must be less than or equal to", math.MaxUint16)
+	if *o.dryRun {
+		*o.verbose = true
+	}
+	if *o.noQuote {
+		quote = func(s string) string { return s }
+	}
+	if *o.logTimestamps {
+		logger.SetOutput(timestampWriter{os.Stderr})
 	}
 
-	if *dryRun {
-		*verbose = true
+	switch mode {
+	case modeCreate:
+		runCreate(o, logger)
+	case modeExtract:
+		runExtract(o, logger)
+	case modeList:
+		runList(o, logger)
+	case modeVerify:
+		runVerify(o, logger)
 	}
+}
 
-	if *extract && !*create {
-		var inputFile *os.File
-		if *inputFileName != "" {
-			file, err := os.Open(*inputFileName)
-			if err != nil {
-				logger.Fatalln("Error opening input file:", err.Error())
-			}
-			inputFile = file
-		} else {
-			inputFile = os.Stdin
+func runList(o *options, logger *log.Logger) {
+	inputFile := openInput(logger, o.inputFileNames)
+	format := listShort
+	if *o.jsonList {
+		format = listJSON
+	} else if *o.verbose {
+		format = listLong
+	}
+	lister := newLister(os.Stdout, format)
+	switch *o.sortList {
+	case "":
+		if *o.reverseList || *o.topList != 0 {
+			logger.Fatalln("reverse and top require sort")
 		}
+	case "name":
+		lister.sort(sortName, *o.reverseList, *o.topList, *o.sortLimit)
+	case "size":
+		lister.sort(sortSize, *o.reverseList, *o.topList, *o.sortLimit)
+	case "mtime":
+		logger.Fatalln("archives don't record modification times, so they can't be sorted by mtime")
+	default:
+		logger.Fatalln("sort must be name or size")
+	}
+	opts := falib.InspectOptions{BackslashPaths: *o.backslashPaths, ArchiveMetadata: lister.archiveMetadata}
+	info, err := falib.InspectFunc(inputFile, opts, lister.entry)
+	if err == nil {
+		err = lister.finish(info)
+	}
+	flushErr := lister.flush()
+	if err != nil {
+		logger.Fatalln("Fatal error reading archive:", inputFile.describe(err))
+	} else if flushErr != nil {
+		logger.Fatalln("Error writing listing:", quote(flushErr.Error()))
+	}
+	inputFile.Close()
+	if info.NonNFCPaths > 0 {
+		logger.Println(info.NonNFCPaths, "paths aren't in Unicode NFC; -normalize nfc composes them when extracting")
+	}
+}
 
-		unarchiver := falib.NewUnarchiver(inputFile)
-		unarchiver.Logger = &MultiLevelLogger{logger, *verbose}
-		unarchiver.IgnorePerms = *ignorePerms
-		unarchiver.IgnoreOwners = *ignoreOwners
-		unarchiver.DryRun = *dryRun
-		err := unarchiver.Run()
+// Reads a whole archive as list does, checking its structure and checksums,
+// but only prints anything if it's damaged, or with -v, a summary.
+func runVerify(o *options, logger *log.Logger) {
+	inputFile := openInput(logger, o.inputFileNames)
+	var truncated []string
+	opts := falib.InspectOptions{BackslashPaths: *o.backslashPaths}
+	info, err := falib.InspectFunc(inputFile, opts, func(entry falib.EntryInfo) error {
+		if entry.Truncated {
+			truncated = append(truncated, entry.Path)
+		}
+		return nil
+	})
+	if info.Metadata != nil && (err != nil || *o.verbose) {
+		logger.Println(describeArchive(info.Metadata))
+	}
+	if err != nil {
+		logger.Fatalln("Fatal error reading archive:", inputFile.describe(err))
+	}
+	inputFile.Close()
+	for _, filePath := range truncated {
+		logger.Println("truncated:", quote(filePath))
+	}
+	if len(truncated) > 0 {
+		logger.Fatalln("archive is incomplete:", len(truncated), "files have no end")
+	}
+	if *o.verbose {
+		logger.Printf("%d files, %d directories, %s of file data; %d checksums verified\n", info.Files, info.Directories, formatSize(info.DataSize), info.Checksums)
+	}
+}
+
+func runExtract(o *options, logger *log.Logger) {
+	inputFile := openInput(logger, o.inputFileNames)
+
+	unarchiver := falib.NewUnarchiver(inputFile)
+	unarchiver.Logger = o.runLogger()
+	unarchiver.IgnorePerms = *o.ignorePerms
+	unarchiver.IgnoreOwners = *o.ignoreOwners
+	unarchiver.DryRun = *o.dryRun
+	unarchiver.DropCaches = *o.dropCaches
+	unarchiver.Resume = *o.resume
+	unarchiver.MetadataOnly = *o.metadataOnly
+	unarchiver.RefuseExisting = !*o.force
+	unarchiver.ExcludePatterns = filepath.SplitList(*o.exclude)
+	unarchiver.IncludePatterns = o.include
+	unarchiver.MatchCaseInsensitive = *o.ignoreCase
+	unarchiver.MatchBaseNames = *o.matchBaseNames
+	unarchiver.BackslashPaths = *o.backslashPaths
+	unarchiver.InputBufferSize = bufferSize(logger, "input-buffer-size", *o.inputBufferSize)
+	unarchiver.FileBufferSize = bufferSize(logger, "file-buffer-size", *o.fileBufferSize)
+	if *o.fileQueueSize < 0 || *o.fileWriterCount < 0 {
+		logger.Fatalln("file-queue and file-writers can't be negative")
+	}
+	unarchiver.FileQueueSize = *o.fileQueueSize
+	unarchiver.WriterCount = *o.fileWriterCount
+	if *o.maxMemory != "" {
+		maxBuffered, err := parseSize(*o.maxMemory)
+		if err != nil {
+			logger.Fatalln("Invalid max-memory:", quote(err.Error()))
+		}
+		unarchiver.MaxBufferedBytes = maxBuffered
+	}
+	if *o.fileMode != "" {
+		mode, err := parseMode(*o.fileMode)
+		if err != nil {
+			logger.Fatalln("Invalid mode:", quote(err.Error()))
+		}
+		unarchiver.FileModeOverride = &mode
+	}
+	if *o.dirMode != "" {
+		mode, err := parseMode(*o.dirMode)
+		if err != nil {
+			logger.Fatalln("Invalid dir-mode:", quote(err.Error()))
+		}
+		unarchiver.DirModeOverride = &mode
+	}
+	if *o.unknownOwner != "" {
+		uid, gid, err := parseOwner(*o.unknownOwner)
+		if err != nil {
+			logger.Fatalln("Invalid unknown-owner:", quote(err.Error()))
+		}
+		unarchiver.FallbackUid = uid
+		unarchiver.FallbackGid = gid
+		unarchiver.MaxOwnerId = *o.maxOwnerId
+	} else if o.given("max-owner-id") {
+		logger.Fatalln("max-owner-id requires unknown-owner")
+	}
+	unarchiver.NormalizePaths = o.normalization(logger)
+	unarchiver.CaseCollisionSuffix = *o.caseSuffix
+	switch *o.caseCollisions {
+	case "detect":
+		unarchiver.CaseCollisions = falib.CaseCollisionsDetect
+	case "always":
+		unarchiver.CaseCollisions = falib.CaseCollisionsAlways
+	case "never":
+		unarchiver.CaseCollisions = falib.CaseCollisionsNever
+	default:
+		logger.Fatalln("case-collisions must be detect, always or never")
+	}
+	if *o.failFast {
+		unarchiver.ErrorPolicy = falib.FailFast
+	}
+	unarchiver.StrictDirectories = *o.strictDirs
+	if *o.transform != "" {
+		pathTransform, err := parseTransform(*o.transform)
 		if err != nil {
-			logger.Fatalln("Fatal error in archiver:", err.Error())
+			logger.Fatalln("Invalid transform:", quote(err.Error()))
 		}
-		inputFile.Close()
+		unarchiver.PathTransform = pathTransform
+	}
+	if *o.noVerify {
+		unarchiver.SkipChecksums = true
+		logger.Println("WARNING: checksum verification is disabled (-no-verify); corrupted data will be extracted without error")
+	}
+	err := unarchiver.Run()
+	if metadata := unarchiver.Metadata(); metadata != nil && (err != nil || *o.verbose) {
+		// Shown with any error, since it's the first thing to know
+		// about an archive that doesn't extract properly.
+		logger.Println(describeArchive(metadata))
+	}
+	if errors.Is(err, falib.ErrPathExists) {
+		logger.Fatalln("Fatal error in archiver:", inputFile.describe(err)+"; nothing that existed was changed; use -force to extract over it")
+	} else if err != nil {
+		logger.Fatalln("Fatal error in archiver:", inputFile.describe(err))
+	}
+	if o.progress != nil {
+		o.progress.Finish()
+	}
+	inputFile.Close()
+	stats := unarchiver.Stats()
+	if stats.AlreadyPresent > 0 {
+		unarchiver.Logger.Verbose(stats.AlreadyPresent, "files were already present")
+	}
+	if stats.OwnershipSkipped > 0 {
+		unarchiver.Logger.Verbose("ownership of", stats.OwnershipSkipped, "entries wasn't restored")
+	}
+	if stats.OwnersRemapped > 0 {
+		logger.Println(stats.OwnersRemapped, "entries with an unknown owner were given", *o.unknownOwner)
+	}
+	if stats.MissingFiles > 0 {
+		logger.Println(stats.MissingFiles, "files in the archive are missing from disk")
+	}
+	if stats.DuplicateDirectories > 0 {
+		unarchiver.Logger.Verbose(stats.DuplicateDirectories, "duplicate directory entries were skipped")
+	}
+	if stats.DirectoryConflicts > 0 {
+		logger.Println(stats.DirectoryConflicts, "directories were archived more than once with different metadata; the later entries were used")
+	}
+	if stats.CaseCollisions > 0 {
+		logger.Println(stats.CaseCollisions, "entries were renamed because their paths differ only in case")
+	}
+	unarchiver.Logger.Verbose("at most", stats.PeakBufferedBytes, "bytes of file data were buffered")
+	_, count := unarchiver.Problems()
+	if *o.totals {
+		logger.Println(totalsLine(stats.Files, stats.Directories, stats.BytesRead, stats.BytesWritten, stats.BytesWritten, stats.Elapsed) +
+			fmt.Sprintf("; worker time reading %.1fs, writing %.1fs; %d problems", stats.ReadTime.Seconds(), stats.WriteTime.Seconds(), count))
+	}
+	if *o.noVerify {
+		// Repeated, since the first warning has likely scrolled away.
+		logger.Println("WARNING: the archive's checksums weren't verified;", stats.ChecksumsSkipped, "were skipped")
+	}
+	if count > 0 {
+		logger.Println(count, "problems occurred during extraction")
+		os.Exit(exitProblems)
+	}
+}
+
+func runCreate(o *options, logger *log.Logger) {
+	if *o.requestedBlockSize > math.MaxUint16 {
+		logger.Fatalln("block-size must be less than or equal to", math.MaxUint16)
+	} else if *o.largeBlockSize > math.MaxUint16 {
+		logger.Fatalln("large-block-size must be less than or equal to", math.MaxUint16)
+	}
 
-	} else if *create && !*extract {
-		if flag.NArg() == 0 {
-			logger.Fatalln("Directories to archive must be specified")
+	if o.flags.NArg() == 0 {
+		logger.Fatalln("Directories or files to archive must be specified")
+	}
+
+	if len(o.outputChecksums) > 0 {
+		if err := falib.CheckOutputChecksums(o.outputChecksums); err != nil {
+			logger.Fatalln("Invalid output-checksum:", quote(err.Error()))
+		}
+		hasFile := false
+		for _, fileName := range o.outputFileNames {
+			hasFile = hasFile || fileName != "-"
 		}
+		if !hasFile {
+			logger.Fatalln("output-checksum requires an output file (-o)")
+		}
+	}
 
-		var outputFile *os.File
-		var outputWriter io.Writer
-		if *dryRun {
-			outputWriter = sink(true)
-		} else if *outputFileName != "" {
-			outputFile, err := os.Create(*outputFileName)
+	var outputFiles []*os.File
+	var outputWriter io.Writer
+	var resumeState *falib.ResumeState
+	var err error
+	if *o.resumeStateFile != "" {
+		if *o.dryRun || len(o.outputFileNames) != 1 || o.outputFileNames[0] == "-" {
+			logger.Fatalln("resume-state requires a single output file (-o)")
+		}
+		resumeState, err = falib.LoadResumeState(*o.resumeStateFile)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Fatalln("Error reading resume state:", quote(err.Error()))
+		}
+	}
+	if *o.dryRun {
+		outputWriter = sink(true)
+	} else if resumeState != nil && resumeState.Offset > 0 {
+		outputFile, err := openForResume(o.outputFileNames[0], resumeState.Offset)
+		if err != nil {
+			logger.Fatalln("Unable to resume output file:", quote(err.Error()))
+		}
+		outputFiles = append(outputFiles, outputFile)
+		outputWriter = outputFile
+	} else if len(o.outputFileNames) <= 1 {
+		outputFile := os.Stdout
+		if len(o.outputFileNames) == 1 && o.outputFileNames[0] != "-" {
+			outputFile, err = os.Create(o.outputFileNames[0])
 			if err != nil {
-				logger.Fatalln("Error creating output file:", err.Error())
+				logger.Fatalln("Error creating output file:", quote(err.Error()))
 			}
-			outputWriter = outputFile
+		}
+		outputFiles = append(outputFiles, outputFile)
+		outputWriter = outputFile
+	} else {
+		tee := falib.NewTeeWriter()
+		tee.DropFailed = *o.dropFailedOutputs
+		tee.Logger = o.baseLogger(*o.verbose)
+		for _, fileName := range o.outputFileNames {
+			outputFile, name := os.Stdout, "stdout"
+			if fileName != "-" {
+				outputFile, err = os.Create(fileName)
+				name = fileName
+				if err != nil {
+					logger.Fatalln("Error creating output file:", quote(err.Error()))
+				}
+			}
+			outputFiles = append(outputFiles, outputFile)
+			tee.Add(name, outputFile)
+		}
+		outputWriter = tee
+	}
+
+	archiver := falib.NewArchiver(outputWriter)
+	archiver.StateFile = *o.resumeStateFile
+	archiver.OutputChecksums = o.outputChecksums
+	var digests map[string]string
+	archiver.OnOutputComplete = func(outputDigests map[string]string) {
+		digests = outputDigests
+	}
+	if resumeState != nil && resumeState.Offset > 0 {
+		archiver.ResumeFrom = resumeState
+	}
+	archiver.BlockSize = uint16(*o.requestedBlockSize)
+	archiver.LargeFileBlockSize = uint16(*o.largeBlockSize)
+	archiver.LargeFileThreshold, err = parseSize(*o.largeFileThreshold)
+	if err != nil {
+		logger.Fatalln("Invalid large-file-threshold:", quote(err.Error()))
+	}
+	archiver.DirScanQueueSize = *o.directoryScanQueueSize
+	archiver.FileReadQueueSize = *o.fileReadQueueSize
+	archiver.BlockQueueSize = *o.blockQueueSize
+	if *o.maxOpenFiles >= 0 {
+		archiver.MaxOpenFiles = *o.maxOpenFiles
+	}
+	archiver.Diagnostics = *o.diagnostics
+	archiver.WriteBufferSize = bufferSize(logger, "write-buffer-size", *o.writeBufferSize)
+	archiver.WriteBufferCount = *o.writeBufferCount
+	archiver.OutputBufferSize = bufferSize(logger, "output-buffer-size", *o.outputBufferSize)
+	archiver.ExcludePatterns = filepath.SplitList(*o.exclude)
+	archiver.IncludePatterns = o.include
+	archiver.MatchCaseInsensitive = *o.ignoreCase
+	archiver.MatchBaseNames = *o.matchBaseNames
+	archiver.HonorCacheDirTags = *o.excludeCaches
+	archiver.ExcludeVCS = *o.excludeVCS
+	archiver.ExcludeVCSIgnores = *o.excludeVCSIgnores
+	archiver.IgnoreMarker = *o.ignoreMarker
+	archiver.OneFileSystem = *o.oneFileSystem
+	archiver.IncludeVirtualFS = *o.includeVirtualFS
+	archiver.SkipRootLinks = *o.skipRootLinks
+	archiver.StrictRoots = *o.strictRoots
+	archiver.MaxDepth = *o.maxDepth
+	archiver.PathPrefix = *o.transformPrefix
+	archiver.NormalizePaths = o.normalization(logger)
+	archiver.Deterministic = *o.deterministic
+	if *o.compat && *o.intraFileParallelism > 1 {
+		logger.Fatalln("-compat can't be used with -intra-file-readers, which writes a version 4 archive")
+	}
+	if !*o.noMetadata && !*o.compat {
+		archiver.ArchiveMetadata = archiveMetadata(*o.deterministic)
+	}
+	archiver.InodeOrder = *o.inodeOrder
+	archiver.NoAtime = *o.noAtime
+	archiver.DropCaches = *o.dropCaches
+	if *o.failFast {
+		archiver.ErrorPolicy = falib.FailFast
+	}
+	archiver.ReadRetries = *o.readRetries
+	archiver.ReadRetryDelay = *o.readRetryDelay
+	archiver.FileReadTimeout = *o.fileReadTimeout
+	archiver.IgnoreVanished = *o.ignoreFailedRead
+	archiver.RereadChanged = *o.rereadChanged
+	archiver.FreshMetadata = *o.freshMetadata
+	archiver.MinFileSize, err = parseSize(*o.minSize)
+	if err != nil {
+		logger.Fatalln("Invalid min-size:", quote(err.Error()))
+	}
+	archiver.MaxFileSize, err = parseSize(*o.maxSize)
+	if err != nil {
+		logger.Fatalln("Invalid max-size:", quote(err.Error()))
+	}
+	archiver.DirReaderCount = *o.dirReaderCount
+	archiver.FileReaderCount = *o.fileReaderCount
+	archiver.LargeFileReaderCount = *o.largeFileReaderCount
+	archiver.IntraFileParallelism = *o.intraFileParallelism
+	if *o.inodeOrder && !o.given("file-readers") {
+		archiver.FileReaderCount = 2
+	}
+	archiver.Logger = o.runLogger()
+	for i := 0; i < o.flags.NArg(); i++ {
+		arg := o.flags.Arg(i)
+		fsPath := filepath.Join(*o.changeDir, arg)
+		fileInfo, err := os.Stat(fsPath)
+		if err == nil && !fileInfo.IsDir() {
+			archiver.AddFileAs(fsPath, arg)
+			continue
+		} else if len(arg) > 1 && os.IsPathSeparator(arg[len(arg)-1]) {
+			// As with rsync, a trailing slash archives the contents.
+			err = archiver.AddDirContentsAs(fsPath, ".")
 		} else {
-			outputFile = os.Stdout
-			outputWriter = os.Stdout
-		}
-
-		archiver := falib.NewArchiver(outputWriter)
-		archiver.BlockSize = uint16(*requestedBlockSize)
-		archiver.DirScanQueueSize = *directoryScanQueueSize
-		archiver.FileReadQueueSize = *fileReadQueueSize
-		archiver.BlockQueueSize = *blockQueueSize
-		archiver.ExcludePatterns = filepath.SplitList(*exclude)
-		archiver.DirReaderCount = *dirReaderCount
-		archiver.FileReaderCount = *fileReaderCount
-		archiver.Logger = &MultiLevelLogger{logger, *verbose}
-		for i := 0; i < flag.NArg(); i++ {
-			archiver.AddDir(flag.Arg(i))
-		}
-		err := archiver.Run()
+			err = archiver.AddDirAs(fsPath, arg)
+		}
 		if err != nil {
-			logger.Fatalln("Fatal error in archiver:", err.Error())
+			logger.Fatalln("Unable to archive", quote(arg)+":", quote(err.Error()))
 		}
-		if !*dryRun {
+	}
+	handlePauseSignals(archiver)
+	err = archiver.Run()
+	if err != nil {
+		logger.Fatalln("Fatal error in archiver:", quote(err.Error()))
+	}
+	if o.progress != nil {
+		o.progress.Finish()
+	}
+	stats := archiver.Stats()
+	printSkipSummary(archiver.Logger, stats)
+	if stats.Diagnostics != nil {
+		logger.Println(stats.Diagnostics)
+	}
+	archiver.Logger.Verbose("at most", stats.PeakOpenFiles, "files and directories were open at once")
+	if stats.GrowingFiles > 0 {
+		archiver.Logger.Verbose(stats.GrowingFiles, "files grew while archiving and were archived at their original size")
+	}
+	if stats.TruncatedFiles > 0 {
+		archiver.Logger.Verbose(stats.TruncatedFiles, "files shrank while archiving")
+	}
+	if stats.DamagedFiles > 0 {
+		archiver.Logger.Warning(stats.DamagedFiles, "files are incomplete due to read errors")
+	}
+	if stats.ChangedFiles > 0 {
+		archiver.Logger.Warning(stats.ChangedFiles, "files changed while being archived")
+	}
+	for _, filePath := range stats.TimedOutFiles {
+		archiver.Logger.Warning("timed out reading", filePath)
+	}
+	if !*o.dryRun {
+		for _, outputFile := range outputFiles {
 			outputFile.Close()
 		}
-	} else {
-		logger.Fatalln("exactly one of extract (-x) or create (-c) flag must be provided")
+		for _, fileName := range o.outputFileNames {
+			if fileName != "-" {
+				writeChecksums(logger, fileName, digests)
+			}
+		}
+	}
+	if *o.resumeStateFile != "" {
+		// The archive is complete, so there's nothing left to resume.
+		os.Remove(*o.resumeStateFile)
+	}
+	_, count := archiver.Problems()
+	if *o.totals {
+		logger.Println(totalsLine(stats.Files, stats.Directories, stats.BytesRead, stats.BytesWritten, stats.BytesRead, stats.Elapsed) +
+			fmt.Sprintf("; worker time scanning %.1fs, reading %.1fs, writing %.1fs; %d problems", stats.ScanTime.Seconds(), stats.ReadTime.Seconds(), stats.WriteTime.Seconds(), count))
+	}
+	if count > 0 {
+		logger.Println(count, "problems occurred while archiving")
+		os.Exit(exitProblems)
 	}
 }
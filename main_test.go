@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"github.com/replicon/fast-archiver/falib"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeterministicMetadataOmitsHostAndTime(t *testing.T) {
+	metadata := archiveMetadata(true)
+	for _, key := range []string{"hostname", "created"} {
+		if _, ok := metadata[key]; ok {
+			t.Errorf("deterministic metadata includes %s", key)
+		}
+	}
+	if metadata["goos"] == "" {
+		t.Error("deterministic metadata is missing goos")
+	}
+	if _, ok := archiveMetadata(false)["created"]; !ok {
+		t.Error("metadata is missing created")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected int64
+		valid    bool
+	}{
+		{"", 0, true},
+		{"512", 512, true},
+		{"10k", 10 << 10, true},
+		{"4M", 4 << 20, true},
+		{"10G", 10 << 30, true},
+		{"8589934591G", 8589934591 << 30, true},
+		{"8589934592G", 0, false},
+		{"9223372036854775807", math.MaxInt64, true},
+		{"9007199254740992M", 0, false},
+		{"-1K", 0, false},
+		{"K", 0, false},
+	}
+	for _, test := range tests {
+		value, err := parseSize(test.s)
+		if test.valid && (err != nil || value != test.expected) {
+			t.Errorf("parseSize(%q) = %d, %v; expected %d", test.s, value, err, test.expected)
+		} else if !test.valid && err == nil {
+			t.Errorf("parseSize(%q) = %d; expected an error", test.s, value)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected os.FileMode
+		valid    bool
+	}{
+		{"644", 0644, true},
+		{"0755", 0755, true},
+		{"4755", os.ModeSetuid | 0755, true},
+		{"2770", os.ModeSetgid | 0770, true},
+		{"1777", os.ModeSticky | 0777, true},
+		{"7777", os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0777, true},
+		{"10000", 0, false},
+		{"788", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		mode, err := parseMode(test.s)
+		if test.valid && (err != nil || mode != test.expected) {
+			t.Errorf("parseMode(%q) = %v, %v; expected %v", test.s, mode, err, test.expected)
+		} else if !test.valid && err == nil {
+			t.Errorf("parseMode(%q) = %v; expected an error", test.s, mode)
+		}
+	}
+}
+
+// A falib.Logger that records its warnings.
+type recordingLogger struct {
+	warnings []string
+}
+
+func (l *recordingLogger) Verbose(v ...interface{}) {}
+
+func (l *recordingLogger) Warning(v ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintln(v...))
+}
+
+func TestPrintSkipSummary(t *testing.T) {
+	logger := &recordingLogger{}
+	printSkipSummary(logger, falib.ArchiverStats{})
+	if len(logger.warnings) != 0 {
+		t.Errorf("printed %q when nothing was skipped", logger.warnings)
+	}
+
+	printSkipSummary(logger, falib.ArchiverStats{SkippedSymlinks: 30000, SkippedSpecial: 2, Excluded: 5, Errors: 1})
+	expected := []string{"skipped: 30000 symbolic links, 2 special files, 5 excluded, 1 unreadable\n"}
+	if !reflect.DeepEqual(logger.warnings, expected) {
+		t.Errorf("printed %q, expected %q", logger.warnings, expected)
+	}
+}
+
+func TestTotalsLine(t *testing.T) {
+	tests := []struct {
+		files, directories, read, written, data int64
+		elapsed                                 time.Duration
+		expected                                string
+	}{
+		{3, 1, 1536, 2 << 20, 1 << 20, 2 * time.Second, "3 files, 1 directories; read 1.5K, wrote 2.0M in 2.0s, 512.0K/s"},
+		{0, 0, 0, 66, 0, 0, "0 files, 0 directories; read 0, wrote 66 in 0.0s"},
+		{1, 0, 3 << 30, 3 << 30, 3 << 30, 1500 * time.Millisecond, "1 files, 0 directories; read 3.0G, wrote 3.0G in 1.5s, 2.0G/s"},
+	}
+	for _, test := range tests {
+		if line := totalsLine(test.files, test.directories, test.read, test.written, test.data, test.elapsed); line != test.expected {
+			t.Errorf("totals are %q, expected %q", line, test.expected)
+		}
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		uid, gid int
+		valid    bool
+	}{
+		{"1000:1000", 1000, 1000, true},
+		{"0:50", 0, 50, true},
+		{":50", -1, 50, true},
+		{"1000:", 1000, -1, true},
+		{":", -1, -1, true},
+		{"1000", 0, 0, false},
+		{"1:2:3", 0, 0, false},
+		{"-1:0", 0, 0, false},
+		{"app:app", 0, 0, false},
+		{"2147483648:0", 0, 0, false},
+	} {
+		uid, gid, err := parseOwner(test.s)
+		if test.valid && (err != nil || uid != test.uid || gid != test.gid) {
+			t.Errorf("parseOwner(%q) = %d, %d, %v; expected %d, %d", test.s, uid, gid, err, test.uid, test.gid)
+		} else if !test.valid && err == nil {
+			t.Errorf("parseOwner(%q) = %d, %d; expected an error", test.s, uid, gid)
+		}
+	}
+}
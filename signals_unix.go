@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/replicon/fast-archiver/falib"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Pauses the archiver on SIGUSR1 and resumes it on SIGCONT.  The process
+// itself keeps running, so that the archive written so far is flushed and
+// checksummed while it's paused.  SIGTSTP is left alone, so that Ctrl-Z
+// still suspends the process to the shell.
+func handlePauseSignals(archiver *falib.Archiver) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGCONT)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				archiver.Logger.Verbose("pausing")
+				archiver.Pause()
+			} else {
+				archiver.Logger.Verbose("resuming")
+				archiver.Resume()
+			}
+		}
+	}()
+}
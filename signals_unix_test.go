@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/replicon/fast-archiver/falib"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Waits up to a second for the archiver's paused state to equal paused.
+func waitForPaused(archiver *falib.Archiver, paused bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if archiver.Stats().Paused == paused {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestPauseSignals(t *testing.T) {
+	archiver := falib.NewArchiverTemplate()
+	handlePauseSignals(archiver)
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	if !waitForPaused(archiver, true) {
+		t.Fatal("SIGUSR1 didn't pause the archiver")
+	}
+	syscall.Kill(syscall.Getpid(), syscall.SIGCONT)
+	if !waitForPaused(archiver, false) {
+		t.Fatal("SIGCONT didn't resume the archiver")
+	}
+}
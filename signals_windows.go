@@ -0,0 +1,7 @@
+package main
+
+import "github.com/replicon/fast-archiver/falib"
+
+// Windows has no job control signals to map onto Pause and Resume.
+func handlePauseSignals(archiver *falib.Archiver) {
+}
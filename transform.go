@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var errInvalidTransform = errors.New("transform must be of the form s/regexp/replacement/[g]")
+
+// Parses a sed-like substitution expression, eg. "s/^old-host/new-host/",
+// into a path transform function.  Any character can be used as the
+// delimiter, and a delimiter can be escaped with a backslash.  In the
+// replacement, & refers to the whole match and \1 through \9 to submatches.
+// The "g" flag replaces every match, rather than just the first.
+func parseTransform(expr string) (func(string) (string, bool), error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		return nil, errInvalidTransform
+	}
+	delimiter := expr[1]
+
+	var parts []string
+	var current []byte
+	for i := 2; i < len(expr); i++ {
+		if expr[i] == '\\' && i+1 < len(expr) && expr[i+1] == delimiter {
+			current = append(current, delimiter)
+			i++
+		} else if expr[i] == delimiter {
+			parts = append(parts, string(current))
+			current = nil
+		} else {
+			current = append(current, expr[i])
+		}
+	}
+	parts = append(parts, string(current))
+	if len(parts) != 3 || (parts[2] != "" && parts[2] != "g") {
+		return nil, errInvalidTransform
+	}
+
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	replacement := sedReplacement(parts[1])
+	global := parts[2] == "g"
+
+	return func(path string) (string, bool) {
+		if global {
+			return re.ReplaceAllString(path, replacement), true
+		}
+		match := re.FindStringSubmatchIndex(path)
+		if match == nil {
+			return path, true
+		}
+		result := re.ExpandString(nil, replacement, path, match)
+		return path[:match[0]] + string(result) + path[match[1]:], true
+	}, nil
+}
+
+// Converts a sed replacement string into the template syntax used by the
+// regexp package.
+func sedReplacement(s string) string {
+	var retval []string
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			retval = append(retval, "${"+s[i+1:i+2]+"}")
+			i++
+		case s[i] == '\\' && i+1 < len(s):
+			retval = append(retval, s[i+1:i+2])
+			i++
+		case s[i] == '&':
+			retval = append(retval, "${0}")
+		case s[i] == '$':
+			retval = append(retval, "$$")
+		default:
+			retval = append(retval, s[i:i+1])
+		}
+	}
+	return strings.Join(retval, "")
+}